@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+// newAMQPProbe returns a probe that opens an AMQP 0-9-1 connection to amqpURI (amqp:// or amqps://,
+// whose path is the vhost) with the given credentials and closes it again. For amqps, the server
+// certificate is verified with caFile.
+func newAMQPProbe(amqpURI, caFile string, timeout time.Duration) (updater.Probe, error) {
+	uri, tlsConfig, err := parseProbeURI(amqpURI, caFile, "amqp", "amqps")
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, username, password string) error {
+		userURI := *uri
+		userURI.User = url.UserPassword(username, password)
+		conn, err := amqp.DialConfig(userURI.String(), amqp.Config{
+			TLSClientConfig: tlsConfig,
+			// Like amqp.DefaultDial, the deadline covers the handshake; amqp091 adds TLS itself.
+			Dial: func(_, addr string) (net.Conn, error) {
+				return dialProbe(ctx, addr, nil, timeout)
+			},
+			Properties: amqp.Table{"connection_name": "rabbitmq-user-credential-updater verification"},
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}, nil
+}
+
+// parseProbeURI parses the URI of a probe, which must have the scheme plainScheme or tlsScheme.
+// For tlsScheme, the returned TLS config verifies the server certificate with caFile.
+func parseProbeURI(probeURI, caFile, plainScheme, tlsScheme string) (*url.URL, *tls.Config, error) {
+	uri, err := url.Parse(probeURI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid URI: %w", err)
+	}
+	if uri.Scheme != plainScheme && uri.Scheme != tlsScheme {
+		return nil, nil, fmt.Errorf("invalid URI %q, expected %s:// or %s://", probeURI, plainScheme, tlsScheme)
+	}
+	if uri.Scheme != tlsScheme {
+		return uri, nil, nil
+	}
+	caCert, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+	return uri, &tls.Config{RootCAs: caCertPool, ServerName: uri.Hostname()}, nil
+}
+
+// dialProbe opens a TCP (or with tlsConfig, a TLS) connection to addr for a probe.
+// The deadline of the connection is set to timeout, if positive.
+func dialProbe(ctx context.Context, addr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+// amqp10SASLHeader is the protocol header that starts the SASL layer of AMQP 1.0.
+var amqp10SASLHeader = []byte{'A', 'M', 'Q', 'P', 3, 1, 0, 0}
+
+// Descriptors of the AMQP 1.0 SASL frames, see section 5.3.3 of the AMQP 1.0 specification.
+const (
+	amqp10SASLMechanisms = 0x40
+	amqp10SASLInit       = 0x41
+	amqp10SASLOutcome    = 0x44
+)
+
+// amqp10SASLCodes are the outcomes of SASL authentication other than ok (0).
+var amqp10SASLCodes = map[byte]string{1: "auth", 2: "sys", 3: "sys-perm", 4: "sys-temp"}
+
+// newAMQP10Probe returns a probe that authenticates with SASL PLAIN over AMQP 1.0 to amqpURI
+// (amqp:// or amqps://) and closes the connection once the SASL outcome was received, so that
+// the credentials of AMQP 1.0 clients are verified without opening a session.
+func newAMQP10Probe(amqpURI, caFile string, timeout time.Duration) (updater.Probe, error) {
+	uri, tlsConfig, err := parseProbeURI(amqpURI, caFile, "amqp", "amqps")
+	if err != nil {
+		return nil, err
+	}
+	port := uri.Port()
+	if port == "" {
+		port = "5672"
+		if tlsConfig != nil {
+			port = "5671"
+		}
+	}
+	addr := net.JoinHostPort(uri.Hostname(), port)
+	return func(ctx context.Context, username, password string) error {
+		conn, err := dialProbe(ctx, addr, tlsConfig, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return amqp10SASLPlain(conn, uri.Hostname(), username, password)
+	}, nil
+}
+
+// amqp10SASLPlain performs the SASL PLAIN handshake of AMQP 1.0 on conn and returns an error
+// unless the server accepted the credentials.
+func amqp10SASLPlain(conn io.ReadWriter, hostname, username, password string) error {
+	if _, err := conn.Write(amqp10SASLHeader); err != nil {
+		return err
+	}
+	header := make([]byte, len(amqp10SASLHeader))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read protocol header: %w", err)
+	}
+	if !bytes.Equal(header, amqp10SASLHeader) {
+		return fmt.Errorf("server does not support AMQP 1.0 with SASL, got protocol header %q", header)
+	}
+	if _, err := readAMQP10SASLFrame(conn, amqp10SASLMechanisms); err != nil {
+		return err
+	}
+	if _, err := conn.Write(amqp10SASLInitFrame(hostname, username, password)); err != nil {
+		return err
+	}
+	fields, err := readAMQP10SASLFrame(conn, amqp10SASLOutcome)
+	if err != nil {
+		return err
+	}
+	// The code is the first field of the list, encoded as ubyte.
+	if len(fields) < 2 || fields[0] != 0x50 {
+		return errors.New("invalid SASL outcome")
+	}
+	if code := fields[1]; code != 0 {
+		return fmt.Errorf("SASL authentication failed with code %d (%s)", code, amqp10SASLCodes[code])
+	}
+	return nil
+}
+
+// amqp10SASLInitFrame returns a sasl-init frame with the PLAIN mechanism for the credentials.
+func amqp10SASLInitFrame(hostname, username, password string) []byte {
+	var fields bytes.Buffer
+	// mechanism (sym32), initial-response (vbin32) and hostname (str32)
+	for _, field := range []struct {
+		code  byte
+		value string
+	}{{0xb3, "PLAIN"}, {0xb0, "\x00" + username + "\x00" + password}, {0xb1, hostname}} {
+		fields.WriteByte(field.code)
+		fields.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field.value))))
+		fields.WriteString(field.value)
+	}
+	// Described list32: descriptor, size (including the count) and count of the fields.
+	body := []byte{0x00, 0x53, amqp10SASLInit, 0xd0}
+	body = binary.BigEndian.AppendUint32(body, uint32(4+fields.Len()))
+	body = binary.BigEndian.AppendUint32(body, 3)
+	body = append(body, fields.Bytes()...)
+	// Frame header: size, data offset (2 words), type (1 for SASL) and channel (unused).
+	frame := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	frame = append(frame, 2, 1, 0, 0)
+	return append(frame, body...)
+}
+
+// readAMQP10SASLFrame reads a SASL frame and returns the encoded fields of its list,
+// or an error if it does not have the expected descriptor.
+func readAMQP10SASLFrame(r io.Reader, descriptor byte) ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read SASL frame: %w", err)
+	}
+	size, dataOffset := binary.BigEndian.Uint32(header), int(header[4])*4
+	if header[5] != 1 || dataOffset < 8 || size < uint32(dataOffset) || size > 1<<16 {
+		return nil, fmt.Errorf("invalid SASL frame header %x", header)
+	}
+	frame := make([]byte, size-8)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, fmt.Errorf("failed to read SASL frame: %w", err)
+	}
+	body := frame[dataOffset-8:]
+	if len(body) < 4 || body[0] != 0x00 || body[1] != 0x53 || body[2] != descriptor {
+		return nil, fmt.Errorf("unexpected SASL frame %x, expected descriptor %#x", body, descriptor)
+	}
+	switch list := body[3:]; {
+	case len(list) >= 3 && list[0] == 0xc0:
+		// list8: size and count
+		return list[3:], nil
+	case len(list) >= 9 && list[0] == 0xd0:
+		// list32: size and count
+		return list[9:], nil
+	case len(list) >= 1 && list[0] == 0x45:
+		// list0
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid SASL frame %x", body)
+}
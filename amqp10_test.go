@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("amqp10SASLPlain", func() {
+	var client, server net.Conn
+
+	// saslFrame returns a SASL frame with body.
+	saslFrame := func(body ...byte) []byte {
+		frame := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+		return append(append(frame, 2, 1, 0, 0), body...)
+	}
+
+	// serve runs the server side of the handshake with header and the SASL outcome code,
+	// and sends the initial response of the sasl-init frame to responses.
+	serve := func(header []byte, code byte) <-chan string {
+		responses := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			defer server.Close()
+			received := make([]byte, 8)
+			_, err := io.ReadFull(server, received)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received).To(Equal(amqp10SASLHeader))
+			_, err = server.Write(header)
+			Expect(err).NotTo(HaveOccurred())
+			if !bytes.Equal(header, amqp10SASLHeader) {
+				return
+			}
+			// sasl-mechanisms with an empty list.
+			_, err = server.Write(saslFrame(0x00, 0x53, amqp10SASLMechanisms, 0x45))
+			Expect(err).NotTo(HaveOccurred())
+			fields, err := readAMQP10SASLFrame(server, amqp10SASLInit)
+			Expect(err).NotTo(HaveOccurred())
+			// The mechanism (sym32) is followed by the initial response (vbin32).
+			Expect(fields[:10]).To(Equal([]byte{0xb3, 0, 0, 0, 5, 'P', 'L', 'A', 'I', 'N'}))
+			size := binary.BigEndian.Uint32(fields[11:15])
+			responses <- string(fields[15 : 15+size])
+			// sasl-outcome with the code as list8.
+			_, err = server.Write(saslFrame(0x00, 0x53, amqp10SASLOutcome, 0xc0, 3, 1, 0x50, code))
+			Expect(err).NotTo(HaveOccurred())
+		}()
+		return responses
+	}
+
+	BeforeEach(func() {
+		client, server = net.Pipe()
+		DeferCleanup(client.Close)
+	})
+
+	It("succeeds if the server accepts the credentials", func() {
+		responses := serve(amqp10SASLHeader, 0)
+		Expect(amqp10SASLPlain(client, "rabbitmq", "app", "s3cret")).To(Succeed())
+		Expect(responses).To(Receive(Equal("\x00app\x00s3cret")))
+	})
+
+	It("fails if the server rejects the credentials", func() {
+		serve(amqp10SASLHeader, 1)
+		Expect(amqp10SASLPlain(client, "rabbitmq", "app", "wrong")).To(MatchError("SASL authentication failed with code 1 (auth)"))
+	})
+
+	It("fails if the server does not support AMQP 1.0", func() {
+		serve([]byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}, 0)
+		Expect(amqp10SASLPlain(client, "rabbitmq", "app", "s3cret")).To(MatchError(ContainSubstring("server does not support AMQP 1.0 with SASL")))
+	})
+})
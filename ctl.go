@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	"github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+// errCtlUnsupported is returned for operations that rabbitmqctl does not support. The updater
+// treats them like endpoints that the Management API does not provide.
+var errCtlUnsupported = errors.New("not supported by the rabbitmqctl backend")
+
+// ctlClient implements updater.RabbitClient by running rabbitmqctl on the local node (or node, if set),
+// for brokers whose management plugin is disabled or unreachable. rabbitmqctl authenticates with
+// the Erlang cookie, the credentials are only used by Whoami to verify them. Passwords are passed
+// on standard input, so that they do not show up in the process list.
+type ctlClient struct {
+	path     string
+	node     string
+	timeout  time.Duration
+	username string
+	password string
+}
+
+// newCtlClient returns a client that runs the rabbitmqctl executable at path against node
+// (the local node if empty), with timeout per command.
+func newCtlClient(path, node string, timeout time.Duration) *ctlClient {
+	return &ctlClient{path: path, node: node, timeout: timeout}
+}
+
+// ctlResponse is returned by successful commands instead of an HTTP response.
+func ctlResponse() *http.Response {
+	return &http.Response{Status: "204 No Content", StatusCode: http.StatusNoContent}
+}
+
+// ctlNotFound is the error of rabbithole for missing objects, see handleHTTPError.
+var ctlNotFound = rabbithole.ErrorResponse{StatusCode: http.StatusNotFound, Message: "Object Not Found", Reason: "Not Found"}
+
+// run runs rabbitmqctl with args and stdin and returns its standard output. Errors about missing
+// objects are returned as ctlNotFound.
+func (c *ctlClient) run(ctx context.Context, stdin string, args ...string) ([]byte, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	if c.node != "" {
+		args = append([]string{"-n", c.node}, args...)
+	}
+	cmd := exec.CommandContext(ctx, c.path, append(args, "--quiet")...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "does not exist") || strings.Contains(message, "no_such_") {
+			return nil, ctlNotFound
+		}
+		if message == "" {
+			return nil, fmt.Errorf("rabbitmqctl %s failed: %w", args[0], err)
+		}
+		return nil, fmt.Errorf("rabbitmqctl %s failed: %w: %s", args[0], err, message)
+	}
+	return stdout.Bytes(), nil
+}
+
+// list runs a rabbitmqctl list command and decodes its JSON output into result.
+func (c *ctlClient) list(ctx context.Context, result any, args ...string) error {
+	out, err := c.run(ctx, "", append(args, "--formatter", "json")...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, result); err != nil {
+		return fmt.Errorf("failed to parse output of rabbitmqctl %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// exec runs a rabbitmqctl command that changes something and returns ctlResponse.
+func (c *ctlClient) exec(ctx context.Context, stdin string, args ...string) (*http.Response, error) {
+	if _, err := c.run(ctx, stdin, args...); err != nil {
+		return nil, err
+	}
+	return ctlResponse(), nil
+}
+
+// ctlTags are the tags of list_users, a list in recent versions and "[tag1, tag2]" in older ones.
+type ctlTags []string
+
+func (t *ctlTags) UnmarshalJSON(data []byte) error {
+	var tags []string
+	if err := json.Unmarshal(data, &tags); err == nil {
+		*t = tags
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*t = nil
+	for _, tag := range strings.Split(strings.Trim(s, "[]"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// ctlJSON is a value that rabbitmqctl prints as JSON, or as string containing JSON in older versions.
+type ctlJSON struct{ value any }
+
+func (v *ctlJSON) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &v.value); err != nil {
+		return err
+	}
+	if s, ok := v.value.(string); ok {
+		var value any
+		if json.Unmarshal([]byte(s), &value) == nil {
+			v.value = value
+		}
+	}
+	return nil
+}
+
+func (c *ctlClient) GetUser(ctx context.Context, username string) (*rabbithole.UserInfo, error) {
+	var users []struct {
+		User string  `json:"user"`
+		Tags ctlTags `json:"tags"`
+	}
+	if err := c.list(ctx, &users, "list_users"); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.User == username {
+			// rabbitmqctl does not show the password hash; the node's hashing algorithm applies.
+			return &rabbithole.UserInfo{Name: user.User, Tags: rabbithole.UserTags(user.Tags)}, nil
+		}
+	}
+	return nil, ctlNotFound
+}
+
+func (c *ctlClient) PutUser(ctx context.Context, username string, settings rabbithole.UserSettings) (*http.Response, error) {
+	if settings.Password == "" {
+		return nil, fmt.Errorf("password hashes are %w", errCtlUnsupported)
+	}
+	_, err := c.GetUser(ctx, username)
+	switch {
+	case err == nil:
+		_, err = c.run(ctx, settings.Password, "change_password", username)
+	case errors.Is(err, ctlNotFound):
+		_, err = c.run(ctx, settings.Password, "add_user", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.setUserTags(ctx, username, settings.Tags)
+}
+
+func (c *ctlClient) PutUserWithoutPassword(ctx context.Context, username string, settings rabbithole.UserSettings) (*http.Response, error) {
+	_, err := c.GetUser(ctx, username)
+	if errors.Is(err, ctlNotFound) {
+		// add_user requires a password, which is cleared right away.
+		_, err = c.run(ctx, rand.Text(), "add_user", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.run(ctx, "", "clear_password", username); err != nil {
+		return nil, err
+	}
+	return c.setUserTags(ctx, username, settings.Tags)
+}
+
+func (c *ctlClient) setUserTags(ctx context.Context, username string, tags rabbithole.UserTags) (*http.Response, error) {
+	args := []string{"set_user_tags", username}
+	for _, tag := range tags {
+		for _, t := range strings.Split(tag, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				args = append(args, t)
+			}
+		}
+	}
+	return c.exec(ctx, "", args...)
+}
+
+func (c *ctlClient) UpdatePermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.Permissions) (*http.Response, error) {
+	return c.exec(ctx, "", "set_permissions", "-p", vhost, username, permissions.Configure, permissions.Write, permissions.Read)
+}
+
+func (c *ctlClient) UpdateTopicPermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.TopicPermissions) (*http.Response, error) {
+	return c.exec(ctx, "", "set_topic_permissions", "-p", vhost, username, permissions.Exchange, permissions.Write, permissions.Read)
+}
+
+func (c *ctlClient) listVhosts(ctx context.Context) ([]string, error) {
+	var vhosts []struct {
+		Name string `json:"name"`
+	}
+	if err := c.list(ctx, &vhosts, "list_vhosts", "name"); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(vhosts))
+	for i, vhost := range vhosts {
+		names[i] = vhost.Name
+	}
+	return names, nil
+}
+
+func (c *ctlClient) GetVhost(ctx context.Context, vhost string) (*rabbithole.VhostInfo, error) {
+	vhosts, err := c.listVhosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(vhosts, vhost) {
+		return nil, ctlNotFound
+	}
+	return &rabbithole.VhostInfo{Name: vhost}, nil
+}
+
+func (c *ctlClient) PutVhost(ctx context.Context, vhost string, _ rabbithole.VhostSettings) (*http.Response, error) {
+	return c.exec(ctx, "", "add_vhost", vhost)
+}
+
+func (c *ctlClient) PutUserLimits(ctx context.Context, username string, limits rabbithole.UserLimitsValues) (*http.Response, error) {
+	definition, err := json.Marshal(limits)
+	if err != nil {
+		return nil, err
+	}
+	return c.exec(ctx, "", "set_user_limits", username, string(definition))
+}
+
+func (c *ctlClient) PutVhostLimits(ctx context.Context, vhost string, limits rabbithole.VhostLimitsValues) (*http.Response, error) {
+	definition, err := json.Marshal(limits)
+	if err != nil {
+		return nil, err
+	}
+	return c.exec(ctx, "", "set_vhost_limits", "-p", vhost, string(definition))
+}
+
+func (c *ctlClient) DeleteUser(ctx context.Context, username string) (*http.Response, error) {
+	return c.exec(ctx, "", "delete_user", username)
+}
+
+func (c *ctlClient) GetPermissionsIn(ctx context.Context, vhost string, username string) (rabbithole.PermissionInfo, error) {
+	permissions, err := c.ListPermissionsOf(ctx, username)
+	if err != nil {
+		return rabbithole.PermissionInfo{}, err
+	}
+	for _, p := range permissions {
+		if p.Vhost == vhost {
+			return p, nil
+		}
+	}
+	return rabbithole.PermissionInfo{}, ctlNotFound
+}
+
+func (c *ctlClient) ListPermissionsOf(ctx context.Context, username string) ([]rabbithole.PermissionInfo, error) {
+	var permissions []rabbithole.PermissionInfo
+	if err := c.list(ctx, &permissions, "list_user_permissions", username); err != nil {
+		return nil, err
+	}
+	for i := range permissions {
+		permissions[i].User = username
+	}
+	return permissions, nil
+}
+
+func (c *ctlClient) ClearPermissionsIn(ctx context.Context, vhost string, username string) (*http.Response, error) {
+	return c.exec(ctx, "", "clear_permissions", "-p", vhost, username)
+}
+
+func (c *ctlClient) ListTopicPermissionsOf(ctx context.Context, username string) ([]rabbithole.TopicPermissionInfo, error) {
+	var permissions []rabbithole.TopicPermissionInfo
+	if err := c.list(ctx, &permissions, "list_user_topic_permissions", username); err != nil {
+		return nil, err
+	}
+	for i := range permissions {
+		permissions[i].User = username
+	}
+	return permissions, nil
+}
+
+func (c *ctlClient) ClearTopicPermissionsIn(ctx context.Context, vhost string, username string) (*http.Response, error) {
+	return c.exec(ctx, "", "clear_topic_permissions", "-p", vhost, username)
+}
+
+func (c *ctlClient) ListConnectionsOfUser(ctx context.Context, username string) ([]rabbithole.UserConnectionInfo, error) {
+	var connections []rabbithole.UserConnectionInfo
+	if err := c.list(ctx, &connections, "list_connections", "name", "user", "vhost"); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(connections, func(conn rabbithole.UserConnectionInfo) bool { return conn.User != username }), nil
+}
+
+func (c *ctlClient) CloseConnection(ctx context.Context, name string, reason string) (*http.Response, error) {
+	return c.exec(ctx, "", "close_connection", name, reason)
+}
+
+func (c *ctlClient) ExportDefinitions(ctx context.Context) (updater.Definitions, error) {
+	var definitions updater.Definitions
+	out, err := c.run(ctx, "", "export_definitions", "-", "--format", "json")
+	if err != nil {
+		return definitions, err
+	}
+	err = json.Unmarshal(out, &definitions)
+	return definitions, err
+}
+
+func (c *ctlClient) UploadDefinitions(ctx context.Context, definitions updater.Definitions) (*http.Response, error) {
+	body, err := json.Marshal(definitions)
+	if err != nil {
+		return nil, err
+	}
+	// Without a file, the definitions are read from standard input.
+	return c.exec(ctx, string(body), "import_definitions", "--format", "json")
+}
+
+func (c *ctlClient) ListRuntimeParametersFor(ctx context.Context, component string) ([]rabbithole.RuntimeParameter, error) {
+	vhosts, err := c.listVhosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var params []rabbithole.RuntimeParameter
+	for _, vhost := range vhosts {
+		var list []struct {
+			Component string  `json:"component"`
+			Name      string  `json:"name"`
+			Value     ctlJSON `json:"value"`
+		}
+		if err := c.list(ctx, &list, "list_parameters", "-p", vhost); err != nil {
+			return nil, err
+		}
+		for _, param := range list {
+			if param.Component == component {
+				params = append(params, rabbithole.RuntimeParameter{Component: component, Vhost: vhost, Name: param.Name, Value: param.Value.value})
+			}
+		}
+	}
+	return params, nil
+}
+
+func (c *ctlClient) PutRuntimeParameter(ctx context.Context, component string, vhost string, name string, value any) (*http.Response, error) {
+	definition, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return c.exec(ctx, "", "set_parameter", "-p", vhost, component, name, string(definition))
+}
+
+// getPolicy returns the policy (or operator policy, if operator is set) name in vhost.
+func (c *ctlClient) getPolicy(ctx context.Context, operator bool, vhost string, name string) (*rabbithole.Policy, error) {
+	command := "list_policies"
+	if operator {
+		command = "list_operator_policies"
+	}
+	var policies []struct {
+		Name       string  `json:"name"`
+		Pattern    string  `json:"pattern"`
+		ApplyTo    string  `json:"apply-to"`
+		Definition ctlJSON `json:"definition"`
+		Priority   int     `json:"priority"`
+	}
+	if err := c.list(ctx, &policies, command, "-p", vhost); err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if policy.Name != name {
+			continue
+		}
+		definition, _ := policy.Definition.value.(map[string]any)
+		return &rabbithole.Policy{Vhost: vhost, Name: name, Pattern: policy.Pattern, ApplyTo: policy.ApplyTo,
+			Definition: definition, Priority: policy.Priority}, nil
+	}
+	return nil, ctlNotFound
+}
+
+// putPolicy sets the policy (or operator policy, if operator is set) name in vhost.
+func (c *ctlClient) putPolicy(ctx context.Context, operator bool, vhost string, name string, policy rabbithole.Policy) (*http.Response, error) {
+	command := "set_policy"
+	if operator {
+		command = "set_operator_policy"
+	}
+	definition, err := json.Marshal(policy.Definition)
+	if err != nil {
+		return nil, err
+	}
+	return c.exec(ctx, "", command, "-p", vhost, "--priority", strconv.Itoa(policy.Priority), "--apply-to", policy.ApplyTo,
+		name, policy.Pattern, string(definition))
+}
+
+func (c *ctlClient) GetPolicy(ctx context.Context, vhost string, name string) (*rabbithole.Policy, error) {
+	return c.getPolicy(ctx, false, vhost, name)
+}
+
+func (c *ctlClient) PutPolicy(ctx context.Context, vhost string, name string, policy rabbithole.Policy) (*http.Response, error) {
+	return c.putPolicy(ctx, false, vhost, name, policy)
+}
+
+func (c *ctlClient) DeletePolicy(ctx context.Context, vhost string, name string) (*http.Response, error) {
+	return c.exec(ctx, "", "clear_policy", "-p", vhost, name)
+}
+
+func (c *ctlClient) GetOperatorPolicy(ctx context.Context, vhost string, name string) (*rabbithole.OperatorPolicy, error) {
+	policy, err := c.getPolicy(ctx, true, vhost, name)
+	return (*rabbithole.OperatorPolicy)(policy), err
+}
+
+func (c *ctlClient) PutOperatorPolicy(ctx context.Context, vhost string, name string, policy rabbithole.OperatorPolicy) (*http.Response, error) {
+	return c.putPolicy(ctx, true, vhost, name, rabbithole.Policy(policy))
+}
+
+func (c *ctlClient) DeleteOperatorPolicy(ctx context.Context, vhost string, name string) (*http.Response, error) {
+	return c.exec(ctx, "", "clear_operator_policy", "-p", vhost, name)
+}
+
+// Whoami verifies the credentials with authenticate_user. Rejected credentials are reported
+// like the Management API does, see handleHTTPError.
+func (c *ctlClient) Whoami(ctx context.Context) (*rabbithole.WhoamiInfo, error) {
+	if _, err := c.run(ctx, c.password, "authenticate_user", c.username); err != nil {
+		if errors.Is(err, ctlNotFound) || strings.Contains(err.Error(), "failed to authenticate") {
+			return nil, errors.New("Error: API responded with a 401 Unauthorized")
+		}
+		return nil, err
+	}
+	info := &rabbithole.WhoamiInfo{Name: c.username}
+	if user, err := c.GetUser(ctx, c.username); err == nil {
+		info.Tags = user.Tags
+	}
+	return info, nil
+}
+
+func (c *ctlClient) HealthCheckAlarms(context.Context) (rabbithole.ResourceAlarmCheckStatus, error) {
+	return rabbithole.ResourceAlarmCheckStatus{}, errCtlUnsupported
+}
+
+func (c *ctlClient) ListNodes(ctx context.Context) ([]rabbithole.NodeInfo, error) {
+	var status struct {
+		RunningNodes []string `json:"running_nodes"`
+	}
+	if err := c.list(ctx, &status, "cluster_status"); err != nil {
+		return nil, err
+	}
+	nodes := make([]rabbithole.NodeInfo, len(status.RunningNodes))
+	for i, node := range status.RunningNodes {
+		nodes[i] = rabbithole.NodeInfo{Name: node, IsRunning: true}
+	}
+	return nodes, nil
+}
+
+func (c *ctlClient) Overview(ctx context.Context) (*rabbithole.Overview, error) {
+	var status struct {
+		RabbitMQVersion string `json:"rabbitmq_version"`
+		Node            string `json:"node_name"`
+	}
+	if err := c.list(ctx, &status, "status"); err != nil {
+		return nil, err
+	}
+	return &rabbithole.Overview{RabbitMQVersion: status.RabbitMQVersion, Node: status.Node}, nil
+}
+
+func (c *ctlClient) AlivenessTest(context.Context, string) error {
+	return errCtlUnsupported
+}
+
+func (c *ctlClient) GetUsername() string {
+	return c.username
+}
+
+func (c *ctlClient) SetUsername(username string) {
+	c.username = username
+}
+
+func (c *ctlClient) SetPassword(password string) {
+	c.password = password
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ctlClient", func() {
+	var (
+		dir    string
+		client *ctlClient
+	)
+
+	// fakeRabbitmqctl installs a fake rabbitmqctl that records its arguments and standard input
+	// (one line per call) and runs the shell case branches of commands for the command in $1.
+	fakeRabbitmqctl := func(commands string) {
+		Expect(os.WriteFile(client.path, []byte(`#!/bin/sh
+echo "$*" >> `+filepath.Join(dir, "args")+`
+{ cat; echo; } >> `+filepath.Join(dir, "stdin")+`
+case "$1" in
+`+commands+`
+esac
+`), 0755)).To(Succeed())
+	}
+
+	calls := func(name string) []string {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		client = newCtlClient(filepath.Join(dir, "rabbitmqctl"), "", time.Minute)
+	})
+
+	Describe("GetUser", func() {
+		It("parses the tags of recent versions", func() {
+			fakeRabbitmqctl(`list_users) echo '[{"user":"admin","tags":["administrator","management"]}]';;`)
+			user, err := client.GetUser(context.Background(), "admin")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Tags).To(Equal(rabbithole.UserTags{"administrator", "management"}))
+			Expect(calls("args")).To(Equal([]string{"list_users --formatter json --quiet"}))
+		})
+
+		It("parses the tags of older versions", func() {
+			fakeRabbitmqctl(`list_users) echo '[{"user":"admin","tags":"[administrator, management]"},{"user":"guest","tags":"[]"}]';;`)
+			user, err := client.GetUser(context.Background(), "admin")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Tags).To(Equal(rabbithole.UserTags{"administrator", "management"}))
+			user, err = client.GetUser(context.Background(), "guest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Tags).To(BeEmpty())
+		})
+
+		It("returns not found for missing users", func() {
+			fakeRabbitmqctl(`list_users) echo '[]';;`)
+			_, err := client.GetUser(context.Background(), "admin")
+			Expect(errors.Is(err, ctlNotFound)).To(BeTrue())
+		})
+
+		It("runs against the configured node", func() {
+			client.node = "rabbit@other"
+			fakeRabbitmqctl(`-n) echo '[]';;`)
+			_, err := client.GetUser(context.Background(), "admin")
+			Expect(errors.Is(err, ctlNotFound)).To(BeTrue())
+			Expect(calls("args")).To(Equal([]string{"-n rabbit@other list_users --formatter json --quiet"}))
+		})
+	})
+
+	Describe("ListRuntimeParametersFor", func() {
+		It("parses values of recent and older versions", func() {
+			fakeRabbitmqctl(`list_vhosts) echo '[{"name":"/"},{"name":"old"}]';;
+list_parameters)
+	if [ "$3" = "/" ]; then
+		echo '[{"component":"shovel","name":"s1","value":{"src-uri":"amqp://a"}},{"component":"federation-upstream","name":"f1","value":{}}]'
+	else
+		echo '[{"component":"shovel","name":"s2","value":"{\"src-uri\":\"amqp://b\"}"}]'
+	fi;;`)
+			params, err := client.ListRuntimeParametersFor(context.Background(), "shovel")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(params).To(Equal([]rabbithole.RuntimeParameter{
+				{Component: "shovel", Vhost: "/", Name: "s1", Value: map[string]any{"src-uri": "amqp://a"}},
+				{Component: "shovel", Vhost: "old", Name: "s2", Value: map[string]any{"src-uri": "amqp://b"}},
+			}))
+		})
+	})
+
+	Describe("errors", func() {
+		It("detects missing objects on stderr", func() {
+			fakeRabbitmqctl(`delete_user) echo "Error: user 'app' does not exist" >&2; exit 70;;
+clear_policy) echo "Error: {no_such_vhost,<<\"tenant\">>}" >&2; exit 70;;`)
+			_, err := client.DeleteUser(context.Background(), "app")
+			Expect(errors.Is(err, ctlNotFound)).To(BeTrue())
+			_, err = client.DeletePolicy(context.Background(), "tenant", "ha")
+			Expect(errors.Is(err, ctlNotFound)).To(BeTrue())
+		})
+
+		It("reports other failures with stderr", func() {
+			fakeRabbitmqctl(`delete_user) echo "Error: unable to perform an operation on node" >&2; exit 69;;`)
+			_, err := client.DeleteUser(context.Background(), "app")
+			Expect(errors.Is(err, ctlNotFound)).To(BeFalse())
+			Expect(err).To(MatchError(ContainSubstring("rabbitmqctl delete_user failed: exit status 69: Error: unable to perform")))
+		})
+	})
+
+	Describe("PutUser", func() {
+		It("changes the password of existing users on standard input", func() {
+			fakeRabbitmqctl(`list_users) echo '[{"user":"app","tags":[]}]';;`)
+			_, err := client.PutUser(context.Background(), "app", rabbithole.UserSettings{Password: "s3cret", Tags: rabbithole.UserTags{"monitoring"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls("args")).To(Equal([]string{
+				"list_users --formatter json --quiet",
+				"change_password app --quiet",
+				"set_user_tags app monitoring --quiet",
+			}))
+			Expect(calls("stdin")).To(Equal([]string{"", "s3cret", ""}))
+		})
+
+		It("adds missing users with the password on standard input", func() {
+			fakeRabbitmqctl(`list_users) echo '[]';;`)
+			_, err := client.PutUser(context.Background(), "app", rabbithole.UserSettings{Password: "s3cret"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls("args")).To(ContainElement("add_user app --quiet"))
+			Expect(calls("stdin")).To(ContainElement("s3cret"))
+		})
+
+		It("adds passwordless users with a random password that is cleared", func() {
+			fakeRabbitmqctl(`list_users) echo '[]';;`)
+			_, err := client.PutUserWithoutPassword(context.Background(), "app", rabbithole.UserSettings{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.PutUserWithoutPassword(context.Background(), "app", rabbithole.UserSettings{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls("args")[1:3]).To(Equal([]string{"add_user app --quiet", "clear_password app --quiet"}))
+			stdin := calls("stdin")
+			Expect(stdin[1]).To(HaveLen(26))
+			Expect(stdin[5]).To(HaveLen(26))
+			Expect(stdin[1]).NotTo(Equal(stdin[5]))
+		})
+	})
+
+	Describe("Whoami", func() {
+		BeforeEach(func() {
+			client.SetUsername("admin")
+			client.SetPassword("s3cret")
+		})
+
+		It("verifies the credentials with authenticate_user", func() {
+			fakeRabbitmqctl(`list_users) echo '[{"user":"admin","tags":["administrator"]}]';;`)
+			info, err := client.Whoami(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(Equal(&rabbithole.WhoamiInfo{Name: "admin", Tags: rabbithole.UserTags{"administrator"}}))
+			Expect(calls("args")[0]).To(Equal("authenticate_user admin --quiet"))
+			Expect(calls("stdin")[0]).To(Equal("s3cret"))
+		})
+
+		It("reports rejected credentials as 401", func() {
+			fakeRabbitmqctl(`authenticate_user) echo 'Error: failed to authenticate user "admin"' >&2; exit 65;;`)
+			_, err := client.Whoami(context.Background())
+			Expect(err).To(MatchError("Error: API responded with a 401 Unauthorized"))
+		})
+
+		It("reports missing users as 401", func() {
+			fakeRabbitmqctl(`authenticate_user) echo "Error: user 'admin' does not exist" >&2; exit 65;;`)
+			_, err := client.Whoami(context.Background())
+			Expect(err).To(MatchError("Error: API responded with a 401 Unauthorized"))
+		})
+	})
+})
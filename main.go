@@ -1,88 +1,862 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
 	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rabbitmq/default-user-credential-updater/updater"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"gopkg.in/ini.v1"
+)
+
+// maxTerminationMessageLength is the maximum length of a termination message shown by Kubernetes.
+const maxTerminationMessageLength = 4096
+
+// Exit codes, so that orchestration tooling can react differently per failure class.
+const (
+	exitOK = 0
+	// exitFailure is used for failures not covered by the exit codes below.
+	exitFailure = 1
+	// exitBadFlags is also used by the flag package for flags that cannot be parsed.
+	exitBadFlags           = 2
+	exitWatchDirUnreadable = 3
+	exitBrokerUnreachable  = 4
+	exitInvalidAdminSecret = 5
+	exitWatcherFailure     = 6
+	exitAuthBackend        = 7
+	exitUnsupportedBroker  = 8
 )
 
 func main() {
-	var managementURI, caFile, adminFile, watchDir string
+	os.Exit(run())
+}
+
+// run runs the updater until it terminates and returns the exit code.
+// Unlike os.Exit(), returning runs deferred functions.
+func run() int {
+	var managementURI, amqpURI, amqp10URI, mqttURI, stompURI, probeUsers, caFile, adminFile, watchDir, metricsAddress, lockFile, stateFile, terminationMessagePath string
+	var maxAttempts, circuitBreakerThreshold, maxConsecutiveFailures, apiBurst, maxCredentialLength int
+	var apiRateLimit float64
+	var failureMode, nodes, includeUsers, excludeUsers, usernamePattern string
+	var verifyPropagation, verifyAliveness, allowControlCharacters, once, stdin, createVhosts, deleteRemovedUsers, closeConnections, batchUpdates, updateFederationUpstreams, updateShovels, requireInternalAuthBackend bool
+	var deleteGracePeriod, closeConnectionsDelay, resyncInterval time.Duration
+	var backupDir, parameterURIs string
+	var protectedUsers, serviceUserID, bootstrapUserID, defaultUserFile, defaultUserID, configFiles, templateFiles, templateURI string
+	var defaultPermissions, defaultVhost, permissionPresetsFile, minHashingAlgorithm, minRabbitMQVersion string
+	var circuitBreakerCooldown, apiTimeout, shutdownTimeout, propagationTimeout time.Duration
+	var oauth2TokenFile, oauth2TokenURL, oauth2ClientID, oauth2ClientSecretFile, oauth2Scope string
+	var backend, rabbitmqctl, adminFileFormat, adminFileSection, adminFileUsernameKey, adminFilePasswordKey string
+	var adminFileConnection, skipAdminFile bool
+	var sources sourceFlags
 
 	flag.StringVar(
 		&adminFile,
 		"admin-file",
 		"/var/lib/rabbitmq/.rabbitmqadmin.conf",
 		"Absolute path to file used by rabbitmqadmin CLI. "+
-			"It contains RabbitMQ admin username (must be the same as default user username) and (old) password.")
+			"It contains RabbitMQ admin username (must be the same as default user username) and (old) password. "+
+			"If empty, no admin file is written and the admin credentials are only verified.")
+	flag.BoolVar(
+		&skipAdminFile,
+		"skip-admin-file",
+		false,
+		"Do not write -admin-file, e.g. if rabbitmqadmin is not used. Same as -admin-file=\"\".")
+	flag.StringVar(
+		&adminFileFormat,
+		"admin-file-format",
+		string(updater.FileFormatINI),
+		"Format of -admin-file: ini (.rabbitmqadmin.conf of rabbitmqadmin v1) or toml (rabbitmqadmin.conf of rabbitmqadmin v2, "+
+			"whose -admin-file-section is updated).")
+	flag.StringVar(
+		&adminFileSection,
+		"admin-file-section",
+		updater.DefaultAdminFileSection,
+		"Section of -admin-file (with -admin-file-format=toml, the table of the node) that contains the admin credentials.")
+	flag.StringVar(
+		&adminFileUsernameKey,
+		"admin-file-username-key",
+		updater.DefaultAdminFileUsernameKey,
+		"Key of the admin username in -admin-file-section.")
+	flag.StringVar(
+		&adminFilePasswordKey,
+		"admin-file-password-key",
+		updater.DefaultAdminFilePasswordKey,
+		"Key of the admin password in -admin-file-section.")
+	flag.BoolVar(
+		&adminFileConnection,
+		"admin-file-connection",
+		false,
+		"Also write the hostname, port, TLS setting (ssl with rabbitmqadmin v1, tls with v2) and path prefix of -management-uri "+
+			"to -admin-file-section, so that a new admin file can be used by rabbitmqadmin right away.")
+	defaultWatchDir := "/etc/rabbitmq/secrets"
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		// Credentials passed by systemd with LoadCredential= or SetCredentialEncrypted=.
+		defaultWatchDir = dir
+	}
 	flag.StringVar(
 		&watchDir,
 		"watch-dir",
-		"/etc/rabbitmq/secrets",
-		"Directory containing user secrets files in the format user_<id>_{username,password,tag}.")
+		defaultWatchDir,
+		"Directory containing user secrets files in the format user_<id>_{username,password,tag}. "+
+			"Defaults to $CREDENTIALS_DIRECTORY if the updater runs as a systemd service with credentials.")
+	flag.StringVar(
+		&lockFile,
+		"lock-file",
+		"",
+		"Optional path to a file (e.g. on a volume shared between nodes) that is locked with flock while updating, "+
+			"so that concurrent updaters do not interleave their updates.")
+	flag.StringVar(
+		&stateFile,
+		"state-file",
+		"",
+		"Optional path to a JSON file recording hashes of the applied passwords, so that credentials changed "+
+			"while the updater was not running are updated after a restart. The key of the hashes is stored in <state-file>.key.")
+	defaultTerminationMessagePath := ""
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		// Running in a Kubernetes Pod, whose containers have a termination message path by default.
+		defaultTerminationMessagePath = "/dev/termination-log"
+	}
+	flag.StringVar(
+		&terminationMessagePath,
+		"termination-message-path",
+		defaultTerminationMessagePath,
+		"Path to write the reason to when terminating due to a fatal error, so that it is shown by "+
+			"'kubectl describe pod'. Defaults to /dev/termination-log in Kubernetes. Disabled if empty.")
 	flag.StringVar(
 		&managementURI,
 		"management-uri",
 		"http://127.0.0.1:15672",
 		"RabbitMQ Management URI")
+	flag.StringVar(
+		&backend,
+		"backend",
+		"http",
+		"How to manage users: http (RabbitMQ Management API) or ctl (rabbitmqctl on the local node, for nodes whose "+
+			"management plugin is disabled or unreachable; requires the Erlang cookie and does not support password hashes, "+
+			"resource alarm checks or aliveness tests).")
+	flag.StringVar(
+		&rabbitmqctl,
+		"rabbitmqctl",
+		"rabbitmqctl",
+		"Path to rabbitmqctl, with -backend=ctl.")
 	flag.StringVar(
 		&caFile,
 		"ca-file",
 		"/etc/rabbitmq-tls/ca.crt",
 		"This file contains the trusted certificate for RabbitMQ server authentication.")
+	flag.StringVar(
+		&oauth2TokenFile,
+		"oauth2-token-file",
+		"",
+		"File with a JWT (e.g. a projected service account token) to authenticate to the Management API with, "+
+			"instead of the admin credentials. It is read for every request, so that it can be rotated.")
+	flag.StringVar(
+		&oauth2TokenURL,
+		"oauth2-token-url",
+		"",
+		"Token endpoint of an OAuth2 authorization server to request access tokens from with the client credentials grant, "+
+			"to authenticate to the Management API with instead of the admin credentials. Requires -oauth2-client-id and -oauth2-client-secret-file.")
+	flag.StringVar(
+		&oauth2ClientID,
+		"oauth2-client-id",
+		"",
+		"OAuth2 client ID for -oauth2-token-url.")
+	flag.StringVar(
+		&oauth2ClientSecretFile,
+		"oauth2-client-secret-file",
+		"",
+		"File with the OAuth2 client secret for -oauth2-token-url.")
+	flag.StringVar(
+		&oauth2Scope,
+		"oauth2-scope",
+		"",
+		"Space separated scopes requested with -oauth2-token-url, e.g. rabbitmq.tag:administrator.")
+	flag.DurationVar(
+		&apiTimeout,
+		"api-timeout",
+		30*time.Second,
+		"Timeout for a single RabbitMQ Management API request. 0 disables the timeout.")
+	flag.IntVar(
+		&maxAttempts,
+		"max-attempts",
+		updater.DefaultRetryPolicy.MaxAttempts,
+		"Maximum number of attempts for a RabbitMQ Management API request failing with a transient error "+
+			"(connection error or 5xx response). Retries use exponential backoff with jitter.")
+	flag.StringVar(
+		&failureMode,
+		"failure-mode",
+		string(updater.FailureModeExit),
+		"What to do when processing the secrets fails (e.g. the admin credentials are rejected): "+
+			"'exit' terminates after -max-consecutive-failures failures, 'retry' retries forever with backoff.")
+	flag.IntVar(
+		&maxConsecutiveFailures,
+		"max-consecutive-failures",
+		1,
+		"Number of consecutive failures after which the updater terminates in 'exit' failure mode.")
+	flag.Float64Var(
+		&apiRateLimit,
+		"api-rate-limit",
+		10,
+		"Maximum average number of RabbitMQ Management API requests per second. 0 disables rate limiting.")
+	flag.IntVar(
+		&apiBurst,
+		"api-burst",
+		20,
+		"Maximum number of RabbitMQ Management API requests sent in a burst when rate limiting.")
+	flag.IntVar(
+		&circuitBreakerThreshold,
+		"circuit-breaker-threshold",
+		5,
+		"Number of consecutive transient RabbitMQ Management API failures after which requests fail fast "+
+			"until the cooldown has passed. 0 disables the circuit breaker.")
+	flag.DurationVar(
+		&circuitBreakerCooldown,
+		"circuit-breaker-cooldown",
+		30*time.Second,
+		"Time to wait before probing the RabbitMQ Management API again after the circuit breaker opened.")
+	flag.DurationVar(
+		&shutdownTimeout,
+		"shutdown-timeout",
+		20*time.Second,
+		"Maximum time to wait for an in-flight sync to finish when terminating.")
+	flag.StringVar(
+		&metricsAddress,
+		"metrics-address",
+		"",
+		"Address (e.g. :9090) to serve Prometheus metrics on at /metrics. Metrics are disabled if empty.")
+	flag.BoolVar(
+		&verifyPropagation,
+		"verify-propagation",
+		false,
+		"Verify that every cluster node accepts an updated password before considering the update successful.")
+	flag.StringVar(
+		&amqpURI,
+		"verify-amqp-uri",
+		"",
+		"AMQP 0-9-1 URI (e.g. amqps://rabbitmq:5671/vhost) to open a connection to with updated credentials, "+
+			"before considering the update successful. For amqps, the server certificate is verified with -ca-file.")
+	flag.StringVar(
+		&amqp10URI,
+		"verify-amqp10-uri",
+		"",
+		"AMQP 1.0 URI (e.g. amqps://rabbitmq:5671) to authenticate to with SASL PLAIN with updated credentials, "+
+			"before considering the update successful. For amqps, the server certificate is verified with -ca-file.")
+	flag.StringVar(
+		&mqttURI,
+		"verify-mqtt-uri",
+		"",
+		"MQTT URI (e.g. mqtts://rabbitmq:8883) to connect to with updated credentials with MQTT 3.1.1, "+
+			"before considering the update successful. For mqtts, the server certificate is verified with -ca-file.")
+	flag.StringVar(
+		&stompURI,
+		"verify-stomp-uri",
+		"",
+		"STOMP URI (e.g. stomps://rabbitmq:61614/vhost) to connect to with updated credentials, "+
+			"before considering the update successful. For stomps, the server certificate is verified with -ca-file.")
+	flag.StringVar(
+		&probeUsers,
+		"probe-users",
+		"",
+		"Comma separated list of <probe>=<pattern> (e.g. mqtt=iot-*,stomp=web-*) restricting the probes amqp091, amqp10, "+
+			"mqtt and stomp to the usernames matching one of their glob patterns. By default, every probe verifies every user.")
+	flag.BoolVar(
+		&verifyAliveness,
+		"verify-aliveness",
+		false,
+		"Verify an updated password with an aliveness test in each vhost of the user (which needs permissions on the "+
+			"aliveness-test queue) before considering the update successful.")
+	flag.StringVar(
+		&nodes,
+		"nodes",
+		"",
+		"Comma separated list of cluster nodes (e.g. rabbit@host) or their Management API URIs to verify updated "+
+			"passwords against. Defaults to the running nodes reported by /api/nodes.")
+	flag.DurationVar(
+		&propagationTimeout,
+		"propagation-timeout",
+		updater.DefaultPropagationTimeout,
+		"Maximum time to wait for every cluster node to accept an updated password.")
+	flag.StringVar(
+		&includeUsers,
+		"include-users",
+		"",
+		"Comma separated list of glob patterns (e.g. app_*). If set, only users whose ID matches one of them are "+
+			"updated. The admin user is always updated.")
+	flag.StringVar(
+		&excludeUsers,
+		"exclude-users",
+		"",
+		"Comma separated list of glob patterns (e.g. default). Users whose ID matches one of them are not updated, "+
+			"e.g. users managed by the cluster operator. The admin user is always updated.")
+	flag.IntVar(
+		&maxCredentialLength,
+		"max-credential-length",
+		updater.DefaultValidationRules.MaxLength,
+		"Maximum length of a username, password or tag in bytes. Longer credentials are rejected. 0 disables the limit.")
+	flag.BoolVar(
+		&allowControlCharacters,
+		"allow-control-characters",
+		false,
+		"Allow control characters (e.g. NUL) in credentials. By default, such credentials are rejected.")
+	flag.StringVar(
+		&usernamePattern,
+		"username-pattern",
+		"",
+		"Go regular expression that every username must match, e.g. '^[a-z0-9_-]+$'. "+
+			"Credentials with other usernames are rejected.")
+	flag.BoolVar(
+		&createVhosts,
+		"create-vhosts",
+		false,
+		"Create missing vhosts that users are granted permissions in, e.g. by user_<id>_vhosts files.")
+	flag.StringVar(
+		&defaultPermissions,
+		"default-permissions",
+		".*;.*;.*",
+		"Permissions granted to new users without permissions, as configure;write;read regular expressions. "+
+			"If empty, such users are created without any permissions.")
+	flag.StringVar(
+		&defaultVhost,
+		"default-vhost",
+		"/",
+		"Vhost in which -default-permissions are granted.")
+	flag.StringVar(
+		&permissionPresetsFile,
+		"permission-presets-file",
+		"",
+		"YAML file mapping user tags to the permissions per vhost that new users with the tag are granted "+
+			"instead of -default-permissions, e.g. 'monitoring: {/: {configure: \"\", write: \"\", read: \".*\"}}'.")
+	flag.StringVar(
+		&minHashingAlgorithm,
+		"min-hashing-algorithm",
+		"",
+		"Minimum password hashing algorithm (md5, sha256 or sha512). Users with a weaker algorithm are upgraded "+
+			"when their password is updated. By default, the algorithm of the existing user is preserved.")
+	flag.BoolVar(
+		&deleteRemovedUsers,
+		"delete-removed-users",
+		false,
+		"Delete users (and their permissions) from RabbitMQ whose secrets have been removed, after -delete-grace-period. "+
+			"Only users applied by the updater (see -state-file) are deleted, never the admin user.")
+	flag.DurationVar(
+		&deleteGracePeriod,
+		"delete-grace-period",
+		10*time.Minute,
+		"Time to wait after the secrets of a user were removed before deleting it, in case they reappear.")
+	flag.StringVar(
+		&protectedUsers,
+		"protected-users",
+		strings.Join(updater.DefaultProtectedUsers, ","),
+		"Comma separated list of glob patterns (e.g. guest,default_user_*). Users whose username matches one of them "+
+			"are never created, modified or deleted, whatever the watch directory contains. The admin user cannot be protected.")
+	flag.StringVar(
+		&serviceUserID,
+		"service-user-id",
+		"",
+		"User ID (e.g. updater for the user_updater_* files) of a dedicated user to authenticate with instead of the admin user, "+
+			"so that rotating the admin password does not affect the updater's own access. The admin user is used until its credentials are applied.")
+	flag.StringVar(
+		&bootstrapUserID,
+		"bootstrap-user-id",
+		"",
+		"User ID (e.g. default for the user_default_* files of the operator's default user) of working administrator credentials "+
+			"that create the admin user with the administrator tag at startup, if RabbitMQ rejects the admin credentials because it does not exist yet.")
+	flag.StringVar(
+		&defaultUserFile,
+		"default-user-file",
+		"",
+		"rabbitmq.conf-style file (e.g. /etc/rabbitmq/conf.d/11-default_user.conf of the cluster operator) to keep default_user "+
+			"and default_pass in sync with the credentials of -default-user-id, preserving other keys. Disabled if empty.")
+	flag.StringVar(
+		&defaultUserID,
+		"default-user-id",
+		"admin",
+		"User ID whose credentials are written to -default-user-file.")
+	flag.StringVar(
+		&configFiles,
+		"config-files",
+		"",
+		"Comma separated list of <user ID>=[<format>:]<path>[:<username key>:<password key>[:<section>]] of files whose keys "+
+			"are kept in sync with the credentials of the user, e.g. admin=/etc/rabbitmq/conf.d/11-default_user.conf,"+
+			"app=ini:/etc/app/app.ini:user:password:rabbitmq. The format is conf (sysctl format of rabbitmq.conf, the default, "+
+			"with the keys default_user and default_pass by default), ini or toml (with the keys username and password in "+
+			"the section default by default), or env (shell variable assignments, e.g. app=env:/shared/rabbitmq.env for "+
+			"sidecars sourcing the file, with the keys RABBITMQ_USERNAME and RABBITMQ_PASSWORD by default). "+
+			"The previous content is backed up to <path>.bak.")
+	flag.StringVar(
+		&templateFiles,
+		"template-files",
+		"",
+		"Comma separated list of <user ID>=<template>:<path> of Go templates (text/template) that are rendered with the "+
+			"credentials of the user into <path>, e.g. app=/etc/updater/amqp.tmpl:/shared/amqp-uri. The template data are "+
+			".Username, .Password and .URI, which is -template-uri with the credentials.")
+	flag.StringVar(
+		&templateURI,
+		"template-uri",
+		"",
+		"URI (e.g. amqps://rabbitmq:5671/vhost) that is rendered with the credentials of the user as .URI of -template-files.")
+	flag.BoolVar(
+		&closeConnections,
+		"close-connections",
+		false,
+		"Close the connections of users after their password was updated or they were disabled, "+
+			"so that clients have to reconnect with the new password.")
+	flag.DurationVar(
+		&closeConnectionsDelay,
+		"close-connections-delay",
+		0,
+		"With -close-connections, time to wait before closing the connections that were open when the password was "+
+			"updated (e.g. 10m), so that applications can pick up the new password on their own. Not supported with -once.")
+	flag.BoolVar(
+		&batchUpdates,
+		"batch-updates",
+		false,
+		"Update changed users with permissions by importing definitions in a single request, e.g. for hundreds of users. "+
+			"Other users, or all users if the import fails, are updated one by one.")
+	flag.BoolVar(
+		&updateFederationUpstreams,
+		"update-federation-upstreams",
+		false,
+		"Replace the password of updated users in the URIs of federation upstreams that use their credentials.")
+	flag.BoolVar(
+		&updateShovels,
+		"update-shovels",
+		false,
+		"Replace the password of updated users in the source and destination URIs of dynamic shovels that use their credentials.")
+	flag.StringVar(
+		&parameterURIs,
+		"update-parameter-uris",
+		"",
+		"Comma separated list of <component>=<key> (e.g. shovel=src-uri,my-plugin=uri). The password of updated users is "+
+			"replaced in the URIs under the key in the values of the runtime parameters of the component that use their credentials.")
+	flag.StringVar(
+		&minRabbitMQVersion,
+		"min-rabbitmq-version",
+		"",
+		"Minimum RabbitMQ version (e.g. 3.12.0). The updater refuses to run if RabbitMQ reports an older version at startup.")
+	flag.BoolVar(
+		&requireInternalAuthBackend,
+		"require-internal-auth-backend",
+		false,
+		"Refuse to run if RabbitMQ reports that the admin user was authenticated by another auth backend than the internal "+
+			"user database (e.g. LDAP), in which updated credentials may have no effect. Other auth backends are only warned about otherwise.")
+	flag.StringVar(
+		&backupDir,
+		"backup-dir",
+		"",
+		"Directory to export the users and permissions of RabbitMQ to (as timestamped definitions files, which contain "+
+			"password hashes) before they are updated, or - for stdout. Disabled by default.")
+	flag.DurationVar(
+		&resyncInterval,
+		"resync-interval",
+		0,
+		"Interval of full syncs (e.g. 1h), which correct tags, hashing algorithms and permissions that were changed "+
+			"on the RabbitMQ server, e.g. with rabbitmqctl. Disabled by default; a full sync can also be requested with SIGHUP.")
+	flag.BoolVar(
+		&once,
+		"once",
+		false,
+		"Apply and verify the credentials once and exit, instead of watching for changes, e.g. in CI jobs. "+
+			"Exits with a non-zero code if any user could not be updated.")
+	flag.BoolVar(
+		&stdin,
+		"stdin",
+		false,
+		"With -once, read the users from stdin as JSON document instead of -source, in the format "+
+			`{"users": {"<id>": {"username": "...", "password": "...", "tag": "..."}}}. The admin user must be included.`)
+	sources.register()
 	flag.Parse()
 
 	log := initLogging().WithName("password-updater")
 
-	rabbitAuthClient, err := newRabbitClient(log, managementURI, caFile)
+	if mode := updater.FailureMode(failureMode); mode != updater.FailureModeExit && mode != updater.FailureModeRetry {
+		log.Error(nil, "invalid failure mode, expected 'exit' or 'retry'", "failure-mode", failureMode)
+		return exitBadFlags
+	}
+
+	if skipAdminFile {
+		adminFile = ""
+	}
+
+	if format := updater.FileFormat(adminFileFormat); format != updater.FileFormatINI && format != updater.FileFormatTOML {
+		log.Error(nil, "invalid admin file format, expected 'ini' or 'toml'", "admin-file-format", adminFileFormat)
+		return exitBadFlags
+	}
+
+	if adminFileSection == "" || adminFileUsernameKey == "" || adminFilePasswordKey == "" || adminFileUsernameKey == adminFilePasswordKey {
+		log.Error(nil, "invalid admin file section or keys, expected a section and two different keys",
+			"admin-file-section", adminFileSection, "admin-file-username-key", adminFileUsernameKey, "admin-file-password-key", adminFilePasswordKey)
+		return exitBadFlags
+	}
+
+	var adminSettings map[string]any
+	if adminFileConnection {
+		var err error
+		adminSettings, err = adminFileSettings(managementURI, updater.FileFormat(adminFileFormat))
+		if err != nil {
+			log.Error(err, "invalid management URI", "management-uri", managementURI)
+			return exitBadFlags
+		}
+	}
+
+	include, err := parseUserPatterns(includeUsers)
 	if err != nil {
-		log.Error(err, "failed to create RabbitMQ auth client")
-		return
+		log.Error(err, "invalid user pattern", "include-users", includeUsers)
+		return exitBadFlags
 	}
-	rabbitAdminClient, err := newRabbitClient(log, managementURI, caFile)
+	exclude, err := parseUserPatterns(excludeUsers)
 	if err != nil {
-		log.Error(err, "failed to create RabbitMQ admin client")
-		return
+		log.Error(err, "invalid user pattern", "exclude-users", excludeUsers)
+		return exitBadFlags
+	}
+
+	defaults, err := parseDefaultPermissions(defaultPermissions, defaultVhost)
+	if err != nil {
+		log.Error(err, "invalid default permissions", "default-permissions", defaultPermissions, "default-vhost", defaultVhost)
+		return exitBadFlags
 	}
 
-	// Remove trailing new line (.rabbitmqadmin.conf has only one section).
-	ini.PrettySection = false
+	uriKeys, err := parseNameValues(parameterURIs)
+	if err != nil {
+		log.Error(err, "invalid runtime parameter URIs", "update-parameter-uris", parameterURIs)
+		return exitBadFlags
+	}
+
+	sinks, err := parseConfigFiles(configFiles)
+	if err != nil {
+		log.Error(err, "invalid config files", "config-files", configFiles)
+		return exitBadFlags
+	}
+	if defaultUserFile != "" {
+		sinks[defaultUserID] = append(sinks[defaultUserID], updater.ConfigFile{Path: defaultUserFile})
+	}
+	templates, err := parseTemplateFiles(templateFiles, templateURI)
+	if err != nil {
+		log.Error(err, "invalid template files", "template-files", templateFiles, "template-uri", templateURI)
+		return exitBadFlags
+	}
+	for userID, files := range templates {
+		sinks[userID] = append(sinks[userID], files...)
+	}
+
+	var presets updater.PermissionPresets
+	if permissionPresetsFile != "" {
+		presets, err = updater.LoadPermissionPresets(permissionPresetsFile)
+		if err != nil {
+			log.Error(err, "invalid permission presets", "permission-presets-file", permissionPresetsFile)
+			return exitBadFlags
+		}
+	}
+
+	var minHashing rabbithole.HashingAlgorithm
+	if minHashingAlgorithm != "" {
+		var ok bool
+		if minHashing, ok = updater.ParseHashingAlgorithm(minHashingAlgorithm); !ok {
+			log.Error(nil, "invalid hashing algorithm, expected md5, sha256 or sha512", "min-hashing-algorithm", minHashingAlgorithm)
+			return exitBadFlags
+		}
+	}
+
+	var minVersion updater.RabbitMQVersion
+	if minRabbitMQVersion != "" {
+		var ok bool
+		if minVersion, ok = updater.ParseRabbitMQVersion(minRabbitMQVersion); !ok {
+			log.Error(nil, "invalid RabbitMQ version, expected <major>.<minor>[.<patch>]", "min-rabbitmq-version", minRabbitMQVersion)
+			return exitBadFlags
+		}
+	}
+
+	protected, err := parseUserPatterns(protectedUsers)
+	if err != nil {
+		log.Error(err, "invalid user pattern", "protected-users", protectedUsers)
+		return exitBadFlags
+	}
+
+	validationRules := updater.ValidationRules{MaxLength: maxCredentialLength, AllowControlCharacters: allowControlCharacters}
+	if usernamePattern != "" {
+		validationRules.UsernamePattern, err = regexp.Compile(usernamePattern)
+		if err != nil {
+			log.Error(err, "invalid username pattern", "username-pattern", usernamePattern)
+			return exitBadFlags
+		}
+	}
+
+	var tokens tokenSource
+	switch {
+	case oauth2TokenFile != "" && oauth2TokenURL != "":
+		log.Error(nil, "-oauth2-token-file and -oauth2-token-url are mutually exclusive")
+		return exitBadFlags
+	case oauth2TokenFile != "":
+		tokens = tokenFile(oauth2TokenFile)
+	case oauth2TokenURL != "":
+		if oauth2ClientID == "" || oauth2ClientSecretFile == "" {
+			log.Error(nil, "-oauth2-token-url requires -oauth2-client-id and -oauth2-client-secret-file")
+			return exitBadFlags
+		}
+		tokens = &clientCredentials{
+			tokenURL:         oauth2TokenURL,
+			clientID:         oauth2ClientID,
+			clientSecretFile: oauth2ClientSecretFile,
+			scope:            oauth2Scope,
+			client:           &http.Client{Timeout: apiTimeout},
+		}
+	}
+
+	var rabbitAuthClient, rabbitAdminClient updater.RabbitClient
+	switch backend {
+	case "http":
+		// The auth client verifies the credentials of users, so it always uses basic auth.
+		rabbitAuthClient, err = newRabbitClient(log, managementURI, caFile, apiTimeout, nil)
+		if err != nil {
+			log.Error(err, "failed to create RabbitMQ auth client")
+			return exitBadFlags
+		}
+		rabbitAdminClient, err = newRabbitClient(log, managementURI, caFile, apiTimeout, tokens)
+		if err != nil {
+			log.Error(err, "failed to create RabbitMQ admin client")
+			return exitBadFlags
+		}
+	case "ctl":
+		if tokens != nil {
+			log.Error(nil, "OAuth2 is not supported with -backend=ctl")
+			return exitBadFlags
+		}
+		rabbitAuthClient = newCtlClient(rabbitmqctl, "", apiTimeout)
+		rabbitAdminClient = newCtlClient(rabbitmqctl, "", apiTimeout)
+	default:
+		log.Error(nil, "invalid backend, expected 'http' or 'ctl'", "backend", backend)
+		return exitBadFlags
+	}
+	// The rate limit applies to all requests, regardless of the client.
+	rateLimiter := updater.NewRateLimiter(apiRateLimit, apiBurst)
+	rabbitAuthClient = updater.NewRateLimitedClient(rabbitAuthClient, rateLimiter)
+	rabbitAdminClient = updater.NewRateLimitedClient(rabbitAdminClient, rateLimiter)
+	rabbitAuthClient = updater.NewCircuitBreakerClient(rabbitAuthClient, circuitBreakerThreshold, circuitBreakerCooldown, log.WithName("auth-client"))
+	rabbitAdminClient = updater.NewCircuitBreakerClient(rabbitAdminClient, circuitBreakerThreshold, circuitBreakerCooldown, log.WithName("admin-client"))
 
 	// This channel will contain a value when the Pod gets terminated.
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 
-	// This channel will contain a value when our program terminates itself.
-	// This is preferred over calling os.Exit() because os.Exit() does not run deferred functions.
-	done := make(chan bool, 1)
+	// This channel will contain a value when an operator requests a full sync (SIGHUP)
+	// or a dump of the internal state (SIGUSR1).
+	requests := make(chan os.Signal, 1)
+	signal.Notify(requests, syscall.SIGHUP, syscall.SIGUSR1)
 
-	passwordUpdater, err := updater.NewPasswordUpdater(adminFile, watchDir, done, log, rabbitAuthClient, rabbitAdminClient)
+	var source updater.SecretSource
+	switch {
+	case stdin && !once:
+		log.Error(nil, "-stdin requires -once")
+		return exitBadFlags
+	case stdin:
+		source, err = updater.ReadUsersDocument(os.Stdin)
+		if err != nil {
+			log.Error(err, "failed to read users from stdin")
+			return exitBadFlags
+		}
+	default:
+		source, err = sources.newSource(watchDir, log.WithName("source"))
+		if err != nil {
+			log.Error(err, "failed to create credential source", "source", sources.source)
+			return exitBadFlags
+		}
+	}
+	var passwordUpdater *updater.PasswordUpdater
+	if directory, ok := source.(updater.DirectorySource); ok && !once {
+		passwordUpdater, err = updater.NewDirectoryPasswordUpdater(adminFile, directory, stateFile, log, rabbitAuthClient, rabbitAdminClient)
+	} else {
+		passwordUpdater, err = updater.NewPasswordUpdaterWithSource(adminFile, source, stateFile, log, rabbitAuthClient, rabbitAdminClient)
+	}
 	if err != nil {
 		log.Error(err, "Failed to initialize PasswordUpdater")
-		return
+		writeTerminationMessage(log, terminationMessagePath, "failed to initialize PasswordUpdater", err)
+		return exitCode(err)
+	}
+	passwordUpdater.RetryPolicy.MaxAttempts = maxAttempts
+	passwordUpdater.FailureMode = updater.FailureMode(failureMode)
+	passwordUpdater.MaxConsecutiveFailures = maxConsecutiveFailures
+	passwordUpdater.LockFile = lockFile
+	passwordUpdater.IncludeUsers = include
+	passwordUpdater.ExcludeUsers = exclude
+	passwordUpdater.ValidationRules = validationRules
+	passwordUpdater.CreateVhosts = createVhosts
+	passwordUpdater.DefaultPermissions = defaults
+	passwordUpdater.PermissionPresets = presets
+	passwordUpdater.MinHashingAlgorithm = minHashing
+	passwordUpdater.DeleteRemovedUsers = deleteRemovedUsers
+	passwordUpdater.DeleteGracePeriod = deleteGracePeriod
+	passwordUpdater.ProtectedUsers = protected
+	passwordUpdater.ServiceUserID = serviceUserID
+	passwordUpdater.BootstrapUserID = bootstrapUserID
+	passwordUpdater.Sinks = sinks
+	passwordUpdater.AdminFileFormat = updater.FileFormat(adminFileFormat)
+	passwordUpdater.AdminFileSection = adminFileSection
+	passwordUpdater.AdminFileUsernameKey = adminFileUsernameKey
+	passwordUpdater.AdminFilePasswordKey = adminFilePasswordKey
+	passwordUpdater.AdminFileSettings = adminSettings
+	passwordUpdater.CloseConnections = closeConnections
+	passwordUpdater.CloseConnectionsDelay = closeConnectionsDelay
+	passwordUpdater.ResyncInterval = resyncInterval
+	passwordUpdater.BatchUpdates = batchUpdates
+	passwordUpdater.BackupDir = backupDir
+	passwordUpdater.UpdateFederationUpstreams = updateFederationUpstreams
+	passwordUpdater.UpdateShovels = updateShovels
+	passwordUpdater.ParameterURIs = uriKeys
+	passwordUpdater.RequireInternalAuthBackend = requireInternalAuthBackend
+	passwordUpdater.MinRabbitMQVersion = minVersion
+	passwordUpdater.VerifyAliveness = verifyAliveness
+	probes := make(map[string]updater.Probe)
+	if amqpURI != "" {
+		probe, err := newAMQPProbe(amqpURI, caFile, apiTimeout)
+		if err != nil {
+			log.Error(err, "invalid AMQP probe", "verify-amqp-uri", amqpURI)
+			return exitBadFlags
+		}
+		probes["amqp091"] = probe
+	}
+	if amqp10URI != "" {
+		probe, err := newAMQP10Probe(amqp10URI, caFile, apiTimeout)
+		if err != nil {
+			log.Error(err, "invalid AMQP 1.0 probe", "verify-amqp10-uri", amqp10URI)
+			return exitBadFlags
+		}
+		probes["amqp10"] = probe
+	}
+	if mqttURI != "" {
+		probe, err := newMQTTProbe(mqttURI, caFile, apiTimeout)
+		if err != nil {
+			log.Error(err, "invalid MQTT probe", "verify-mqtt-uri", mqttURI)
+			return exitBadFlags
+		}
+		probes["mqtt"] = probe
+	}
+	if stompURI != "" {
+		probe, err := newSTOMPProbe(stompURI, caFile, apiTimeout)
+		if err != nil {
+			log.Error(err, "invalid STOMP probe", "verify-stomp-uri", stompURI)
+			return exitBadFlags
+		}
+		probes["stomp"] = probe
+	}
+	passwordUpdater.Probes = probes
+	probeUserPatterns, err := parseNameValues(probeUsers)
+	if err != nil {
+		log.Error(err, "invalid probe users", "probe-users", probeUsers)
+		return exitBadFlags
+	}
+	for probe, patterns := range probeUserPatterns {
+		if _, ok := probes[probe]; !ok {
+			log.Error(nil, "probe users of a probe that is not configured", "probe-users", probeUsers, "probe", probe)
+			return exitBadFlags
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Error(err, "invalid user pattern", "probe-users", probeUsers)
+				return exitBadFlags
+			}
+		}
+	}
+	passwordUpdater.ProbeUsers = probeUserPatterns
+	if verifyPropagation || nodes != "" {
+		passwordUpdater.NodeClient = func(node string) (updater.RabbitClient, error) {
+			if backend == "ctl" {
+				return updater.NewRateLimitedClient(newCtlClient(rabbitmqctl, node, apiTimeout), rateLimiter), nil
+			}
+			uri, err := nodeManagementURI(managementURI, node)
+			if err != nil {
+				return nil, err
+			}
+			client, err := newRabbitClient(log, uri, caFile, apiTimeout, nil)
+			if err != nil {
+				return nil, err
+			}
+			return updater.NewRateLimitedClient(client, rateLimiter), nil
+		}
+		if nodes != "" {
+			passwordUpdater.Nodes = strings.Split(nodes, ",")
+		}
+		passwordUpdater.PropagationTimeout = propagationTimeout
+	}
+	if once {
+		if err := passwordUpdater.RunOnce(context.Background()); err != nil {
+			log.Error(err, "failed to apply credentials")
+			writeTerminationMessage(log, terminationMessagePath, "failed to apply credentials", err)
+			return exitCode(err)
+		}
+		log.V(0).Info("applied credentials")
+		return exitOK
+	}
+	if notifier := updater.NewSystemdNotifier(); notifier != nil {
+		passwordUpdater.Notifier = notifier
+		passwordUpdater.WatchdogInterval = updater.SystemdWatchdogInterval()
+	}
+
+	if metricsAddress != "" {
+		go serveMetrics(log, metricsAddress)
 	}
 
-	go passwordUpdater.HandleEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// This channel will contain a value when our program terminates itself.
+	done := make(chan error, 1)
+	go func() {
+		done <- passwordUpdater.HandleEvents(ctx)
+	}()
 
-	select {
-	case sig := <-sigs:
-		log.V(1).Info("terminating", "signal", sig.String())
-	case <-done:
-		log.V(1).Info("terminating")
+	for {
+		select {
+		case sig := <-requests:
+			switch sig {
+			case syscall.SIGHUP:
+				log.V(1).Info("triggering full sync", "signal", sig.String())
+				passwordUpdater.TriggerSync()
+			case syscall.SIGUSR1:
+				log.V(1).Info("dumping state", "signal", sig.String())
+				passwordUpdater.DumpState()
+			}
+		case sig := <-sigs:
+			log.V(1).Info("terminating", "signal", sig.String())
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(shutdownTimeout):
+				log.V(0).Info("in-flight sync did not finish in time", "timeout", shutdownTimeout.String())
+			}
+			return exitOK
+		case err := <-done:
+			if err != nil {
+				log.Error(err, "terminating", "exitCode", exitCode(err))
+				writeTerminationMessage(log, terminationMessagePath, "terminating", err)
+				return exitCode(err)
+			}
+			log.V(1).Info("terminating")
+			return exitOK
+		}
 	}
 }
 
@@ -98,7 +872,62 @@ func initLogging() logr.Logger {
 	return zapr.NewLogger(zapLogger)
 }
 
-func newRabbitClient(log logr.Logger, managementURI, caFile string) (updater.RabbitClient, error) {
+// exitCode returns the exit code for the class of err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, updater.ErrWatchDir):
+		return exitWatchDirUnreadable
+	case errors.Is(err, updater.ErrBrokerUnreachable):
+		return exitBrokerUnreachable
+	case errors.Is(err, updater.ErrInvalidAdminCredentials):
+		return exitInvalidAdminSecret
+	case errors.Is(err, updater.ErrWatcher), errors.Is(err, updater.ErrSource):
+		return exitWatcherFailure
+	case errors.Is(err, updater.ErrAuthBackend):
+		return exitAuthBackend
+	case errors.Is(err, updater.ErrUnsupportedBroker):
+		return exitUnsupportedBroker
+	default:
+		return exitFailure
+	}
+}
+
+// writeTerminationMessage writes the reason for terminating to path (by default the
+// Kubernetes termination message path). Kubernetes truncates messages longer than 4096 bytes,
+// so longer messages are truncated here on a rune boundary, which keeps them valid UTF-8.
+func writeTerminationMessage(log logr.Logger, path, msg string, err error) {
+	if path == "" {
+		return
+	}
+	message := msg + ": " + err.Error()
+	if len(message) > maxTerminationMessageLength {
+		n := maxTerminationMessageLength
+		for n > 0 && !utf8.RuneStart(message[n]) {
+			n--
+		}
+		message = message[:n]
+	}
+	if err := os.WriteFile(path, []byte(message), 0644); err != nil {
+		log.V(1).Info("failed to write termination message", "path", path, "error", err.Error())
+	}
+}
+
+func serveMetrics(log logr.Logger, address string) {
+	registry := prometheus.NewRegistry()
+	updater.RegisterMetrics(registry)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	log.V(1).Info("serving metrics", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Error(err, "failed to serve metrics", "address", address)
+	}
+}
+
+// newRabbitClient returns a client of the Management API at managementURI, which authenticates with
+// the bearer tokens of tokens, if set, or with basic auth.
+func newRabbitClient(log logr.Logger, managementURI, caFile string, timeout time.Duration, tokens tokenSource) (updater.RabbitClient, error) {
+	var rmqc *rabbithole.Client
+	var transport http.RoundTripper = http.DefaultTransport
 	if strings.HasPrefix(managementURI, "https") {
 		caCert, err := os.ReadFile(caFile)
 		if err != nil {
@@ -110,37 +939,379 @@ func newRabbitClient(log logr.Logger, managementURI, caFile string) (updater.Rab
 		tlsConfig := &tls.Config{
 			RootCAs: caCertPool,
 		}
-		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		rmqc, err := rabbithole.NewTLSClient(managementURI, "", "", transport)
+		tlsTransport := &http.Transport{TLSClientConfig: tlsConfig}
+		rmqc, err = rabbithole.NewTLSClient(managementURI, "", "", tlsTransport)
 		if err != nil {
 			log.Error(err, "failed to create rabbithole TLS client", "uri", managementURI, "ca-file", caFile)
 			return nil, err
 		}
-		return rabbitHoleClientWrapper{rmqc}, nil
+		transport = tlsTransport
+	} else {
+		var err error
+		rmqc, err = rabbithole.NewClient(managementURI, "", "")
+		if err != nil {
+			log.Error(err, "failed to create rabbithole client", "uri", managementURI)
+			return nil, err
+		}
+	}
+	rmqc.SetTimeout(timeout)
+	if tokens != nil {
+		transport = bearerTransport{tokens, transport}
+	}
+	return rabbitHoleClientWrapper{rmqc, transport, timeout}, nil
+}
+
+// nodeManagementURI returns the Management API URI of a cluster node. node is either a URI,
+// or a node name (e.g. rabbit@host) whose host replaces the host of managementURI.
+func nodeManagementURI(managementURI, node string) (string, error) {
+	if strings.Contains(node, "://") {
+		return node, nil
+	}
+	_, host, found := strings.Cut(node, "@")
+	if !found || host == "" {
+		return "", fmt.Errorf("invalid node name %q", node)
+	}
+	uri, err := url.Parse(managementURI)
+	if err != nil {
+		return "", fmt.Errorf("invalid management URI %q: %w", managementURI, err)
+	}
+	if port := uri.Port(); port != "" {
+		uri.Host = net.JoinHostPort(host, port)
+	} else {
+		uri.Host = host
+	}
+	return uri.String(), nil
+}
+
+// parseUserPatterns parses a comma separated list of glob patterns on user IDs.
+func parseUserPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseDefaultPermissions parses the -default-permissions flag ("configure;write;read") into
+// the permissions granted in vhost. An empty value grants no permissions.
+func parseDefaultPermissions(s, vhost string) (map[string]rabbithole.Permissions, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	if vhost == "" {
+		return nil, errors.New("vhost must not be empty")
+	}
+	parts := strings.Split(s, ";")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expected configure;write;read, got %d fields", len(parts))
+	}
+	for _, part := range parts {
+		if _, err := regexp.Compile(part); err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", part, err)
+		}
 	}
-	rmqc, err := rabbithole.NewClient(managementURI, "", "")
+	return map[string]rabbithole.Permissions{vhost: {Configure: parts[0], Write: parts[1], Read: parts[2]}}, nil
+}
+
+// parseNameValues parses flags like -update-parameter-uris ("<component>=<key>,...") and -probe-users
+// ("<probe>=<pattern>,...") into the values per name.
+func parseNameValues(s string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, found := strings.Cut(entry, "=")
+		if !found || name == "" || value == "" {
+			return nil, fmt.Errorf("expected <name>=<value>, got %q", entry)
+		}
+		values[name] = append(values[name], value)
+	}
+	return values, nil
+}
+
+// adminFileSettings returns the hostname, port, TLS setting and path prefix of the Management API at
+// managementURI, with the keys of rabbitmqadmin v1 (format ini) or v2 (format toml).
+func adminFileSettings(managementURI string, format updater.FileFormat) (map[string]any, error) {
+	uri, err := url.Parse(managementURI)
 	if err != nil {
-		log.Error(err, "failed to create rabbithole client", "uri", managementURI)
 		return nil, err
 	}
-	return rabbitHoleClientWrapper{rmqc}, nil
+	if uri.Hostname() == "" {
+		return nil, errors.New("management URI has no host")
+	}
+	secure := uri.Scheme == "https"
+	port := 80
+	if secure {
+		port = 443
+	}
+	if uri.Port() != "" {
+		if port, err = strconv.Atoi(uri.Port()); err != nil {
+			return nil, fmt.Errorf("invalid port: %w", err)
+		}
+	}
+	settings := map[string]any{"hostname": uri.Hostname(), "port": port}
+	if format == updater.FileFormatTOML {
+		settings["tls"] = secure
+	} else {
+		settings["ssl"] = secure
+	}
+	if prefix := strings.TrimSuffix(uri.Path, "/"); prefix != "" {
+		settings["path_prefix"] = prefix
+	}
+	return settings, nil
+}
+
+// parseConfigFiles parses a comma separated list of
+// <user ID>=[<format>:]<path>[:<username key>:<password key>[:<section>]] into sinks by user ID.
+func parseConfigFiles(s string) (map[string][]updater.CredentialSink, error) {
+	paths, err := parseNameValues(s)
+	if err != nil {
+		return nil, err
+	}
+	sinks := make(map[string][]updater.CredentialSink)
+	for userID, values := range paths {
+		for _, value := range values {
+			var file updater.ConfigFile
+			parts := strings.Split(value, ":")
+			switch format := updater.FileFormat(parts[0]); format {
+			case updater.FileFormatConf, updater.FileFormatINI, updater.FileFormatTOML, updater.FileFormatEnv:
+				if len(parts) > 1 {
+					file.Format, parts = format, parts[1:]
+				}
+			}
+			file.Path = parts[0]
+			sections := file.Format == updater.FileFormatINI || file.Format == updater.FileFormatTOML
+			switch {
+			case len(parts) == 1:
+			case len(parts) == 3, len(parts) == 4 && sections:
+				file.UsernameKey, file.PasswordKey = parts[1], parts[2]
+				if len(parts) == 4 {
+					file.Section = parts[3]
+				}
+			default:
+				return nil, fmt.Errorf("expected [<format>:]<path>[:<username key>:<password key>[:<section>]], got %q", value)
+			}
+			if slices.Contains(parts, "") {
+				return nil, fmt.Errorf("empty path, key or section in %q", value)
+			}
+			sinks[userID] = append(sinks[userID], file)
+		}
+	}
+	return sinks, nil
+}
+
+// parseTemplateFiles parses a comma separated list of <user ID>=<template>:<path> into sinks by user ID,
+// which render the credentials into templateURI, if set.
+func parseTemplateFiles(s, templateURI string) (map[string][]updater.CredentialSink, error) {
+	paths, err := parseNameValues(s)
+	if err != nil {
+		return nil, err
+	}
+	var uri *url.URL
+	if templateURI != "" {
+		if uri, err = url.Parse(templateURI); err != nil {
+			return nil, fmt.Errorf("invalid template URI: %w", err)
+		}
+	}
+	sinks := make(map[string][]updater.CredentialSink)
+	for userID, values := range paths {
+		for _, value := range values {
+			templatePath, path, found := strings.Cut(value, ":")
+			if !found || templatePath == "" || path == "" {
+				return nil, fmt.Errorf("expected <template>:<path>, got %q", value)
+			}
+			file, err := updater.LoadTemplateFile(templatePath, path, uri)
+			if err != nil {
+				return nil, err
+			}
+			sinks[userID] = append(sinks[userID], file)
+		}
+	}
+	return sinks, nil
 }
 
 type rabbitHoleClientWrapper struct {
 	rabbitHoleClient *rabbithole.Client
+	transport        http.RoundTripper
+	timeout          time.Duration
 }
 
-func (w rabbitHoleClientWrapper) GetUser(username string) (*rabbithole.UserInfo, error) {
-	return w.rabbitHoleClient.GetUser(username)
+// withContext returns a copy of the rabbithole client whose requests are bound to ctx,
+// since rabbithole does not support contexts itself.
+func (w rabbitHoleClientWrapper) withContext(ctx context.Context) *rabbithole.Client {
+	rmqc := *w.rabbitHoleClient
+	rmqc.SetTransport(contextTransport{ctx: ctx, transport: w.transport})
+	return &rmqc
+}
+
+func (w rabbitHoleClientWrapper) GetUser(ctx context.Context, username string) (*rabbithole.UserInfo, error) {
+	return w.withContext(ctx).GetUser(username)
+}
+func (w rabbitHoleClientWrapper) PutUser(ctx context.Context, username string, info rabbithole.UserSettings) (*http.Response, error) {
+	return w.withContext(ctx).PutUser(username, info)
+}
+func (w rabbitHoleClientWrapper) PutUserWithoutPassword(ctx context.Context, username string, info rabbithole.UserSettings) (*http.Response, error) {
+	return w.withContext(ctx).PutUserWithoutPassword(username, info)
+}
+func (w rabbitHoleClientWrapper) Whoami(ctx context.Context) (*rabbithole.WhoamiInfo, error) {
+	return w.withContext(ctx).Whoami()
+}
+func (w rabbitHoleClientWrapper) UpdatePermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.Permissions) (*http.Response, error) {
+	return w.withContext(ctx).UpdatePermissionsIn(vhost, username, permissions)
+}
+func (w rabbitHoleClientWrapper) UpdateTopicPermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.TopicPermissions) (*http.Response, error) {
+	return w.withContext(ctx).UpdateTopicPermissionsIn(vhost, username, permissions)
+}
+func (w rabbitHoleClientWrapper) GetVhost(ctx context.Context, vhost string) (*rabbithole.VhostInfo, error) {
+	return w.withContext(ctx).GetVhost(vhost)
+}
+func (w rabbitHoleClientWrapper) PutVhost(ctx context.Context, vhost string, settings rabbithole.VhostSettings) (*http.Response, error) {
+	return w.withContext(ctx).PutVhost(vhost, settings)
+}
+func (w rabbitHoleClientWrapper) PutUserLimits(ctx context.Context, username string, limits rabbithole.UserLimitsValues) (*http.Response, error) {
+	return w.withContext(ctx).PutUserLimits(username, limits)
+}
+func (w rabbitHoleClientWrapper) PutVhostLimits(ctx context.Context, vhost string, limits rabbithole.VhostLimitsValues) (*http.Response, error) {
+	return w.withContext(ctx).PutVhostLimits(vhost, limits)
+}
+func (w rabbitHoleClientWrapper) DeleteUser(ctx context.Context, username string) (*http.Response, error) {
+	return w.withContext(ctx).DeleteUser(username)
 }
-func (w rabbitHoleClientWrapper) PutUser(username string, info rabbithole.UserSettings) (*http.Response, error) {
-	return w.rabbitHoleClient.PutUser(username, info)
+func (w rabbitHoleClientWrapper) GetPermissionsIn(ctx context.Context, vhost string, username string) (rabbithole.PermissionInfo, error) {
+	return w.withContext(ctx).GetPermissionsIn(vhost, username)
 }
-func (w rabbitHoleClientWrapper) Whoami() (*rabbithole.WhoamiInfo, error) {
-	return w.rabbitHoleClient.Whoami()
+func (w rabbitHoleClientWrapper) ListPermissionsOf(ctx context.Context, username string) ([]rabbithole.PermissionInfo, error) {
+	return w.withContext(ctx).ListPermissionsOf(username)
 }
-func (w rabbitHoleClientWrapper) UpdatePermissionsIn(vhost string, username string, permissions rabbithole.Permissions) (*http.Response, error) {
-	return w.rabbitHoleClient.UpdatePermissionsIn(vhost, username, permissions)
+func (w rabbitHoleClientWrapper) ClearPermissionsIn(ctx context.Context, vhost string, username string) (*http.Response, error) {
+	return w.withContext(ctx).ClearPermissionsIn(vhost, username)
+}
+func (w rabbitHoleClientWrapper) ListTopicPermissionsOf(ctx context.Context, username string) ([]rabbithole.TopicPermissionInfo, error) {
+	return w.withContext(ctx).ListTopicPermissionsOf(username)
+}
+func (w rabbitHoleClientWrapper) ClearTopicPermissionsIn(ctx context.Context, vhost string, username string) (*http.Response, error) {
+	return w.withContext(ctx).ClearTopicPermissionsIn(vhost, username)
+}
+func (w rabbitHoleClientWrapper) ListConnectionsOfUser(ctx context.Context, username string) ([]rabbithole.UserConnectionInfo, error) {
+	return w.withContext(ctx).ListConnectionsOfUser(username)
+}
+func (w rabbitHoleClientWrapper) CloseConnection(ctx context.Context, name string, reason string) (*http.Response, error) {
+	rmqc := *w.rabbitHoleClient
+	// The Management API shows the X-Reason header to the client.
+	rmqc.SetTransport(contextTransport{ctx: ctx, transport: w.transport, header: http.Header{"X-Reason": {reason}}})
+	return rmqc.CloseConnection(name)
+}
+func (w rabbitHoleClientWrapper) ExportDefinitions(ctx context.Context) (updater.Definitions, error) {
+	var definitions updater.Definitions
+	resp, err := w.request(ctx, http.MethodGet, "/api/definitions", nil)
+	if err != nil {
+		return definitions, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&definitions)
+	return definitions, err
+}
+func (w rabbitHoleClientWrapper) UploadDefinitions(ctx context.Context, definitions updater.Definitions) (*http.Response, error) {
+	body, err := json.Marshal(definitions)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.request(ctx, http.MethodPost, "/api/definitions", body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// request sends a request to path and returns errors like rabbithole does, for endpoints that rabbithole
+// does not support (aliveness tests) or not as needed (rabbithole.ExportedDefinitions cannot express
+// permissions, which need the user and vhost).
+func (w rabbitHoleClientWrapper) request(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.rabbitHoleClient.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(w.rabbitHoleClient.Username, w.rabbitHoleClient.Password)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Transport: w.transport, Timeout: w.timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		// Same error as rabbithole, see handleHTTPError.
+		return nil, errors.New("Error: API responded with a 401 Unauthorized")
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		errResp := rabbithole.ErrorResponse{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			errResp.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, errResp
+	}
+	return resp, nil
+}
+func (w rabbitHoleClientWrapper) ListRuntimeParametersFor(ctx context.Context, component string) ([]rabbithole.RuntimeParameter, error) {
+	return w.withContext(ctx).ListRuntimeParametersFor(component)
+}
+func (w rabbitHoleClientWrapper) PutRuntimeParameter(ctx context.Context, component string, vhost string, name string, value any) (*http.Response, error) {
+	return w.withContext(ctx).PutRuntimeParameter(component, vhost, name, value)
+}
+func (w rabbitHoleClientWrapper) GetPolicy(ctx context.Context, vhost string, name string) (*rabbithole.Policy, error) {
+	return w.withContext(ctx).GetPolicy(vhost, name)
+}
+func (w rabbitHoleClientWrapper) PutPolicy(ctx context.Context, vhost string, name string, policy rabbithole.Policy) (*http.Response, error) {
+	return w.withContext(ctx).PutPolicy(vhost, name, policy)
+}
+func (w rabbitHoleClientWrapper) DeletePolicy(ctx context.Context, vhost string, name string) (*http.Response, error) {
+	return w.withContext(ctx).DeletePolicy(vhost, name)
+}
+func (w rabbitHoleClientWrapper) GetOperatorPolicy(ctx context.Context, vhost string, name string) (*rabbithole.OperatorPolicy, error) {
+	return w.withContext(ctx).GetOperatorPolicy(vhost, name)
+}
+func (w rabbitHoleClientWrapper) PutOperatorPolicy(ctx context.Context, vhost string, name string, policy rabbithole.OperatorPolicy) (*http.Response, error) {
+	return w.withContext(ctx).PutOperatorPolicy(vhost, name, policy)
+}
+func (w rabbitHoleClientWrapper) DeleteOperatorPolicy(ctx context.Context, vhost string, name string) (*http.Response, error) {
+	return w.withContext(ctx).DeleteOperatorPolicy(vhost, name)
+}
+func (w rabbitHoleClientWrapper) HealthCheckAlarms(ctx context.Context) (rabbithole.ResourceAlarmCheckStatus, error) {
+	return w.withContext(ctx).HealthCheckAlarms()
+}
+func (w rabbitHoleClientWrapper) ListNodes(ctx context.Context) ([]rabbithole.NodeInfo, error) {
+	return w.withContext(ctx).ListNodes()
+}
+func (w rabbitHoleClientWrapper) AlivenessTest(ctx context.Context, vhost string) error {
+	resp, err := w.request(ctx, http.MethodGet, "/api/aliveness-test/"+url.PathEscape(vhost), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Status != "ok" {
+		return fmt.Errorf("aliveness test failed: %s %s", result.Status, result.Reason)
+	}
+	return nil
+}
+func (w rabbitHoleClientWrapper) Overview(ctx context.Context) (*rabbithole.Overview, error) {
+	return w.withContext(ctx).Overview()
 }
 func (w rabbitHoleClientWrapper) GetUsername() string {
 	return w.rabbitHoleClient.Username
@@ -151,3 +1322,23 @@ func (w rabbitHoleClientWrapper) SetUsername(username string) {
 func (w rabbitHoleClientWrapper) SetPassword(passwd string) {
 	w.rabbitHoleClient.Password = passwd
 }
+
+// contextTransport attaches a context to every request it sends.
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+	// header is added to every request, if set.
+	header http.Header
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.header) == 0 {
+		return t.transport.RoundTrip(req.WithContext(t.ctx))
+	}
+	// A RoundTripper must not modify the request.
+	req = req.Clone(t.ctx)
+	for key, values := range t.header {
+		req.Header[key] = values
+	}
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDefaultUserCredentialUpdater(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Main Suite")
+}
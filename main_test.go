@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("newRabbitClient", func() {
+	const timeout = 50 * time.Millisecond
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		// The Management API does not respond in time.
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	It("applies the timeout to rabbithole requests", func() {
+		client, err := newRabbitClient(logr.Discard(), server.URL, "", timeout, nil)
+		Expect(err).NotTo(HaveOccurred())
+		start := time.Now()
+		_, err = client.Whoami(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("Client.Timeout exceeded")))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("applies the timeout to requests that rabbithole does not support", func() {
+		client, err := newRabbitClient(logr.Discard(), server.URL, "", timeout, nil)
+		Expect(err).NotTo(HaveOccurred())
+		start := time.Now()
+		err = client.AlivenessTest(context.Background(), "/")
+		Expect(err).To(MatchError(ContainSubstring("Client.Timeout exceeded")))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+})
+
+var _ = Describe("writeTerminationMessage", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "termination-log")
+	})
+
+	It("writes the reason for terminating", func() {
+		writeTerminationMessage(logr.Discard(), path, "terminating", errors.New("connection refused"))
+		Expect(os.ReadFile(path)).To(BeEquivalentTo("terminating: connection refused"))
+	})
+
+	It("truncates long messages on a rune boundary", func() {
+		// "ä" is encoded in two bytes, so that the limit falls in the middle of a rune.
+		writeTerminationMessage(logr.Discard(), path, "terminating", errors.New(strings.Repeat("ä", maxTerminationMessageLength)))
+		content, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(content)).To(BeNumerically("<=", maxTerminationMessageLength))
+		Expect(len(content)).To(BeNumerically(">", maxTerminationMessageLength-utf8.UTFMax))
+		Expect(utf8.Valid(content)).To(BeTrue())
+		Expect(string(content)).To(HavePrefix("terminating: ää"))
+	})
+
+	It("does not write anything if the path is empty", func() {
+		writeTerminationMessage(logr.Discard(), "", "terminating", errors.New("connection refused"))
+		Expect(path).NotTo(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+// mqttConnackCodes are the MQTT 3.1.1 return codes of a refused connection.
+var mqttConnackCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// newMQTTProbe returns a probe that connects to mqttURI (mqtt:// or mqtts://) with MQTT 3.1.1
+// and disconnects once the server acknowledged the connection.
+func newMQTTProbe(mqttURI, caFile string, timeout time.Duration) (updater.Probe, error) {
+	uri, tlsConfig, err := parseProbeURI(mqttURI, caFile, "mqtt", "mqtts")
+	if err != nil {
+		return nil, err
+	}
+	port := uri.Port()
+	if port == "" {
+		port = "1883"
+		if tlsConfig != nil {
+			port = "8883"
+		}
+	}
+	addr := net.JoinHostPort(uri.Hostname(), port)
+	return func(ctx context.Context, username, password string) error {
+		conn, err := dialProbe(ctx, addr, tlsConfig, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return mqttConnect(conn, username, password)
+	}, nil
+}
+
+// mqttConnect sends a CONNECT packet with the credentials (and a clean session) on conn and
+// returns an error unless the server accepted the connection, which is disconnected then.
+func mqttConnect(conn io.ReadWriter, username, password string) error {
+	var body []byte
+	appendString := func(s string) {
+		body = binary.BigEndian.AppendUint16(body, uint16(len(s)))
+		body = append(body, s...)
+	}
+	appendString("MQTT")
+	// Protocol level 4 (3.1.1), flags for user name, password and clean session, keep alive of 60s.
+	body = append(body, 4, 0xc2, 0, 60)
+	appendString("rabbitmq-user-credential-updater-" + username)
+	appendString(username)
+	appendString(password)
+
+	packet := []byte{0x10}
+	// The remaining length is encoded with 7 bits per byte.
+	for n := len(body); ; {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	if _, err := conn.Write(append(packet, body...)); err != nil {
+		return err
+	}
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if connack[0] != 0x20 || connack[1] != 2 {
+		return fmt.Errorf("unexpected packet %x, expected CONNACK", connack)
+	}
+	if code := connack[3]; code != 0 {
+		return fmt.Errorf("connection refused with code %d (%s)", code, mqttConnackCodes[code])
+	}
+	_, err := conn.Write([]byte{0xe0, 0})
+	return err
+}
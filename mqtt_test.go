@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("mqttConnect", func() {
+	var client, server net.Conn
+
+	// serve runs the server side of the handshake, responding with the CONNACK return code,
+	// and sends the user name and password of the CONNECT packet to credentials.
+	serve := func(code byte) <-chan [2]string {
+		credentials := make(chan [2]string, 1)
+		go func() {
+			defer GinkgoRecover()
+			defer server.Close()
+			header := make([]byte, 2)
+			_, err := io.ReadFull(server, header)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(header[0]).To(Equal(byte(0x10)))
+			body := make([]byte, header[1])
+			_, err = io.ReadFull(server, body)
+			Expect(err).NotTo(HaveOccurred())
+			// Protocol name, level 4, flags for user name, password and clean session.
+			Expect(body[:8]).To(Equal([]byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0xc2}))
+			var fields []string
+			for rest := body[10:]; len(rest) > 0; {
+				n := binary.BigEndian.Uint16(rest)
+				fields = append(fields, string(rest[2:2+n]))
+				rest = rest[2+n:]
+			}
+			Expect(fields).To(HaveLen(3))
+			credentials <- [2]string{fields[1], fields[2]}
+			_, err = server.Write([]byte{0x20, 2, 0, code})
+			Expect(err).NotTo(HaveOccurred())
+			if code == 0 {
+				disconnect := make([]byte, 2)
+				_, err = io.ReadFull(server, disconnect)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(disconnect).To(Equal([]byte{0xe0, 0}))
+			}
+		}()
+		return credentials
+	}
+
+	BeforeEach(func() {
+		client, server = net.Pipe()
+		DeferCleanup(client.Close)
+	})
+
+	It("succeeds and disconnects if the server accepts the connection", func() {
+		credentials := serve(0)
+		Expect(mqttConnect(client, "app", "s3cret")).To(Succeed())
+		Expect(credentials).To(Receive(Equal([2]string{"app", "s3cret"})))
+	})
+
+	It("fails if the server refuses the connection", func() {
+		serve(4)
+		Expect(mqttConnect(client, "app", "wrong")).To(MatchError("connection refused with code 4 (bad user name or password)"))
+	})
+
+	It("fails if the server does not respond with CONNACK", func() {
+		go func() {
+			defer GinkgoRecover()
+			defer server.Close()
+			header := make([]byte, 2)
+			_, err := io.ReadFull(server, header)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = io.ReadFull(server, make([]byte, header[1]))
+			Expect(err).NotTo(HaveOccurred())
+		}()
+		Expect(mqttConnect(client, "app", "s3cret")).To(MatchError(ContainSubstring("failed to read CONNACK")))
+	})
+})
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before its expiry an OAuth2 access token is replaced.
+const tokenRefreshMargin = 30 * time.Second
+
+// tokenSource returns the bearer token to authenticate to the Management API with.
+type tokenSource interface {
+	token(ctx context.Context) (string, error)
+}
+
+// tokenFile is a JWT in a file, e.g. a projected Kubernetes service account token. It is read
+// for every request, since it may be rotated at any time.
+type tokenFile string
+
+func (f tokenFile) token(context.Context) (string, error) {
+	content, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", f)
+	}
+	return token, nil
+}
+
+// clientCredentials requests access tokens from an OAuth2 authorization server with the
+// client credentials grant (RFC 6749, section 4.4) and caches them until shortly before they expire.
+type clientCredentials struct {
+	tokenURL         string
+	clientID         string
+	clientSecretFile string
+	scope            string
+	client           *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+func (c *clientCredentials) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accessToken != "" && time.Now().Before(c.expiry) {
+		return c.accessToken, nil
+	}
+	// Read for every token request, so that the secret can be rotated.
+	secret, err := os.ReadFile(c.clientSecretFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read client secret file: %w", err)
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if c.scope != "" {
+		form.Set("scope", c.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, with the credentials form-encoded as required by RFC 6749, section 2.3.1.
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(strings.TrimSpace(string(secret))))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request access token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read access token response: %w", err)
+	}
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("failed to parse access token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("access token request returned %s: %s %s", resp.Status, result.Error, result.ErrorDescription)
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("access token response contains no access_token")
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer") {
+		return "", fmt.Errorf("unsupported token type %q", result.TokenType)
+	}
+	// Tokens without expires_in are requested again next time.
+	c.accessToken, c.expiry = "", time.Time{}
+	if result.ExpiresIn > 0 {
+		c.accessToken = result.AccessToken
+		c.expiry = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - tokenRefreshMargin)
+	}
+	return result.AccessToken, nil
+}
+
+// bearerTransport authenticates every request with a bearer token instead of basic auth,
+// for clusters that disabled basic auth on the Management API (management.disable_basic_auth).
+type bearerTransport struct {
+	tokens    tokenSource
+	transport http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	// A RoundTripper must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("clientCredentials", func() {
+	var (
+		server   *httptest.Server
+		tokens   *clientCredentials
+		requests atomic.Int32
+		// response is the status and body of the token endpoint.
+		status int
+		body   string
+	)
+
+	BeforeEach(func() {
+		requests.Store(0)
+		status, body = http.StatusOK, `{"access_token":"token1","token_type":"Bearer","expires_in":3600}`
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			requests.Add(1)
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/x-www-form-urlencoded"))
+			Expect(r.ParseForm()).To(Succeed())
+			Expect(r.PostForm.Get("grant_type")).To(Equal("client_credentials"))
+			Expect(r.PostForm.Get("scope")).To(Equal("rabbitmq.tag:administrator"))
+			// client_secret_basic with form-encoded credentials.
+			username, password, ok := r.BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(username).To(Equal("updater+client"))
+			Expect(password).To(Equal("s3cret%2F%2B%26"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		}))
+		DeferCleanup(server.Close)
+
+		secretFile := filepath.Join(GinkgoT().TempDir(), "secret")
+		Expect(os.WriteFile(secretFile, []byte("s3cret/+&\n"), 0600)).To(Succeed())
+		tokens = &clientCredentials{
+			tokenURL:         server.URL,
+			clientID:         "updater client",
+			clientSecretFile: secretFile,
+			scope:            "rabbitmq.tag:administrator",
+			client:           server.Client(),
+		}
+	})
+
+	It("caches the access token until it expires", func() {
+		Expect(tokens.token(context.Background())).To(Equal("token1"))
+		body = `{"access_token":"token2","token_type":"Bearer","expires_in":3600}`
+		Expect(tokens.token(context.Background())).To(Equal("token1"))
+		Expect(requests.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("requests a new access token within tokenRefreshMargin of the expiry", func() {
+		body = fmt.Sprintf(`{"access_token":"token1","token_type":"Bearer","expires_in":%d}`, int(tokenRefreshMargin.Seconds()))
+		Expect(tokens.token(context.Background())).To(Equal("token1"))
+		body = `{"access_token":"token2","token_type":"Bearer","expires_in":3600}`
+		Expect(tokens.token(context.Background())).To(Equal("token2"))
+		Expect(requests.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("does not cache access tokens without expires_in", func() {
+		body = `{"access_token":"token1","token_type":"bearer"}`
+		Expect(tokens.token(context.Background())).To(Equal("token1"))
+		Expect(tokens.token(context.Background())).To(Equal("token1"))
+		Expect(requests.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("reports the error of the authorization server", func() {
+		status, body = http.StatusUnauthorized, `{"error":"invalid_client","error_description":"client authentication failed"}`
+		_, err := tokens.token(context.Background())
+		Expect(err).To(MatchError("access token request returned 401 Unauthorized: invalid_client client authentication failed"))
+	})
+
+	It("rejects responses without a bearer token", func() {
+		body = `{"token_type":"Bearer","expires_in":3600}`
+		_, err := tokens.token(context.Background())
+		Expect(err).To(MatchError("access token response contains no access_token"))
+		body = `{"access_token":"token1","token_type":"mac","expires_in":3600}`
+		_, err = tokens.token(context.Background())
+		Expect(err).To(MatchError(`unsupported token type "mac"`))
+	})
+
+	It("authenticates requests with the access token", func() {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Header.Get("Authorization"))
+		}))
+		DeferCleanup(api.Close)
+		client := &http.Client{Transport: bearerTransport{tokens, http.DefaultTransport}}
+		resp, err := client.Get(api.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(io.ReadAll(resp.Body)).To(BeEquivalentTo("Bearer token1"))
+	})
+})
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+const sourceDirectory = "directory"
+
+// sourceFlags configures where the credentials are read from.
+type sourceFlags struct {
+	source string
+
+	pollInterval time.Duration
+
+	sops           bool
+	decryptKeyFile string
+	systemdCreds   bool
+	signatureKey   string
+	secretFiles    string
+	filePattern    string
+
+	kubernetesNamespace     string
+	kubernetesLabelSelector string
+
+	vaultAddress   string
+	vaultTokenFile string
+	vaultPaths     string
+
+	awsRegion       string
+	awsEndpoint     string
+	awsSecretIDs    string
+	awsSecretPrefix string
+
+	azureVaultURL string
+
+	gcpSecrets      string
+	gcpSubscription string
+
+	conjurURL        string
+	conjurAccount    string
+	conjurLogin      string
+	conjurAPIKeyFile string
+	conjurVariables  string
+
+	httpURL             string
+	httpBearerTokenFile string
+	httpCAFile          string
+	httpCertFile        string
+	httpKeyFile         string
+
+	etcdEndpoint     string
+	etcdPrefix       string
+	etcdUsername     string
+	etcdPasswordFile string
+	etcdCAFile       string
+	etcdCertFile     string
+	etcdKeyFile      string
+
+	consulAddress   string
+	consulPrefix    string
+	consulTokenFile string
+}
+
+func (f *sourceFlags) register() {
+	flag.StringVar(
+		&f.source,
+		"source",
+		sourceDirectory,
+		"Where to read the user credentials from: 'directory' (files in -watch-dir), 'kubernetes' (Secrets "+
+			"watched via the Kubernetes API), 'vault' (Vault secrets, renewed and rotated before their lease expires), "+
+			"'aws' (AWS Secrets Manager secrets, polled for rotations), 'azure' (Azure Key Vault secrets, polled), "+
+			"'gcp' (Google Secret Manager secrets, polled or notified via Pub/Sub), 'conjur' (CyberArk Conjur variables, polled) "+
+			"'http' (a JSON document polled from an HTTPS endpoint), 'etcd' (keys with a prefix watched in etcd) "+
+			"or 'consul' (Consul KV keys watched with blocking queries).")
+	flag.DurationVar(
+		&f.pollInterval,
+		"poll-interval",
+		updater.DefaultPollInterval,
+		"Interval in which sources without change notifications are polled.")
+	flag.BoolVar(
+		&f.sops,
+		"sops",
+		false,
+		"Decrypt SOPS-encrypted files in -watch-dir in memory with the sops binary, using the keys configured for sops "+
+			"(e.g. $SOPS_AGE_KEY_FILE or cloud KMS credentials). Unencrypted files are read as is. "+
+			"The sops binary is not part of the container image and must be installed in $PATH.")
+	flag.StringVar(
+		&f.decryptKeyFile,
+		"decrypt-key-file",
+		"",
+		"File with age identities to decrypt the files with the extension .age in -watch-dir, "+
+			"e.g. user_default_password.age, in memory.")
+	flag.BoolVar(
+		&f.systemdCreds,
+		"systemd-creds",
+		false,
+		"Decrypt the files with the extension .cred in -watch-dir, e.g. user_default_password.cred encrypted with "+
+			"systemd-creds encrypt, in memory with systemd-creds of the host, which must be installed in $PATH.")
+	flag.StringVar(
+		&f.signatureKey,
+		"signature-public-key-file",
+		"",
+		"PEM encoded public key (Ed25519, ECDSA or RSA) to verify the files in -watch-dir with. If set, every file "+
+			"(e.g. user_<id>_password or user_<id>_tag) is only applied with a valid detached signature of its "+
+			"(decrypted) content in <file>.sig, e.g. user_<id>_password.sig.")
+	flag.StringVar(
+		&f.secretFiles,
+		"secret-files",
+		"",
+		"Comma separated list of <file>=<userID>/<field> pairs mapping files in -watch-dir that do not follow the "+
+			"user_<id>_<field> naming convention, e.g. Docker secrets in /run/secrets, to users and the fields "+
+			"username, password or tag.")
+	flag.StringVar(
+		&f.filePattern,
+		"file-pattern",
+		"",
+		"Go regular expression with the named groups id and field (username, password or tag) matching the names "+
+			"of files in -watch-dir that do not follow the user_<id>_<field> naming convention, "+
+			"e.g. '^rabbitmq-(?P<id>.+)-(?P<field>username|password|tag)$'.")
+	flag.StringVar(
+		&f.kubernetesNamespace,
+		"kubernetes-namespace",
+		"",
+		"Namespace of the Secrets for -source=kubernetes. Defaults to the namespace of the Pod.")
+	flag.StringVar(
+		&f.kubernetesLabelSelector,
+		"kubernetes-label-selector",
+		"",
+		"Label selector of the Secrets for -source=kubernetes, e.g. app.kubernetes.io/part-of=rabbitmq.")
+	flag.StringVar(
+		&f.vaultAddress,
+		"vault-address",
+		os.Getenv("VAULT_ADDR"),
+		"Address of the Vault server for -source=vault. Defaults to $VAULT_ADDR.")
+	flag.StringVar(
+		&f.vaultTokenFile,
+		"vault-token-file",
+		"/etc/vault/token",
+		"File containing the Vault token for -source=vault, e.g. written by Vault agent.")
+	flag.StringVar(
+		&f.vaultPaths,
+		"vault-paths",
+		"",
+		"Comma separated list of <userID>=<path> pairs for -source=vault, e.g. default=rabbitmq/creds/default. "+
+			"Every path must contain the keys username and password, and optionally tag.")
+	flag.StringVar(
+		&f.awsRegion,
+		"aws-region",
+		os.Getenv("AWS_REGION"),
+		"AWS region for -source=aws. Defaults to $AWS_REGION.")
+	flag.StringVar(
+		&f.awsEndpoint,
+		"aws-endpoint",
+		"",
+		"Secrets Manager endpoint for -source=aws, e.g. a VPC endpoint. Defaults to the regional endpoint.")
+	flag.StringVar(
+		&f.awsSecretIDs,
+		"aws-secret-ids",
+		"",
+		"Comma separated list of <userID>=<secret ARN or name> pairs for -source=aws. "+
+			"Every secret must contain a JSON object with the keys username and password, and optionally tag.")
+	flag.StringVar(
+		&f.awsSecretPrefix,
+		"aws-secret-prefix",
+		"",
+		"Name prefix of the secrets for -source=aws if -aws-secret-ids is not set, e.g. rabbitmq/ for the secret rabbitmq/<userID>.")
+	flag.StringVar(
+		&f.azureVaultURL,
+		"azure-vault-url",
+		"",
+		"URL of the Azure Key Vault for -source=azure, e.g. https://my-vault.vault.azure.net. "+
+			"The secrets user-<id>-username, user-<id>-password and user-<id>-tag are read using workload identity.")
+	flag.StringVar(
+		&f.gcpSecrets,
+		"gcp-secrets",
+		"",
+		"Comma separated list of <userID>=projects/<project>/secrets/<secret>[/versions/<version>] pairs for -source=gcp. "+
+			"The version defaults to latest. Every secret must contain a JSON object with the keys username and password, and optionally tag.")
+	flag.StringVar(
+		&f.gcpSubscription,
+		"gcp-subscription",
+		"",
+		"Pub/Sub subscription (projects/<project>/subscriptions/<subscription>) to the notification topic of the secrets "+
+			"for -source=gcp. If not set, the secrets are polled.")
+	flag.StringVar(
+		&f.conjurURL,
+		"conjur-url",
+		os.Getenv("CONJUR_APPLIANCE_URL"),
+		"URL of the Conjur appliance for -source=conjur. Defaults to $CONJUR_APPLIANCE_URL.")
+	flag.StringVar(
+		&f.conjurAccount,
+		"conjur-account",
+		os.Getenv("CONJUR_ACCOUNT"),
+		"Conjur account for -source=conjur. Defaults to $CONJUR_ACCOUNT.")
+	flag.StringVar(
+		&f.conjurLogin,
+		"conjur-login",
+		os.Getenv("CONJUR_AUTHN_LOGIN"),
+		"Host identity for -source=conjur, e.g. host/rabbitmq/updater. Defaults to $CONJUR_AUTHN_LOGIN.")
+	flag.StringVar(
+		&f.conjurAPIKeyFile,
+		"conjur-api-key-file",
+		"/etc/conjur/api-key",
+		"File containing the API key of the host for -source=conjur.")
+	flag.StringVar(
+		&f.conjurVariables,
+		"conjur-variables",
+		"",
+		"Comma separated list of <userID>=<path> pairs for -source=conjur, e.g. default=rabbitmq/default. "+
+			"The variables <path>/username and <path>/password, and optionally <path>/tag are read.")
+	flag.StringVar(
+		&f.httpURL,
+		"http-url",
+		"",
+		`URL of the JSON document for -source=http, containing {"users": {"<userID>": {"username": ..., "password": ..., "tag": ...}}}.`)
+	flag.StringVar(
+		&f.httpBearerTokenFile,
+		"http-bearer-token-file",
+		"",
+		"File containing a bearer token for -source=http.")
+	flag.StringVar(
+		&f.httpCAFile,
+		"http-ca-file",
+		"",
+		"CA certificates to verify the server for -source=http. Defaults to the system CAs.")
+	flag.StringVar(
+		&f.httpCertFile,
+		"http-cert-file",
+		"",
+		"Client certificate for mTLS for -source=http.")
+	flag.StringVar(
+		&f.httpKeyFile,
+		"http-key-file",
+		"",
+		"Key of the client certificate for -source=http.")
+	flag.StringVar(
+		&f.etcdEndpoint,
+		"etcd-endpoint",
+		"",
+		"URL of an etcd member for -source=etcd, e.g. https://etcd:2379.")
+	flag.StringVar(
+		&f.etcdPrefix,
+		"etcd-prefix",
+		"",
+		"Key prefix for -source=etcd. The keys <prefix>user_<id>_username, <prefix>user_<id>_password "+
+			"and <prefix>user_<id>_tag are read.")
+	flag.StringVar(
+		&f.etcdUsername,
+		"etcd-username",
+		"",
+		"User for etcd authentication for -source=etcd. Requires -etcd-password-file.")
+	flag.StringVar(
+		&f.etcdPasswordFile,
+		"etcd-password-file",
+		"",
+		"File containing the password of -etcd-username.")
+	flag.StringVar(
+		&f.etcdCAFile,
+		"etcd-ca-file",
+		"",
+		"CA certificates to verify etcd for -source=etcd. Defaults to the system CAs.")
+	flag.StringVar(
+		&f.etcdCertFile,
+		"etcd-cert-file",
+		"",
+		"Client certificate for -source=etcd.")
+	flag.StringVar(
+		&f.etcdKeyFile,
+		"etcd-key-file",
+		"",
+		"Key of the client certificate for -source=etcd.")
+	consulAddress := "http://127.0.0.1:8500"
+	if addr := os.Getenv("CONSUL_HTTP_ADDR"); addr != "" {
+		consulAddress = addr
+	}
+	flag.StringVar(
+		&f.consulAddress,
+		"consul-address",
+		consulAddress,
+		"URL of the Consul agent for -source=consul. Defaults to $CONSUL_HTTP_ADDR.")
+	flag.StringVar(
+		&f.consulPrefix,
+		"consul-prefix",
+		"rabbitmq/users",
+		"Key prefix for -source=consul. The keys <prefix>/<userID>/username, <prefix>/<userID>/password "+
+			"and <prefix>/<userID>/tag are read.")
+	flag.StringVar(
+		&f.consulTokenFile,
+		"consul-token-file",
+		"",
+		"File containing an ACL token for -source=consul.")
+}
+
+// newDirectorySource returns the source for -source=directory.
+func (f *sourceFlags) newDirectorySource(watchDir string, log logr.Logger) (updater.DirectorySource, error) {
+	source := updater.DirectorySource{Dir: watchDir, Log: log}
+	if f.sops {
+		decrypter := updater.SOPSDecrypter{}
+		if err := decrypter.CheckCommand(); err != nil {
+			return source, fmt.Errorf("invalid -sops: %w", err)
+		}
+		source.Decrypters = append(source.Decrypters, decrypter)
+	}
+	if f.decryptKeyFile != "" {
+		source.Decrypters = append(source.Decrypters, updater.AgeDecrypter{IdentityFile: f.decryptKeyFile})
+	}
+	if f.systemdCreds {
+		decrypter := updater.SystemdCredsDecrypter{}
+		if err := decrypter.CheckCommand(); err != nil {
+			return source, fmt.Errorf("invalid -systemd-creds: %w", err)
+		}
+		source.Decrypters = append(source.Decrypters, decrypter)
+	}
+	if f.signatureKey != "" {
+		key, err := updater.LoadSignatureKey(f.signatureKey)
+		if err != nil {
+			return source, fmt.Errorf("invalid -signature-public-key-file: %w", err)
+		}
+		source.SignatureKey = key
+	}
+	if f.secretFiles != "" {
+		files, err := parseSecretFiles(f.secretFiles)
+		if err != nil {
+			return source, fmt.Errorf("invalid -secret-files: %w", err)
+		}
+		source.Files = files
+	}
+	if f.filePattern != "" {
+		pattern, err := regexp.Compile(f.filePattern)
+		if err != nil {
+			return source, fmt.Errorf("invalid -file-pattern: %w", err)
+		}
+		if pattern.SubexpIndex("id") < 0 || pattern.SubexpIndex("field") < 0 {
+			return source, errors.New("invalid -file-pattern: the named groups id and field are required")
+		}
+		source.Pattern = pattern
+	}
+	return source, nil
+}
+
+// parseSecretFiles parses a comma separated list of <file>=<userID>/<field> pairs.
+func parseSecretFiles(s string) (map[string]updater.SecretFile, error) {
+	mapping, err := parseMapping(s)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]updater.SecretFile, len(mapping))
+	for name, target := range mapping {
+		userID, field, found := strings.Cut(target, "/")
+		if !found || userID == "" {
+			return nil, fmt.Errorf("invalid target %q of file %q, expected <userID>/<field>", target, name)
+		}
+		switch field {
+		case "username", "password", "tag":
+		default:
+			return nil, fmt.Errorf("invalid field %q of file %q, expected username, password or tag", field, name)
+		}
+		files[name] = updater.SecretFile{UserID: userID, Field: field}
+	}
+	return files, nil
+}
+
+// newSource returns the configured SecretSource. For -source=directory, it returns
+// an updater.DirectorySource for updater.NewDirectoryPasswordUpdater.
+func (f *sourceFlags) newSource(watchDir string, log logr.Logger) (updater.SecretSource, error) {
+	switch f.source {
+	case sourceDirectory:
+		return f.newDirectorySource(watchDir, log)
+	case "kubernetes":
+		return updater.NewInClusterKubernetesSource(f.kubernetesNamespace, f.kubernetesLabelSelector, log)
+	case "vault":
+		paths, err := parseMapping(f.vaultPaths)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -vault-paths: %w", err)
+		}
+		return &updater.VaultSource{
+			Address:      f.vaultAddress,
+			TokenFile:    f.vaultTokenFile,
+			Paths:        paths,
+			PollInterval: f.pollInterval,
+			Client:       &http.Client{},
+			Log:          log,
+		}, nil
+	case "aws":
+		if f.awsRegion == "" {
+			return nil, errors.New("-aws-region is required for -source=aws")
+		}
+		source, err := updater.NewAWSSecretsManagerSource(context.Background(), f.awsRegion, f.awsEndpoint, log)
+		if err != nil {
+			return nil, err
+		}
+		source.Prefix = f.awsSecretPrefix
+		source.PollInterval = f.pollInterval
+		if f.awsSecretIDs != "" {
+			secretIDs, err := parseMapping(f.awsSecretIDs)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -aws-secret-ids: %w", err)
+			}
+			source.SecretIDs = secretIDs
+		} else if f.awsSecretPrefix == "" {
+			return nil, errors.New("-aws-secret-ids or -aws-secret-prefix is required for -source=aws")
+		}
+		return source, nil
+	case "azure":
+		if f.azureVaultURL == "" {
+			return nil, errors.New("-azure-vault-url is required for -source=azure")
+		}
+		return &updater.AzureKeyVaultSource{
+			VaultURL:     f.azureVaultURL,
+			PollInterval: f.pollInterval,
+			Token:        updater.NewAzureWorkloadIdentityTokenProvider(&http.Client{}),
+			Client:       &http.Client{},
+			Log:          log,
+		}, nil
+	case "gcp":
+		secrets, err := parseMapping(f.gcpSecrets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -gcp-secrets: %w", err)
+		}
+		return &updater.GCPSecretManagerSource{
+			Secrets:      secrets,
+			Subscription: f.gcpSubscription,
+			PollInterval: f.pollInterval,
+			Token:        updater.NewGCPMetadataTokenProvider(&http.Client{}),
+			Client:       &http.Client{},
+			Log:          log,
+		}, nil
+	case "conjur":
+		if f.conjurURL == "" || f.conjurAccount == "" || f.conjurLogin == "" {
+			return nil, errors.New("-conjur-url, -conjur-account and -conjur-login are required for -source=conjur")
+		}
+		variables, err := parseMapping(f.conjurVariables)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -conjur-variables: %w", err)
+		}
+		return &updater.ConjurSource{
+			URL:          f.conjurURL,
+			Account:      f.conjurAccount,
+			Login:        f.conjurLogin,
+			APIKeyFile:   f.conjurAPIKeyFile,
+			Variables:    variables,
+			PollInterval: f.pollInterval,
+			Client:       &http.Client{},
+			Log:          log,
+		}, nil
+	case "http":
+		if f.httpURL == "" {
+			return nil, errors.New("-http-url is required for -source=http")
+		}
+		client, err := newTLSClient(f.httpCAFile, f.httpCertFile, f.httpKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration for -source=http: %w", err)
+		}
+		return &updater.HTTPSource{
+			URL:             f.httpURL,
+			BearerTokenFile: f.httpBearerTokenFile,
+			PollInterval:    f.pollInterval,
+			Client:          client,
+			Log:             log,
+		}, nil
+	case "etcd":
+		if f.etcdEndpoint == "" {
+			return nil, errors.New("-etcd-endpoint is required for -source=etcd")
+		}
+		if f.etcdUsername != "" && f.etcdPasswordFile == "" {
+			return nil, errors.New("-etcd-password-file is required with -etcd-username")
+		}
+		client, err := newTLSClient(f.etcdCAFile, f.etcdCertFile, f.etcdKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration for -source=etcd: %w", err)
+		}
+		return &updater.EtcdSource{
+			Endpoint:     f.etcdEndpoint,
+			Prefix:       f.etcdPrefix,
+			Username:     f.etcdUsername,
+			PasswordFile: f.etcdPasswordFile,
+			Client:       client,
+			Log:          log,
+		}, nil
+	case "consul":
+		return &updater.ConsulSource{
+			Address:   f.consulAddress,
+			Prefix:    f.consulPrefix,
+			TokenFile: f.consulTokenFile,
+			Client:    &http.Client{},
+			Log:       log,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown source %q", f.source)
+	}
+}
+
+// newTLSClient returns an HTTP client verifying the server with the CA certificates in caFile
+// (or the system CAs) and authenticating with the client certificate in certFile, if set.
+func newTLSClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}, nil
+}
+
+// parseMapping parses a comma separated list of key=value pairs.
+func parseMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected <key>=<value>", pair)
+		}
+		mapping[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if len(mapping) == 0 {
+		return nil, errors.New("no pairs")
+	}
+	return mapping, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+// newSTOMPProbe returns a probe that connects to stompURI (stomp:// or stomps://, whose path is
+// the vhost) with STOMP and disconnects once the server sent the CONNECTED frame.
+func newSTOMPProbe(stompURI, caFile string, timeout time.Duration) (updater.Probe, error) {
+	uri, tlsConfig, err := parseProbeURI(stompURI, caFile, "stomp", "stomps")
+	if err != nil {
+		return nil, err
+	}
+	port := uri.Port()
+	if port == "" {
+		port = "61613"
+		if tlsConfig != nil {
+			port = "61614"
+		}
+	}
+	addr := net.JoinHostPort(uri.Hostname(), port)
+	vhost := "/"
+	if uri.Path != "" && uri.Path != "/" {
+		vhost = strings.TrimPrefix(uri.Path, "/")
+	}
+	return func(ctx context.Context, username, password string) error {
+		conn, err := dialProbe(ctx, addr, tlsConfig, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return stompConnect(conn, vhost, username, password)
+	}, nil
+}
+
+// stompConnect sends a CONNECT frame with the credentials on conn and returns an error unless
+// the server accepted the connection, which is disconnected then. Like the server, it does not
+// escape the headers of the CONNECT frame.
+func stompConnect(conn io.ReadWriter, vhost, username, password string) error {
+	if strings.ContainsAny(username+password, "\r\n\x00") {
+		return fmt.Errorf("credentials contain characters that STOMP does not support")
+	}
+	frame := "CONNECT\naccept-version:1.0,1.1,1.2\nhost:" + vhost + "\nlogin:" + username +
+		"\npasscode:" + password + "\nheart-beat:0,0\n\n\x00"
+	if _, err := io.WriteString(conn, frame); err != nil {
+		return err
+	}
+	response, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECTED frame: %w", err)
+	}
+	command, headers, _ := strings.Cut(strings.TrimLeft(response, "\r\n"), "\n")
+	switch strings.TrimSuffix(command, "\r") {
+	case "CONNECTED":
+		_, err = io.WriteString(conn, "DISCONNECT\n\n\x00")
+		return err
+	case "ERROR":
+		for _, header := range strings.Split(headers, "\n") {
+			if message, found := strings.CutPrefix(strings.TrimSuffix(header, "\r"), "message:"); found {
+				return fmt.Errorf("connection refused: %s", message)
+			}
+		}
+		return fmt.Errorf("connection refused")
+	}
+	return fmt.Errorf("unexpected frame %q, expected CONNECTED", command)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stompConnect", func() {
+	var client, server net.Conn
+
+	// serve runs the server side of the handshake, responding with the frame response,
+	// and sends the received CONNECT frame to frames.
+	serve := func(response string) <-chan string {
+		frames := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			defer server.Close()
+			r := bufio.NewReader(server)
+			frame, err := r.ReadString(0)
+			Expect(err).NotTo(HaveOccurred())
+			frames <- frame
+			_, err = io.WriteString(server, response)
+			Expect(err).NotTo(HaveOccurred())
+			if strings.HasPrefix(response, "CONNECTED") {
+				disconnect, err := r.ReadString(0)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(disconnect).To(Equal("DISCONNECT\n\n\x00"))
+			}
+		}()
+		return frames
+	}
+
+	BeforeEach(func() {
+		client, server = net.Pipe()
+		DeferCleanup(client.Close)
+	})
+
+	It("succeeds and disconnects if the server sends CONNECTED", func() {
+		frames := serve("CONNECTED\nversion:1.2\nheart-beat:0,0\n\n\x00")
+		Expect(stompConnect(client, "tenant", "app", "s3cret")).To(Succeed())
+		Expect(frames).To(Receive(Equal("CONNECT\naccept-version:1.0,1.1,1.2\nhost:tenant\nlogin:app\npasscode:s3cret\nheart-beat:0,0\n\n\x00")))
+	})
+
+	It("fails with the message of an ERROR frame", func() {
+		serve("ERROR\r\nmessage:Bad CONNECT\r\ncontent-type:text/plain\r\n\r\nAccess refused for user 'app'\x00")
+		Expect(stompConnect(client, "/", "app", "wrong")).To(MatchError("connection refused: Bad CONNECT"))
+	})
+
+	It("rejects credentials with line breaks", func() {
+		Expect(stompConnect(client, "/", "app", "s3cret\npasscode:other")).To(MatchError(ContainSubstring("characters that STOMP does not support")))
+	})
+})
@@ -0,0 +1,87 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Defaults of the section and keys of the admin credentials, as used by rabbitmqadmin
+// (v2 with --node default).
+const (
+	DefaultAdminFileSection     = "default"
+	DefaultAdminFileUsernameKey = "username"
+	DefaultAdminFilePasswordKey = "password"
+)
+
+// adminFileSyntax returns the configSyntax of the AdminFileFormat, FileFormatINI unless it is FileFormatTOML.
+func (u *PasswordUpdater) adminFileSyntax() configSyntax {
+	if u.AdminFileFormat == FileFormatTOML {
+		return FileFormatTOML.syntax()
+	}
+	return FileFormatINI.syntax()
+}
+
+// adminFileValues returns the keys (in the order they are added to a new file) and values of the admin file.
+func (u *PasswordUpdater) adminFileValues(cred UserCredentials) ([]string, map[string]any) {
+	keys := []string{u.AdminFileUsernameKey, u.AdminFilePasswordKey}
+	values := map[string]any{u.AdminFileUsernameKey: cred.Username, u.AdminFilePasswordKey: cred.Password}
+	for _, key := range slices.Sorted(maps.Keys(u.AdminFileSettings)) {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+			values[key] = u.AdminFileSettings[key]
+		}
+	}
+	return keys, values
+}
+
+// adminFileSink is the CredentialSink of the AdminFile of the admin user.
+type adminFileSink struct {
+	u *PasswordUpdater
+}
+
+func (s adminFileSink) Check(_ context.Context, cred UserCredentials) (bool, error) {
+	return s.u.checkAdminFile(cred)
+}
+
+func (s adminFileSink) Write(ctx context.Context, cred UserCredentials) error {
+	return s.u.updateAdminFile(ctx, cred)
+}
+
+func (s adminFileSink) String() string {
+	return s.u.AdminFile
+}
+
+// updateAdminFile writes the admin credentials (and AdminFileSettings) into the AdminFileSection of the
+// rabbitmqadmin file (the table of a node with FileFormatTOML), leaving all other content unchanged.
+// If the file does not exist, it creates a new one. Concurrent writers are serialized, see lockAdminFile.
+func (u *PasswordUpdater) updateAdminFile(ctx context.Context, cred UserCredentials) error {
+	release, err := u.lockAdminFile(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	keys, values := u.adminFileValues(cred)
+	if err := updateConfigFile(u.AdminFile, u.AdminFileSection, keys, values, u.adminFileSyntax()); err != nil {
+		return fmt.Errorf("failed to save admin file: %w", err)
+	}
+	return nil
+}
+
+// checkAdminFile checks whether the admin credentials file contains the expected username and password
+// (and AdminFileSettings). Returns true if the file is correct, or false if it is missing or has incorrect credentials.
+func (u *PasswordUpdater) checkAdminFile(cred UserCredentials) (bool, error) {
+	syntax := u.adminFileSyntax()
+	actual, err := readConfigFile(u.AdminFile, u.AdminFileSection, syntax)
+	if err != nil {
+		return false, err
+	}
+	keys, values := u.adminFileValues(cred)
+	for _, key := range keys {
+		if actual[syntax.normalize(key)] != fmt.Sprint(values[key]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,36 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// verifyAliveness verifies that cred can declare, publish to and consume from a queue in each vhost
+// it has permissions in (or is granted as a new user), with GET /api/aliveness-test/<vhost>.
+// Unlike Whoami, this proves that the user can use its vhosts, not only authenticate.
+func (u *PasswordUpdater) verifyAliveness(ctx context.Context, cred UserCredentials) error {
+	permissions := cred.Permissions
+	if len(permissions) == 0 {
+		permissions = u.newUserPermissions(cred.Tag)
+	}
+	if len(permissions) == 0 {
+		u.Log.V(1).Info("user has no vhost, skipping aliveness test", "user", cred.Username)
+		return nil
+	}
+	u.authClient.SetUsername(cred.Username)
+	u.authClient.SetPassword(cred.Password)
+	for _, vhost := range slices.Sorted(maps.Keys(permissions)) {
+		err := u.retry(ctx, http.MethodGet+" /api/aliveness-test/"+url.PathEscape(vhost), func() error {
+			return u.authClient.AlivenessTest(ctx, vhost)
+		})
+		if err != nil {
+			return fmt.Errorf("aliveness test in vhost %q failed: %w", vhost, err)
+		}
+		u.Log.V(1).Info("aliveness test succeeded", "user", cred.Username, "vhost", vhost)
+	}
+	return nil
+}
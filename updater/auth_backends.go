@@ -0,0 +1,48 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	// internalAuthBackend is the auth backend of the internal user database, which users are updated in.
+	internalAuthBackend = "rabbit_auth_backend_internal"
+	// authBackendPluginPrefix prefixes the plugins of other auth backends, e.g. LDAP, OAuth 2.0 or HTTP.
+	authBackendPluginPrefix = "rabbitmq_auth_backend_"
+)
+
+// checkAuthBackends warns if RabbitMQ has auth backends other than the internal user database enabled,
+// since updated credentials may have no effect on logins then. With RequireInternalAuthBackend, it
+// returns an error if RabbitMQ reports that the admin user was authenticated by another backend, i.e.
+// if the internal user database is absent or not consulted first. The check is skipped if RabbitMQ
+// cannot be queried, e.g. because it is not running yet or the admin credentials are outdated.
+// The enabled plugins are those detected by probeBroker.
+func (u *PasswordUpdater) checkAuthBackends(ctx context.Context) error {
+	var plugins []string
+	for _, plugin := range u.broker.plugins {
+		if strings.HasPrefix(plugin, authBackendPluginPrefix) {
+			plugins = append(plugins, plugin)
+		}
+	}
+	if len(plugins) > 0 {
+		u.Log.Info("WARNING: auth backends other than the internal user database are enabled, "+
+			"updated credentials may have no effect on logins", "plugins", plugins)
+	}
+
+	info, err := u.adminClient.Whoami(ctx)
+	if err != nil {
+		u.Log.V(1).Info("failed to detect auth backend of admin user, skipping check", "error", err.Error())
+		return nil
+	}
+	if info == nil || info.AuthBackend == "" || info.AuthBackend == internalAuthBackend {
+		return nil
+	}
+	u.Log.Info("WARNING: admin user was not authenticated by the internal user database, "+
+		"which is therefore not authoritative", "user", info.Name, "authBackend", info.AuthBackend)
+	if u.RequireInternalAuthBackend {
+		return fmt.Errorf("%w: admin user was authenticated by %s", ErrAuthBackend, info.AuthBackend)
+	}
+	return nil
+}
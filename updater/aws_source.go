@@ -0,0 +1,136 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/go-logr/logr"
+)
+
+// AWSSecretsManagerSource reads credentials from AWS Secrets Manager. Every secret contains a
+// JSON object with the keys username, password and tag. The secrets are polled for rotations,
+// i.e. for a new version with the AWSCURRENT stage.
+type AWSSecretsManagerSource struct {
+	// SecretIDs maps userIDs to secret ARNs or names.
+	SecretIDs map[string]string
+	// Prefix is used if SecretIDs is empty: the secrets named <Prefix><userID> are read.
+	Prefix string
+	// PollInterval defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	Client       *secretsmanager.Client
+	Log          logr.Logger
+}
+
+// NewAWSSecretsManagerSource returns an AWSSecretsManagerSource whose client looks up the credentials
+// like the AWS SDKs do, e.g. from $AWS_ACCESS_KEY_ID, a web identity token (IAM roles for service
+// accounts on EKS) or the EC2 instance metadata service. If endpoint is set, it overrides the
+// Secrets Manager endpoint, e.g. for VPC endpoints.
+func NewAWSSecretsManagerSource(ctx context.Context, region, endpoint string, log logr.Logger) (*AWSSecretsManagerSource, error) {
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(region),
+		config.WithHTTPClient(awshttp.NewBuildableClient().WithTimeout(30*time.Second)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return &AWSSecretsManagerSource{Client: client, Log: log}, nil
+}
+
+const awsCurrentStage = "AWSCURRENT"
+
+// awsSecret is an entry of ListSecrets or the result of DescribeSecret.
+type awsSecret struct {
+	ARN string
+	// Versions maps the version IDs to their stages.
+	Versions map[string][]string
+}
+
+// currentVersion returns the ID of the version with the AWSCURRENT stage.
+func (s awsSecret) currentVersion() string {
+	for id, stages := range s.Versions {
+		if slices.Contains(stages, awsCurrentStage) {
+			return id
+		}
+	}
+	return ""
+}
+
+func (s *AWSSecretsManagerSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	secrets, err := s.secrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]UserCredentials, len(secrets))
+	for userID, secret := range secrets {
+		result, err := s.Client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secret.ARN)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret %q: %w", secret.ARN, err)
+		}
+		cred, err := parseCredentialsJSON([]byte(aws.ToString(result.SecretString)))
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", secret.ARN, err)
+		}
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch polls the current versions of the secrets.
+func (s *AWSSecretsManagerSource) Watch(ctx context.Context, changed func()) error {
+	return pollForChanges(ctx, pollInterval(s.PollInterval), s.Log, func(ctx context.Context) (string, error) {
+		secrets, err := s.secrets(ctx)
+		if err != nil {
+			return "", err
+		}
+		versions := make([]string, 0, len(secrets))
+		for userID, secret := range secrets {
+			versions = append(versions, userID+"="+secret.currentVersion())
+		}
+		slices.Sort(versions)
+		return strings.Join(versions, ","), nil
+	}, changed)
+}
+
+// secrets returns the secrets keyed by userID, including their versions.
+func (s *AWSSecretsManagerSource) secrets(ctx context.Context) (map[string]awsSecret, error) {
+	secrets := make(map[string]awsSecret)
+	if len(s.SecretIDs) > 0 {
+		for userID, id := range s.SecretIDs {
+			secret, err := s.Client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(id)})
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe secret %q: %w", id, err)
+			}
+			secrets[userID] = awsSecret{ARN: aws.ToString(secret.ARN), Versions: secret.VersionIdsToStages}
+		}
+		return secrets, nil
+	}
+	pages := secretsmanager.NewListSecretsPaginator(s.Client, &secretsmanager.ListSecretsInput{
+		Filters: []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{s.Prefix}}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list secrets with prefix %q: %w", s.Prefix, err)
+		}
+		for _, secret := range page.SecretList {
+			// The name filter also matches words within the name.
+			if userID, ok := strings.CutPrefix(aws.ToString(secret.Name), s.Prefix); ok && userID != "" {
+				secrets[userID] = awsSecret{ARN: aws.ToString(secret.ARN), Versions: secret.SecretVersionsToStages}
+			}
+		}
+	}
+	return secrets, nil
+}
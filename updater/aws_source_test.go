@@ -0,0 +1,127 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("AWSSecretsManagerSource", func() {
+	var (
+		source   *AWSSecretsManagerSource
+		mu       sync.Mutex
+		versions map[string]string
+		values   map[string]string
+	)
+
+	setSecret := func(name, version, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		versions[name] = version
+		values[name] = value
+	}
+
+	BeforeEach(func() {
+		versions = make(map[string]string)
+		values = make(map[string]string)
+		setSecret("rabbitmq/default", "v1", `{"username":"default","password":"pwd1"}`)
+		setSecret("rabbitmq/admin", "v1", `{"username":"admin","password":"adminpwd","tag":"administrator"}`)
+		setSecret("other/secret", "v1", `{}`)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Header.Get("Authorization")).To(HavePrefix("AWS4-HMAC-SHA256 Credential=AKID/"))
+			Expect(r.Header.Get("Authorization")).To(ContainSubstring("/eu-de-1/secretsmanager/aws4_request"))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/x-amz-json-1.1"))
+			var body struct {
+				SecretID string `json:"SecretId"`
+				Filters  []struct {
+					Values []string
+				}
+			}
+			Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+			mu.Lock()
+			defer mu.Unlock()
+			secret := func(name string) map[string]any {
+				return map[string]any{"ARN": "arn:" + name, "Name": name, "SecretVersionsToStages": map[string][]string{versions[name]: {"AWSCURRENT"}}}
+			}
+			switch r.Header.Get("X-Amz-Target") {
+			case "secretsmanager.ListSecrets":
+				var list []map[string]any
+				for name := range versions {
+					if strings.HasPrefix(name, body.Filters[0].Values[0]) {
+						list = append(list, secret(name))
+					}
+				}
+				Expect(json.NewEncoder(w).Encode(map[string]any{"SecretList": list})).To(Succeed())
+			case "secretsmanager.DescribeSecret":
+				name := strings.TrimPrefix(body.SecretID, "arn:")
+				fmt.Fprintf(w, `{"ARN":"arn:%s","Name":%q,"VersionIdsToStages":{%q:["AWSCURRENT"]}}`, name, name, versions[name])
+			case "secretsmanager.GetSecretValue":
+				Expect(json.NewEncoder(w).Encode(map[string]any{"SecretString": values[strings.TrimPrefix(body.SecretID, "arn:")]})).To(Succeed())
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		DeferCleanup(server.Close)
+
+		source = &AWSSecretsManagerSource{
+			Prefix:       "rabbitmq/",
+			PollInterval: 50 * time.Millisecond,
+			Client: secretsmanager.New(secretsmanager.Options{
+				Region:       "eu-de-1",
+				BaseEndpoint: aws.String(server.URL),
+				Credentials:  credentials.NewStaticCredentialsProvider("AKID", "secret", ""),
+				HTTPClient:   server.Client(),
+			}),
+			Log: initLogging(),
+		}
+	})
+
+	It("reads the secrets with the prefix", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+	})
+
+	It("reads the secrets by ID", func() {
+		source.SecretIDs = map[string]string{"default": "rabbitmq/default"}
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+		}))
+	})
+
+	It("reports rotated secrets", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		changes := make(chan struct{}, 10)
+		go func() {
+			_ = source.Watch(ctx, func() { changes <- struct{}{} })
+		}()
+		Eventually(changes).Should(Receive())
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		setSecret("rabbitmq/default", "v2", `{"username":"default","password":"pwd2"}`)
+		Eventually(changes).Should(Receive())
+		credentials, err := source.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials["default"].Password).To(Equal("pwd2"))
+	})
+})
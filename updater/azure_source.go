@@ -0,0 +1,211 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const azureKeyVaultAPIVersion = "7.4"
+
+// AzureTokenProvider returns an access token for Azure Key Vault.
+type AzureTokenProvider func(ctx context.Context) (string, error)
+
+// NewAzureWorkloadIdentityTokenProvider returns a provider that exchanges the federated token
+// of Azure workload identity for an access token. It uses the environment variables injected
+// by the workload identity webhook: $AZURE_CLIENT_ID, $AZURE_TENANT_ID,
+// $AZURE_FEDERATED_TOKEN_FILE and $AZURE_AUTHORITY_HOST.
+func NewAzureWorkloadIdentityTokenProvider(client *http.Client) AzureTokenProvider {
+	var mu sync.Mutex
+	var cached string
+	var expires time.Time
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached != "" && time.Until(expires) > 5*time.Minute {
+			return cached, nil
+		}
+		clientID, tenantID, tokenFile := os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		if clientID == "" || tenantID == "" || tokenFile == "" {
+			return "", errors.New("workload identity is not configured, missing $AZURE_CLIENT_ID, $AZURE_TENANT_ID or $AZURE_FEDERATED_TOKEN_FILE")
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com/"
+		}
+		// The federated token is rotated by the kubelet, so it is read for every exchange.
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read federated token: %w", err)
+		}
+		form := url.Values{
+			"client_id":             {clientID},
+			"scope":                 {"https://vault.azure.net/.default"},
+			"grant_type":            {"client_credentials"},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		}
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+			strings.TrimSuffix(authority, "/")+"/"+url.PathEscape(tenantID)+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		body, err := doRequest(client, req)
+		if err != nil {
+			return "", fmt.Errorf("failed to get access token: %w", err)
+		}
+		var token struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if err := json.Unmarshal(body, &token); err != nil {
+			return "", fmt.Errorf("failed to decode access token: %w", err)
+		}
+		cached = token.AccessToken
+		expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+		return cached, nil
+	}
+}
+
+// AzureKeyVaultSource reads credentials from the secrets of an Azure Key Vault named
+// user-<id>-username, user-<id>-password and user-<id>-tag, analogous to the files of
+// DirectorySource (Key Vault does not allow underscores in secret names).
+// The vault is polled for changes.
+type AzureKeyVaultSource struct {
+	// VaultURL is the URL of the vault, e.g. https://my-vault.vault.azure.net.
+	VaultURL string
+	// PollInterval defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	Token        AzureTokenProvider
+	Client       *http.Client
+	Log          logr.Logger
+}
+
+type azureSecretItem struct {
+	ID         string `json:"id"`
+	Attributes struct {
+		Enabled bool  `json:"enabled"`
+		Updated int64 `json:"updated"`
+	} `json:"attributes"`
+}
+
+// name returns the secret name from the ID https://<vault>/secrets/<name>[/<version>].
+func (i azureSecretItem) name() string {
+	_, path, _ := strings.Cut(i.ID, "/secrets/")
+	name, _, _ := strings.Cut(path, "/")
+	return name
+}
+
+func (s *AzureKeyVaultSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	items, err := s.listSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]UserCredentials)
+	for _, item := range items {
+		userID, field, _ := parseAzureSecretName(item.name())
+		var secret struct {
+			Value string `json:"value"`
+		}
+		if err := s.get(ctx, "/secrets/"+url.PathEscape(item.name()), &secret); err != nil {
+			return nil, fmt.Errorf("failed to get secret %q: %w", item.name(), err)
+		}
+		cred := credentials[userID]
+		cred.set(field, strings.TrimSpace(secret.Value))
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch polls the update timestamps of the secrets.
+func (s *AzureKeyVaultSource) Watch(ctx context.Context, changed func()) error {
+	return pollForChanges(ctx, pollInterval(s.PollInterval), s.Log, func(ctx context.Context) (string, error) {
+		items, err := s.listSecrets(ctx)
+		if err != nil {
+			return "", err
+		}
+		versions := make([]string, 0, len(items))
+		for _, item := range items {
+			versions = append(versions, fmt.Sprintf("%s=%d", item.name(), item.Attributes.Updated))
+		}
+		slices.Sort(versions)
+		return strings.Join(versions, ","), nil
+	}, changed)
+}
+
+// listSecrets returns the enabled secrets with user credentials.
+func (s *AzureKeyVaultSource) listSecrets(ctx context.Context) ([]azureSecretItem, error) {
+	var items []azureSecretItem
+	next := "/secrets"
+	for next != "" {
+		var page struct {
+			Value    []azureSecretItem `json:"value"`
+			NextLink string            `json:"nextLink"`
+		}
+		if err := s.get(ctx, next, &page); err != nil {
+			return nil, fmt.Errorf("failed to list secrets: %w", err)
+		}
+		for _, item := range page.Value {
+			if _, _, ok := parseAzureSecretName(item.name()); ok && item.Attributes.Enabled {
+				items = append(items, item)
+			}
+		}
+		next = page.NextLink
+	}
+	return items, nil
+}
+
+// get requests path, relative to VaultURL, or an absolute nextLink.
+func (s *AzureKeyVaultSource) get(ctx context.Context, path string, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	target := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		target = strings.TrimSuffix(s.VaultURL, "/") + path + "?api-version=" + azureKeyVaultAPIVersion
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	token, err := s.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Azure access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	body, err := doRequest(s.Client, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// parseAzureSecretName splits a secret name like user-<id>-password into the userID
+// and the credential field. ok is false if the name does not match.
+func parseAzureSecretName(name string) (userID string, field string, ok bool) {
+	rest, found := strings.CutPrefix(name, "user-")
+	if !found {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, "-")
+	if i <= 0 {
+		return "", "", false
+	}
+	userID, field = rest[:i], rest[i+1:]
+	if !slices.Contains([]string{"username", "password", "tag"}, field) {
+		return "", "", false
+	}
+	return userID, field, true
+}
@@ -0,0 +1,118 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("AzureKeyVaultSource", func() {
+	type secret struct {
+		value   string
+		enabled bool
+		updated int64
+	}
+
+	var (
+		source  *AzureKeyVaultSource
+		mu      sync.Mutex
+		secrets map[string]secret
+	)
+
+	BeforeEach(func() {
+		secrets = map[string]secret{
+			"user-default-username": {"default", true, 1},
+			"user-default-password": {"pwd1", true, 1},
+			"user-admin-username":   {"admin", true, 1},
+			"user-admin-password":   {"adminpwd", true, 1},
+			"user-admin-tag":        {"administrator", true, 1},
+			"user-old-password":     {"disabled", false, 1},
+			"unrelated":             {"value", true, 1},
+		}
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Header.Get("Authorization")).To(Equal("Bearer my-token"))
+			mu.Lock()
+			defer mu.Unlock()
+			if r.URL.Path == "/secrets" {
+				// Every page contains a single secret.
+				var names []string
+				for name := range secrets {
+					names = append(names, name)
+				}
+				slices.Sort(names)
+				page := 0
+				if p := r.URL.Query().Get("page"); p != "" {
+					page, _ = strconv.Atoi(p)
+				}
+				s := secrets[names[page]]
+				result := map[string]any{"value": []map[string]any{{
+					"id":         server.URL + "/secrets/" + names[page],
+					"attributes": map[string]any{"enabled": s.enabled, "updated": s.updated},
+				}}}
+				if page+1 < len(names) {
+					result["nextLink"] = server.URL + "/secrets?api-version=7.4&page=" + strconv.Itoa(page+1)
+				}
+				Expect(json.NewEncoder(w).Encode(result)).To(Succeed())
+				return
+			}
+			Expect(r.URL.Query().Get("api-version")).To(Equal("7.4"))
+			s, ok := secrets[strings.TrimPrefix(r.URL.Path, "/secrets/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			Expect(json.NewEncoder(w).Encode(map[string]any{"value": s.value})).To(Succeed())
+		}))
+		DeferCleanup(server.Close)
+
+		source = &AzureKeyVaultSource{
+			VaultURL:     server.URL,
+			PollInterval: 50 * time.Millisecond,
+			Token: func(context.Context) (string, error) {
+				return "my-token", nil
+			},
+			Client: server.Client(),
+			Log:    initLogging(),
+		}
+	})
+
+	It("reads the enabled user secrets of all pages", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+	})
+
+	It("reports updated secrets", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		changes := make(chan struct{}, 10)
+		go func() {
+			_ = source.Watch(ctx, func() { changes <- struct{}{} })
+		}()
+		Eventually(changes).Should(Receive())
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		mu.Lock()
+		secrets["user-default-password"] = secret{"pwd2", true, 2}
+		mu.Unlock()
+		Eventually(changes).Should(Receive())
+		credentials, err := source.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials["default"].Password).To(Equal("pwd2"))
+	})
+})
@@ -0,0 +1,50 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupToStdout is the BackupDir that writes backups to stdout instead of a file.
+const backupToStdout = "-"
+
+// backupDefinitions exports the users, permissions and topic permissions of the RabbitMQ server
+// to a timestamped file in BackupDir, once per sync before the first update, so that operators can
+// restore them (e.g. with rabbitmqctl import_definitions) if bad credentials were applied.
+func (u *PasswordUpdater) backupDefinitions(ctx context.Context) error {
+	if u.BackupDir == "" || u.backedUp {
+		return nil
+	}
+	var defs Definitions
+	err := u.retry(ctx, http.MethodGet+" /api/definitions", func() (err error) {
+		defs, err = u.adminClient.ExportDefinitions(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export definitions for backup: %w", err)
+	}
+	content, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal definitions for backup: %w", err)
+	}
+	file := backupToStdout
+	if u.BackupDir == backupToStdout {
+		if _, err := os.Stdout.Write(append(content, '\n')); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+	} else {
+		// The backup contains password hashes.
+		file = filepath.Join(u.BackupDir, "definitions-"+time.Now().UTC().Format("20060102T150405.000Z")+".json")
+		if err := os.WriteFile(file, content, 0600); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+	}
+	u.backedUp = true
+	u.Log.V(0).Info("backed up users and permissions", "file", file, "users", len(defs.Users))
+	return nil
+}
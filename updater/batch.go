@@ -0,0 +1,129 @@
+package updater
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// Definitions is a partial definitions document with users and their permissions,
+// which is imported with POST /api/definitions, see BatchUpdates.
+type Definitions struct {
+	Users            []rabbithole.UserInfo            `json:"users"`
+	Permissions      []rabbithole.PermissionInfo      `json:"permissions"`
+	TopicPermissions []rabbithole.TopicPermissionInfo `json:"topic_permissions,omitempty"`
+}
+
+// isBatchable returns true if cred can be updated by importing definitions. The admin user is
+// updated on its own, since the admin file is updated with it, as are the ServiceUserID (whose
+// credentials are verified before and after the update), disabled and deleted users
+// and users with limits. Users without permissions of their own are not batched either, since
+// only new users are granted the DefaultPermissions.
+func (u *PasswordUpdater) isBatchable(userID string, cred UserCredentials) bool {
+	return !u.isClientUser(userID) && !cred.Disabled && !cred.Deleted && !cred.Passwordless && len(cred.Permissions) > 0 &&
+		len(cred.Limits) == 0 && len(cred.VHostLimits) == 0
+}
+
+// userDefinition returns the definition of cred, with its password hashed like RabbitMQ does,
+// or false if the password cannot be hashed with its hashing algorithm (e.g. MD5).
+func (u *PasswordUpdater) userDefinition(cred UserCredentials) (rabbithole.UserInfo, bool) {
+	user := rabbithole.UserInfo{
+		Name:             cred.Username,
+		PasswordHash:     cred.PasswordHash,
+		HashingAlgorithm: cmp.Or(cred.HashingAlgorithm, rabbithole.HashingAlgorithmSHA256),
+		Tags:             normalizeTags(cred.Tag),
+	}
+	if cred.Password == "" {
+		return user, true
+	}
+	user.HashingAlgorithm = atLeast(user.HashingAlgorithm, u.MinHashingAlgorithm)
+	switch user.HashingAlgorithm {
+	case rabbithole.HashingAlgorithmSHA256:
+		user.PasswordHash = rabbithole.Base64EncodedSaltedPasswordHashSHA256(cred.Password)
+	case rabbithole.HashingAlgorithmSHA512:
+		user.PasswordHash = rabbithole.Base64EncodedSaltedPasswordHashSHA512(cred.Password)
+	default:
+		return rabbithole.UserInfo{}, false
+	}
+	return user, true
+}
+
+// importDefinitions updates the batchable users of pending, with their permissions and topic permissions,
+// by importing definitions in a single request, and returns their userIDs. If the import fails, e.g.
+// because the endpoint is not available, nothing is returned, so that the users are updated one by one.
+func (u *PasswordUpdater) importDefinitions(ctx context.Context, pending map[string]UserCredentials) map[string]bool {
+	if !u.broker.supports(hashingAlgorithmVersion) {
+		// Older brokers would import the users without their hashing algorithm.
+		u.Log.V(1).Info("definitions import is not supported by RabbitMQ, updating users one by one",
+			"version", u.broker.version.String())
+		return nil
+	}
+	var defs Definitions
+	batched := make(map[string]bool)
+	for _, userID := range slices.Sorted(maps.Keys(pending)) {
+		cred := pending[userID]
+		if !u.isBatchable(userID, cred) {
+			continue
+		}
+		user, ok := u.userDefinition(cred)
+		if !ok {
+			continue
+		}
+		defs.Users = append(defs.Users, user)
+		for _, vhost := range slices.Sorted(maps.Keys(cred.Permissions)) {
+			p := cred.Permissions[vhost]
+			defs.Permissions = append(defs.Permissions, rabbithole.PermissionInfo{
+				User: cred.Username, Vhost: vhost, Configure: p.Configure, Write: p.Write, Read: p.Read,
+			})
+		}
+		for _, p := range cred.TopicPermissions {
+			defs.TopicPermissions = append(defs.TopicPermissions, rabbithole.TopicPermissionInfo{
+				User: cred.Username, Vhost: p.VHost, Exchange: p.Exchange, Write: p.Write, Read: p.Read,
+			})
+		}
+		batched[userID] = true
+	}
+	if len(batched) == 0 {
+		return nil
+	}
+	if !u.broker.supports(topicPermissionsVersion) {
+		defs.TopicPermissions = nil
+	}
+
+	if u.CreateVhosts {
+		vhosts := make(map[string]bool)
+		for _, p := range defs.Permissions {
+			vhosts[p.Vhost] = true
+		}
+		for _, p := range defs.TopicPermissions {
+			vhosts[p.Vhost] = true
+		}
+		for _, vhost := range slices.Sorted(maps.Keys(vhosts)) {
+			if err := u.ensureVhost(ctx, vhost); err != nil {
+				u.Log.Error(err, "failed to create vhost for definitions import, updating users one by one")
+				return nil
+			}
+		}
+	}
+	var resp *http.Response
+	err := u.retry(ctx, http.MethodPost+" /api/definitions", func() (err error) {
+		resp, err = u.adminClient.UploadDefinitions(ctx, defs)
+		return err
+	})
+	if err != nil {
+		u.Log.Error(err, "failed to import definitions, updating users one by one", "users", len(batched))
+		return nil
+	}
+	u.Log.V(2).Info("HTTP response", "method", http.MethodPost, "path", "/api/definitions", "status", resp.Status)
+	u.Log.V(0).Info("imported users on RabbitMQ server", "users", len(batched))
+	if u.CloseConnections {
+		for _, userID := range slices.Sorted(maps.Keys(batched)) {
+			u.closeConnections(ctx, pending[userID].Username)
+		}
+	}
+	return batched
+}
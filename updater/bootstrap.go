@@ -0,0 +1,93 @@
+package updater
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// administratorTag is the user tag that grants access to the whole Management API.
+const administratorTag = "administrator"
+
+// bootstrapAdmin creates the admin user with the credentials of BootstrapUserID, e.g. the default user
+// of the cluster operator, if RabbitMQ rejects the admin credentials because the admin user does not
+// exist yet, e.g. on a fresh broker. The admin user gets the administrator tag and its permissions
+// (or those of new users). If the admin user exists, its credentials are left alone.
+func (u *PasswordUpdater) bootstrapAdmin(ctx context.Context) error {
+	admin := u.CredentialState[adminUserID]
+	if u.BootstrapUserID == "" || !admin.hasPassword() {
+		return nil
+	}
+	u.authClient.SetUsername(admin.Username)
+	u.authClient.SetPassword(admin.Password)
+	err := u.retry(ctx, http.MethodGet+" /api/whoami", func() (err error) {
+		_, err = u.authClient.Whoami(ctx)
+		return err
+	})
+	if err == nil || err.Error() != errUnauthorized {
+		// Other failures, e.g. an unreachable broker, are left to the regular updates.
+		return nil
+	}
+	seed := u.CredentialState[u.BootstrapUserID]
+	if !seed.hasPassword() {
+		return fmt.Errorf("%w: RabbitMQ rejects the admin credentials and there are no credentials of the bootstrap user %q",
+			ErrInvalidAdminCredentials, u.BootstrapUserID)
+	}
+	u.adminClient.SetUsername(seed.Username)
+	u.adminClient.SetPassword(seed.Password)
+	defer u.setClientCredentials()
+
+	pathUsers := "/api/users/" + admin.Username
+	err = u.retry(ctx, http.MethodGet+" "+pathUsers, func() (err error) {
+		_, err = u.adminClient.GetUser(ctx, admin.Username)
+		return err
+	})
+	if err == nil {
+		u.Log.V(0).Info("RabbitMQ rejects the admin credentials although the admin user exists, not bootstrapping it",
+			"user", admin.Username)
+		return nil
+	}
+	if err.Error() != errNotFound {
+		return bootstrapError(err)
+	}
+
+	tags := normalizeTags(admin.Tag)
+	if !slices.Contains(tags, administratorTag) {
+		tags = append(tags, administratorTag)
+	}
+	settings := rabbithole.UserSettings{
+		Name:             admin.Username,
+		Tags:             tags,
+		Password:         admin.Password,
+		HashingAlgorithm: atLeast(cmp.Or(admin.HashingAlgorithm, rabbithole.HashingAlgorithmSHA256), u.MinHashingAlgorithm),
+	}
+	err = u.retry(ctx, http.MethodPut+" "+pathUsers, func() (err error) {
+		_, err = u.adminClient.PutUser(ctx, admin.Username, settings)
+		return err
+	})
+	if err != nil {
+		return bootstrapError(err)
+	}
+	permissions := admin.Permissions
+	if len(permissions) == 0 {
+		permissions = u.newUserPermissions(admin.Tag)
+	}
+	if err := u.updatePermissions(ctx, admin.Username, permissions, admin.TopicPermissions); err != nil {
+		return bootstrapError(err)
+	}
+	u.Log.V(0).Info("bootstrapped admin user on RabbitMQ server", "user", admin.Username, "bootstrapUser", seed.Username)
+	return nil
+}
+
+// bootstrapError classifies a failure to bootstrap the admin user, like adminAuthError.
+func bootstrapError(err error) error {
+	if isTransient(err) || errors.Is(err, ErrCircuitOpen) {
+		return fmt.Errorf("%w: failed to bootstrap admin user: %w", ErrBrokerUnreachable, err)
+	}
+	return fmt.Errorf("%w: failed to bootstrap admin user: %w", ErrInvalidAdminCredentials, err)
+}
@@ -0,0 +1,124 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// pluginPrefix prefixes the names of the applications of RabbitMQ plugins.
+const pluginPrefix = "rabbitmq_"
+
+// Versions of RabbitMQ that introduced Management API features which are not available on older brokers.
+var (
+	// hashingAlgorithmVersion introduced the hashing algorithm of users, e.g. in imported definitions.
+	hashingAlgorithmVersion = RabbitMQVersion{3, 6, 0}
+	// topicPermissionsVersion introduced topic permissions.
+	topicPermissionsVersion = RabbitMQVersion{3, 7, 0}
+	// vhostLimitsVersion introduced /api/vhost-limits.
+	vhostLimitsVersion = RabbitMQVersion{3, 7, 0}
+	// userLimitsVersion introduced /api/user-limits.
+	userLimitsVersion = RabbitMQVersion{3, 8, 10}
+)
+
+// RabbitMQVersion is the major, minor and patch version of RabbitMQ.
+type RabbitMQVersion [3]int
+
+func (v RabbitMQVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// ParseRabbitMQVersion parses a RabbitMQ version such as 3.13.7, 3.12 or 4.0.0-rc.1,
+// or returns false if it cannot be parsed.
+func ParseRabbitMQVersion(s string) (RabbitMQVersion, bool) {
+	var v RabbitMQVersion
+	s, _, _ = strings.Cut(s, "-")
+	s, _, _ = strings.Cut(s, "+")
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > len(v) {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// brokerInfo is what RabbitMQ reported about itself at startup, see probeBroker.
+type brokerInfo struct {
+	// version is the RabbitMQ version, if it was detected.
+	version      RabbitMQVersion
+	versionKnown bool
+	// plugins are the enabled plugins, nil if they were not detected.
+	plugins []string
+}
+
+// supports returns true if the broker is at least version minVersion. A broker whose version
+// was not detected is assumed to be recent.
+func (b brokerInfo) supports(minVersion RabbitMQVersion) bool {
+	return !b.versionKnown || slices.Compare(b.version[:], minVersion[:]) >= 0
+}
+
+// checkBroker bootstraps the admin user, if needed, and probes the broker at startup. It returns
+// an error if the broker must not be operated on, see MinRabbitMQVersion and RequireInternalAuthBackend.
+func (u *PasswordUpdater) checkBroker(ctx context.Context) error {
+	u.setClientCredentials()
+	if err := u.bootstrapAdmin(ctx); err != nil {
+		return err
+	}
+	u.probeBroker(ctx)
+	if u.MinRabbitMQVersion != (RabbitMQVersion{}) && u.broker.versionKnown && !u.broker.supports(u.MinRabbitMQVersion) {
+		return fmt.Errorf("%w: RabbitMQ %s is older than the minimum version %s", ErrUnsupportedBroker,
+			u.broker.version, u.MinRabbitMQVersion)
+	}
+	return u.checkAuthBackends(ctx)
+}
+
+// probeBroker detects the RabbitMQ version (GET /api/overview) and the enabled plugins (GET /api/nodes),
+// so that features that the broker does not support are skipped instead of failing. Failures are logged,
+// the broker is then assumed to be recent.
+func (u *PasswordUpdater) probeBroker(ctx context.Context) {
+	err := u.retry(ctx, http.MethodGet+" /api/overview", func() error {
+		overview, err := u.adminClient.Overview(ctx)
+		if err != nil {
+			return err
+		}
+		if overview != nil {
+			u.broker.version, u.broker.versionKnown = ParseRabbitMQVersion(overview.RabbitMQVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		u.Log.V(1).Info("failed to detect RabbitMQ version, assuming a recent one", "error", err.Error())
+	}
+	err = u.retry(ctx, http.MethodGet+" /api/nodes", func() error {
+		nodes, err := u.adminClient.ListNodes(ctx)
+		if err != nil {
+			return err
+		}
+		plugins := []string{}
+		for _, node := range nodes {
+			for _, app := range node.ErlangApps {
+				if strings.HasPrefix(app.Name, pluginPrefix) && !slices.Contains(plugins, app.Name) {
+					plugins = append(plugins, app.Name)
+				}
+			}
+		}
+		slices.Sort(plugins)
+		u.broker.plugins = plugins
+		return nil
+	})
+	if err != nil {
+		u.Log.V(1).Info("failed to detect RabbitMQ plugins", "error", err.Error())
+	}
+	if u.broker.versionKnown {
+		u.Log.V(0).Info("detected RabbitMQ", "version", u.broker.version.String(), "plugins", u.broker.plugins)
+	}
+}
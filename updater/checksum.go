@@ -0,0 +1,35 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checksumFileSuffix is the extension of optional checksum files, e.g. user_default_password.sha256.
+const checksumFileSuffix = ".sha256"
+
+// verifyChecksumFile compares the SHA-256 checksum of content with the one in checksumFile,
+// as written by sha256sum (the file name after the hex digest is ignored). A missing
+// checksum file is not an error, the checksum is optional.
+func verifyChecksumFile(checksumFile string, content []byte) error {
+	checksum, err := os.ReadFile(checksumFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checksum: %w", err)
+	}
+	fields := strings.Fields(string(checksum))
+	if len(fields) == 0 {
+		return errors.New("empty checksum file")
+	}
+	sum := sha256.Sum256(content)
+	if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+		return errors.New("checksum mismatch, the file may be truncated or corrupted")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package updater_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("Checksum files", func() {
+	var (
+		dir    string
+		source DirectorySource
+	)
+
+	writeFile := func(name, content string) {
+		Expect(os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)).To(Succeed())
+	}
+
+	// load returns the loaded credentials. A rejected password is reported as failed to load.
+	load := func() map[string]UserCredentials {
+		credentials, err := source.Load(context.Background())
+		if credentials["default"].Password == "" {
+			Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_password"}}))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		return credentials
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		source = DirectorySource{Dir: dir, Log: initLogging()}
+		writeFile("user_default_username", "default")
+		writeFile("user_default_password", "pwd1")
+	})
+
+	It("accepts passwords without a checksum file", func() {
+		Expect(load()).To(Equal(map[string]UserCredentials{"default": {Username: "default", Password: "pwd1"}}))
+	})
+
+	It("accepts passwords with a matching checksum", func() {
+		// echo -n pwd1 | sha256sum
+		writeFile("user_default_password.sha256", "6eac1114aa783f6549327e7d01f63752995da7b31f1f37092b7dcb9f49cf5651  user_default_password\n")
+		Expect(load()).To(Equal(map[string]UserCredentials{"default": {Username: "default", Password: "pwd1"}}))
+	})
+
+	It("rejects truncated passwords", func() {
+		writeFile("user_default_password.sha256", "6eac1114aa783f6549327e7d01f63752995da7b31f1f37092b7dcb9f49cf5651\n")
+		writeFile("user_default_password", "pw")
+		Expect(load()).To(Equal(map[string]UserCredentials{"default": {Username: "default"}}))
+	})
+})
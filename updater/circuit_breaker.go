@@ -0,0 +1,120 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// ErrCircuitOpen is returned by a circuit breaker client while RabbitMQ is considered unavailable.
+var ErrCircuitOpen = errors.New("circuit breaker is open, RabbitMQ Management API is considered unavailable")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker intercepts the RabbitMQ Management API functions of a RabbitClient.
+// After threshold consecutive transient failures the circuit opens and all calls fail fast
+// with ErrCircuitOpen. Once the cooldown has passed, a single probe request is let through:
+// the circuit closes if it succeeds and opens again if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	log       logr.Logger
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreakerClient wraps client in a circuit breaker that opens after threshold
+// consecutive transient failures and probes RabbitMQ again after cooldown.
+// If threshold is not positive, client is returned unchanged.
+func NewCircuitBreakerClient(client RabbitClient, threshold int, cooldown time.Duration, log logr.Logger) RabbitClient {
+	if threshold <= 0 {
+		return client
+	}
+	breaker := &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		log:       log,
+	}
+	return &interceptedClient{RabbitClient: client, intercept: breaker.call}
+}
+
+// call runs fn if the circuit allows it and records the outcome.
+func (c *circuitBreaker) call(_ context.Context, fn func() error) error {
+	if !c.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	c.record(err)
+	return err
+}
+
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			return false
+		}
+		c.setState(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		// Only the single probe request is let through.
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the circuit state. Only transient errors count as failures,
+// other errors (e.g. 401 Unauthorized) prove that RabbitMQ is reachable.
+func (c *circuitBreaker) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil || !isTransient(err) {
+		c.failures = 0
+		if c.state != circuitClosed {
+			c.setState(circuitClosed)
+		}
+		return
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.threshold {
+		c.openedAt = time.Now()
+		if c.state != circuitOpen {
+			c.setState(circuitOpen)
+		}
+	}
+}
+
+func (c *circuitBreaker) setState(state circuitState) {
+	c.log.V(0).Info("circuit breaker state changed",
+		"from", c.state.String(),
+		"to", state.String(),
+		"consecutiveFailures", c.failures,
+		"cooldown", c.cooldown.String())
+	c.state = state
+}
@@ -0,0 +1,75 @@
+package updater_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("CircuitBreakerClient", func() {
+	const cooldown = 50 * time.Millisecond
+	var (
+		ctx            = context.Background()
+		fakeClient     *fakeRabbitClient
+		client         RabbitClient
+		errUnavailable = rabbithole.ErrorResponse{StatusCode: http.StatusServiceUnavailable}
+	)
+
+	BeforeEach(func() {
+		fakeClient = &fakeRabbitClient{whoamiReturn: whoamiReturn{err: errUnavailable}}
+		client = NewCircuitBreakerClient(fakeClient, 2, cooldown, initLogging())
+	})
+
+	It("opens after consecutive transient failures", func() {
+		_, err := client.Whoami(ctx)
+		Expect(err).To(Equal(errUnavailable))
+		_, err = client.Whoami(ctx)
+		Expect(err).To(Equal(errUnavailable))
+
+		_, err = client.Whoami(ctx)
+		Expect(err).To(MatchError(ErrCircuitOpen))
+		Expect(fakeClient.WhoamiCallCount()).To(Equal(2))
+	})
+
+	It("does not count non-transient errors as failures", func() {
+		fakeClient.whoamiReturn = whoamiReturn{err: errors.New("Error: API responded with a 401 Unauthorized")}
+		for range 3 {
+			_, err := client.Whoami(ctx)
+			Expect(err).NotTo(MatchError(ErrCircuitOpen))
+		}
+		Expect(fakeClient.WhoamiCallCount()).To(Equal(3))
+	})
+
+	When("the circuit is open", func() {
+		BeforeEach(func() {
+			_, _ = client.Whoami(ctx)
+			_, _ = client.Whoami(ctx)
+			_, err := client.Whoami(ctx)
+			Expect(err).To(MatchError(ErrCircuitOpen))
+			time.Sleep(cooldown)
+		})
+
+		It("closes if the probe request after the cooldown succeeds", func() {
+			fakeClient.whoamiReturn = whoamiReturn{}
+			_, err := client.Whoami(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.Whoami(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.WhoamiCallCount()).To(Equal(4))
+		})
+
+		It("opens again if the probe request after the cooldown fails", func() {
+			_, err := client.Whoami(ctx)
+			Expect(err).To(Equal(errUnavailable))
+			_, err = client.Whoami(ctx)
+			Expect(err).To(MatchError(ErrCircuitOpen))
+			Expect(fakeClient.WhoamiCallCount()).To(Equal(3))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package updater
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// Keys of the default user in rabbitmq.conf.
+const (
+	defaultUserKey = "default_user"
+	defaultPassKey = "default_pass"
+)
+
+// Default keys of FileFormatEnv.
+const (
+	envUsernameKey = "RABBITMQ_USERNAME"
+	envPasswordKey = "RABBITMQ_PASSWORD"
+)
+
+// configFileBackupSuffix is appended to the path of a ConfigFile to back up its previous content.
+const configFileBackupSuffix = ".bak"
+
+// ConfigFile is a CredentialSink that keeps keys of a configuration file in sync with the credentials of
+// a user, e.g. /etc/rabbitmq/conf.d/11-default_user.conf of the cluster operator, or the configuration file
+// of an application.
+type ConfigFile struct {
+	Path string
+	// Format defaults to FileFormatConf.
+	Format FileFormat
+	// Section is the section (or TOML table) of the keys, DefaultAdminFileSection by default.
+	// FileFormatConf and FileFormatEnv have no sections.
+	Section string
+	// UsernameKey and PasswordKey default to default_user and default_pass with FileFormatConf,
+	// to RABBITMQ_USERNAME and RABBITMQ_PASSWORD with FileFormatEnv, and to DefaultAdminFileUsernameKey
+	// and DefaultAdminFilePasswordKey otherwise.
+	UsernameKey string
+	PasswordKey string
+}
+
+// Check returns true if the file already contains the username and password of cred.
+func (f ConfigFile) Check(_ context.Context, cred UserCredentials) (bool, error) {
+	content, updated, _, err := f.edit(cred)
+	return err == nil && updated == content, err
+}
+
+// Write sets the username and password keys in the file, see editConfig. The previous content is
+// backed up and the file is replaced atomically, keeping its permissions.
+func (f ConfigFile) Write(_ context.Context, cred UserCredentials) error {
+	content, updated, existed, err := f.edit(cred)
+	if err != nil || updated == content {
+		return err
+	}
+	mode := fs.FileMode(0600)
+	if info, err := os.Stat(f.Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if existed {
+		if err := os.WriteFile(f.Path+configFileBackupSuffix, []byte(content), mode); err != nil {
+			return fmt.Errorf("failed to back up config file: %w", err)
+		}
+	}
+	if err := replaceFile(f.Path, updated, mode); err != nil {
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return nil
+}
+
+func (f ConfigFile) String() string {
+	return f.Path
+}
+
+// edit returns the current content of the file and the content with the credentials of cred.
+func (f ConfigFile) edit(cred UserCredentials) (content, updated string, existed bool, err error) {
+	if strings.ContainsAny(cred.Username+cred.Password, "\r\n") {
+		return "", "", false, errors.New("credentials containing line breaks cannot be written to a config file")
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", "", false, fmt.Errorf("failed to read config file: %w", err)
+	}
+	section, usernameKey, passwordKey := "", defaultUserKey, defaultPassKey
+	switch f.Format {
+	case "", FileFormatConf:
+	case FileFormatEnv:
+		usernameKey, passwordKey = envUsernameKey, envPasswordKey
+	default:
+		section = cmp.Or(f.Section, DefaultAdminFileSection)
+		usernameKey, passwordKey = DefaultAdminFileUsernameKey, DefaultAdminFilePasswordKey
+	}
+	keys := []string{cmp.Or(f.UsernameKey, usernameKey), cmp.Or(f.PasswordKey, passwordKey)}
+	values := map[string]any{keys[0]: cred.Username, keys[1]: cred.Password}
+	return string(data), editConfig(string(data), section, keys, values, f.Format.syntax()), err == nil, nil
+}
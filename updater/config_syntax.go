@@ -0,0 +1,374 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FileFormat is the format of a configuration file that credentials are written to.
+type FileFormat string
+
+const (
+	// FileFormatConf is the sysctl format of rabbitmq.conf, which has no sections.
+	FileFormatConf FileFormat = "conf"
+	// FileFormatINI is e.g. the .rabbitmqadmin.conf of rabbitmqadmin v1.
+	FileFormatINI FileFormat = "ini"
+	// FileFormatTOML is e.g. the rabbitmqadmin.conf of rabbitmqadmin v2, which has a table per node.
+	FileFormatTOML FileFormat = "toml"
+	// FileFormatEnv is a file of shell variable assignments, which has no sections, e.g. sourced by
+	// the entrypoint of a sidecar container.
+	FileFormatEnv FileFormat = "env"
+)
+
+// configLine is a line of a configuration file. Only sections and keys with their values (as
+// formatted by fmt.Sprint) are parsed, all other lines are preserved as is.
+type configLine struct {
+	text    string
+	section string
+	key     string
+	value   string
+}
+
+// configSyntax parses and formats the lines of a configuration file format.
+type configSyntax struct {
+	parse func(content string) []configLine
+	// header is nil for formats without sections.
+	header func(section string) string
+	entry  func(key string, value any) string
+	// foldCase is set if keys are case-insensitive; parse returns them in lower case.
+	foldCase bool
+}
+
+// normalize returns key as returned by parse.
+func (s configSyntax) normalize(key string) string {
+	if s.foldCase {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// syntax returns the configSyntax of the file format.
+func (f FileFormat) syntax() configSyntax {
+	switch f {
+	case FileFormatINI:
+		return configSyntax{parse: parseINI, header: iniHeader, entry: iniEntry, foldCase: true}
+	case FileFormatTOML:
+		return configSyntax{parse: parseTOML, header: tomlHeader, entry: tomlEntry}
+	case FileFormatEnv:
+		return configSyntax{parse: parseEnv, entry: envEntry}
+	default:
+		return configSyntax{parse: parseConf, entry: confEntry}
+	}
+}
+
+// splitLines splits content into lines without the trailing line break.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// readConfigFile returns the values of section in the configuration file at path.
+// A missing file has no values.
+func readConfigFile(path, section string, syntax configSyntax) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range syntax.parse(string(content)) {
+		if line.section == section && line.key != "" {
+			values[line.key] = line.value
+		}
+	}
+	return values, nil
+}
+
+// updateConfigFile sets keys of section in the configuration file at path, see editConfig. If the file
+// does not exist, it creates a new one. It is replaced atomically, keeping its permissions, see replaceFile.
+func updateConfigFile(path, section string, keys []string, values map[string]any, syntax configSyntax) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	mode := fs.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return replaceFile(path, editConfig(string(content), section, keys, values, syntax), mode)
+}
+
+// editConfig sets the keys (in order) of section in content to values (strings, integers or booleans),
+// preserving all other lines byte by byte. Keys that occur several times are all updated, since the last
+// one usually wins. Missing keys are added to the end of the section, a missing section to the end of the file.
+func editConfig(content, section string, keys []string, values map[string]any, syntax configSyntax) string {
+	lines := syntax.parse(content)
+	normalized := make(map[string]any, len(values))
+	for key, value := range values {
+		normalized[syntax.normalize(key)] = value
+	}
+	written := make(map[string]bool, len(keys))
+	// end is the index after the last non-empty line of the section, -1 if it does not exist.
+	end := -1
+	for i, line := range lines {
+		if line.section != section {
+			continue
+		}
+		if strings.TrimSpace(line.text) != "" {
+			end = i + 1
+		}
+		if value, ok := normalized[line.key]; ok && line.key != "" {
+			if line.value != fmt.Sprint(value) {
+				indent := line.text[:len(line.text)-len(strings.TrimLeft(line.text, " \t"))]
+				lines[i].text = indent + syntax.entry(line.key, value)
+			}
+			written[line.key] = true
+		}
+	}
+	var missing []configLine
+	for _, key := range keys {
+		if !written[syntax.normalize(key)] {
+			missing = append(missing, configLine{text: syntax.entry(key, values[key])})
+		}
+	}
+	switch {
+	case end < 0 && syntax.header != nil:
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1].text) != "" {
+			lines = append(lines, configLine{})
+		}
+		lines = append(lines, configLine{text: syntax.header(section)})
+		lines = append(lines, missing...)
+	case end < 0:
+		lines = append(lines, missing...)
+	case len(missing) > 0:
+		lines = append(lines[:end], append(missing, lines[end:]...)...)
+	}
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.text
+	}
+	return strings.Join(texts, "\n") + "\n"
+}
+
+// parseConf parses the sysctl format of rabbitmq.conf: values follow the first =, comments start with #.
+func parseConf(content string) []configLine {
+	var lines []configLine
+	for _, text := range splitLines(content) {
+		line := configLine{text: text}
+		trimmed := strings.TrimSpace(text)
+		if key, value, found := strings.Cut(trimmed, "="); found && !strings.HasPrefix(trimmed, "#") {
+			line.key, line.value = strings.TrimSpace(key), strings.TrimSpace(value)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func confEntry(key string, value any) string {
+	return key + " = " + fmt.Sprint(value)
+}
+
+// parseEnv parses shell variable assignments (optionally exported), unquoting their values.
+// Command substitutions and variable expansions are not supported.
+func parseEnv(content string) []configLine {
+	var lines []configLine
+	for _, text := range splitLines(content) {
+		line := configLine{text: text}
+		trimmed := strings.TrimPrefix(strings.TrimSpace(text), "export ")
+		if key, value, found := strings.Cut(trimmed, "="); found && !strings.HasPrefix(trimmed, "#") {
+			line.key, line.value = strings.TrimSpace(key), unquoteShell(value)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// envEntry returns the assignment of value in single quotes, so that it is never expanded.
+func envEntry(key string, value any) string {
+	return key + "=" + quoteShell(fmt.Sprint(value))
+}
+
+// quoteShell returns s in single quotes, ending and reopening them around single quotes of s.
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// unquoteShell removes the single and double quotes and backslash escapes of a shell word.
+func unquoteShell(s string) string {
+	var b strings.Builder
+	s = strings.TrimSpace(s)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\", s[i+1]) >= 0 {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// parseINI parses content like Python's configparser, which rabbitmqadmin v1 uses: values follow
+// the first = or :, without quotes or inline comments, and keys are case-insensitive.
+// Multi-line values are not supported.
+func parseINI(content string) []configLine {
+	var lines []configLine
+	var section string
+	for _, text := range splitLines(content) {
+		line := configLine{text: text}
+		trimmed := strings.TrimSpace(text)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";"):
+		case strings.HasPrefix(trimmed, "[") && strings.Contains(trimmed, "]"):
+			section, _, _ = strings.Cut(trimmed[1:], "]")
+		default:
+			if i := strings.IndexAny(trimmed, "=:"); i > 0 {
+				line.key = strings.ToLower(strings.TrimSpace(trimmed[:i]))
+				line.value = strings.TrimSpace(trimmed[i+1:])
+			}
+		}
+		line.section = section
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func iniHeader(section string) string {
+	return "[" + section + "]"
+}
+
+func iniEntry(key string, value any) string {
+	return key + " = " + fmt.Sprint(value)
+}
+
+// parseTOML records the tables of lines and their keys. The values of strings are unquoted,
+// other values are returned as is.
+func parseTOML(content string) []configLine {
+	var lines []configLine
+	var table string
+	for _, text := range splitLines(content) {
+		line := configLine{text: text}
+		trimmed := strings.TrimSpace(text)
+		switch {
+		case strings.HasPrefix(trimmed, "[["):
+			// Arrays of tables are not used by rabbitmqadmin.
+			table = ""
+		case strings.HasPrefix(trimmed, "["):
+			name, _, _ := strings.Cut(strings.TrimPrefix(trimmed, "["), "]")
+			table = unquoteTOMLKey(name)
+		default:
+			key, value, found := strings.Cut(trimmed, "=")
+			if found && !strings.HasPrefix(trimmed, "#") {
+				line.key = unquoteTOMLKey(key)
+				if s, ok := parseTOMLString(strings.TrimSpace(value)); ok {
+					line.value = s
+				} else {
+					// Comments cannot be part of other values than strings.
+					value, _, _ = strings.Cut(value, "#")
+					line.value = strings.TrimSpace(value)
+				}
+			}
+		}
+		line.section = table
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func tomlHeader(table string) string {
+	return "[" + quoteTOMLKey(table) + "]"
+}
+
+func tomlEntry(key string, value any) string {
+	if s, ok := value.(string); ok {
+		return quoteTOMLKey(key) + " = " + quoteTOMLString(s)
+	}
+	return quoteTOMLKey(key) + " = " + fmt.Sprint(value)
+}
+
+// unquoteTOMLKey returns the bare or quoted key (or table name) s without quotes.
+func unquoteTOMLKey(s string) string {
+	s = strings.TrimSpace(s)
+	if unquoted, ok := parseTOMLString(s); ok {
+		return unquoted
+	}
+	return s
+}
+
+// parseTOMLString parses a basic or literal string, optionally followed by a comment.
+func parseTOMLString(s string) (string, bool) {
+	if strings.HasPrefix(s, "'") {
+		value, rest, found := strings.Cut(s[1:], "'")
+		return value, found && isTOMLComment(rest)
+	}
+	if !strings.HasPrefix(s, `"`) {
+		return "", false
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			return value, err == nil && isTOMLComment(s[i+1:])
+		}
+	}
+	return "", false
+}
+
+func isTOMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// quoteTOMLString returns s as TOML basic string.
+func quoteTOMLString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// quoteTOMLKey returns key as bare key if possible, or as quoted key otherwise.
+func quoteTOMLKey(key string) string {
+	if key != "" && strings.IndexFunc(key, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+	}) < 0 {
+		return key
+	}
+	return quoteTOMLString(key)
+}
@@ -0,0 +1,139 @@
+package updater
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// conjurTokenLifetime is shorter than the 8 minutes a Conjur access token is valid.
+const conjurTokenLifetime = 4 * time.Minute
+
+var errConjurNotFound = errors.New("variable not found")
+
+// ConjurSource reads credentials from CyberArk Conjur variables, authenticating as a host
+// with its API key. Every user has the variables <path>/username, <path>/password and
+// optionally <path>/tag. The variables are polled for changes.
+type ConjurSource struct {
+	// URL is the URL of the Conjur appliance, e.g. https://conjur.example.com.
+	URL     string
+	Account string
+	// Login is the host identity, e.g. host/rabbitmq/updater.
+	Login string
+	// APIKeyFile contains the API key of the host. It is read for every authentication.
+	APIKeyFile string
+	// Variables maps userIDs to variable paths, e.g. "default" to "rabbitmq/default".
+	Variables map[string]string
+	// PollInterval defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	Client       *http.Client
+	Log          logr.Logger
+
+	mu            sync.Mutex
+	token         string
+	authenticated time.Time
+}
+
+func (s *ConjurSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	credentials := make(map[string]UserCredentials, len(s.Variables))
+	for userID, path := range s.Variables {
+		var cred UserCredentials
+		for _, field := range []string{"username", "password", "tag"} {
+			value, err := s.variable(ctx, path+"/"+field)
+			if errors.Is(err, errConjurNotFound) && field == "tag" {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve variable %q: %w", path+"/"+field, err)
+			}
+			cred.set(field, strings.TrimSpace(value))
+		}
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch polls the variables.
+func (s *ConjurSource) Watch(ctx context.Context, changed func()) error {
+	return pollForChanges(ctx, pollInterval(s.PollInterval), s.Log, func(ctx context.Context) (string, error) {
+		credentials, err := s.Load(ctx)
+		if err != nil {
+			return "", err
+		}
+		return credentialsFingerprint(credentials), nil
+	}, changed)
+}
+
+func (s *ConjurSource) variable(ctx context.Context, id string) (string, error) {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate with Conjur: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/secrets/%s/variable/%s", strings.TrimSuffix(s.URL, "/"), url.PathEscape(s.Account), url.PathEscape(id)), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", `Token token="`+token+`"`)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return string(body), nil
+	case http.StatusNotFound:
+		return "", errConjurNotFound
+	case http.StatusUnauthorized:
+		// The token expired early, authenticate again with the next request.
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+	}
+	return "", fmt.Errorf("GET %s returned %s: %s", req.URL.Path, resp.Status, body)
+}
+
+// accessToken returns the base64 encoded access token, authenticating if necessary.
+func (s *ConjurSource) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Since(s.authenticated) < conjurTokenLifetime {
+		return s.token, nil
+	}
+	apiKey, err := os.ReadFile(s.APIKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API key: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%s/authn/%s/%s/authenticate", strings.TrimSuffix(s.URL, "/"), url.PathEscape(s.Account), url.PathEscape(s.Login)),
+		strings.NewReader(strings.TrimSpace(string(apiKey))))
+	if err != nil {
+		return "", err
+	}
+	body, err := doRequest(s.Client, req)
+	if err != nil {
+		return "", err
+	}
+	s.token = base64.StdEncoding.EncodeToString(body)
+	s.authenticated = time.Now()
+	return s.token, nil
+}
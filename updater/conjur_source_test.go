@@ -0,0 +1,113 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("ConjurSource", func() {
+	var (
+		source          *ConjurSource
+		mu              sync.Mutex
+		variables       map[string]string
+		authentications atomic.Int32
+	)
+
+	BeforeEach(func() {
+		variables = map[string]string{
+			"rabbitmq/default/username": "default",
+			"rabbitmq/default/password": "pwd1",
+			"rabbitmq/admin/username":   "admin",
+			"rabbitmq/admin/password":   "adminpwd",
+			"rabbitmq/admin/tag":        "administrator",
+		}
+		authentications.Store(0)
+		token := `{"protected":"abc","payload":"def","signature":"ghi"}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			if r.URL.Path == "/authn/myorg/host/rabbitmq/updater/authenticate" {
+				Expect(r.URL.EscapedPath()).To(Equal("/authn/myorg/host%2Frabbitmq%2Fupdater/authenticate"))
+				apiKey, err := io.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+				if string(apiKey) != "my-api-key" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				authentications.Add(1)
+				fmt.Fprint(w, token)
+				return
+			}
+			Expect(r.Header.Get("Authorization")).To(Equal(`Token token="` + base64.StdEncoding.EncodeToString([]byte(token)) + `"`))
+			id, found := strings.CutPrefix(r.URL.Path, "/secrets/myorg/variable/")
+			Expect(found).To(BeTrue())
+			mu.Lock()
+			defer mu.Unlock()
+			value, ok := variables[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, value)
+		}))
+		DeferCleanup(server.Close)
+
+		apiKeyFile := filepath.Join(GinkgoT().TempDir(), "api-key")
+		Expect(os.WriteFile(apiKeyFile, []byte("my-api-key\n"), 0600)).To(Succeed())
+		source = &ConjurSource{
+			URL:          server.URL,
+			Account:      "myorg",
+			Login:        "host/rabbitmq/updater",
+			APIKeyFile:   apiKeyFile,
+			Variables:    map[string]string{"default": "rabbitmq/default", "admin": "rabbitmq/admin"},
+			PollInterval: 50 * time.Millisecond,
+			Client:       server.Client(),
+			Log:          initLogging(),
+		}
+	})
+
+	It("reads the variables with a single authentication", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+		Expect(authentications.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("fails if a password is missing", func() {
+		delete(variables, "rabbitmq/default/password")
+		_, err := source.Load(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("rabbitmq/default/password")))
+	})
+
+	It("reports changed variables", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		changes := make(chan struct{}, 10)
+		go func() {
+			_ = source.Watch(ctx, func() { changes <- struct{}{} })
+		}()
+		Eventually(changes).Should(Receive())
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		mu.Lock()
+		variables["rabbitmq/default/password"] = "pwd2"
+		mu.Unlock()
+		Eventually(changes).Should(Receive())
+	})
+})
@@ -0,0 +1,95 @@
+package updater
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// connectionCloseReason is shown to clients whose connections are closed by closeConnections.
+const connectionCloseReason = "Credentials rotated by the credential updater, please reconnect"
+
+// pendingClose records the connections of a user that are closed once due, see CloseConnectionsDelay.
+type pendingClose struct {
+	username    string
+	connections []string
+	due         time.Time
+}
+
+// closeConnections closes all connections of username, e.g. after its password was changed,
+// so that clients have to reconnect with the new credentials. With CloseConnectionsDelay, only
+// the current connections are closed once the delay has passed, not those opened in the meantime,
+// e.g. with the new password. Failures are logged, since the credentials were updated nevertheless.
+func (u *PasswordUpdater) closeConnections(ctx context.Context, username string) {
+	var connections []rabbithole.UserConnectionInfo
+	err := u.retry(ctx, http.MethodGet+" /api/connections/username/"+url.PathEscape(username), func() (err error) {
+		connections, err = u.adminClient.ListConnectionsOfUser(ctx, username)
+		return err
+	})
+	if err != nil {
+		u.Log.Error(err, "failed to list connections of user", "user", username)
+		return
+	}
+	if len(connections) == 0 {
+		return
+	}
+	names := make([]string, 0, len(connections))
+	for _, connection := range connections {
+		names = append(names, connection.Name)
+	}
+	if u.CloseConnectionsDelay <= 0 {
+		u.closeConnectionNames(ctx, username, names)
+		return
+	}
+	u.Log.V(1).Info("scheduled closing connections of user", "user", username,
+		"connections", len(names), "delay", u.CloseConnectionsDelay.String())
+	u.pendingCloses = append(u.pendingCloses, pendingClose{username: username, connections: names, due: time.Now().Add(u.CloseConnectionsDelay)})
+	u.scheduleCloses()
+}
+
+// closePendingConnections closes the connections of pendingCloses that are due.
+func (u *PasswordUpdater) closePendingConnections(ctx context.Context) {
+	now := time.Now()
+	u.pendingCloses = slices.DeleteFunc(u.pendingCloses, func(p pendingClose) bool {
+		if now.Before(p.due) {
+			return false
+		}
+		u.closeConnectionNames(ctx, p.username, p.connections)
+		return true
+	})
+	u.scheduleCloses()
+}
+
+// scheduleCloses sets connectionCloses to receive a value when the earliest of pendingCloses is due.
+func (u *PasswordUpdater) scheduleCloses() {
+	u.connectionCloses = nil
+	if len(u.pendingCloses) == 0 {
+		return
+	}
+	next := slices.MinFunc(u.pendingCloses, func(a, b pendingClose) int { return a.due.Compare(b.due) })
+	u.connectionCloses = time.After(time.Until(next.due))
+}
+
+// closeConnectionNames closes the named connections of username.
+func (u *PasswordUpdater) closeConnectionNames(ctx context.Context, username string, names []string) {
+	closed := 0
+	for _, name := range names {
+		err := u.retry(ctx, http.MethodDelete+" /api/connections/"+url.PathEscape(name), func() (err error) {
+			_, err = u.adminClient.CloseConnection(ctx, name, connectionCloseReason)
+			return err
+		})
+		// The connection may have been closed by the client in the meantime.
+		if err != nil && err.Error() != errNotFound {
+			u.Log.Error(err, "failed to close connection of user", "user", username, "connection", name)
+			continue
+		}
+		closed++
+	}
+	if closed > 0 {
+		u.Log.V(0).Info("closed connections of user", "user", username, "connections", closed)
+	}
+}
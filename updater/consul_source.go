@@ -0,0 +1,140 @@
+package updater
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// consulWaitTime is the maximum duration of a blocking query.
+const consulWaitTime = 5 * time.Minute
+
+// ConsulSource reads credentials from the Consul KV keys <Prefix>/<userID>/username,
+// <Prefix>/<userID>/password and <Prefix>/<userID>/tag, and detects changes with blocking queries.
+type ConsulSource struct {
+	// Address is the URL of the Consul agent, e.g. http://127.0.0.1:8500.
+	Address string
+	Prefix  string
+	// TokenFile optionally contains an ACL token. It is read for every request.
+	TokenFile string
+	Client    *http.Client
+	Log       logr.Logger
+}
+
+type consulKeyValue struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+func (s *ConsulSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	kvs, _, err := s.list(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keys with prefix %q: %w", s.Prefix, err)
+	}
+	credentials := make(map[string]UserCredentials)
+	prefix := strings.Trim(s.Prefix, "/") + "/"
+	for _, kv := range kvs {
+		userID, field, found := strings.Cut(strings.TrimPrefix(kv.Key, prefix), "/")
+		if !found || userID == "" || (field != "username" && field != "password" && field != "tag") {
+			s.Log.V(1).Info("ignoring key with unexpected name format", "key", kv.Key)
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode value of key %q: %w", kv.Key, err)
+		}
+		cred := credentials[userID]
+		cred.set(field, strings.TrimSpace(string(value)))
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch runs blocking queries on the prefix and calls changed whenever the index changes.
+func (s *ConsulSource) Watch(ctx context.Context, changed func()) error {
+	delay := watchInitialDelay
+	var index uint64
+	for {
+		_, newIndex, err := s.list(ctx, index)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			s.Log.V(0).Info("failed to query keys, retrying", "prefix", s.Prefix, "delay", delay.String(), "error", err.Error())
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+			delay = min(2*delay, watchMaxDelay)
+			continue
+		}
+		delay = watchInitialDelay
+		if newIndex != index {
+			changed()
+		}
+		// The index must be reset if it goes backwards, e.g. after a snapshot restore.
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// list returns the keys with the prefix and the index of the result. If index is not zero,
+// the query blocks until the index changes or consulWaitTime has passed.
+func (s *ConsulSource) list(ctx context.Context, index uint64) ([]consulKeyValue, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWaitTime.String())
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, consulWaitTime+consulWaitTime/16+30*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(s.Address, "/")+"/v1/kv/"+strings.Trim(s.Prefix, "/")+"/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.TokenFile != "" {
+		token, err := os.ReadFile(s.TokenFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read ACL token: %w", err)
+		}
+		req.Header.Set("X-Consul-Token", strings.TrimSpace(string(token)))
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// There are no keys with the prefix (yet).
+		return nil, newIndex, nil
+	default:
+		return nil, 0, fmt.Errorf("GET %s returned %s: %s", req.URL.Path, resp.Status, body)
+	}
+	var kvs []consulKeyValue
+	if err := json.Unmarshal(body, &kvs); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode keys: %w", err)
+	}
+	return kvs, newIndex, nil
+}
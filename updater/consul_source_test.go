@@ -0,0 +1,115 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("ConsulSource", func() {
+	var (
+		source  *ConsulSource
+		mu      sync.Mutex
+		keys    map[string]string
+		index   int
+		updated chan struct{}
+	)
+
+	setKey := func(key, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys[key] = value
+		index++
+		close(updated)
+		updated = make(chan struct{})
+	}
+
+	BeforeEach(func() {
+		keys = map[string]string{
+			"rabbitmq/users/default/username": "default",
+			"rabbitmq/users/default/password": "pwd1",
+			"rabbitmq/users/admin/username":   "admin",
+			"rabbitmq/users/admin/password":   "adminpwd",
+			"rabbitmq/users/admin/tag":        "administrator",
+			"rabbitmq/users/admin/unrelated":  "value",
+		}
+		index = 5
+		updated = make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.URL.Path).To(Equal("/v1/kv/rabbitmq/users/"))
+			Expect(r.URL.Query().Get("recurse")).To(Equal("true"))
+			mu.Lock()
+			if r.URL.Query().Get("index") == fmt.Sprint(index) {
+				Expect(r.URL.Query().Get("wait")).To(Equal("5m0s"))
+				wait := updated
+				mu.Unlock()
+				select {
+				case <-wait:
+				case <-r.Context().Done():
+					return
+				}
+				mu.Lock()
+			}
+			defer mu.Unlock()
+			var names []string
+			for key := range keys {
+				names = append(names, key)
+			}
+			sort.Strings(names)
+			var kvs []map[string]string
+			for _, key := range names {
+				if strings.HasPrefix(key, "rabbitmq/users/") {
+					kvs = append(kvs, map[string]string{"Key": key, "Value": base64.StdEncoding.EncodeToString([]byte(keys[key]))})
+				}
+			}
+			w.Header().Set("X-Consul-Index", fmt.Sprint(index))
+			Expect(json.NewEncoder(w).Encode(kvs)).To(Succeed())
+		}))
+		DeferCleanup(server.Close)
+
+		source = &ConsulSource{
+			Address: server.URL,
+			Prefix:  "rabbitmq/users",
+			Client:  server.Client(),
+			Log:     initLogging(),
+		}
+	})
+
+	It("reads the keys with the prefix", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+	})
+
+	It("reports changes detected by blocking queries", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		changes := make(chan struct{}, 10)
+		go func() {
+			_ = source.Watch(ctx, func() { changes <- struct{}{} })
+		}()
+		Eventually(changes).Should(Receive())
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		setKey("rabbitmq/users/default/password", "pwd2")
+		Eventually(changes).Should(Receive())
+		credentials, err := source.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials["default"].Password).To(Equal("pwd2"))
+	})
+})
@@ -0,0 +1,79 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CredentialSink is a destination besides RabbitMQ that the credentials of a user are written to,
+// e.g. the AdminFile or a ConfigFile, see PasswordUpdater.Sinks.
+type CredentialSink interface {
+	// Check returns true if the sink already contains cred, so that it need not be written.
+	Check(ctx context.Context, cred UserCredentials) (bool, error)
+	// Write writes cred to the sink.
+	Write(ctx context.Context, cred UserCredentials) error
+}
+
+// AddSink registers sink for the credentials of userID.
+func (u *PasswordUpdater) AddSink(userID string, sink CredentialSink) {
+	if u.Sinks == nil {
+		u.Sinks = make(map[string][]CredentialSink)
+	}
+	u.Sinks[userID] = append(u.Sinks[userID], sink)
+}
+
+// sinks returns the CredentialSinks of userID: the AdminFile (if set) for the admin user, and the registered Sinks.
+func (u *PasswordUpdater) sinks(userID string) []CredentialSink {
+	if userID == adminUserID && u.AdminFile != "" {
+		return append([]CredentialSink{adminFileSink{u}}, u.Sinks[userID]...)
+	}
+	return u.Sinks[userID]
+}
+
+// syncSinks writes the credentials of userID to its sinks, unless they are already up-to-date.
+// Failures are only logged, since the credentials are applied in RabbitMQ nevertheless.
+func (u *PasswordUpdater) syncSinks(ctx context.Context, userID string, cred UserCredentials) {
+	if !cred.hasPassword() {
+		return
+	}
+	for _, sink := range u.sinks(userID) {
+		correct, err := sink.Check(ctx, cred)
+		if err != nil {
+			u.Log.Error(err, "failed to check credential sink", "sink", sink, "user", cred.Username)
+		}
+		if correct {
+			u.Log.V(2).Info("credential sink is already up-to-date", "sink", sink, "user", cred.Username)
+			continue
+		}
+		if err := sink.Write(ctx, cred); err != nil {
+			u.Log.Error(err, "failed to write credential sink", "sink", sink, "user", cred.Username)
+			continue
+		}
+		u.Log.V(1).Info("updated credential sink", "sink", sink, "user", cred.Username)
+	}
+}
+
+// replaceFile atomically replaces the file at path with content, via a temporary file in the same directory
+// with the given mode, so that readers never see a partially written file.
+func replaceFile(path, content string, mode fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,175 @@
+package updater
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Decrypter decrypts secret files in memory, so that plaintext credentials are not stored on disk.
+type Decrypter interface {
+	// Decrypt returns the plaintext of the file at path with the given content.
+	// ok is false if the file is not encrypted in the format of the Decrypter.
+	Decrypt(ctx context.Context, path string, content []byte) (plaintext []byte, ok bool, err error)
+}
+
+const (
+	// ageFileSuffix is the extension of age-encrypted files, e.g. user_default_password.age.
+	ageFileSuffix = ".age"
+	// systemdCredFileSuffix is the extension of credentials encrypted with systemd-creds encrypt,
+	// e.g. user_default_password.cred.
+	systemdCredFileSuffix = ".cred"
+)
+
+// trimEncryptedSuffix returns name without the extension of an encrypted file format,
+// and whether there was one.
+func trimEncryptedSuffix(name string) (string, bool) {
+	for _, suffix := range []string{ageFileSuffix, systemdCredFileSuffix} {
+		if key, found := strings.CutSuffix(name, suffix); found {
+			return key, true
+		}
+	}
+	return name, false
+}
+
+// decrypt returns the content decrypted by the first matching Decrypter, or content
+// unchanged if it is not encrypted. decrypted reports whether a Decrypter matched.
+func decrypt(ctx context.Context, path string, content []byte, decrypters []Decrypter) (plaintext []byte, decrypted bool, err error) {
+	for _, d := range decrypters {
+		plaintext, ok, err := d.Decrypt(ctx, path, content)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return plaintext, true, nil
+		}
+	}
+	return content, false, nil
+}
+
+// SOPSDecrypter decrypts SOPS-encrypted files with the sops binary, which supports all
+// key types (age, PGP and the cloud KMS). Files without an extension are stored by SOPS
+// in its binary format, a JSON document with the keys data and sops.
+// The keys are looked up by sops as usual, e.g. via $SOPS_AGE_KEY_FILE.
+// The sops binary is not part of the container image, see CheckCommand.
+type SOPSDecrypter struct {
+	// Command defaults to sops.
+	Command string
+}
+
+// CheckCommand returns an error if the sops binary cannot be found, so that a missing binary is
+// reported at startup rather than for every encrypted file.
+func (d SOPSDecrypter) CheckCommand() error {
+	return checkDecryptCommand(cmp.Or(d.Command, "sops"))
+}
+
+func (d SOPSDecrypter) Decrypt(ctx context.Context, path string, content []byte) ([]byte, bool, error) {
+	var document struct {
+		Sops json.RawMessage `json:"sops"`
+	}
+	if json.Unmarshal(content, &document) != nil || len(document.Sops) == 0 {
+		return nil, false, nil
+	}
+	plaintext, err := runDecryptCommand(ctx, cmp.Or(d.Command, "sops"), "--decrypt", "--input-type", "binary", "--output-type", "binary", path)
+	return plaintext, true, err
+}
+
+// AgeDecrypter decrypts files with the extension .age (binary or ASCII armored) with the identities
+// (private keys) in IdentityFile, e.g. encrypted credentials committed to a GitOps repository.
+// The IdentityFile is read for every file, so that identities can be rotated.
+type AgeDecrypter struct {
+	IdentityFile string
+}
+
+func (d AgeDecrypter) Decrypt(_ context.Context, path string, content []byte) ([]byte, bool, error) {
+	if !strings.HasSuffix(path, ageFileSuffix) {
+		return nil, false, nil
+	}
+	identities, err := readAgeIdentities(d.IdentityFile)
+	if err != nil {
+		return nil, true, err
+	}
+	var r io.Reader = bytes.NewReader(content)
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte(armor.Header)) {
+		r = armor.NewReader(r)
+	}
+	decrypted, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decrypt age file: %w", err)
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decrypt age file: %w", err)
+	}
+	return plaintext, true, nil
+}
+
+// readAgeIdentities parses the identities in path, one AGE-SECRET-KEY-1 per line.
+func readAgeIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identities: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identities: %w", err)
+	}
+	return identities, nil
+}
+
+// SystemdCredsDecrypter decrypts files with the extension .cred with systemd-creds, e.g.
+// credentials encrypted with the TPM2 or the host key of the machine via systemd-creds encrypt.
+// Credentials passed to the service with LoadCredentialEncrypted= or SetCredentialEncrypted=
+// are already decrypted by systemd into $CREDENTIALS_DIRECTORY and need no Decrypter.
+// The systemd-creds binary of the host is required, see CheckCommand.
+type SystemdCredsDecrypter struct {
+	// Command defaults to systemd-creds.
+	Command string
+}
+
+// CheckCommand returns an error if the systemd-creds binary cannot be found.
+func (d SystemdCredsDecrypter) CheckCommand() error {
+	return checkDecryptCommand(cmp.Or(d.Command, "systemd-creds"))
+}
+
+func (d SystemdCredsDecrypter) Decrypt(ctx context.Context, path string, _ []byte) ([]byte, bool, error) {
+	if !strings.HasSuffix(path, systemdCredFileSuffix) {
+		return nil, false, nil
+	}
+	// The credential name embedded during encryption must match, it defaults to the file name.
+	name := strings.TrimSuffix(filepath.Base(path), systemdCredFileSuffix)
+	plaintext, err := runDecryptCommand(ctx, cmp.Or(d.Command, "systemd-creds"), "decrypt", "--name="+name, path, "-")
+	return plaintext, true, err
+}
+
+// checkDecryptCommand returns an error if command is not an executable file in $PATH (or, if it
+// contains a slash, at its path).
+func checkDecryptCommand(command string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("%s is required to decrypt files, but not installed: %w", command, err)
+	}
+	return nil
+}
+
+// runDecryptCommand runs command and returns its output. The plaintext is only kept in memory.
+func runDecryptCommand(ctx context.Context, command string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,179 @@
+package updater_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("SOPSDecrypter", func() {
+	var (
+		dir    string
+		source DirectorySource
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		// The fake sops prints the value of the data key.
+		command := filepath.Join(GinkgoT().TempDir(), "sops")
+		Expect(os.WriteFile(command, []byte(`#!/bin/sh
+[ "$1 $2 $3 $4 $5" = "--decrypt --input-type binary --output-type binary" ] || exit 2
+grep -q '"mac": "invalid"' "$6" && { echo "MAC mismatch" >&2; exit 1; }
+sed -n 's/.*"data": "ENC\[\([^]]*\)\]".*/\1/p' "$6"
+`), 0755)).To(Succeed())
+		source = DirectorySource{Dir: dir, Decrypters: []Decrypter{SOPSDecrypter{Command: command}}, Log: initLogging()}
+	})
+
+	writeFile := func(name, content string) {
+		Expect(os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)).To(Succeed())
+	}
+
+	It("decrypts encrypted files and reads other files as is", func() {
+		writeFile("user_default_username", "default")
+		writeFile("user_default_password", `{"data": "ENC[pwd1]", "sops": {"mac": "valid"}}`)
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+		}))
+	})
+
+	It("skips files that cannot be decrypted", func() {
+		writeFile("user_default_username", "default")
+		writeFile("user_default_password", `{"data": "ENC[pwd1]", "sops": {"mac": "invalid"}}`)
+		credentials, err := source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_password"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default"},
+		}))
+	})
+
+	It("reports a missing sops binary", func() {
+		Expect(source.Decrypters[0].(SOPSDecrypter).CheckCommand()).To(Succeed())
+		missing := SOPSDecrypter{Command: filepath.Join(dir, "sops")}
+		Expect(missing.CheckCommand()).To(MatchError(ContainSubstring("is required to decrypt files, but not installed")))
+	})
+})
+
+var _ = Describe("AgeDecrypter", func() {
+	var (
+		dir      string
+		source   DirectorySource
+		identity *age.X25519Identity
+	)
+
+	encrypt := func(plaintext string, armored bool) []byte {
+		var buf bytes.Buffer
+		var out io.WriteCloser = nopWriteCloser{&buf}
+		if armored {
+			out = armor.NewWriter(&buf)
+		}
+		w, err := age.Encrypt(out, identity.Recipient())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = io.WriteString(w, plaintext)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		Expect(out.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		var err error
+		identity, err = age.GenerateX25519Identity()
+		Expect(err).NotTo(HaveOccurred())
+		identityFile := filepath.Join(GinkgoT().TempDir(), "identity")
+		Expect(os.WriteFile(identityFile, []byte("# created: today\n"+identity.String()+"\n"), 0600)).To(Succeed())
+		source = DirectorySource{Dir: dir, Decrypters: []Decrypter{AgeDecrypter{IdentityFile: identityFile}}, Log: initLogging()}
+		Expect(os.WriteFile(filepath.Join(dir, "user_default_username"), []byte("default"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "user_default_password.age"), encrypt("pwd1", false), 0600)).To(Succeed())
+	})
+
+	It("decrypts files with the extension .age", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+		}))
+	})
+
+	It("decrypts ASCII armored files", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "user_default_password.age"), encrypt("pwd2", true), 0600)).To(Succeed())
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd2"},
+		}))
+	})
+
+	It("skips files encrypted for other identities", func() {
+		var err error
+		identity, err = age.GenerateX25519Identity()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "user_default_password.age"), encrypt("pwd2", false), 0600)).To(Succeed())
+		credentials, err := source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_password.age"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default"},
+		}))
+	})
+
+	It("does not use encrypted files without identity", func() {
+		source.Decrypters = nil
+		credentials, err := source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_password.age"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default"},
+		}))
+	})
+})
+
+// nopWriteCloser is an io.WriteCloser for unarmored age files.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+var _ = Describe("SystemdCredsDecrypter", func() {
+	var (
+		dir    string
+		source DirectorySource
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		// The fake systemd-creds strips the "encrypted:" prefix if the credential name matches.
+		command := filepath.Join(GinkgoT().TempDir(), "systemd-creds")
+		Expect(os.WriteFile(command, []byte(`#!/bin/sh
+[ "$1 $2 $4" = "decrypt --name=user_default_password -" ] || exit 2
+sed -n 's/^encrypted://p' "$3"
+`), 0755)).To(Succeed())
+		source = DirectorySource{Dir: dir, Decrypters: []Decrypter{SystemdCredsDecrypter{Command: command}}, Log: initLogging()}
+		Expect(os.WriteFile(filepath.Join(dir, "user_default_username"), []byte("default"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "user_default_password.cred"), []byte("encrypted:pwd1"), 0600)).To(Succeed())
+	})
+
+	It("decrypts files with the extension .cred", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+		}))
+	})
+
+	It("reports a missing systemd-creds binary", func() {
+		Expect(source.Decrypters[0].(SystemdCredsDecrypter).CheckCommand()).To(Succeed())
+		missing := SystemdCredsDecrypter{Command: filepath.Join(dir, "systemd-creds")}
+		Expect(missing.CheckCommand()).To(MatchError(ContainSubstring("is required to decrypt files, but not installed")))
+	})
+})
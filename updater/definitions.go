@@ -0,0 +1,66 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// definitionsFile is a RabbitMQ definitions export (rabbitmqctl export_definitions or
+// GET /api/definitions) in the watch directory. Its users are reconciled with their password
+// hashes, tags and permissions, keyed by username as userID. Other definitions are ignored.
+const definitionsFile = "definitions.json"
+
+type definitions struct {
+	Users []struct {
+		Name             string                      `json:"name"`
+		PasswordHash     string                      `json:"password_hash"`
+		HashingAlgorithm rabbithole.HashingAlgorithm `json:"hashing_algorithm"`
+		// Tags is a list, or a comma separated string in older exports.
+		Tags json.RawMessage `json:"tags"`
+	} `json:"users"`
+	Permissions []struct {
+		User  string `json:"user"`
+		VHost string `json:"vhost"`
+		rabbithole.Permissions
+	} `json:"permissions"`
+}
+
+// parseDefinitions parses the content of definitionsFile into credentials keyed by userID.
+func parseDefinitions(content []byte) (map[string]UserCredentials, error) {
+	var defs definitions
+	if err := json.Unmarshal(content, &defs); err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]UserCredentials, len(defs.Users))
+	for _, user := range defs.Users {
+		var tags []string
+		if err := json.Unmarshal(user.Tags, &tags); err != nil {
+			var tag string
+			if len(user.Tags) > 0 && json.Unmarshal(user.Tags, &tag) != nil {
+				return nil, fmt.Errorf("user %q: invalid tags %s", user.Name, user.Tags)
+			}
+			tags = strings.Split(tag, ",")
+		}
+		credentials[user.Name] = UserCredentials{
+			Username:         user.Name,
+			PasswordHash:     user.PasswordHash,
+			HashingAlgorithm: user.HashingAlgorithm,
+			Tag:              strings.Join(tags, ","),
+		}
+	}
+	for _, permission := range defs.Permissions {
+		cred, ok := credentials[permission.User]
+		if !ok {
+			continue
+		}
+		if cred.Permissions == nil {
+			cred.Permissions = make(map[string]rabbithole.Permissions)
+		}
+		cred.Permissions[permission.VHost] = permission.Permissions
+		credentials[permission.User] = cred
+	}
+	return credentials, nil
+}
@@ -0,0 +1,49 @@
+package updater
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// disabledFileSuffix is the suffix of the optional marker file that suspends a user,
+// e.g. user_default_disabled, see UserCredentials.Disabled.
+const disabledFileSuffix = "_disabled"
+
+// disableUser sets the password of cred.Username to a random value that is not stored anywhere,
+// and removes its tags and all of its permissions and topic permissions. The user is kept,
+// so that it can be enabled again by removing the marker file.
+func (u *PasswordUpdater) disableUser(ctx context.Context, cred UserCredentials) error {
+	pathUsers := "/api/users/" + cred.Username
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Errorf("failed to generate random password: %w", err)
+	}
+	settings := rabbithole.UserSettings{
+		Name:             cred.Username,
+		Tags:             rabbithole.UserTags{},
+		Password:         hex.EncodeToString(random),
+		HashingAlgorithm: cmp.Or(u.MinHashingAlgorithm, rabbithole.HashingAlgorithmSHA256),
+	}
+	err := u.retry(ctx, http.MethodPut+" "+pathUsers, func() (err error) {
+		_, err = u.adminClient.PutUser(ctx, cred.Username, settings)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable user on RabbitMQ server: %w", err)
+	}
+
+	if err := u.clearPermissions(ctx, cred.Username); err != nil {
+		return err
+	}
+	if u.CloseConnections {
+		u.closeConnections(ctx, cred.Username)
+	}
+	u.Log.V(0).Info("disabled user on RabbitMQ server", "user", cred.Username)
+	return nil
+}
@@ -0,0 +1,40 @@
+package updater
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// hasDrifted returns true if the tags or the hashing algorithm of user on the RabbitMQ server differ
+// from cred, e.g. because they were changed with rabbitmqctl, although RabbitMQ accepts its password.
+func (u *PasswordUpdater) hasDrifted(user *rabbithole.UserInfo, cred UserCredentials) bool {
+	if !slices.Equal(normalizeTags(user.Tags...), normalizeTags(cred.Tag)) {
+		u.Log.V(0).Info("tags differ on RabbitMQ server, correcting them", "user", cred.Username,
+			"actual", strings.Join(user.Tags, ","), "expected", cred.Tag)
+		return true
+	}
+	expected := atLeast(cmp.Or(cred.HashingAlgorithm, user.HashingAlgorithm), u.MinHashingAlgorithm)
+	if user.HashingAlgorithm != expected {
+		u.Log.V(0).Info("hashing algorithm differs on RabbitMQ server, correcting it", "user", cred.Username,
+			"actual", user.HashingAlgorithm, "expected", expected)
+		return true
+	}
+	return false
+}
+
+// normalizeTags returns the sorted tags, which may be comma-separated, without empty ones.
+func normalizeTags(tags ...string) []string {
+	var normalized []string
+	for _, tag := range tags {
+		for _, t := range strings.Split(tag, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				normalized = append(normalized, t)
+			}
+		}
+	}
+	slices.Sort(normalized)
+	return normalized
+}
@@ -0,0 +1,33 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by NewPasswordUpdater and HandleEvents wrap one of the following errors
+// to classify why the updater cannot continue, e.g. to exit with distinct exit codes.
+var (
+	// ErrWatchDir means that the watch directory cannot be watched or read.
+	ErrWatchDir = errors.New("watch directory unreadable")
+	// ErrWatcher means that the file system watcher failed.
+	ErrWatcher = errors.New("file system watcher failed")
+	// ErrSource means that a WatchingSecretSource failed to watch for changes.
+	ErrSource = errors.New("credential source failed")
+	// ErrBrokerUnreachable means that the RabbitMQ Management API cannot be reached.
+	ErrBrokerUnreachable = errors.New("RabbitMQ Management API unreachable")
+	// ErrInvalidAdminCredentials means that the admin secret is incomplete or rejected by RabbitMQ.
+	ErrInvalidAdminCredentials = errors.New("invalid admin credentials")
+	// ErrAuthBackend means that the internal user database is not authoritative, see RequireInternalAuthBackend.
+	ErrAuthBackend = errors.New("internal auth backend not authoritative")
+	// ErrUnsupportedBroker means that RabbitMQ is older than MinRabbitMQVersion.
+	ErrUnsupportedBroker = errors.New("unsupported RabbitMQ version")
+)
+
+// adminAuthError classifies a failed authentication with the admin credentials.
+func adminAuthError(err error) error {
+	if isTransient(err) || errors.Is(err, ErrCircuitOpen) {
+		return fmt.Errorf("%w: failed to authenticate with current admin credentials: %w", ErrBrokerUnreachable, err)
+	}
+	return fmt.Errorf("%w: failed to authenticate with current admin credentials: %w", ErrInvalidAdminCredentials, err)
+}
@@ -0,0 +1,288 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+var errRevisionCompacted = errors.New("revision has been compacted")
+
+// EtcdSource reads credentials from the keys <Prefix>user_<id>_username, <Prefix>user_<id>_password
+// and <Prefix>user_<id>_tag in etcd, analogous to the files of DirectorySource, and watches
+// the prefix for changes. It uses the JSON gateway of the etcd v3 API.
+// Client certificates for mTLS are configured in Client.
+type EtcdSource struct {
+	// Endpoint is the URL of an etcd member, e.g. https://etcd:2379.
+	Endpoint string
+	// Prefix of the keys, e.g. /rabbitmq/.
+	Prefix string
+	// Username and PasswordFile optionally configure etcd authentication.
+	Username     string
+	PasswordFile string
+	Client       *http.Client
+	Log          logr.Logger
+
+	mu    sync.Mutex
+	token string
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (s *EtcdSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	var result struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.call(ctx, "/v3/kv/range", s.rangeRequest(), &result); err != nil {
+		return nil, fmt.Errorf("failed to get keys with prefix %q: %w", s.Prefix, err)
+	}
+	credentials := make(map[string]UserCredentials)
+	for _, kv := range result.KVs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key: %w", err)
+		}
+		userID, field, ok := parseSecretKey(strings.TrimPrefix(string(key), s.Prefix))
+		if !ok {
+			s.Log.V(1).Info("ignoring key with unexpected name format", "key", string(key))
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode value of key %q: %w", key, err)
+		}
+		cred := credentials[userID]
+		cred.set(field, strings.TrimSpace(string(value)))
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch watches the prefix, resuming after the last observed revision if the stream ends.
+func (s *EtcdSource) Watch(ctx context.Context, changed func()) error {
+	delay := watchInitialDelay
+	var revision int64
+	for {
+		if revision == 0 {
+			var err error
+			revision, err = s.revision(ctx)
+			if err != nil {
+				s.Log.V(0).Info("failed to get revision, retrying", "prefix", s.Prefix, "delay", delay.String(), "error", err.Error())
+				if err := sleep(ctx, delay); err != nil {
+					return err
+				}
+				delay = min(2*delay, watchMaxDelay)
+				continue
+			}
+			// Keys may have changed while not watching.
+			changed()
+		}
+		var err error
+		revision, err = s.watch(ctx, revision, changed)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errRevisionCompacted) {
+			s.Log.V(1).Info("watch revision compacted, reading keys again", "prefix", s.Prefix)
+			revision = 0
+			continue
+		}
+		if err != nil {
+			s.Log.V(0).Info("failed to watch keys, retrying", "prefix", s.Prefix, "delay", delay.String(), "error", err.Error())
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+			delay = min(2*delay, watchMaxDelay)
+			continue
+		}
+		delay = watchInitialDelay
+	}
+}
+
+// revision returns the current revision of the store.
+func (s *EtcdSource) revision(ctx context.Context) (int64, error) {
+	req := s.rangeRequest()
+	req["count_only"] = true
+	var result struct {
+		Header etcdHeader `json:"header"`
+	}
+	if err := s.call(ctx, "/v3/kv/range", req, &result); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(result.Header.Revision, 10, 64)
+}
+
+// watch streams watch responses for the changes after revision until the server closes the stream.
+// It returns the last observed revision.
+func (s *EtcdSource) watch(ctx context.Context, revision int64, changed func()) (int64, error) {
+	req := map[string]any{"create_request": map[string]any{
+		"key":            base64.StdEncoding.EncodeToString([]byte(s.Prefix)),
+		"range_end":      base64.StdEncoding.EncodeToString(prefixRangeEnd([]byte(s.Prefix))),
+		"start_revision": strconv.FormatInt(revision+1, 10),
+	}}
+	resp, err := s.post(ctx, "/v3/watch", req)
+	if err != nil {
+		return revision, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result struct {
+				Header          etcdHeader `json:"header"`
+				Canceled        bool       `json:"canceled"`
+				CancelReason    string     `json:"cancel_reason"`
+				CompactRevision string     `json:"compact_revision"`
+				Events          []struct {
+					KV etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(err, io.EOF) {
+				return revision, nil
+			}
+			return revision, err
+		}
+		if message.Error != nil {
+			return revision, errors.New(message.Error.Message)
+		}
+		result := message.Result
+		if result.CompactRevision != "" && result.CompactRevision != "0" {
+			return revision, errRevisionCompacted
+		}
+		if result.Canceled {
+			return revision, fmt.Errorf("watch canceled: %s", result.CancelReason)
+		}
+		if r, err := strconv.ParseInt(result.Header.Revision, 10, 64); err == nil && r > revision {
+			revision = r
+		}
+		if len(result.Events) > 0 {
+			s.Log.V(1).Info("keys changed", "prefix", s.Prefix, "events", len(result.Events), "revision", revision)
+			changed()
+		}
+	}
+}
+
+func (s *EtcdSource) rangeRequest() map[string]any {
+	return map[string]any{
+		"key":       base64.StdEncoding.EncodeToString([]byte(s.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd([]byte(s.Prefix))),
+	}
+}
+
+func (s *EtcdSource) call(ctx context.Context, path string, body any, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := s.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// post sends a request to the etcd API. The caller must close the response body.
+func (s *EtcdSource) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.Endpoint, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Username != "" {
+		token, err := s.authToken(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to authenticate with etcd: %w", err)
+		}
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			// The token expired, authenticate again with the next request.
+			s.mu.Lock()
+			s.token = ""
+			s.mu.Unlock()
+		}
+		return nil, fmt.Errorf("POST %s returned %s: %s", path, resp.Status, respBody)
+	}
+	return resp, nil
+}
+
+func (s *EtcdSource) authToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" {
+		return s.token, nil
+	}
+	password, err := os.ReadFile(s.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	payload, err := json.Marshal(map[string]string{"name": s.Username, "password": strings.TrimSpace(string(password))})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.Endpoint, "/")+"/v3/auth/authenticate", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	body, err := doRequest(s.Client, req)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+	s.token = result.Token
+	return s.token, nil
+}
+
+// prefixRangeEnd returns the range end to get all keys with prefix,
+// i.e. prefix with the last byte incremented.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All bytes are 0xff: the range ends with the last key.
+	return []byte{0}
+}
@@ -0,0 +1,171 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("EtcdSource", func() {
+	var (
+		source        *EtcdSource
+		mu            sync.Mutex
+		keys          map[string]string
+		revision      int
+		watchEvents   chan string
+		startRevision chan string
+		ranges        atomic.Int32
+	)
+
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	unb64 := func(s string) string {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		Expect(err).NotTo(HaveOccurred())
+		return string(decoded)
+	}
+
+	BeforeEach(func() {
+		keys = map[string]string{
+			"/rabbitmq/user_default_username": "default",
+			"/rabbitmq/user_default_password": "pwd1",
+			"/rabbitmq/user_admin_username":   "admin",
+			"/rabbitmq/user_admin_password":   "adminpwd",
+			"/rabbitmq/user_admin_tag":        "administrator",
+			"/rabbitmq/unrelated":             "value",
+			"/rabbitmr/user_other_password":   "outside of prefix",
+		}
+		revision = 10
+		watchEvents = make(chan string, 10)
+		startRevision = make(chan string, 10)
+		ranges.Store(0)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			if r.URL.Path == "/v3/auth/authenticate" {
+				var body map[string]string
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				Expect(body).To(Equal(map[string]string{"name": "updater", "password": "etcdpwd"}))
+				fmt.Fprint(w, `{"token":"my-token"}`)
+				return
+			}
+			Expect(r.Header.Get("Authorization")).To(Equal("my-token"))
+			switch r.URL.Path {
+			case "/v3/kv/range":
+				ranges.Add(1)
+				var body struct {
+					Key       string `json:"key"`
+					RangeEnd  string `json:"range_end"`
+					CountOnly bool   `json:"count_only"`
+				}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				Expect(unb64(body.Key)).To(Equal("/rabbitmq/"))
+				Expect(unb64(body.RangeEnd)).To(Equal("/rabbitmq0"))
+				mu.Lock()
+				defer mu.Unlock()
+				var kvs []map[string]string
+				if !body.CountOnly {
+					var names []string
+					for key := range keys {
+						if strings.HasPrefix(key, "/rabbitmq/") {
+							names = append(names, key)
+						}
+					}
+					sort.Strings(names)
+					for _, key := range names {
+						kvs = append(kvs, map[string]string{"key": b64(key), "value": b64(keys[key])})
+					}
+				}
+				Expect(json.NewEncoder(w).Encode(map[string]any{"header": map[string]string{"revision": fmt.Sprint(revision)}, "kvs": kvs})).To(Succeed())
+			case "/v3/watch":
+				var body struct {
+					CreateRequest struct {
+						StartRevision string `json:"start_revision"`
+					} `json:"create_request"`
+				}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				startRevision <- body.CreateRequest.StartRevision
+				fmt.Fprint(w, `{"result":{"header":{"revision":"10"},"created":true}}`+"\n")
+				w.(http.Flusher).Flush()
+				for {
+					select {
+					case event, ok := <-watchEvents:
+						if !ok {
+							return
+						}
+						fmt.Fprint(w, event+"\n")
+						w.(http.Flusher).Flush()
+					case <-r.Context().Done():
+						return
+					}
+				}
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		DeferCleanup(server.Close)
+
+		passwordFile := filepath.Join(GinkgoT().TempDir(), "password")
+		Expect(os.WriteFile(passwordFile, []byte("etcdpwd\n"), 0600)).To(Succeed())
+		source = &EtcdSource{
+			Endpoint:     server.URL,
+			Prefix:       "/rabbitmq/",
+			Username:     "updater",
+			PasswordFile: passwordFile,
+			Client:       server.Client(),
+			Log:          initLogging(),
+		}
+	})
+
+	It("reads the keys with the prefix", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+	})
+
+	When("watching", func() {
+		var changes chan struct{}
+
+		BeforeEach(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			changes = make(chan struct{}, 10)
+			go func() {
+				_ = source.Watch(ctx, func() { changes <- struct{}{} })
+			}()
+			DeferCleanup(cancel)
+			Eventually(startRevision).Should(Receive(Equal("11")))
+			Eventually(changes).Should(Receive())
+		})
+
+		It("reports changes and resumes after the last revision", func() {
+			watchEvents <- `{"result":{"header":{"revision":"12"},"events":[{"kv":{"key":"` + b64("/rabbitmq/user_default_password") + `","mod_revision":"12"}}]}}`
+			Eventually(changes).Should(Receive())
+
+			close(watchEvents)
+			Eventually(startRevision, 3*time.Second).Should(Receive(Equal("13")))
+			Expect(changes).NotTo(Receive())
+		})
+
+		It("reads the keys again if the revision was compacted", func() {
+			watchEvents <- `{"result":{"header":{"revision":"20"},"canceled":true,"compact_revision":"15"}}`
+			Eventually(startRevision).Should(Receive(Equal("11")))
+			Eventually(changes).Should(Receive())
+			Expect(ranges.Load()).To(BeEquivalentTo(2))
+		})
+	})
+})
@@ -1,24 +1,44 @@
 package updater
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-logr/logr"
 	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
-	"gopkg.in/ini.v1"
 )
 
 const (
-	userFilePrefix     = "user_"
-	passwordFileSuffix = "_password"
-	usernameFileSuffix = "_username"
-	tagFileSuffix      = "_tag"
-	adminFileSection   = "default"
+	userFilePrefix         = "user_"
+	passwordFileSuffix     = "_password"
+	passwordHashFileSuffix = "_password_hash"
+	// hashingAlgorithmFileSuffix is the suffix of the optional file with the hashing algorithm
+	// of a user, e.g. user_default_hashing_algorithm containing "sha512".
+	hashingAlgorithmFileSuffix = "_hashing_algorithm"
+	usernameFileSuffix         = "_username"
+	tagFileSuffix              = "_tag"
+	jsonFileSuffix             = ".json"
+	envFileSuffix              = ".env"
+	// kubernetesDataLink is the symlink that Kubernetes atomically swaps when
+	// updating the contents of a secret or projected volume.
+	kubernetesDataLink = "..data"
 	adminUserID        = "admin"
+
+	// Backoff bounds for re-adding the watch directory after it was removed.
+	rewatchInitialDelay = 100 * time.Millisecond
+	rewatchMaxDelay     = 30 * time.Second
 )
 
 var (
@@ -27,34 +47,272 @@ var (
 	defaultUserPermissions = rabbithole.Permissions{Configure: ".*", Write: ".*", Read: ".*"}
 )
 
+// DefaultPermissions is used by NewPasswordUpdater: full permissions in the vhost "/".
+var DefaultPermissions = map[string]rabbithole.Permissions{"/": defaultUserPermissions}
+
 // UserCredentials holds the plain‐text credentials read from a secret file group.
 type UserCredentials struct {
 	Username string
 	Password string
-	Tag      string
+	// PasswordHash is a RabbitMQ password hash, applied instead of Password if
+	// Password is empty. Since it cannot be used to authenticate, it is not supported for the admin user.
+	PasswordHash string
+	// HashingAlgorithm of PasswordHash, defaults to SHA-256. With Password, it overrides the
+	// algorithm of the existing user when the user is created or its password is updated.
+	HashingAlgorithm rabbithole.HashingAlgorithm
+	Tag              string
+	// Permissions are granted per vhost when the user is created or the permissions change.
+	// New users without permissions get the PermissionPresets of their tags or the DefaultPermissions
+	// of the PasswordUpdater.
+	Permissions map[string]rabbithole.Permissions
+	// TopicPermissions are granted when the user is created or they change.
+	TopicPermissions []TopicPermission
+	// Limits (max-connections, max-channels) are set when the user is created or they change.
+	Limits rabbithole.UserLimitsValues
+	// VHostLimits (max-connections, max-queues) are set per vhost along with the user's limits.
+	// If several users set limits of the same vhost, the last one applied wins.
+	VHostLimits map[string]rabbithole.VhostLimitsValues
+	// Disabled suspends the user: its password is set to a random value and its tags and
+	// permissions are removed, without deleting it. Once enabled again, the credentials are
+	// applied and users without permissions get the default permissions again.
+	Disabled bool
+	// Deleted deletes the user (and its permissions) from RabbitMQ, see deleteFileSuffix.
+	Deleted bool
+	// Passwordless users have no password and authenticate otherwise, e.g. with an x509 client
+	// certificate, see passwordlessFileSuffix. Password and PasswordHash are ignored; only the tags,
+	// permissions and limits are managed. The admin user cannot be passwordless.
+	Passwordless bool
+}
+
+// equal returns true if c and other contain the same credentials and permissions.
+func (c UserCredentials) equal(other UserCredentials) bool {
+	return c.Username == other.Username && c.Password == other.Password && c.PasswordHash == other.PasswordHash &&
+		c.HashingAlgorithm == other.HashingAlgorithm && c.Tag == other.Tag && maps.Equal(c.Permissions, other.Permissions) &&
+		slices.Equal(c.TopicPermissions, other.TopicPermissions) && maps.Equal(c.Limits, other.Limits) &&
+		maps.EqualFunc(c.VHostLimits, other.VHostLimits, maps.Equal) && c.Disabled == other.Disabled &&
+		c.Deleted == other.Deleted && c.Passwordless == other.Passwordless
+}
+
+// isComplete returns true if both username and password (or password hash) are set.
+// Disabled, deleted and passwordless users do not need a password.
+func (c UserCredentials) isComplete() bool {
+	return c.Username != "" && (c.Password != "" || c.PasswordHash != "" || c.Disabled || c.Deleted || c.Passwordless)
 }
 
-// PasswordUpdater now uses a WatchDir instead of single default configuration file.
+// hasPassword returns true if the Password of c is applied and can be used to authenticate.
+func (c UserCredentials) hasPassword() bool {
+	return c.Password != "" && !c.Disabled && !c.Deleted && !c.Passwordless
+}
+
+// PasswordUpdater reads the expected user credentials from Source, e.g. the files in WatchDir.
 // CredentialState stores the last successfully verified user credentials.
 // CredentialSpec stores the expected user credentials.
+// The fields must not be accessed while HandleEvents is running; use TriggerSync, DumpState
+// and Snapshot instead.
 type PasswordUpdater struct {
-	AdminFile       string
+	// AdminFile is the rabbitmqadmin configuration file of the admin credentials. It is not written if empty.
+	AdminFile string
+	// AdminFileFormat is FileFormatINI (the default) or FileFormatTOML.
+	AdminFileFormat FileFormat
+	// AdminFileSection is the section (or TOML table) of the admin credentials, whose keys are
+	// AdminFileUsernameKey and AdminFilePasswordKey.
+	AdminFileSection     string
+	AdminFileUsernameKey string
+	AdminFilePasswordKey string
+	// AdminFileSettings are written to the AdminFileSection along with the admin credentials,
+	// e.g. the hostname and port of the Management API. The values are strings, integers or booleans.
+	AdminFileSettings map[string]any
+	Source            SecretSource
+	// Watcher and WatchDir are only set if the credentials are read from a directory.
 	Watcher         *fsnotify.Watcher
 	WatchDir        string
-	Done            chan<- bool
+	StateFile       string
 	Log             logr.Logger
-	adminClient     RabbitClient
-	authClient      RabbitClient
 	CredentialState map[string]UserCredentials
 	CredentialSpec  map[string]UserCredentials
+
+	// RetryPolicy configures retries of failed requests, users and syncs.
+	RetryPolicy RetryPolicy
+	// ValidationRules restrict the credentials that are applied.
+	ValidationRules ValidationRules
+	// FailureMode and MaxConsecutiveFailures control when a failing sync terminates HandleEvents.
+	FailureMode            FailureMode
+	MaxConsecutiveFailures int
+	// LockFile, if set, is locked while processing secrets, so that updaters on different
+	// nodes sharing a volume do not interleave their updates.
+	LockFile string
+	// Notifier, if set, is notified once a sync reached RabbitMQ and updated all users
+	// ("READY=1") and pinged from the event loop every WatchdogInterval ("WATCHDOG=1"), if positive.
+	Notifier         Notifier
+	WatchdogInterval time.Duration
+	// ResyncInterval, if positive, performs a full sync periodically, so that changes made on the
+	// RabbitMQ server (e.g. tags or permissions changed with rabbitmqctl) are corrected.
+	ResyncInterval time.Duration
+	// NodeClient, if set, creates a client for the Management API of the given cluster node.
+	// Updated passwords are then verified against every node (Nodes, or the nodes reported by
+	// /api/nodes if empty) for up to PropagationTimeout before the update is considered successful.
+	NodeClient         func(node string) (RabbitClient, error)
+	Nodes              []string
+	PropagationTimeout time.Duration
+	// IncludeUsers and ExcludeUsers, if set, restrict the users that are updated to those whose
+	// userID matches one of the IncludeUsers and none of the ExcludeUsers glob patterns (see path.Match),
+	// e.g. to leave the default user to the cluster operator. The admin user is always included,
+	// since it is needed to authenticate.
+	IncludeUsers []string
+	ExcludeUsers []string
+	// CreateVhosts creates missing vhosts that users are granted permissions in.
+	CreateVhosts bool
+	// MinHashingAlgorithm, if set, replaces weaker hashing algorithms (e.g. MD5 or SHA-256 if set
+	// to SHA-512) when a password is updated, instead of preserving the algorithm of the existing user.
+	// It does not apply to password hashes, which cannot be rehashed.
+	MinHashingAlgorithm rabbithole.HashingAlgorithm
+	// DefaultPermissions are granted per vhost to new users without permissions.
+	// If empty, such users are created without any permissions.
+	DefaultPermissions map[string]rabbithole.Permissions
+	// DeleteRemovedUsers deletes users from RabbitMQ whose secrets have been removed, DeleteGracePeriod
+	// after the removal was detected. Only users that were applied by the updater are deleted.
+	DeleteRemovedUsers bool
+	DeleteGracePeriod  time.Duration
+	// ProtectedUsers are glob patterns (see path.Match) of usernames that are never created, modified
+	// or deleted, whatever the source contains, e.g. the default user of the cluster operator.
+	// The admin user cannot be protected, since it is needed to authenticate.
+	ProtectedUsers []string
+	// ServiceUserID, if set, is the userID of a dedicated user (e.g. "updater" for the user_updater_* files)
+	// that the updater authenticates with instead of the admin user, so that rotating the admin password
+	// does not affect its own access. Like the admin user, it is always included and cannot be protected.
+	// Until its credentials are applied, the updater authenticates with the admin user.
+	ServiceUserID string
+	// BootstrapUserID, if set, is the userID of working credentials (e.g. "default" for the default user of
+	// the cluster operator) that create the admin user at startup if it does not exist yet, see bootstrapAdmin.
+	BootstrapUserID string
+	// Sinks are kept in sync with the credentials of their users (by userID), e.g. ConfigFiles with
+	// default_user and default_pass in rabbitmq.conf, so that nodes started with an empty database use
+	// the current credentials, too. The AdminFile is a sink of the admin user as well.
+	Sinks map[string][]CredentialSink
+	// CloseConnections closes the connections of existing users after their password was updated
+	// (or they were disabled), so that clients cannot continue to use the old password.
+	// CloseConnectionsDelay gives clients time to reconnect with the new password on their own first.
+	CloseConnections      bool
+	CloseConnectionsDelay time.Duration
+	// PermissionPresets, if set, are granted instead of the DefaultPermissions to new users
+	// without permissions, based on their tags.
+	PermissionPresets PermissionPresets
+	// BatchUpdates updates changed users with their permissions by importing definitions
+	// (POST /api/definitions) in a single request, instead of one request per user and vhost.
+	// Users that cannot be imported (see isBatchable) are still updated one by one, as are all
+	// users if the import fails.
+	BatchUpdates bool
+	// BackupDir, if set, is the directory that the users and permissions of the RabbitMQ server are
+	// exported to, before they are first updated in a sync; "-" writes them to stdout instead.
+	// Corrections of permissions that were changed on the RabbitMQ server are not backed up.
+	BackupDir string
+	// UpdateFederationUpstreams replaces the password of updated users in the URIs of federation
+	// upstreams that use their credentials, so that the upstreams keep working.
+	UpdateFederationUpstreams bool
+	// UpdateShovels does the same for the source and destination URIs of dynamic shovels.
+	UpdateShovels bool
+	// ParameterURIs are the keys of URIs per runtime parameter component (e.g. of other plugins)
+	// in which the password of updated users is replaced as well.
+	ParameterURIs map[string][]string
+	// RequireInternalAuthBackend refuses to run if RabbitMQ reports at startup that the admin user
+	// was authenticated by another auth backend than the internal user database (e.g. LDAP), in which
+	// updated credentials may have no effect. Other auth backends are only warned about otherwise.
+	RequireInternalAuthBackend bool
+	// MinRabbitMQVersion, if set, refuses to run against older brokers, as detected at startup,
+	// instead of failing with errors of missing Management API endpoints later on. Brokers whose
+	// version cannot be detected, e.g. because they are not running yet, are not refused.
+	MinRabbitMQVersion RabbitMQVersion
+	// VerifyAliveness verifies updated passwords with an aliveness test (GET /api/aliveness-test/<vhost>)
+	// in each vhost of the user as well, which needs permissions on the "aliveness-test" queue.
+	// Failed verifications are retried like failed updates.
+	VerifyAliveness bool
+	// Probes, if set, verify updated passwords by name (e.g. by opening an AMQP connection) before
+	// the update is considered successful, since the Management API accepting credentials does not
+	// always prove that messaging clients can log in. Failed verifications are retried like failed updates.
+	Probes map[string]Probe
+	// ProbeUsers restrict Probes by name to the usernames matching one of their glob patterns (see path.Match),
+	// e.g. to the users of MQTT devices. Probes without patterns verify every user.
+	ProbeUsers map[string][]string
+
+	adminClient RabbitClient
+	authClient  RabbitClient
+
+	retries      *retryQueue
+	syncRequests chan struct{}
+	dumpRequests chan struct{}
+	// sourceChanges receives a value when a WatchingSecretSource detected a change.
+	sourceChanges chan struct{}
+	resync        <-chan time.Time
+	// removedUsers are the userIDs of removed users and when they are due for deletion,
+	// and deletions receives a value when the earliest one is due, see DeleteRemovedUsers.
+	removedUsers map[string]time.Time
+	deletions    <-chan time.Time
+	// pendingCloses are delayed closes of connections, and connectionCloses receives a value
+	// when the earliest one is due, see CloseConnectionsDelay.
+	pendingCloses    []pendingClose
+	connectionCloses <-chan time.Time
+
+	// broker is what RabbitMQ reported about itself at startup.
+	broker brokerInfo
+	// appliedPolicies are the policies applied from policy files, see applyPolicies.
+	appliedPolicies map[policyKey]bool
+	// backedUp is true once the current sync has backed up the definitions, see BackupDir.
+	backedUp bool
+	// consecutiveFailures counts failed syncs since the last successful one.
+	consecutiveFailures int
+	// ready is true once a sync authenticated with RabbitMQ and updated all users, see readinessError.
+	ready bool
+	// notReadySyncs counts the syncs that did not make the updater ready.
+	notReadySyncs int
+	// applied records when each user's credentials were last applied, see StateFile.
+	applied map[string]appliedCredentials
+	// stateKey is the key of the password hashes in applied, see hashPassword.
+	stateKey []byte
+
+	// mu guards CredentialState, CredentialSpec and the sync results below against concurrent
+	// reads by Snapshot. They are only modified by the HandleEvents goroutine.
+	mu          sync.Mutex
+	lastSync    time.Time
+	lastSyncErr error
+	lastErrors  map[string]error
 }
 
 type RabbitClient interface {
 	// RabbitMQ Management API functions
-	GetUser(username string) (*rabbithole.UserInfo, error)
-	PutUser(username string, settings rabbithole.UserSettings) (*http.Response, error)
-	UpdatePermissionsIn(vhost string, username string, permissions rabbithole.Permissions) (*http.Response, error)
-	Whoami() (*rabbithole.WhoamiInfo, error)
+	GetUser(ctx context.Context, username string) (*rabbithole.UserInfo, error)
+	PutUser(ctx context.Context, username string, settings rabbithole.UserSettings) (*http.Response, error)
+	PutUserWithoutPassword(ctx context.Context, username string, settings rabbithole.UserSettings) (*http.Response, error)
+	UpdatePermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.Permissions) (*http.Response, error)
+	UpdateTopicPermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.TopicPermissions) (*http.Response, error)
+	GetVhost(ctx context.Context, vhost string) (*rabbithole.VhostInfo, error)
+	PutVhost(ctx context.Context, vhost string, settings rabbithole.VhostSettings) (*http.Response, error)
+	PutUserLimits(ctx context.Context, username string, limits rabbithole.UserLimitsValues) (*http.Response, error)
+	PutVhostLimits(ctx context.Context, vhost string, limits rabbithole.VhostLimitsValues) (*http.Response, error)
+	DeleteUser(ctx context.Context, username string) (*http.Response, error)
+	GetPermissionsIn(ctx context.Context, vhost string, username string) (rabbithole.PermissionInfo, error)
+	ListPermissionsOf(ctx context.Context, username string) ([]rabbithole.PermissionInfo, error)
+	ClearPermissionsIn(ctx context.Context, vhost string, username string) (*http.Response, error)
+	ListTopicPermissionsOf(ctx context.Context, username string) ([]rabbithole.TopicPermissionInfo, error)
+	ClearTopicPermissionsIn(ctx context.Context, vhost string, username string) (*http.Response, error)
+	ListConnectionsOfUser(ctx context.Context, username string) ([]rabbithole.UserConnectionInfo, error)
+	// CloseConnection closes the connection with the given name, showing reason to the client.
+	CloseConnection(ctx context.Context, name string, reason string) (*http.Response, error)
+	ExportDefinitions(ctx context.Context) (Definitions, error)
+	ListRuntimeParametersFor(ctx context.Context, component string) ([]rabbithole.RuntimeParameter, error)
+	GetPolicy(ctx context.Context, vhost string, name string) (*rabbithole.Policy, error)
+	PutPolicy(ctx context.Context, vhost string, name string, policy rabbithole.Policy) (*http.Response, error)
+	DeletePolicy(ctx context.Context, vhost string, name string) (*http.Response, error)
+	GetOperatorPolicy(ctx context.Context, vhost string, name string) (*rabbithole.OperatorPolicy, error)
+	PutOperatorPolicy(ctx context.Context, vhost string, name string, policy rabbithole.OperatorPolicy) (*http.Response, error)
+	DeleteOperatorPolicy(ctx context.Context, vhost string, name string) (*http.Response, error)
+	PutRuntimeParameter(ctx context.Context, component string, vhost string, name string, value any) (*http.Response, error)
+	UploadDefinitions(ctx context.Context, definitions Definitions) (*http.Response, error)
+	Whoami(ctx context.Context) (*rabbithole.WhoamiInfo, error)
+	HealthCheckAlarms(ctx context.Context) (rabbithole.ResourceAlarmCheckStatus, error)
+	ListNodes(ctx context.Context) ([]rabbithole.NodeInfo, error)
+	Overview(ctx context.Context) (*rabbithole.Overview, error)
+	// AlivenessTest returns an error unless the aliveness test in vhost succeeded.
+	AlivenessTest(ctx context.Context, vhost string) error
 
 	// Credential management functions
 	GetUsername() string
@@ -62,72 +320,406 @@ type RabbitClient interface {
 	SetPassword(password string)
 }
 
-// HandleEvents continuously waits for file system events and processes secrets when any file
-// matching the expected pattern is changed.
-func (u *PasswordUpdater) HandleEvents() {
-	defer u.Watcher.Close()
+// HandleEvents performs an initial sync, then continuously waits for file system events (or
+// changes detected by a WatchingSecretSource) and processes secrets when any file matching the
+// expected pattern is changed. It returns nil once ctx is cancelled, or an error if the updater
+// cannot continue.
+func (u *PasswordUpdater) HandleEvents(ctx context.Context) error {
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if u.Watcher != nil {
+		defer u.Watcher.Close()
+		events, watchErrors = u.Watcher.Events, u.Watcher.Errors
+	}
+
+	var sourceErrors chan error
+	if source, ok := u.Source.(WatchingSecretSource); ok {
+		sourceErrors = make(chan error, 1)
+		go func() {
+			sourceErrors <- source.Watch(ctx, u.sourceChanged)
+		}()
+	}
+
+	var watchdog <-chan time.Time
+	if u.Notifier != nil && u.WatchdogInterval > 0 {
+		ticker := time.NewTicker(u.WatchdogInterval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	var resyncs <-chan time.Time
+	if u.ResyncInterval > 0 {
+		ticker := time.NewTicker(u.ResyncInterval)
+		defer ticker.Stop()
+		resyncs = ticker.C
+	}
+
+	if err := u.checkBroker(ctx); err != nil {
+		return err
+	}
+	// Credentials may have changed while the updater was not running.
+	if err := u.sync(ctx, false); err != nil {
+		return err
+	}
 
 	for {
 		select {
-		case event, ok := <-u.Watcher.Events:
+		case <-ctx.Done():
+			u.Log.V(1).Info("context cancelled, exiting...")
+			u.notify("STOPPING=1")
+			return nil
+		case event, ok := <-events:
 			if !ok {
 				u.Log.V(0).Info("watcher events channel is closed, exiting...", "directory", u.WatchDir)
-				u.Done <- true
-				return
+				return fmt.Errorf("%w: events channel is closed", ErrWatcher)
 			}
 			u.Log.V(4).Info("file system event", "file", event.Name, "operation", event.Op.String())
-			if isSecretFile(event.Name) {
-				if err := u.processSecrets(); err != nil {
-					u.Log.Error(err, "failed to process secrets")
-					u.Done <- true
-					return
+			if u.isWatchDirRemoved(event) {
+				u.Log.V(0).Info("watch directory was removed, waiting for it to be recreated", "directory", u.WatchDir)
+				if err := u.rewatch(ctx); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return fmt.Errorf("%w: failed to resume watching directory %q: %w", ErrWatcher, u.WatchDir, err)
+				}
+				watchUserDirs(u.Watcher, u.WatchDir, u.Log)
+				// Files may have been created before the watch was re-added.
+				if err := u.sync(ctx, false); err != nil {
+					return err
+				}
+				continue
+			}
+			if u.isUserDirEvent(event) || isSecretFile(event.Name) || u.isMappedFile(event.Name) || isAtomicUpdate(event.Name) {
+				if err := u.sync(ctx, false); err != nil {
+					return err
 				}
 			}
-		case err, ok := <-u.Watcher.Errors:
+		case <-u.sourceChanges:
+			u.Log.V(4).Info("credential source changed")
+			if err := u.sync(ctx, false); err != nil {
+				return err
+			}
+		case err := <-sourceErrors:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("%w: %w", ErrSource, err)
+		case <-u.syncRequests:
+			u.Log.V(0).Info("full sync requested")
+			if err := u.sync(ctx, true); err != nil {
+				return err
+			}
+		case <-u.resync:
+			u.resync = nil
+			u.Log.V(1).Info("retrying failed sync", "consecutiveFailures", u.consecutiveFailures)
+			if err := u.sync(ctx, false); err != nil {
+				return err
+			}
+		case <-u.deletions:
+			u.deletions = nil
+			u.Log.V(1).Info("deleting removed users", "users", len(u.removedUsers))
+			if err := u.sync(ctx, false); err != nil {
+				return err
+			}
+		case <-resyncs:
+			u.Log.V(1).Info("periodic full sync")
+			if err := u.sync(ctx, true); err != nil {
+				return err
+			}
+		case <-u.connectionCloses:
+			u.connectionCloses = nil
+			u.closePendingConnections(ctx)
+		case <-u.dumpRequests:
+			u.dumpState()
+		case <-watchdog:
+			u.notify("WATCHDOG=1")
+		case <-u.retries.wait():
+			u.Log.V(1).Info("retrying failed updates", "users", u.retries.len())
+			if err := u.sync(ctx, false); err != nil {
+				return err
+			}
+		case err, ok := <-watchErrors:
 			if !ok {
 				u.Log.V(0).Info("watcher errors channel is closed, exiting...")
-				u.Done <- true
-				return
+				return fmt.Errorf("%w: errors channel is closed", ErrWatcher)
 			}
 			u.Log.Error(err, "failed to watch", "directory", u.WatchDir)
 		}
 	}
 }
 
-// isSecretFile returns true if the base name starts with "user_".
+// TriggerSync requests an immediate full sync, which re-reads the watch directory and
+// reconciles all users, including those whose credentials did not change.
+// It does not block; the sync is performed by HandleEvents.
+func (u *PasswordUpdater) TriggerSync() {
+	select {
+	case u.syncRequests <- struct{}{}:
+	default:
+		// A sync is already pending.
+	}
+}
+
+// sync processes the secrets. A returned error means that the updater must terminate,
+// according to FailureMode; otherwise a failed sync is retried with backoff.
+// An in-flight sync is not aborted when ctx is cancelled, so that the admin file does not
+// get out of sync with RabbitMQ during shutdown.
+func (u *PasswordUpdater) sync(ctx context.Context, full bool) error {
+	if u.LockFile != "" {
+		release, err := u.acquireLock(ctx)
+		if ctx.Err() != nil {
+			// Terminating while waiting for the lock, nothing is in-flight.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to acquire lock %q: %w", u.LockFile, err)
+		}
+		defer release()
+	}
+	err := u.processSecrets(context.WithoutCancel(ctx), full)
+	if err == nil && !u.ready {
+		err = u.readinessError(ctx)
+	}
+	u.mu.Lock()
+	u.lastSync = time.Now()
+	u.lastSyncErr = err
+	u.mu.Unlock()
+	if err == nil {
+		u.consecutiveFailures = 0
+		if !u.ready {
+			u.ready = true
+			u.notify("READY=1")
+		}
+		return nil
+	}
+	if !u.ready && (errors.Is(err, ErrBrokerUnreachable) || errors.Is(err, errUsersNotUpdated)) {
+		// An unreachable broker at startup is not fatal, the initial sync is retried until it
+		// succeeds, regardless of FailureMode.
+		u.notReadySyncs++
+		delay := u.RetryPolicy.delay(u.notReadySyncs - 1)
+		u.Log.Error(err, "initial sync did not succeed, retrying", "delay", delay.String())
+		u.resync = time.After(delay)
+		return nil
+	}
+	u.consecutiveFailures++
+	u.Log.Error(err, "failed to process secrets", "consecutiveFailures", u.consecutiveFailures)
+	if u.FailureMode != FailureModeRetry && u.consecutiveFailures >= u.MaxConsecutiveFailures {
+		return fmt.Errorf("failed to process secrets: %w", err)
+	}
+	delay := u.RetryPolicy.delay(u.consecutiveFailures - 1)
+	u.Log.V(1).Info("scheduled sync retry", "delay", delay.String())
+	u.resync = time.After(delay)
+	return nil
+}
+
+// errUsersNotUpdated means that some users failed to update, which are retried in the background.
+var errUsersNotUpdated = errors.New("failed to update")
+
+// readinessError returns an error unless RabbitMQ accepts the admin credentials and
+// no user failed to update in the last sync. Since CredentialState assumes that the
+// credentials at startup are applied, the initial sync may not reach RabbitMQ otherwise.
+func (u *PasswordUpdater) readinessError(ctx context.Context) error {
+	if err := u.authenticate(ctx, u.adminClient); err != nil {
+		return adminAuthError(err)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.lastErrors) > 0 {
+		return fmt.Errorf("%w: %d users", errUsersNotUpdated, len(u.lastErrors))
+	}
+	return nil
+}
+
+// isWatchDirRemoved returns true if the event reports that the watch directory itself
+// was removed or moved away, in which case the watcher no longer observes it.
+func (u *PasswordUpdater) isWatchDirRemoved(event fsnotify.Event) bool {
+	return filepath.Clean(event.Name) == filepath.Clean(u.WatchDir) &&
+		event.Has(fsnotify.Remove|fsnotify.Rename)
+}
+
+// rewatch adds the watch directory back to the watcher, retrying with exponential backoff
+// until the directory has been recreated (e.g. after a volume remount).
+// Returns an error only if the watcher has been closed or ctx is cancelled in the meantime.
+func (u *PasswordUpdater) rewatch(ctx context.Context) error {
+	delay := rewatchInitialDelay
+	for {
+		err := u.Watcher.Add(u.WatchDir)
+		if err == nil {
+			u.Log.V(0).Info("resumed watching", "directory", u.WatchDir)
+			return nil
+		}
+		if errors.Is(err, fsnotify.ErrClosed) {
+			return err
+		}
+		u.Log.V(1).Info("failed to add directory to watcher, retrying", "directory", u.WatchDir, "delay", delay.String(), "error", err.Error())
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay = min(2*delay, rewatchMaxDelay)
+	}
+}
+
+// filterUsers removes the users that are not selected by IncludeUsers and ExcludeUsers, and the ProtectedUsers.
+func (u *PasswordUpdater) filterUsers(credentials map[string]UserCredentials) map[string]UserCredentials {
+	if len(u.IncludeUsers) == 0 && len(u.ExcludeUsers) == 0 && len(u.ProtectedUsers) == 0 {
+		return credentials
+	}
+	filtered := make(map[string]UserCredentials, len(credentials))
+	for userID, cred := range credentials {
+		if !u.isSelected(userID) {
+			u.Log.V(4).Info("ignoring user not selected by the include and exclude patterns", "userID", userID)
+			continue
+		}
+		if !u.isClientUser(userID) && u.isProtected(cred.Username) {
+			u.Log.V(1).Info("ignoring protected user", "userID", userID, "user", cred.Username)
+			continue
+		}
+		filtered[userID] = cred
+	}
+	return filtered
+}
+
+// isSelected returns true if userID is selected by IncludeUsers and ExcludeUsers.
+func (u *PasswordUpdater) isSelected(userID string) bool {
+	matches := func(patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := path.Match(pattern, userID)
+			return matched
+		})
+	}
+	return u.isClientUser(userID) || ((len(u.IncludeUsers) == 0 || matches(u.IncludeUsers)) && !matches(u.ExcludeUsers))
+}
+
+// isUserDirEvent returns true if the event concerns a per-user subdirectory of the watch
+// directory or a file in one. Newly created subdirectories are added to the watcher.
+func (u *PasswordUpdater) isUserDirEvent(event fsnotify.Event) bool {
+	dir, base := filepath.Split(filepath.Clean(event.Name))
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	watchDir := filepath.Clean(u.WatchDir)
+	if filepath.Clean(dir) != watchDir {
+		return filepath.Dir(filepath.Clean(dir)) == watchDir
+	}
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			watchUserDir(u.Watcher, event.Name, u.Log)
+			return true
+		}
+	}
+	// The watch on a removed subdirectory is removed by fsnotify.
+	return event.Has(fsnotify.Remove | fsnotify.Rename)
+}
+
+// isSecretFile returns true if the base name starts with "user_", is the users spec or definitions file,
+// or is a policy file.
 func isSecretFile(filePath string) bool {
 	base := filepath.Base(filePath)
-	return strings.HasPrefix(base, userFilePrefix)
+	return strings.HasPrefix(base, userFilePrefix) || base == usersSpecFile || base == definitionsFile || isPolicyFile(filePath)
+}
+
+// isMappedFile returns true if the base name is mapped to a user by DirectorySource.Files
+// or DirectorySource.Pattern.
+func (u *PasswordUpdater) isMappedFile(filePath string) bool {
+	source, ok := u.Source.(DirectorySource)
+	if !ok {
+		return false
+	}
+	key, _ := trimEncryptedSuffix(filepath.Base(filePath))
+	_, mapped := source.mapFile(key)
+	return mapped
+}
+
+// isAtomicUpdate returns true if the base name is the "..data" symlink.
+// Kubernetes updates mounted secrets by swapping this symlink, so the events are
+// reported on the symlink rather than on the "user_" files pointing through it.
+func isAtomicUpdate(filePath string) bool {
+	return filepath.Base(filePath) == kubernetesDataLink
 }
 
 // processSecrets reads all files in WatchDir, groups them by user ID (based on file names),
 // and then (using admin credentials) updates every user whose password has changed.
-func (u *PasswordUpdater) processSecrets() error {
+// Failing to update a single user is logged and retried in the background,
+// but does not return an error. If full is true, unchanged users are reconciled as well.
+func (u *PasswordUpdater) processSecrets(ctx context.Context, full bool) error {
 	// Explicitly set admin credentials from state before processing secrets
-	u.adminClient.SetUsername(u.CredentialState[adminUserID].Username)
-	u.adminClient.SetPassword(u.CredentialState[adminUserID].Password)
+	u.setClientCredentials()
 
-	var err error
-	u.CredentialSpec, err = loadSecrets(u.WatchDir, u.Log)
+	credentials, err := u.Source.Load(ctx)
+	// The files that failed to load were logged, the other users are updated nevertheless.
+	incomplete := (*IncompleteLoadError)(nil)
+	if errors.As(err, &incomplete) {
+		err = nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to load credential state: %w", err)
 	}
+	u.backedUp = false
+	spec := u.validCredentials(completeCredentials(u.filterUsers(credentials), u.Log))
+	u.mu.Lock()
+	u.CredentialSpec = spec
+	u.mu.Unlock()
+	if err := u.checkAdminCredentials(credentials); err != nil {
+		return err
+	}
+	u.retries.retain(u.CredentialSpec)
 
+	// Users are updated independently, so that one failing user does not block the others.
+	var updateErrs []error
+	// Resource alarms are checked once, before the first update.
+	var alarmsChecked, alarmsActive bool
+	// With BatchUpdates, changed users are imported at once, before the loop below.
+	var batched map[string]bool
+	if u.BatchUpdates {
+		changed := make(map[string]UserCredentials)
+		for userID, creds := range u.CredentialSpec {
+			if !u.isUnchanged(userID, creds) {
+				changed[userID] = creds
+			}
+		}
+		if len(changed) > 0 {
+			alarmsChecked = true
+			alarmsActive = u.hasActiveAlarms(ctx)
+			if !alarmsActive {
+				if err := u.backupDefinitions(ctx); err != nil {
+					return err
+				}
+				batched = u.importDefinitions(ctx, changed)
+			}
+		}
+	}
 	for userID, creds := range u.CredentialSpec {
 		username := creds.Username
-		password := creds.Password
-		tag := creds.Tag
-		if state, exists := u.CredentialState[userID]; exists &&
-			state.Password == password && state.Tag == tag {
+		if !full && u.isUnchanged(userID, creds) {
 			u.Log.V(4).Info("credentials unchanged, skipping update", "user", username)
+			// The permissions may have been changed on the RabbitMQ server nevertheless.
+			if len(creds.Permissions) > 0 && !creds.Disabled && !creds.Deleted {
+				if err := u.updatePermissions(ctx, username, creds.Permissions, nil); err != nil {
+					u.Log.Error(err, "failed to reconcile permissions in RabbitMQ for user", "user", username)
+					updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+					u.scheduleRetry(userID, username, err)
+					continue
+				}
+			}
+			// The sinks may have been reverted, e.g. a config file by the cluster operator.
+			u.syncSinks(ctx, userID, creds)
+			u.clearRetry(userID)
 			continue
 		}
 
-		if userID == adminUserID {
+		if !alarmsChecked {
+			alarmsChecked = true
+			alarmsActive = u.hasActiveAlarms(ctx)
+		}
+		if alarmsActive {
+			delay := u.retries.add(userID, u.RetryPolicy)
+			u.Log.V(1).Info("postponed update due to resource alarms", "user", username, "delay", delay.String())
+			continue
+		}
+
+		if u.isClientUser(userID) {
 			// Verify that we can authenticate with the current admin credentials
-			if err := u.authenticate(u.adminClient); err != nil {
+			if err := u.authenticate(ctx, u.adminClient); err != nil {
 				u.Log.Error(err, "failed to authenticate with current admin credentials", "user", username)
-				return fmt.Errorf("failed to authenticate with current admin credentials: %w", err)
+				return adminAuthError(err)
 			}
 
 			// If admin username has changed, verify we can still authenticate
@@ -135,67 +727,184 @@ func (u *PasswordUpdater) processSecrets() error {
 			currentAdminUser := u.adminClient.GetUsername()
 			if currentAdminUser != username {
 				u.Log.V(1).Info("admin username changed", "old", currentAdminUser, "new", username)
-				if err := u.authenticate(u.adminClient); err != nil {
+				if err := u.authenticate(ctx, u.adminClient); err != nil {
 					u.Log.Error(err, "failed to authenticate with current admin credentials", "user", username)
-					return fmt.Errorf("failed to authenticate with current admin credentials: %w", err)
+					return adminAuthError(err)
 				}
 			}
 		}
 
-		newCred := UserCredentials{
-			Username: username,
-			Password: password,
-			Tag:      tag,
+		newCred := creds
+		if err := u.backupDefinitions(ctx); err != nil {
+			return err
 		}
 
-		// Update credentials in RabbitMQ
-		if err := u.updateInRabbitMQ(newCred, u.CredentialSpec); err != nil {
-			u.Log.Error(err, "failed to update credentials in RabbitMQ for user", "user", username)
-			break
+		// Update credentials in RabbitMQ, unless they were imported with other users.
+		if !batched[userID] {
+			if err := u.updateInRabbitMQ(ctx, newCred, u.CredentialSpec); err != nil {
+				u.Log.Error(err, "failed to update credentials in RabbitMQ for user", "user", username)
+				updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+				u.scheduleRetry(userID, username, err)
+				continue
+			}
+		}
+		if newCred.hasPassword() {
+			u.updateAllParameterURIs(ctx, username, newCred.Password)
+		}
+		// A password hash (or the random password of a disabled user) cannot be used to verify the propagation.
+		if u.NodeClient != nil && newCred.hasPassword() {
+			if err := u.waitForPropagation(ctx, newCred); err != nil {
+				u.Log.Error(err, "failed to verify propagation of credentials to all cluster nodes", "user", username)
+				updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+				u.scheduleRetry(userID, username, err)
+				continue
+			}
+		}
+		if u.VerifyAliveness && newCred.hasPassword() {
+			if err := u.verifyAliveness(ctx, newCred); err != nil {
+				u.Log.Error(err, "failed to verify credentials with aliveness test", "user", username)
+				updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+				u.scheduleRetry(userID, username, err)
+				continue
+			}
+		}
+		if len(u.Probes) > 0 && newCred.hasPassword() {
+			if err := u.runProbes(ctx, newCred); err != nil {
+				u.Log.Error(err, "failed to verify credentials with probe", "user", username)
+				updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+				u.scheduleRetry(userID, username, err)
+				continue
+			}
 		}
 		// Update credentials state, so that we can skip the next update if the credentials haven't changed
+		previous, hadPrevious := u.CredentialState[userID]
+		if hadPrevious && previous.Disabled && !newCred.Disabled && len(newCred.Permissions) == 0 {
+			// The permissions were removed when the user was disabled.
+			if err := u.updatePermissions(ctx, username, u.newUserPermissions(newCred.Tag), nil); err != nil {
+				u.Log.Error(err, "failed to restore permissions of enabled user", "user", username)
+				updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+				u.scheduleRetry(userID, username, err)
+				continue
+			}
+		}
+		u.mu.Lock()
 		u.CredentialState[userID] = newCred
+		u.mu.Unlock()
 		// Update admin RabbitMQ client credentials
-		u.adminClient.SetUsername(u.CredentialState[adminUserID].Username)
-		u.adminClient.SetPassword(u.CredentialState[adminUserID].Password)
-
-		if userID == adminUserID {
-			// Update admin credentials file, eg /var/lib/rabbitmq/.rabbitmqadmin.conf
-			// Check whether the current admin file are up-to-date.
-			correct, err := u.checkAdminFile(newCred)
-			if err != nil {
-				u.Log.Error(err, "failed to load admin credentials file", "file", u.AdminFile)
-			}
-			if !correct {
-				if err := u.updateAdminFile(newCred); err != nil {
-					u.Log.Error(err, "failed to update RabbitMQ admin credentials file", "user", username)
+		u.setClientCredentials()
+
+		if u.isClientUser(userID) {
+			if err := u.verifyClientCredentials(ctx, userID, newCred); err != nil {
+				// Revert to the previous credentials, so that subsequent syncs use working credentials.
+				// The sinks still contain them.
+				u.mu.Lock()
+				if hadPrevious {
+					u.CredentialState[userID] = previous
 				} else {
-					u.Log.V(1).Info("updated admin credentials file", "file", u.AdminFile)
+					delete(u.CredentialState, userID)
 				}
-			} else {
-				u.Log.V(1).Info("admin credentials file is already up-to-date, no update needed", "file", u.AdminFile)
-			}
-			// Verification: re-authenticate after updating admin credentials
-			if err := u.authenticate(u.adminClient); err != nil {
-				u.Log.Error(err, "extra admin step: failed to re-authenticate after updating admin credentials", "user", username)
-			} else {
-				u.Log.V(1).Info("extra admin step: re-authentication successful for admin", "user", username)
+				u.mu.Unlock()
+				u.setClientCredentials()
+				updateErrs = append(updateErrs, fmt.Errorf("user %q: %w", username, err))
+				u.scheduleRetry(userID, username, err)
+				continue
 			}
 		}
+		u.syncSinks(ctx, userID, newCred)
+		u.clearRetry(userID)
+		u.recordApplied(userID, newCred)
+	}
+	if len(updateErrs) > 0 {
+		u.Log.Error(errors.Join(updateErrs...), "failed to update credentials in RabbitMQ for some users",
+			"failed", len(updateErrs), "total", len(u.CredentialSpec))
+	}
+	u.applyPolicies(ctx)
+	if incomplete != nil {
+		// Users whose files failed to load must not be mistaken for removed users.
+		u.Log.V(1).Info("not deleting removed users, since some secret files failed to load", "files", incomplete.Files)
+	} else {
+		u.deleteRemovedUsers(ctx, credentials)
+	}
+	return nil
+}
+
+// checkAdminCredentials returns ErrInvalidAdminCredentials if the admin secret was incomplete at startup
+// and still is, so that NewPasswordUpdater does not fail while the secret is being written.
+// Once complete, the admin credentials are assumed to be applied, like those loaded at startup.
+func (u *PasswordUpdater) checkAdminCredentials(credentials map[string]UserCredentials) error {
+	if _, ok := u.CredentialState[adminUserID]; ok || u.ready {
+		return nil
+	}
+	admin, ok := credentials[adminUserID]
+	if !ok {
+		return nil
+	}
+	if admin.Username == "" || admin.Password == "" {
+		return fmt.Errorf("%w: incomplete credentials, missing username or password for admin user", ErrInvalidAdminCredentials)
+	}
+	if cred, ok := u.CredentialSpec[adminUserID]; ok {
+		u.mu.Lock()
+		u.CredentialState[adminUserID] = cred
+		u.mu.Unlock()
+		u.setClientCredentials()
 	}
 	return nil
 }
 
+// isUnchanged returns true if creds were already applied, according to CredentialState.
+func (u *PasswordUpdater) isUnchanged(userID string, creds UserCredentials) bool {
+	state, exists := u.CredentialState[userID]
+	return exists &&
+		state.Password == creds.Password && state.PasswordHash == creds.PasswordHash &&
+		state.HashingAlgorithm == creds.HashingAlgorithm && state.Tag == creds.Tag &&
+		maps.Equal(state.Permissions, creds.Permissions) && slices.Equal(state.TopicPermissions, creds.TopicPermissions) &&
+		maps.Equal(state.Limits, creds.Limits) && maps.EqualFunc(state.VHostLimits, creds.VHostLimits, maps.Equal) &&
+		state.Disabled == creds.Disabled && state.Deleted == creds.Deleted && state.Passwordless == creds.Passwordless
+}
+
+// scheduleRetry records that updating a user failed and schedules a retry with backoff.
+func (u *PasswordUpdater) scheduleRetry(userID, username string, err error) {
+	u.mu.Lock()
+	u.lastErrors[userID] = err
+	u.mu.Unlock()
+	delay := u.retries.add(userID, u.RetryPolicy)
+	u.Log.V(1).Info("scheduled retry", "user", username, "delay", delay.String())
+}
+
+// clearRetry records that a user is up-to-date and cancels any pending retry.
+func (u *PasswordUpdater) clearRetry(userID string) {
+	u.mu.Lock()
+	delete(u.lastErrors, userID)
+	u.mu.Unlock()
+	u.retries.remove(userID)
+}
+
 // updateInRabbitMQ tries to update a user's password (and tag) on the RabbitMQ server.
-func (u *PasswordUpdater) updateInRabbitMQ(cred UserCredentials, spec map[string]UserCredentials) error {
+func (u *PasswordUpdater) updateInRabbitMQ(ctx context.Context, cred UserCredentials, spec map[string]UserCredentials) error {
+	if cred.Deleted {
+		if err := u.deleteUser(ctx, cred.Username); err != nil {
+			return fmt.Errorf("failed to delete user on RabbitMQ server: %w", err)
+		}
+		u.Log.V(0).Info("deleted user on RabbitMQ server", "user", cred.Username)
+		return nil
+	}
+	if cred.Disabled {
+		return u.disableUser(ctx, cred)
+	}
+	if cred.Passwordless {
+		return u.updatePasswordlessUser(ctx, cred, spec)
+	}
 	pathUsers := "/api/users/" + cred.Username
 	isNewUser := false
 
 	var user *rabbithole.UserInfo
 	var err error
 
-	user, err = u.adminClient.GetUser(cred.Username)
-	errHTTP := u.handleHTTPError(u.adminClient, err, http.MethodGet, pathUsers, spec[adminUserID].Password)
+	err = u.retry(ctx, http.MethodGet+" "+pathUsers, func() (err error) {
+		user, err = u.adminClient.GetUser(ctx, cred.Username)
+		return err
+	})
+	errHTTP := u.handleHTTPError(ctx, u.adminClient, err, http.MethodGet, pathUsers, spec[u.clientUserID()].Password)
 	if errHTTP != nil {
 		if errHTTP.Error() == errNotFound {
 			isNewUser = true
@@ -204,6 +913,18 @@ func (u *PasswordUpdater) updateInRabbitMQ(cred UserCredentials, spec map[string
 		}
 	}
 
+	// Only one node in a multi node RabbitMQ cluster needs to update the password.
+	// Skip the update if RabbitMQ already has the new password, unless the tags or the
+	// hashing algorithm of the user were changed on the RabbitMQ server.
+	passwordAccepted := user != nil && u.storesPassword(ctx, user, cred)
+	if passwordAccepted && !u.hasDrifted(user, cred) {
+		u.Log.V(1).Info("RabbitMQ already accepts the new password, skipping update", "user", cred.Username)
+		if err := u.updatePermissions(ctx, cred.Username, cred.Permissions, cred.TopicPermissions); err != nil {
+			return err
+		}
+		return u.updateLimits(ctx, cred.Username, cred.Limits, cred.VHostLimits)
+	}
+
 	hashingAlgorithm := rabbithole.HashingAlgorithmSHA256
 	if user != nil {
 		hashingAlgorithm = user.HashingAlgorithm
@@ -213,24 +934,40 @@ func (u *PasswordUpdater) updateInRabbitMQ(cred UserCredentials, spec map[string
 		Name:             cred.Username,
 		Tags:             rabbithole.UserTags{cred.Tag},
 		Password:         cred.Password,
-		HashingAlgorithm: hashingAlgorithm,
+		HashingAlgorithm: cmp.Or(cred.HashingAlgorithm, hashingAlgorithm),
+	}
+	if upgraded := atLeast(newUserSettings.HashingAlgorithm, u.MinHashingAlgorithm); upgraded != newUserSettings.HashingAlgorithm {
+		u.Log.V(1).Info("upgrading hashing algorithm", "user", cred.Username, "from", newUserSettings.HashingAlgorithm, "to", upgraded)
+		newUserSettings.HashingAlgorithm = upgraded
 	}
-	resp, err := u.adminClient.PutUser(cred.Username, newUserSettings)
+	if cred.Password == "" {
+		newUserSettings.PasswordHash = cred.PasswordHash
+		newUserSettings.HashingAlgorithm = cmp.Or(cred.HashingAlgorithm, rabbithole.HashingAlgorithmSHA256)
+	}
+	var resp *http.Response
+	err = u.retry(ctx, http.MethodPut+" "+pathUsers, func() (err error) {
+		resp, err = u.adminClient.PutUser(ctx, cred.Username, newUserSettings)
+		return err
+	})
 	if err != nil {
-		return u.handleHTTPError(u.adminClient, err, http.MethodPut, pathUsers, spec[adminUserID].Password)
+		return u.handleHTTPError(ctx, u.adminClient, err, http.MethodPut, pathUsers, spec[u.clientUserID()].Password)
 	}
 	u.Log.V(2).Info("HTTP response", "method", http.MethodPut, "path", pathUsers, "status", resp.Status)
 	u.Log.V(1).Info("updated password on RabbitMQ server", "user", cred.Username)
-	if isNewUser {
-		if _, err = u.adminClient.UpdatePermissionsIn("/", cred.Username, defaultUserPermissions); err != nil {
-			return fmt.Errorf("failed to update permissions on RabbitMQ server: %w", err)
-		}
-		u.Log.V(1).Info("set default permissions on RabbitMQ server", "user", cred.Username)
+	if u.CloseConnections && !isNewUser && !passwordAccepted {
+		u.closeConnections(ctx, cred.Username)
 	}
-	return nil
+	permissions := cred.Permissions
+	if isNewUser && len(permissions) == 0 {
+		permissions = u.newUserPermissions(cred.Tag)
+	}
+	if err := u.updatePermissions(ctx, cred.Username, permissions, cred.TopicPermissions); err != nil {
+		return err
+	}
+	return u.updateLimits(ctx, cred.Username, cred.Limits, cred.VHostLimits)
 }
 
-func (u *PasswordUpdater) handleHTTPError(client RabbitClient, err error, httpMethod, pathUsers, newPasswd string) error {
+func (u *PasswordUpdater) handleHTTPError(ctx context.Context, client RabbitClient, err error, httpMethod, pathUsers, newPasswd string) error {
 	if err == nil {
 		return nil
 	}
@@ -242,7 +979,7 @@ func (u *PasswordUpdater) handleHTTPError(client RabbitClient, err error, httpMe
 		u.Log.V(1).Info("HTTP request with old password returned 401 Unauthorized; authenticating with new password...",
 			"method", httpMethod, "path", pathUsers)
 		client.SetPassword(newPasswd)
-		return u.authenticate(client)
+		return u.authenticate(ctx, client)
 	}
 	if err.Error() == errNotFound && httpMethod == http.MethodGet {
 		// If the user does not exist, GET will return a 404 error.
@@ -255,12 +992,34 @@ func (u *PasswordUpdater) handleHTTPError(client RabbitClient, err error, httpMe
 	return err
 }
 
+// hasActiveAlarms returns true if memory or disk alarms are in effect in the cluster,
+// in which case updates are postponed. Failing to query the alarms (e.g. because the
+// health check endpoint is not supported) does not postpone updates.
+func (u *PasswordUpdater) hasActiveAlarms(ctx context.Context) bool {
+	const pathAlarms = "/api/health/checks/alarms"
+	status, err := u.adminClient.HealthCheckAlarms(ctx)
+	if err != nil {
+		u.Log.V(1).Info("failed to check resource alarms, continuing", "path", pathAlarms, "error", err.Error())
+		return false
+	}
+	if status.Ok() {
+		return false
+	}
+	for _, alarm := range status.Alarms {
+		u.Log.V(0).Info("resource alarm in effect", "node", alarm.Node, "resource", alarm.Resource)
+	}
+	return true
+}
+
 // authenticate checks whether authentication succeeds.
 // It queries /api/whoami (although it could query any other endpoint requiring basic auth).
 // Returns an error if authentication fails.
-func (u *PasswordUpdater) authenticate(client RabbitClient) error {
+func (u *PasswordUpdater) authenticate(ctx context.Context, client RabbitClient) error {
 	const pathWhoAmI = "/api/whoami"
-	_, err := client.Whoami()
+	err := u.retry(ctx, http.MethodGet+" "+pathWhoAmI, func() (err error) {
+		_, err = client.Whoami(ctx)
+		return err
+	})
 	if err != nil {
 		u.Log.Error(
 			err,
@@ -280,33 +1039,22 @@ func (u *PasswordUpdater) authenticate(client RabbitClient) error {
 	return nil
 }
 
-// updateAdminFile writes the admin credentials into the rabbitmqadmin file using gopkg.in/ini.v1.
-// If the file does not exist, it creates a new one.
-func (u *PasswordUpdater) updateAdminFile(cred UserCredentials) error {
-	cfg, err := ini.LooseLoad(u.AdminFile)
-	if err != nil {
-		return fmt.Errorf("failed to load admin ini file: %w", err)
+// verifyAdminCredentials verifies that RabbitMQ accepts the updated admin credentials. The sinks of
+// the admin user, e.g. the AdminFile /var/lib/rabbitmq/.rabbitmqadmin.conf, are only written afterwards,
+// so that they never contain credentials that RabbitMQ rejects.
+func (u *PasswordUpdater) verifyAdminCredentials(ctx context.Context, cred UserCredentials) error {
+	// Verification: re-authenticate after updating admin credentials
+	client := u.adminClient
+	if u.clientUserID() != adminUserID {
+		// The updater authenticates as the ServiceUserID, so the admin user is verified like other users.
+		client = u.authClient
+		client.SetUsername(cred.Username)
+		client.SetPassword(cred.Password)
 	}
-	// Update the default section with the new admin username and password.
-	cfg.Section(adminFileSection).Key("username").SetValue(cred.Username)
-	cfg.Section(adminFileSection).Key("password").SetValue(cred.Password)
-	if err := cfg.SaveTo(u.AdminFile); err != nil {
-		return fmt.Errorf("failed to save admin ini file: %w", err)
+	if err := u.authenticate(ctx, client); err != nil {
+		u.Log.Error(err, "extra admin step: failed to re-authenticate after updating admin credentials, rolling back", "user", cred.Username)
+		return fmt.Errorf("failed to verify updated admin credentials: %w", err)
 	}
+	u.Log.V(1).Info("extra admin step: re-authentication successful for admin", "user", cred.Username)
 	return nil
 }
-
-// checkAdminFile checks whether the admin credentials file contains the expected username and password.
-// Returns true if the file is correct, or false if it is missing or has incorrect credentials.
-func (u *PasswordUpdater) checkAdminFile(cred UserCredentials) (bool, error) {
-	cfg, err := ini.LooseLoad(u.AdminFile)
-	if err != nil {
-		return false, err
-	}
-	section := cfg.Section(adminFileSection)
-	if strings.TrimSpace(section.Key("username").String()) != cred.Username ||
-		strings.TrimSpace(section.Key("password").String()) != cred.Password {
-		return false, nil
-	}
-	return true, nil
-}
@@ -0,0 +1,225 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// GCPTokenProvider returns an OAuth2 access token for Google Cloud APIs.
+type GCPTokenProvider func(ctx context.Context) (string, error)
+
+// NewGCPMetadataTokenProvider returns a provider that gets access tokens of the attached
+// service account from the metadata server, e.g. with GKE workload identity.
+func NewGCPMetadataTokenProvider(client *http.Client) GCPTokenProvider {
+	var mu sync.Mutex
+	var cached string
+	var expires time.Time
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached != "" && time.Until(expires) > 5*time.Minute {
+			return cached, nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		body, err := doRequest(client, req)
+		if err != nil {
+			return "", fmt.Errorf("failed to get access token from metadata server: %w", err)
+		}
+		var token struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if err := json.Unmarshal(body, &token); err != nil {
+			return "", fmt.Errorf("failed to decode access token: %w", err)
+		}
+		cached = token.AccessToken
+		expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+		return cached, nil
+	}
+}
+
+// GCPSecretManagerSource reads credentials from Google Secret Manager. Every secret contains
+// a JSON object with the keys username, password and tag.
+// If Subscription is set, changes are detected by pulling the Pub/Sub notifications of the
+// secrets, otherwise the versions of the secrets are polled.
+type GCPSecretManagerSource struct {
+	// Secrets maps userIDs to secrets like projects/<project>/secrets/<secret>, optionally
+	// followed by /versions/<version>. The version defaults to the "latest" alias.
+	Secrets map[string]string
+	// Subscription is a Pub/Sub subscription like projects/<project>/subscriptions/<subscription>
+	// to the notification topic of the secrets.
+	Subscription string
+	// PollInterval defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	// Endpoint and PubSubEndpoint override the API endpoints.
+	Endpoint       string
+	PubSubEndpoint string
+	Token          GCPTokenProvider
+	Client         *http.Client
+	Log            logr.Logger
+}
+
+func (s *GCPSecretManagerSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	credentials := make(map[string]UserCredentials, len(s.Secrets))
+	for userID, secret := range s.Secrets {
+		var result struct {
+			Payload struct {
+				Data string `json:"data"`
+			} `json:"payload"`
+		}
+		if err := s.call(ctx, s.endpoint(), http.MethodGet, gcpSecretVersion(secret)+":access", nil, &result); err != nil {
+			return nil, fmt.Errorf("failed to access secret %q: %w", secret, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: failed to decode payload: %w", secret, err)
+		}
+		cred, err := parseCredentialsJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", secret, err)
+		}
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch pulls the notifications from Subscription, or polls the versions of the secrets.
+func (s *GCPSecretManagerSource) Watch(ctx context.Context, changed func()) error {
+	if s.Subscription == "" {
+		return pollForChanges(ctx, pollInterval(s.PollInterval), s.Log, s.versions, changed)
+	}
+	for {
+		if err := s.pull(ctx, changed); err != nil && ctx.Err() == nil {
+			s.Log.V(0).Info("failed to pull notifications, retrying", "subscription", s.Subscription, "error", err.Error())
+			if err := sleep(ctx, pollInterval(s.PollInterval)); err != nil {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// versions returns the resolved versions of the secrets, e.g. the version the "latest" alias points to.
+func (s *GCPSecretManagerSource) versions(ctx context.Context) (string, error) {
+	versions := make([]string, 0, len(s.Secrets))
+	for _, secret := range s.Secrets {
+		var result struct {
+			Name string `json:"name"`
+		}
+		if err := s.call(ctx, s.endpoint(), http.MethodGet, gcpSecretVersion(secret), nil, &result); err != nil {
+			return "", fmt.Errorf("failed to get version of secret %q: %w", secret, err)
+		}
+		versions = append(versions, result.Name)
+	}
+	slices.Sort(versions)
+	return strings.Join(versions, ","), nil
+}
+
+// pull receives and acknowledges notifications, and calls changed if any of them concerns the secrets.
+func (s *GCPSecretManagerSource) pull(ctx context.Context, changed func()) error {
+	var result struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Attributes map[string]string `json:"attributes"`
+			} `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	endpoint := s.PubSubEndpoint
+	if endpoint == "" {
+		endpoint = "https://pubsub.googleapis.com"
+	}
+	if err := s.call(ctx, endpoint, http.MethodPost, s.Subscription+":pull", map[string]any{"maxMessages": 100}, &result); err != nil {
+		return err
+	}
+	if len(result.ReceivedMessages) == 0 {
+		return nil
+	}
+	relevant := false
+	ackIDs := make([]string, 0, len(result.ReceivedMessages))
+	for _, m := range result.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckID)
+		secretID := m.Message.Attributes["secretId"]
+		if secretID == "" || s.isWatched(secretID) {
+			s.Log.V(1).Info("received secret notification", "secret", secretID, "eventType", m.Message.Attributes["eventType"])
+			relevant = true
+		}
+	}
+	if relevant {
+		changed()
+	}
+	var ack struct{}
+	return s.call(ctx, endpoint, http.MethodPost, s.Subscription+":acknowledge", map[string]any{"ackIds": ackIDs}, &ack)
+}
+
+// isWatched returns whether secretID (projects/<project>/secrets/<secret>) is one of Secrets.
+func (s *GCPSecretManagerSource) isWatched(secretID string) bool {
+	for _, secret := range s.Secrets {
+		if name, _, _ := strings.Cut(secret, "/versions/"); name == secretID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *GCPSecretManagerSource) endpoint() string {
+	if s.Endpoint == "" {
+		return "https://secretmanager.googleapis.com"
+	}
+	return s.Endpoint
+}
+
+func (s *GCPSecretManagerSource) call(ctx context.Context, endpoint, method, resource string, body any, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(endpoint, "/")+"/v1/"+resource, &reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := s.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Google Cloud access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	respBody, err := doRequest(s.Client, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// gcpSecretVersion returns the version resource of secret, using the "latest" alias if secret has no version.
+func gcpSecretVersion(secret string) string {
+	if strings.Contains(secret, "/versions/") {
+		return secret
+	}
+	return secret + "/versions/latest"
+}
@@ -0,0 +1,148 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("GCPSecretManagerSource", func() {
+	var (
+		source        *GCPSecretManagerSource
+		mu            sync.Mutex
+		latest        int
+		notifications []string
+		acked         []string
+	)
+
+	BeforeEach(func() {
+		latest = 1
+		notifications = nil
+		acked = nil
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Header.Get("Authorization")).To(Equal("Bearer my-token"))
+			mu.Lock()
+			defer mu.Unlock()
+			switch path := strings.TrimPrefix(r.URL.Path, "/v1/"); path {
+			case "projects/p/secrets/default/versions/latest:access":
+				data := fmt.Sprintf(`{"username":"default","password":"pwd%d"}`, latest)
+				fmt.Fprintf(w, `{"payload":{"data":%q}}`, base64.StdEncoding.EncodeToString([]byte(data)))
+			case "projects/p/secrets/admin/versions/3:access":
+				data := `{"username":"admin","password":"adminpwd","tag":"administrator"}`
+				fmt.Fprintf(w, `{"payload":{"data":%q}}`, base64.StdEncoding.EncodeToString([]byte(data)))
+			case "projects/p/secrets/default/versions/latest":
+				fmt.Fprintf(w, `{"name":"projects/p/secrets/default/versions/%d"}`, latest)
+			case "projects/p/secrets/admin/versions/3":
+				fmt.Fprint(w, `{"name":"projects/p/secrets/admin/versions/3"}`)
+			case "projects/p/subscriptions/secrets:pull":
+				var messages []map[string]any
+				for i, secretID := range notifications {
+					messages = append(messages, map[string]any{
+						"ackId":   fmt.Sprintf("%s-%d", secretID, i),
+						"message": map[string]any{"attributes": map[string]string{"secretId": secretID, "eventType": "SECRET_VERSION_ADD"}},
+					})
+				}
+				notifications = nil
+				if len(messages) == 0 {
+					// Pub/Sub waits for messages before returning an empty response.
+					mu.Unlock()
+					time.Sleep(20 * time.Millisecond)
+					mu.Lock()
+				}
+				Expect(json.NewEncoder(w).Encode(map[string]any{"receivedMessages": messages})).To(Succeed())
+			case "projects/p/subscriptions/secrets:acknowledge":
+				var body struct {
+					AckIDs []string `json:"ackIds"`
+				}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				acked = append(acked, body.AckIDs...)
+				fmt.Fprint(w, `{}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		DeferCleanup(server.Close)
+
+		source = &GCPSecretManagerSource{
+			Secrets: map[string]string{
+				"default": "projects/p/secrets/default",
+				"admin":   "projects/p/secrets/admin/versions/3",
+			},
+			PollInterval:   50 * time.Millisecond,
+			Endpoint:       server.URL,
+			PubSubEndpoint: server.URL,
+			Token: func(context.Context) (string, error) {
+				return "my-token", nil
+			},
+			Client: server.Client(),
+			Log:    initLogging(),
+		}
+	})
+
+	addVersion := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		latest++
+	}
+
+	It("reads the latest or configured versions", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+	})
+
+	watch := func() chan struct{} {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		changes := make(chan struct{}, 10)
+		go func() {
+			_ = source.Watch(ctx, func() { changes <- struct{}{} })
+		}()
+		return changes
+	}
+
+	It("polls the latest version without subscription", func() {
+		changes := watch()
+		Eventually(changes).Should(Receive())
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		addVersion()
+		Eventually(changes).Should(Receive())
+	})
+
+	It("reacts to notifications of the secrets", func() {
+		source.Subscription = "projects/p/subscriptions/secrets"
+		changes := watch()
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		mu.Lock()
+		notifications = []string{"projects/p/secrets/other"}
+		mu.Unlock()
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		addVersion()
+		mu.Lock()
+		notifications = []string{"projects/p/secrets/default"}
+		mu.Unlock()
+		Eventually(changes).Should(Receive())
+		Eventually(func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return acked
+		}).Should(ConsistOf("projects/p/secrets/other-0", "projects/p/secrets/default-0"))
+	})
+})
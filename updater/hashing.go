@@ -0,0 +1,41 @@
+package updater
+
+import (
+	"slices"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// hashingAlgorithms are the hashing algorithms supported by RabbitMQ, from weakest to strongest.
+var hashingAlgorithms = []rabbithole.HashingAlgorithm{
+	rabbithole.HashingAlgorithmMD5,
+	rabbithole.HashingAlgorithmSHA256,
+	rabbithole.HashingAlgorithmSHA512,
+}
+
+// hashingAlgorithm returns the RabbitMQ hashing algorithm with the given name,
+// which may be abbreviated, e.g. "sha512" for "rabbit_password_hashing_sha512".
+func hashingAlgorithm(name string) rabbithole.HashingAlgorithm {
+	switch name {
+	case "sha256", "sha512", "md5":
+		name = "rabbit_password_hashing_" + name
+	}
+	return rabbithole.HashingAlgorithm(name)
+}
+
+// ParseHashingAlgorithm returns the RabbitMQ hashing algorithm with the given name, which may be
+// abbreviated (e.g. "sha512"), or false if it is not supported.
+func ParseHashingAlgorithm(name string) (rabbithole.HashingAlgorithm, bool) {
+	algorithm := hashingAlgorithm(name)
+	return algorithm, slices.Contains(hashingAlgorithms, algorithm)
+}
+
+// atLeast returns minimum if algorithm is a known algorithm that is weaker than minimum, otherwise algorithm.
+// Unknown algorithms, e.g. of custom backends, are not replaced, nor is any algorithm if minimum is empty.
+func atLeast(algorithm, minimum rabbithole.HashingAlgorithm) rabbithole.HashingAlgorithm {
+	i := slices.Index(hashingAlgorithms, algorithm)
+	if i >= 0 && i < slices.Index(hashingAlgorithms, minimum) {
+		return minimum
+	}
+	return algorithm
+}
@@ -0,0 +1,83 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// HTTPSource polls a JSON document of users from an HTTPS endpoint, e.g. an in-house
+// credential service:
+//
+//	{"users": {"default": {"username": "...", "password": "...", "tag": "..."}}}
+//
+// Client certificates for mTLS are configured in Client.
+type HTTPSource struct {
+	URL string
+	// BearerTokenFile optionally contains a token sent in the Authorization header.
+	// It is read for every request, so that it can be rotated.
+	BearerTokenFile string
+	// PollInterval defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	Client       *http.Client
+	Log          logr.Logger
+}
+
+func (s *HTTPSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.BearerTokenFile != "" {
+		token, err := os.ReadFile(s.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	body, err := doRequest(s.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	return parseUsersDocument(body)
+}
+
+// parseUsersDocument parses a JSON document with the credentials of parseCredentialsJSON
+// keyed by userID in "users".
+func parseUsersDocument(content []byte) (map[string]UserCredentials, error) {
+	var document struct {
+		Users map[string]json.RawMessage `json:"users"`
+	}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse users: %w", err)
+	}
+	credentials := make(map[string]UserCredentials, len(document.Users))
+	for userID, user := range document.Users {
+		cred, err := parseCredentialsJSON(user)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", userID, err)
+		}
+		credentials[userID] = cred
+	}
+	return credentials, nil
+}
+
+// Watch polls the document.
+func (s *HTTPSource) Watch(ctx context.Context, changed func()) error {
+	return pollForChanges(ctx, pollInterval(s.PollInterval), s.Log, func(ctx context.Context) (string, error) {
+		credentials, err := s.Load(ctx)
+		if err != nil {
+			return "", err
+		}
+		return credentialsFingerprint(credentials), nil
+	}, changed)
+}
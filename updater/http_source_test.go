@@ -0,0 +1,79 @@
+package updater_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("HTTPSource", func() {
+	var (
+		source   *HTTPSource
+		mu       sync.Mutex
+		password string
+	)
+
+	BeforeEach(func() {
+		password = "pwd1"
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer my-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(w, `{"users":{"default":{"username":"default","password":%q},"admin":{"username":"admin","password":"adminpwd","tag":"administrator"}}}`, password)
+		}))
+		DeferCleanup(server.Close)
+
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("my-token\n"), 0600)).To(Succeed())
+		source = &HTTPSource{
+			URL:             server.URL + "/users",
+			BearerTokenFile: tokenFile,
+			PollInterval:    50 * time.Millisecond,
+			Client:          server.Client(),
+			Log:             initLogging(),
+		}
+	})
+
+	It("reads the users", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+	})
+
+	It("fails without a valid token", func() {
+		Expect(os.WriteFile(source.BearerTokenFile, []byte("wrong"), 0600)).To(Succeed())
+		_, err := source.Load(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("401")))
+	})
+
+	It("reports changed users", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		changes := make(chan struct{}, 10)
+		go func() {
+			_ = source.Watch(ctx, func() { changes <- struct{}{} })
+		}()
+		Eventually(changes).Should(Receive())
+		Consistently(changes, 200*time.Millisecond).ShouldNot(Receive())
+
+		mu.Lock()
+		password = "pwd2"
+		mu.Unlock()
+		Eventually(changes).Should(Receive())
+	})
+})
@@ -0,0 +1,271 @@
+package updater
+
+import (
+	"context"
+	"net/http"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// interceptedClient calls every RabbitMQ Management API function of a RabbitClient through intercept,
+// so that decorators like the rate limiter and the circuit breaker only implement intercept.
+// The other functions, e.g. SetUsername, are those of the embedded RabbitClient.
+type interceptedClient struct {
+	RabbitClient
+	// intercept runs call, which calls the function of the RabbitClient, and returns its error.
+	intercept func(ctx context.Context, call func() error) error
+}
+
+func (c *interceptedClient) GetUser(ctx context.Context, username string) (user *rabbithole.UserInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		user, err = c.RabbitClient.GetUser(ctx, username)
+		return err
+	})
+	return user, err
+}
+
+func (c *interceptedClient) PutUser(ctx context.Context, username string, settings rabbithole.UserSettings) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutUser(ctx, username, settings)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) PutUserWithoutPassword(ctx context.Context, username string, settings rabbithole.UserSettings) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutUserWithoutPassword(ctx, username, settings)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) UpdatePermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.Permissions) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.UpdatePermissionsIn(ctx, vhost, username, permissions)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) UpdateTopicPermissionsIn(ctx context.Context, vhost string, username string, permissions rabbithole.TopicPermissions) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.UpdateTopicPermissionsIn(ctx, vhost, username, permissions)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) GetVhost(ctx context.Context, vhost string) (info *rabbithole.VhostInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		info, err = c.RabbitClient.GetVhost(ctx, vhost)
+		return err
+	})
+	return info, err
+}
+
+func (c *interceptedClient) PutVhost(ctx context.Context, vhost string, settings rabbithole.VhostSettings) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutVhost(ctx, vhost, settings)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) PutUserLimits(ctx context.Context, username string, limits rabbithole.UserLimitsValues) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutUserLimits(ctx, username, limits)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) PutVhostLimits(ctx context.Context, vhost string, limits rabbithole.VhostLimitsValues) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutVhostLimits(ctx, vhost, limits)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) DeleteUser(ctx context.Context, username string) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.DeleteUser(ctx, username)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) GetPermissionsIn(ctx context.Context, vhost string, username string) (permissions rabbithole.PermissionInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		permissions, err = c.RabbitClient.GetPermissionsIn(ctx, vhost, username)
+		return err
+	})
+	return permissions, err
+}
+
+func (c *interceptedClient) ListPermissionsOf(ctx context.Context, username string) (permissions []rabbithole.PermissionInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		permissions, err = c.RabbitClient.ListPermissionsOf(ctx, username)
+		return err
+	})
+	return permissions, err
+}
+
+func (c *interceptedClient) ClearPermissionsIn(ctx context.Context, vhost string, username string) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.ClearPermissionsIn(ctx, vhost, username)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) ListTopicPermissionsOf(ctx context.Context, username string) (permissions []rabbithole.TopicPermissionInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		permissions, err = c.RabbitClient.ListTopicPermissionsOf(ctx, username)
+		return err
+	})
+	return permissions, err
+}
+
+func (c *interceptedClient) ClearTopicPermissionsIn(ctx context.Context, vhost string, username string) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.ClearTopicPermissionsIn(ctx, vhost, username)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) ListConnectionsOfUser(ctx context.Context, username string) (connections []rabbithole.UserConnectionInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		connections, err = c.RabbitClient.ListConnectionsOfUser(ctx, username)
+		return err
+	})
+	return connections, err
+}
+
+func (c *interceptedClient) CloseConnection(ctx context.Context, name string, reason string) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.CloseConnection(ctx, name, reason)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) ExportDefinitions(ctx context.Context) (definitions Definitions, err error) {
+	err = c.intercept(ctx, func() error {
+		definitions, err = c.RabbitClient.ExportDefinitions(ctx)
+		return err
+	})
+	return definitions, err
+}
+
+func (c *interceptedClient) UploadDefinitions(ctx context.Context, definitions Definitions) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.UploadDefinitions(ctx, definitions)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) ListRuntimeParametersFor(ctx context.Context, component string) (params []rabbithole.RuntimeParameter, err error) {
+	err = c.intercept(ctx, func() error {
+		params, err = c.RabbitClient.ListRuntimeParametersFor(ctx, component)
+		return err
+	})
+	return params, err
+}
+
+func (c *interceptedClient) PutRuntimeParameter(ctx context.Context, component string, vhost string, name string, value any) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutRuntimeParameter(ctx, component, vhost, name, value)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) GetPolicy(ctx context.Context, vhost string, name string) (policy *rabbithole.Policy, err error) {
+	err = c.intercept(ctx, func() error {
+		policy, err = c.RabbitClient.GetPolicy(ctx, vhost, name)
+		return err
+	})
+	return policy, err
+}
+
+func (c *interceptedClient) PutPolicy(ctx context.Context, vhost string, name string, policy rabbithole.Policy) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutPolicy(ctx, vhost, name, policy)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) DeletePolicy(ctx context.Context, vhost string, name string) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.DeletePolicy(ctx, vhost, name)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) GetOperatorPolicy(ctx context.Context, vhost string, name string) (policy *rabbithole.OperatorPolicy, err error) {
+	err = c.intercept(ctx, func() error {
+		policy, err = c.RabbitClient.GetOperatorPolicy(ctx, vhost, name)
+		return err
+	})
+	return policy, err
+}
+
+func (c *interceptedClient) PutOperatorPolicy(ctx context.Context, vhost string, name string, policy rabbithole.OperatorPolicy) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.PutOperatorPolicy(ctx, vhost, name, policy)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) DeleteOperatorPolicy(ctx context.Context, vhost string, name string) (resp *http.Response, err error) {
+	err = c.intercept(ctx, func() error {
+		resp, err = c.RabbitClient.DeleteOperatorPolicy(ctx, vhost, name)
+		return err
+	})
+	return resp, err
+}
+
+func (c *interceptedClient) Whoami(ctx context.Context) (info *rabbithole.WhoamiInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		info, err = c.RabbitClient.Whoami(ctx)
+		return err
+	})
+	return info, err
+}
+
+func (c *interceptedClient) HealthCheckAlarms(ctx context.Context) (status rabbithole.ResourceAlarmCheckStatus, err error) {
+	err = c.intercept(ctx, func() error {
+		status, err = c.RabbitClient.HealthCheckAlarms(ctx)
+		return err
+	})
+	return status, err
+}
+
+func (c *interceptedClient) ListNodes(ctx context.Context) (nodes []rabbithole.NodeInfo, err error) {
+	err = c.intercept(ctx, func() error {
+		nodes, err = c.RabbitClient.ListNodes(ctx)
+		return err
+	})
+	return nodes, err
+}
+
+func (c *interceptedClient) AlivenessTest(ctx context.Context, vhost string) error {
+	return c.intercept(ctx, func() error {
+		return c.RabbitClient.AlivenessTest(ctx, vhost)
+	})
+}
+
+func (c *interceptedClient) Overview(ctx context.Context) (overview *rabbithole.Overview, err error) {
+	err = c.intercept(ctx, func() error {
+		overview, err = c.RabbitClient.Overview(ctx)
+		return err
+	})
+	return overview, err
+}
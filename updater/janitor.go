@@ -0,0 +1,105 @@
+package updater
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"time"
+)
+
+// DefaultProtectedUsers is used by NewPasswordUpdater: the guest user, which the cluster operator manages.
+var DefaultProtectedUsers = []string{"guest"}
+
+// deleteFileSuffix is the suffix of the optional marker file that deletes a user on the next sync,
+// e.g. user_default_delete. It may contain the username, if the other files of the user are gone.
+const deleteFileSuffix = "_delete"
+
+// deleteRemovedUsers deletes the users whose secrets have been removed from the source, i.e. that
+// were applied before but are no longer part of loaded, once DeleteGracePeriod has passed.
+// Their permissions and topic permissions are cleared as well. The admin user, the ProtectedUsers
+// and users that are not selected by IncludeUsers and ExcludeUsers are never deleted.
+// Failed deletions are logged and retried with the RetryPolicy.
+func (u *PasswordUpdater) deleteRemovedUsers(ctx context.Context, loaded map[string]UserCredentials) {
+	if !u.DeleteRemovedUsers {
+		return
+	}
+	// Users are known from the current state and, across restarts, from the state file.
+	usernames := make(map[string]string)
+	for userID, a := range u.applied {
+		usernames[userID] = a.Username
+	}
+	for userID, cred := range u.CredentialState {
+		usernames[userID] = cred.Username
+	}
+	for userID := range u.removedUsers {
+		if _, exists := loaded[userID]; exists {
+			u.Log.V(0).Info("secrets of removed user reappeared, cancelling deletion", "userID", userID)
+			delete(u.removedUsers, userID)
+		}
+	}
+
+	now := time.Now()
+	for _, userID := range slices.Sorted(maps.Keys(usernames)) {
+		username := usernames[userID]
+		if _, exists := loaded[userID]; exists || username == "" || u.isClientUser(userID) || !u.isSelected(userID) || u.isProtected(username) {
+			continue
+		}
+		due, pending := u.removedUsers[userID]
+		if !pending {
+			due = now.Add(u.DeleteGracePeriod)
+			u.removedUsers[userID] = due
+			u.Log.V(0).Info("secrets of user removed, scheduling deletion", "user", username, "gracePeriod", u.DeleteGracePeriod.String())
+		}
+		if now.Before(due) {
+			continue
+		}
+		if err := u.backupDefinitions(ctx); err != nil {
+			u.Log.Error(err, "failed to back up definitions before deleting removed user", "user", username)
+			u.removedUsers[userID] = now.Add(u.RetryPolicy.delay(0))
+			continue
+		}
+		if err := u.deleteUser(ctx, username); err != nil {
+			u.Log.Error(err, "failed to delete removed user", "user", username)
+			u.removedUsers[userID] = now.Add(u.RetryPolicy.delay(0))
+			continue
+		}
+		u.Log.V(0).Info("deleted removed user on RabbitMQ server", "user", username)
+		delete(u.removedUsers, userID)
+		u.mu.Lock()
+		delete(u.CredentialState, userID)
+		u.mu.Unlock()
+		u.forgetApplied(userID)
+	}
+
+	u.deletions = nil
+	if len(u.removedUsers) > 0 {
+		next := slices.MinFunc(slices.Collect(maps.Values(u.removedUsers)), time.Time.Compare)
+		u.deletions = time.After(time.Until(next))
+	}
+}
+
+// deleteUser deletes username on the RabbitMQ server, after clearing its permissions, so that no
+// permissions remain e.g. if the user is deleted concurrently. A user that does not exist is not an error.
+func (u *PasswordUpdater) deleteUser(ctx context.Context, username string) error {
+	if err := u.clearPermissions(ctx, username); err != nil {
+		return err
+	}
+	err := u.retry(ctx, http.MethodDelete+" /api/users/"+username, func() (err error) {
+		_, err = u.adminClient.DeleteUser(ctx, username)
+		return err
+	})
+	if err != nil && err.Error() != errNotFound {
+		return err
+	}
+	return nil
+}
+
+// isProtected returns true if username matches one of the ProtectedUsers.
+func (u *PasswordUpdater) isProtected(username string) bool {
+	return slices.ContainsFunc(u.ProtectedUsers, func(pattern string) bool {
+		matched, _ := path.Match(pattern, username)
+		return matched
+	})
+}
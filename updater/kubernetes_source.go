@@ -0,0 +1,165 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// Backoff bounds for re-establishing a watch after it failed.
+	watchInitialDelay = time.Second
+	watchMaxDelay     = time.Minute
+)
+
+// KubernetesSource reads credentials directly from the Kubernetes Secrets in Namespace that
+// match LabelSelector, so that no mounted volume is required. The keys of the secrets follow
+// the same convention as the files in a watch directory, e.g. user_<id>_password.
+// Changes are detected by an informer, which avoids the kubelet sync delay.
+type KubernetesSource struct {
+	Namespace     string
+	LabelSelector string
+	Client        kubernetes.Interface
+	Log           logr.Logger
+
+	// lister reads the secrets from the cache of the informer, once Watch has synced it.
+	lister atomic.Pointer[corev1listers.SecretLister]
+}
+
+// NewInClusterKubernetesSource returns a KubernetesSource that authenticates with the
+// service account of the Pod. If namespace is empty, the namespace of the Pod is used.
+func NewInClusterKubernetesSource(namespace, labelSelector string, log logr.Logger) (*KubernetesSource, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster configuration: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	if namespace == "" {
+		content, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(content))
+	}
+	return &KubernetesSource{
+		Namespace:     namespace,
+		LabelSelector: labelSelector,
+		Client:        client,
+		Log:           log,
+	}, nil
+}
+
+// Load reads the credentials from the cache of the informer, or from the API server until
+// Watch has synced the cache.
+func (s *KubernetesSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	var secrets []*corev1.Secret
+	if lister := s.lister.Load(); lister != nil {
+		var err error
+		secrets, err = (*lister).Secrets(s.Namespace).List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list cached secrets: %w", err)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		list, err := s.Client.CoreV1().Secrets(s.Namespace).List(ctx, metav1.ListOptions{LabelSelector: s.LabelSelector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list secrets: %w", err)
+		}
+		for i := range list.Items {
+			secrets = append(secrets, &list.Items[i])
+		}
+	}
+	// Sort by name, so that duplicate keys in several secrets are resolved deterministically.
+	slices.SortFunc(secrets, func(a, b *corev1.Secret) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	credentials := make(map[string]UserCredentials)
+	for _, secret := range secrets {
+		for key, value := range secret.Data {
+			userID, field, ok := parseSecretKey(key)
+			if !ok {
+				s.Log.V(4).Info("ignoring secret key with unexpected name format", "secret", secret.Name, "key", key)
+				continue
+			}
+			cred := credentials[userID]
+			cred.set(field, strings.TrimSpace(string(value)))
+			credentials[userID] = cred
+		}
+	}
+	return credentials, nil
+}
+
+// Watch runs an informer for the secrets and calls changed for every added, updated or deleted secret.
+// Listing and watching again after failures or expired watches is left to the informer.
+func (s *KubernetesSource) Watch(ctx context.Context, changed func()) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.Client, 0,
+		informers.WithNamespace(s.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = s.LabelSelector
+		}),
+	)
+	defer factory.Shutdown()
+	secrets := factory.Core().V1().Secrets()
+	informer := secrets.Informer()
+	if err := informer.SetWatchErrorHandlerWithContext(func(_ context.Context, _ *cache.Reflector, err error) {
+		s.Log.V(0).Info("failed to watch secrets, retrying", "namespace", s.Namespace, "error", err.Error())
+	}); err != nil {
+		return fmt.Errorf("failed to set watch error handler: %w", err)
+	}
+	report := func(event string, obj any) {
+		if secret, ok := obj.(*corev1.Secret); ok {
+			s.Log.V(4).Info("secret changed", "secret", secret.Name, "type", event)
+		}
+		changed()
+	}
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			// The initial list is reported once the cache has synced.
+			if !isInInitialList {
+				report("ADDED", obj)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			if oldObj.(*corev1.Secret).ResourceVersion != newObj.(*corev1.Secret).ResourceVersion {
+				report("MODIFIED", newObj)
+			}
+		},
+		DeleteFunc: func(obj any) {
+			report("DELETED", obj)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add event handler: %w", err)
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return ctx.Err()
+	}
+	lister := secrets.Lister()
+	s.lister.Store(&lister)
+	defer s.lister.Store(nil)
+	// Secrets may have changed before watching.
+	changed()
+	<-ctx.Done()
+	return ctx.Err()
+}
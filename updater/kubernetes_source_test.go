@@ -0,0 +1,87 @@
+package updater_test
+
+import (
+	"context"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("KubernetesSource", func() {
+	var (
+		client *fake.Clientset
+		source *KubernetesSource
+	)
+
+	secret := func(name string, labels map[string]string, data map[string]string) *corev1.Secret {
+		s := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rabbitmq", Labels: labels},
+			Data:       map[string][]byte{},
+		}
+		for key, value := range data {
+			s.Data[key] = []byte(value)
+		}
+		return s
+	}
+	labels := map[string]string{"app": "rabbitmq"}
+
+	BeforeEach(func() {
+		client = fake.NewClientset(
+			secret("admin", labels, map[string]string{"user_admin_username": "admin", "user_admin_password": "pwd1\n"}),
+			secret("default", labels, map[string]string{"user_default_username": "default", "user_default_password": "pwd1", "other": "ignored"}),
+			secret("unrelated", map[string]string{"app": "other"}, map[string]string{"user_other_username": "other", "user_other_password": "pwd1"}),
+		)
+		source = &KubernetesSource{
+			Namespace:     "rabbitmq",
+			LabelSelector: "app=rabbitmq",
+			Client:        client,
+			Log:           initLogging(),
+		}
+	})
+
+	It("loads the credentials from the secrets", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"admin":   {Username: "admin", Password: "pwd1"},
+			"default": {Username: "default", Password: "pwd1"},
+		}))
+	})
+
+	It("reports changes of the secrets", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		var changes atomic.Int32
+		done := make(chan error, 1)
+		go func() {
+			done <- source.Watch(ctx, func() { changes.Add(1) })
+		}()
+		// The initial list is reported as a single change.
+		Eventually(changes.Load).Should(BeEquivalentTo(1))
+
+		updated := secret("default", labels, map[string]string{"user_default_username": "default", "user_default_password": "pwd2"})
+		updated.ResourceVersion = "2"
+		_, err := client.CoreV1().Secrets("rabbitmq").Update(ctx, updated, metav1.UpdateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(changes.Load).Should(BeEquivalentTo(2))
+		// The credentials are loaded from the cache of the informer.
+		Eventually(func() (map[string]UserCredentials, error) {
+			return source.Load(ctx)
+		}).Should(HaveKeyWithValue("default", UserCredentials{Username: "default", Password: "pwd2"}))
+
+		Expect(client.CoreV1().Secrets("rabbitmq").Delete(ctx, "admin", metav1.DeleteOptions{})).To(Succeed())
+		Eventually(changes.Load).Should(BeEquivalentTo(3))
+		Eventually(func() (map[string]UserCredentials, error) {
+			return source.Load(ctx)
+		}).Should(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd2"},
+		}))
+
+		cancel()
+		Eventually(done).Should(Receive(MatchError(context.Canceled)))
+	})
+})
@@ -0,0 +1,162 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// limitsFileSuffix is the suffix of the optional file with the limits of a user,
+// e.g. user_default_limits, see parseLimits.
+const limitsFileSuffix = "_limits"
+
+// vhostLimitsFileSuffix is the suffix of the optional companion file of user_<id>_vhosts
+// with the limits of the vhosts, e.g. user_default_vhost_limits, see parseVHostLimits.
+const vhostLimitsFileSuffix = "_vhost_limits"
+
+// userLimitNames and vhostLimitNames are the limits supported by RabbitMQ per user and per vhost.
+var (
+	userLimitNames  = []string{"max-connections", "max-channels"}
+	vhostLimitNames = []string{"max-connections", "max-queues"}
+)
+
+// parseLimits parses the limits of a user, either as JSON object {"max-connections": ..., "max-channels": ...}
+// or as lines "max-connections=<n>". A negative value means unlimited.
+func parseLimits(content []byte) (rabbithole.UserLimitsValues, error) {
+	content = bytes.TrimSpace(content)
+	limits := make(rabbithole.UserLimitsValues)
+	if bytes.HasPrefix(content, []byte("{")) {
+		if err := json.Unmarshal(content, &limits); err != nil {
+			return nil, fmt.Errorf("failed to parse limits: %w", err)
+		}
+	} else {
+		for i, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := parseLimit(limits, line); err != nil {
+				return nil, fmt.Errorf("failed to parse limits: line %d: %w", i+1, err)
+			}
+		}
+	}
+	if err := checkLimits(limits, userLimitNames); err != nil {
+		return nil, fmt.Errorf("failed to parse limits: %w", err)
+	}
+	return limits, nil
+}
+
+// parseVHostLimits parses the limits per vhost, either as JSON object
+// {"<vhost>": {"max-connections": ..., "max-queues": ...}} or as lines "<vhost>=max-connections=<n>,max-queues=<n>".
+// A negative value means unlimited.
+func parseVHostLimits(content []byte) (map[string]rabbithole.VhostLimitsValues, error) {
+	content = bytes.TrimSpace(content)
+	limits := make(map[string]rabbithole.VhostLimitsValues)
+	if bytes.HasPrefix(content, []byte("{")) {
+		if err := json.Unmarshal(content, &limits); err != nil {
+			return nil, fmt.Errorf("failed to parse vhost limits: %w", err)
+		}
+	} else {
+		for i, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			vhost, values, found := strings.Cut(line, "=")
+			if !found || vhost == "" {
+				return nil, fmt.Errorf("failed to parse vhost limits: line %d: expected <vhost>=<limit>=<value>,...", i+1)
+			}
+			vhostLimits := make(rabbithole.VhostLimitsValues)
+			for _, value := range strings.Split(values, ",") {
+				if err := parseLimit(vhostLimits, value); err != nil {
+					return nil, fmt.Errorf("failed to parse vhost limits: line %d: %w", i+1, err)
+				}
+			}
+			limits[vhost] = vhostLimits
+		}
+	}
+	for vhost, values := range limits {
+		if err := checkLimits(values, vhostLimitNames); err != nil {
+			return nil, fmt.Errorf("failed to parse vhost limits of %q: %w", vhost, err)
+		}
+	}
+	return limits, nil
+}
+
+// parseLimit parses "<limit>=<value>" into limits.
+func parseLimit(limits map[string]int, s string) error {
+	name, value, found := strings.Cut(s, "=")
+	if !found {
+		return fmt.Errorf("expected <limit>=<value>, got %q", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	limits[strings.TrimSpace(name)] = n
+	return nil
+}
+
+// checkLimits returns an error if limits contains a limit that is not known.
+func checkLimits(limits map[string]int, known []string) error {
+	for name := range limits {
+		if !slices.Contains(known, name) {
+			return fmt.Errorf("unknown limit %q, expected one of %s", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// updateLimits sets the limits of username and of the vhosts in vhostLimits.
+// Limits that are not set are left unchanged, as are limits that the broker does not support.
+// With CreateVhosts, missing vhosts are created first.
+func (u *PasswordUpdater) updateLimits(ctx context.Context, username string, limits rabbithole.UserLimitsValues, vhostLimits map[string]rabbithole.VhostLimitsValues) error {
+	if len(limits) > 0 && !u.broker.supports(userLimitsVersion) {
+		u.Log.V(0).Info("user limits are not supported by RabbitMQ, skipping them", "user", username,
+			"version", u.broker.version.String())
+		limits = nil
+	}
+	if len(vhostLimits) > 0 && !u.broker.supports(vhostLimitsVersion) {
+		u.Log.V(0).Info("vhost limits are not supported by RabbitMQ, skipping them", "user", username,
+			"version", u.broker.version.String())
+		vhostLimits = nil
+	}
+	if len(limits) > 0 {
+		err := u.retry(ctx, http.MethodPut+" /api/user-limits/"+username, func() (err error) {
+			_, err = u.adminClient.PutUserLimits(ctx, username, limits)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update limits on RabbitMQ server: %w", err)
+		}
+		u.Log.V(1).Info("set limits on RabbitMQ server", "user", username, "limits", slices.Sorted(maps.Keys(limits)))
+	}
+	for _, vhost := range slices.Sorted(maps.Keys(vhostLimits)) {
+		if len(vhostLimits[vhost]) == 0 {
+			continue
+		}
+		if u.CreateVhosts {
+			if err := u.ensureVhost(ctx, vhost); err != nil {
+				return err
+			}
+		}
+		err := u.retry(ctx, http.MethodPut+" /api/vhost-limits/"+url.PathEscape(vhost), func() (err error) {
+			_, err = u.adminClient.PutVhostLimits(ctx, vhost, vhostLimits[vhost])
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update limits of vhost %q on RabbitMQ server: %w", vhost, err)
+		}
+		u.Log.V(1).Info("set vhost limits on RabbitMQ server", "vhost", vhost, "limits", slices.Sorted(maps.Keys(vhostLimits[vhost])))
+	}
+	return nil
+}
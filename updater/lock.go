@@ -0,0 +1,68 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const lockPollInterval = 100 * time.Millisecond
+
+var errLockNotSupported = errors.New("file locking is not supported on this platform")
+
+// acquireLock opens (and creates if needed) the lock file and waits until it holds an
+// exclusive advisory lock on it, so that updaters on different nodes sharing a volume do
+// not interleave their updates. The returned function releases the lock.
+func (u *PasswordUpdater) acquireLock(ctx context.Context) (func(), error) {
+	return u.lockFile(ctx, u.LockFile)
+}
+
+// adminFileLockSuffix is appended to the AdminFile for the lock file of its writers, see lockAdminFile.
+const adminFileLockSuffix = ".lock"
+
+// lockAdminFile waits until it holds an exclusive advisory lock on the lock file of the admin file
+// (creating it if needed), so that concurrent writers (e.g. a second updater) do not lose each other's
+// changes to other sections. The admin file itself is replaced atomically, so readers need no lock.
+// Without file locking support, it is not locked.
+func (u *PasswordUpdater) lockAdminFile(ctx context.Context) (func(), error) {
+	release, err := u.lockFile(ctx, u.AdminFile+adminFileLockSuffix)
+	if errors.Is(err, errLockNotSupported) {
+		return func() {}, nil
+	}
+	return release, err
+}
+
+// lockFile opens (and creates if needed) path and waits until it holds an exclusive advisory lock on it.
+// The returned function releases the lock.
+func (u *PasswordUpdater) lockFile(ctx context.Context, path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	for waiting := false; ; waiting = true {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock file: %w", err)
+		}
+		if locked {
+			break
+		}
+		if !waiting {
+			u.Log.V(1).Info("waiting for lock held by another process", "file", path)
+		}
+		if err := sleep(ctx, lockPollInterval); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	u.Log.V(2).Info("acquired lock", "file", path)
+	return func() {
+		if err := unlock(f); err != nil {
+			u.Log.Error(err, "failed to unlock file", "file", path)
+		}
+		f.Close()
+	}, nil
+}
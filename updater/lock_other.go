@@ -0,0 +1,13 @@
+//go:build !unix
+
+package updater
+
+import "os"
+
+func tryLock(_ *os.File) (bool, error) {
+	return false, errLockNotSupported
+}
+
+func unlock(_ *os.File) error {
+	return errLockNotSupported
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package updater
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock tries to acquire an exclusive flock on f without blocking.
+// It returns false if the lock is held by someone else.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
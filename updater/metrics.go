@@ -0,0 +1,22 @@
+package updater
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "credential_updater"
+
+var (
+	retryQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "retry_queue_length",
+		Help:      "Number of users whose credential update failed and is waiting to be retried.",
+	})
+)
+
+// RegisterMetrics registers the updater's metrics with the given registerer.
+func RegisterMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(
+		retryQueueLength,
+	)
+}
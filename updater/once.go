@@ -0,0 +1,74 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+)
+
+// StaticSource provides fixed credentials, e.g. read once from stdin by ReadUsersDocument.
+type StaticSource map[string]UserCredentials
+
+func (s StaticSource) Load(_ context.Context) (map[string]UserCredentials, error) {
+	return maps.Clone(s), nil
+}
+
+// ReadUsersDocument reads a JSON document of users in the format of HTTPSource:
+//
+//	{"users": {"default": {"username": "...", "password": "...", "tag": "..."}}}
+func ReadUsersDocument(r io.Reader) (StaticSource, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users: %w", err)
+	}
+	return parseUsersDocument(content)
+}
+
+// RunOnce applies the credentials of Source once, e.g. in CI jobs and migration scripts,
+// instead of watching for changes with HandleEvents. Updated passwords are verified by
+// authenticating with them. Failed updates are not retried but returned as error.
+func (u *PasswordUpdater) RunOnce(ctx context.Context) error {
+	if u.LockFile != "" {
+		release, err := u.acquireLock(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to acquire lock %q: %w", u.LockFile, err)
+		}
+		defer release()
+	}
+	if err := u.checkBroker(ctx); err != nil {
+		return err
+	}
+	// All users are reconciled, the credentials loaded at startup may not have been applied yet.
+	if err := u.processSecrets(ctx, true); err != nil {
+		return err
+	}
+	var errs []error
+	for _, userID := range slices.Sorted(maps.Keys(u.CredentialSpec)) {
+		if err := u.lastErrors[userID]; err != nil {
+			errs = append(errs, fmt.Errorf("user %q: %w", userID, err))
+			continue
+		}
+		if u.retries.attempts(userID) > 0 {
+			// Postponed, e.g. due to resource alarms.
+			errs = append(errs, fmt.Errorf("user %q: not updated", userID))
+			continue
+		}
+		cred := u.CredentialState[userID]
+		if !cred.hasPassword() {
+			// A password hash cannot be used to authenticate, nor can a disabled, deleted or passwordless user.
+			continue
+		}
+		u.authClient.SetUsername(cred.Username)
+		u.authClient.SetPassword(cred.Password)
+		if err := u.authenticate(ctx, u.authClient); err != nil {
+			errs = append(errs, fmt.Errorf("user %q: failed to verify credentials: %w", userID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to apply credentials: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package updater_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("RunOnce", func() {
+	var (
+		adminClient *fakeRabbitClient
+		authClient  *fakeRabbitClient
+		u           *PasswordUpdater
+	)
+
+	BeforeEach(func() {
+		source, err := ReadUsersDocument(strings.NewReader(`{"users": {
+			"admin": {"username": "admin", "password": "pwd1", "tag": "administrator"},
+			"default": {"username": "default", "password": "pwd1", "tag": "mytag"}
+		}}`))
+		Expect(err).NotTo(HaveOccurred())
+		adminClient = &fakeRabbitClient{
+			getUserReturn: map[string]getUserReturn{
+				"admin":   {userInfo: &rabbithole.UserInfo{HashingAlgorithm: "adminalgo", Tags: rabbithole.UserTags{"administrator"}}},
+				"default": {userInfo: &rabbithole.UserInfo{HashingAlgorithm: "myalgo", Tags: rabbithole.UserTags{"mytag"}}},
+			},
+			putUserReturn: putUserReturn{resp: &http.Response{Status: "204 No Content"}},
+		}
+		authClient = &fakeRabbitClient{}
+		u, err = NewPasswordUpdaterWithSource(testAdminFile, source, "", initLogging(), adminClient, authClient)
+		Expect(err).NotTo(HaveOccurred())
+		u.RetryPolicy.MaxAttempts = 1
+	})
+
+	It("verifies the credentials without updating accepted ones", func() {
+		Expect(u.RunOnce(context.Background())).To(Succeed())
+		Expect(adminClient.PutUserCalls).To(BeEmpty())
+		Expect(authClient.WhoamiCalls).NotTo(BeEmpty())
+	})
+
+	It("fails if the updated credentials are rejected", func() {
+		authClient.whoamiReturn = whoamiReturn{err: errors.New("Error: API responded with a 401 Unauthorized")}
+		err := u.RunOnce(context.Background())
+		Expect(err).To(MatchError(ContainSubstring(`user "default": failed to verify credentials`)))
+		Expect(adminClient.PutUserCalls).To(ContainElement(HaveField("Username", "default")))
+	})
+
+	When("the admin user does not exist yet", func() {
+		BeforeEach(func() {
+			u.BootstrapUserID = "default"
+			authClient.whoamiErrors = []error{errors.New("Error: API responded with a 401 Unauthorized")}
+			adminClient.getUserReturn["admin"] = getUserReturn{err: errors.New("Error 404 (Object Not Found): Not Found")}
+		})
+		It("creates it with the bootstrap credentials", func() {
+			Expect(u.RunOnce(context.Background())).To(Succeed())
+			Expect(adminClient.PutUserCalls[0]).To(Equal(PutUserCall{Username: "admin", Settings: rabbithole.UserSettings{
+				Name: "admin", Tags: rabbithole.UserTags{"administrator"}, Password: "pwd1", HashingAlgorithm: rabbithole.HashingAlgorithmSHA256,
+			}}))
+			Expect(adminClient.UpdatePermissionsInCalls).To(ContainElement(UpdatePermissionsInCall{
+				Vhost: "/", Username: "admin", Permissions: rabbithole.Permissions{Configure: ".*", Write: ".*", Read: ".*"}}))
+		})
+		It("fails without bootstrap credentials", func() {
+			u.BootstrapUserID = "seed"
+			Expect(u.RunOnce(context.Background())).To(MatchError(ErrInvalidAdminCredentials))
+			Expect(adminClient.PutUserCalls).To(BeEmpty())
+		})
+	})
+	When("RabbitMQ is too old for topic permissions and limits", func() {
+		BeforeEach(func() {
+			source := StaticSource{
+				"admin": {Username: "admin", Password: "pwd1", Tag: "administrator"},
+				"default": {Username: "default", Password: "pwd1", Tag: "mytag",
+					TopicPermissions: []TopicPermission{{VHost: "/", TopicPermissions: rabbithole.TopicPermissions{Exchange: "amq.topic", Write: ".*", Read: ".*"}}},
+					Limits:           rabbithole.UserLimitsValues{"max-connections": 10},
+				},
+			}
+			var err error
+			u, err = NewPasswordUpdaterWithSource(testAdminFile, source, "", initLogging(), adminClient, authClient)
+			Expect(err).NotTo(HaveOccurred())
+			u.RetryPolicy.MaxAttempts = 1
+			adminClient.overview = &rabbithole.Overview{RabbitMQVersion: "3.6.16"}
+		})
+		It("skips them", func() {
+			Expect(u.RunOnce(context.Background())).To(Succeed())
+			Expect(adminClient.UpdateTopicPermissionsInCalls).To(BeEmpty())
+			Expect(adminClient.PutUserLimitsCalls).To(BeEmpty())
+		})
+		It("applies them once RabbitMQ supports them", func() {
+			adminClient.overview.RabbitMQVersion = "3.13.7"
+			Expect(u.RunOnce(context.Background())).To(Succeed())
+			Expect(adminClient.UpdateTopicPermissionsInCalls).To(HaveLen(1))
+			Expect(adminClient.PutUserLimitsCalls).To(HaveLen(1))
+		})
+	})
+
+	When("RabbitMQ is older than the minimum version", func() {
+		BeforeEach(func() {
+			adminClient.overview = &rabbithole.Overview{RabbitMQVersion: "3.11.28"}
+			var ok bool
+			u.MinRabbitMQVersion, ok = ParseRabbitMQVersion("3.12")
+			Expect(ok).To(BeTrue())
+		})
+		It("refuses to run", func() {
+			err := u.RunOnce(context.Background())
+			Expect(err).To(MatchError(ErrUnsupportedBroker))
+			Expect(err).To(MatchError(ContainSubstring("RabbitMQ 3.11.28 is older than the minimum version 3.12.0")))
+			Expect(adminClient.PutUserCalls).To(BeEmpty())
+		})
+		It("runs once RabbitMQ is upgraded", func() {
+			adminClient.overview.RabbitMQVersion = "3.12.0-rc.1"
+			Expect(u.RunOnce(context.Background())).To(Succeed())
+		})
+	})
+
+	When("RabbitMQ reports that the admin user was authenticated by another auth backend", func() {
+		BeforeEach(func() {
+			adminClient.whoamiReturn = whoamiReturn{info: &rabbithole.WhoamiInfo{Name: "admin", AuthBackend: "rabbit_auth_backend_ldap"}}
+		})
+		It("only warns by default", func() {
+			Expect(u.RunOnce(context.Background())).To(Succeed())
+		})
+		It("refuses to run if the internal auth backend is required", func() {
+			u.RequireInternalAuthBackend = true
+			Expect(u.RunOnce(context.Background())).To(MatchError(ErrAuthBackend))
+			Expect(adminClient.PutUserCalls).To(BeEmpty())
+			Expect(authClient.WhoamiCalls).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package updater
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// federationUpstreamURIKeys are the keys of the AMQP URIs in the value of a federation upstream.
+var federationUpstreamURIKeys = []string{"uri"}
+
+// shovelComponent is the runtime parameter component of dynamic shovels.
+const shovelComponent = "shovel"
+
+// shovelURIKeys are the keys of the source and destination URIs in the value of a dynamic shovel.
+var shovelURIKeys = []string{"src-uri", "dest-uri"}
+
+// parameterURIs returns the keys of the URIs per runtime parameter component whose credentials
+// are updated: those of ParameterURIs, federation upstreams and shovels.
+func (u *PasswordUpdater) parameterURIs() map[string][]string {
+	uris := make(map[string][]string, len(u.ParameterURIs)+2)
+	add := func(component string, keys []string) {
+		for _, key := range keys {
+			if !slices.Contains(uris[component], key) {
+				uris[component] = append(uris[component], key)
+			}
+		}
+	}
+	for component, keys := range u.ParameterURIs {
+		add(component, keys)
+	}
+	if u.UpdateFederationUpstreams {
+		add(rabbithole.FederationUpstreamComponent, federationUpstreamURIKeys)
+	}
+	if u.UpdateShovels {
+		add(shovelComponent, shovelURIKeys)
+	}
+	return uris
+}
+
+// updateAllParameterURIs replaces the password of username in the URIs of all parameterURIs.
+func (u *PasswordUpdater) updateAllParameterURIs(ctx context.Context, username, password string) {
+	uris := u.parameterURIs()
+	for _, component := range slices.Sorted(maps.Keys(uris)) {
+		u.updateParameterURIs(ctx, component, uris[component], username, password)
+	}
+}
+
+// updateParameterURIs replaces the password of username in the AMQP URIs under keys of the runtime
+// parameters of component, e.g. federation upstreams, so that they keep working after the password
+// was updated. Failures are logged, since the credentials were updated nevertheless.
+func (u *PasswordUpdater) updateParameterURIs(ctx context.Context, component string, keys []string, username, password string) {
+	var params []rabbithole.RuntimeParameter
+	err := u.retry(ctx, http.MethodGet+" /api/parameters/"+url.PathEscape(component), func() (err error) {
+		params, err = u.adminClient.ListRuntimeParametersFor(ctx, component)
+		return err
+	})
+	// The plugin of the component may not be enabled.
+	if err != nil && err.Error() != errNotFound {
+		u.Log.Error(err, "failed to list runtime parameters", "component", component)
+		return
+	}
+	for _, param := range params {
+		value, ok := param.Value.(map[string]any)
+		if !ok {
+			continue
+		}
+		changed := false
+		for _, key := range keys {
+			if uris, ok := replaceURIPasswords(value[key], username, password); ok {
+				value[key] = uris
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		pathParam := "/api/parameters/" + url.PathEscape(component) + "/" + url.PathEscape(param.Vhost) + "/" + url.PathEscape(param.Name)
+		err := u.retry(ctx, http.MethodPut+" "+pathParam, func() (err error) {
+			_, err = u.adminClient.PutRuntimeParameter(ctx, component, param.Vhost, param.Name, value)
+			return err
+		})
+		if err != nil {
+			u.Log.Error(err, "failed to update password in runtime parameter", "component", component,
+				"vhost", param.Vhost, "name", param.Name, "user", username)
+			continue
+		}
+		u.Log.V(0).Info("updated password in runtime parameter", "component", component,
+			"vhost", param.Vhost, "name", param.Name, "user", username)
+	}
+}
+
+// replaceURIPasswords replaces the password of username in uris, which is a URI or a list of URIs,
+// and returns the result, or false if none of the URIs has to be changed.
+func replaceURIPasswords(uris any, username, password string) (any, bool) {
+	switch uris := uris.(type) {
+	case string:
+		return replaceURIPassword(uris, username, password)
+	case []any:
+		replaced := make([]any, len(uris))
+		changed := false
+		for i, uri := range uris {
+			replaced[i] = uri
+			if s, ok := uri.(string); ok {
+				if r, ok := replaceURIPassword(s, username, password); ok {
+					replaced[i] = r
+					changed = true
+				}
+			}
+		}
+		return replaced, changed
+	}
+	return nil, false
+}
+
+// replaceURIPassword replaces the password in uri if it contains the credentials of username
+// with a different password. The URI is not returned otherwise, e.g. if it cannot be parsed or
+// has no password, e.g. with x509 authentication.
+func replaceURIPassword(uri, username, password string) (any, bool) {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.User == nil || parsed.User.Username() != username {
+		return nil, false
+	}
+	if current, ok := parsed.User.Password(); !ok || current == password {
+		return nil, false
+	}
+	parsed.User = url.UserPassword(username, password)
+	return parsed.String(), true
+}
@@ -0,0 +1,57 @@
+package updater
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// saltLength is the length of the salt that RabbitMQ prepends to password hashes.
+const saltLength = 4
+
+// storesPassword returns true if RabbitMQ already has the Password of cred for user, as returned by GET /api/users/<name>.
+// The stored password hash is compared if available. Otherwise, e.g. if the hash is not returned, the updater
+// authenticates with the new password instead.
+func (u *PasswordUpdater) storesPassword(ctx context.Context, user *rabbithole.UserInfo, cred UserCredentials) bool {
+	if cred.Password == "" {
+		return false
+	}
+	if user.PasswordHash != "" {
+		return passwordMatchesHash(cred.Password, user.PasswordHash, user.HashingAlgorithm)
+	}
+	u.authClient.SetUsername(cred.Username)
+	u.authClient.SetPassword(cred.Password)
+	_, err := u.authClient.Whoami(ctx)
+	return err == nil
+}
+
+// passwordMatchesHash returns true if passwordHash, as returned by GET /api/users/<name>, is the salted hash
+// of password, so that updating the user would not change anything. RabbitMQ hashes base64(salt + H(salt + password))
+// with the user's hashing algorithm. Empty hashes (e.g. of users without password) and unknown algorithms never match.
+func passwordMatchesHash(password, passwordHash string, algorithm rabbithole.HashingAlgorithm) bool {
+	decoded, err := base64.StdEncoding.DecodeString(passwordHash)
+	if err != nil || len(decoded) <= saltLength {
+		return false
+	}
+	var h hash.Hash
+	switch algorithm {
+	case rabbithole.HashingAlgorithmSHA256, "":
+		h = sha256.New()
+	case rabbithole.HashingAlgorithmSHA512:
+		h = sha512.New()
+	case rabbithole.HashingAlgorithmMD5:
+		h = md5.New()
+	default:
+		return false
+	}
+	salt := decoded[:saltLength]
+	h.Write(salt)
+	h.Write([]byte(password))
+	return subtle.ConstantTimeCompare(h.Sum(nil), decoded[saltLength:]) == 1
+}
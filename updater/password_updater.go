@@ -1,123 +1,506 @@
 package updater
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-logr/logr"
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
 )
 
-// NewPasswordUpdater creates a new instance of PasswordUpdater with a properly
-// initialized CredentialState and file system watcher.
-func NewPasswordUpdater(adminFile string, watchDir string, done chan<- bool, log logr.Logger, adminClient RabbitClient, authClient RabbitClient) (*PasswordUpdater, error) {
+// NewPasswordUpdater creates a new instance of PasswordUpdater that reads the credentials
+// from watchDir, with a properly initialized CredentialState and file system watcher.
+// It does not contact RabbitMQ, so that the updater starts (and starts watching)
+// even while the broker is unreachable, e.g. during a broker restart.
+// If stateFile is set, credentials that changed since they were last applied according
+// to the state file are left out of CredentialState, so that they are updated by the first sync.
+func NewPasswordUpdater(adminFile string, watchDir string, stateFile string, log logr.Logger, adminClient RabbitClient, authClient RabbitClient) (*PasswordUpdater, error) {
+	return NewDirectoryPasswordUpdater(adminFile, DirectorySource{Dir: watchDir, Log: log}, stateFile, log, adminClient, authClient)
+}
+
+// NewDirectoryPasswordUpdater is like NewPasswordUpdater, but reads the credentials with
+// a configured DirectorySource, e.g. one that decrypts the files.
+func NewDirectoryPasswordUpdater(adminFile string, source DirectorySource, stateFile string, log logr.Logger, adminClient RabbitClient, authClient RabbitClient) (*PasswordUpdater, error) {
+	watchDir := source.Dir
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create watcher: %w", err)
+		return nil, fmt.Errorf("%w: failed to create watcher: %w", ErrWatcher, err)
 	}
 
 	log.V(1).Info("start watching", "directory", watchDir)
 	if err := watcher.Add(watchDir); err != nil {
 		watcher.Close()
-		return nil, fmt.Errorf("failed to add directory %q to watcher: %w", watchDir, err)
+		return nil, fmt.Errorf("%w: failed to add directory %q to watcher: %w", ErrWatchDir, watchDir, err)
+	}
+	watchUserDirs(watcher, watchDir, log)
+
+	u, err := NewPasswordUpdaterWithSource(adminFile, source, stateFile, log, adminClient, authClient)
+	if err != nil {
+		watcher.Close()
+		return nil, err
 	}
+	u.WatchDir = watchDir
+	u.Watcher = watcher
+	return u, nil
+}
 
-	credentialState, err := loadSecrets(watchDir, log)
+// NewPasswordUpdaterWithSource creates a new instance of PasswordUpdater that reads the
+// credentials from source, e.g. directly from Kubernetes secrets instead of a mounted volume.
+// It does not contact RabbitMQ, see NewPasswordUpdater.
+func NewPasswordUpdaterWithSource(adminFile string, source SecretSource, stateFile string, log logr.Logger, adminClient RabbitClient, authClient RabbitClient) (*PasswordUpdater, error) {
+	credentials, err := source.Load(context.Background())
+	if incomplete := (*IncompleteLoadError)(nil); errors.As(err, &incomplete) {
+		// The files that failed to load were logged, the other users are updated nevertheless.
+		err = nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to load credential state: %w", err)
 	}
+	applied, err := loadStateFile(stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state file %q: %w", stateFile, err)
+	}
+	stateKey, err := loadStateKey(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	credentialState := verifiedCredentials(completeCredentials(credentials, log), applied, stateKey, log)
 	credentialSpec := make(map[string]UserCredentials)
 
 	return &PasswordUpdater{
-		AdminFile:       adminFile,
-		WatchDir:        watchDir,
-		Watcher:         watcher,
-		Done:            done,
-		Log:             log,
-		adminClient:     adminClient,
-		authClient:      authClient,
-		CredentialState: credentialState,
-		CredentialSpec:  credentialSpec,
+		AdminFile:              adminFile,
+		AdminFileFormat:        FileFormatINI,
+		AdminFileSection:       DefaultAdminFileSection,
+		AdminFileUsernameKey:   DefaultAdminFileUsernameKey,
+		AdminFilePasswordKey:   DefaultAdminFilePasswordKey,
+		Source:                 source,
+		StateFile:              stateFile,
+		Log:                    log,
+		RetryPolicy:            DefaultRetryPolicy,
+		ValidationRules:        DefaultValidationRules,
+		DefaultPermissions:     DefaultPermissions,
+		ProtectedUsers:         DefaultProtectedUsers,
+		FailureMode:            FailureModeExit,
+		MaxConsecutiveFailures: 1,
+		PropagationTimeout:     DefaultPropagationTimeout,
+		retries:                newRetryQueue(),
+		syncRequests:           make(chan struct{}, 1),
+		dumpRequests:           make(chan struct{}, 1),
+		sourceChanges:          make(chan struct{}, 1),
+		lastErrors:             make(map[string]error),
+		removedUsers:           make(map[string]time.Time),
+		appliedPolicies:        make(map[policyKey]bool),
+		applied:                applied,
+		stateKey:               stateKey,
+		adminClient:            adminClient,
+		authClient:             authClient,
+		CredentialState:        credentialState,
+		CredentialSpec:         credentialSpec,
 	}, nil
 }
 
 // loadSecrets scans the watch directory and loads existing credential files
-// into a map keyed by userID.
-func loadSecrets(watchDir string, log logr.Logger) (map[string]UserCredentials, error) {
+// into a map keyed by userID, decrypting them with the first matching Decrypter and
+// verifying the signatures of all files if SignatureKey is set.
+// The returned credentials may be incomplete. failed are the names of files that could not be
+// read, decrypted, verified or parsed, whose users may be missing or incomplete.
+func (s DirectorySource) loadSecrets(ctx context.Context) (_ map[string]UserCredentials, failed []string, _ error) {
+	watchDir, log := s.Dir, s.Log
 	credentialState := make(map[string]UserCredentials)
 	files, err := os.ReadDir(watchDir)
 	if err != nil {
 		log.Error(err, "failed to read watch directory", "watchDir", watchDir)
-		return nil, fmt.Errorf("failed to read watch directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to read watch directory: %w", err)
 	}
 
+	var userDirs []string
 	for _, file := range files {
-		if file.IsDir() || !strings.HasPrefix(file.Name(), userFilePrefix) {
+		name := file.Name()
+		if isUserDir(watchDir, file) {
+			userDirs = append(userDirs, name)
+			continue
+		}
+		key, _ := trimEncryptedSuffix(name)
+		mapped, isMapped := s.mapFile(key)
+		if file.IsDir() || strings.HasSuffix(name, signatureFileSuffix) || strings.HasSuffix(name, checksumFileSuffix) ||
+			(!strings.HasPrefix(name, userFilePrefix) && key != usersSpecFile && key != definitionsFile && !isMapped) {
 			continue
 		}
 
-		name := file.Name()
-
-		var userID, key string
-		switch {
-		case strings.HasSuffix(name, usernameFileSuffix):
-			userID = strings.TrimSuffix(strings.TrimPrefix(name, userFilePrefix), usernameFileSuffix)
-			key = "username"
-		case strings.HasSuffix(name, passwordFileSuffix):
-			userID = strings.TrimSuffix(strings.TrimPrefix(name, userFilePrefix), passwordFileSuffix)
-			key = "password"
-		case strings.HasSuffix(name, tagFileSuffix):
-			userID = strings.TrimSuffix(strings.TrimPrefix(name, userFilePrefix), tagFileSuffix)
-			key = "tag"
-		default:
+		userID, field, ok := parseSecretKey(key)
+		fileUserID, format, isConsolidated := parseConsolidatedSecretFile(key)
+		if isConsolidated {
+			userID, field, ok = fileUserID, "", true
+		}
+		if permissionsUserID, kind, isPermissions := parsePermissionsFile(key); isPermissions {
+			userID, field, ok = permissionsUserID, kind, true
+		}
+		if isMapped {
+			userID, field, ok = mapped.UserID, mapped.Field, true
+		}
+		if key == usersSpecFile || key == definitionsFile {
+			ok = true
+		}
+		if !ok {
 			log.V(1).Info("ignoring file with unexpected name format", "file", name)
 			continue
 		}
 
-		content, err := os.ReadFile(filepath.Join(watchDir, name))
-		if err != nil {
-			log.Error(err, "failed to read secret file", "file", name)
+		content, ok := s.readSecretFile(ctx, watchDir, name, field == "password" || field == "password_hash" || field == "")
+		if !ok {
+			failed = append(failed, name)
 			continue
 		}
 
-		value := strings.TrimSpace(string(content))
-		cred := credentialState[userID]
-		switch key {
-		case "username":
-			cred.Username = value
-		case "password":
-			cred.Password = value
-		case "tag":
-			if value != "" {
-				cred.Tag = value
-			} else {
-				cred.Tag = ""
+		if key == usersSpecFile || key == definitionsFile {
+			parse := parseUsersSpec
+			if key == definitionsFile {
+				parse = parseDefinitions
+			}
+			users, err := parse(content)
+			if err != nil {
+				log.Error(err, "failed to parse users file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			// Separate files of the same user take precedence.
+			for userID, cred := range users {
+				credentialState[userID] = mergeCredentials(cred, credentialState[userID])
 			}
-		default:
-			log.V(1).Info("ignoring unknown credential key", "file", name, "key", key)
 			continue
 		}
+		if field == "" {
+			// A user_<id>.json or user_<id>.env file contains all fields, separate files of the same user take precedence.
+			parse := parseCredentialsJSON
+			if format == envFileSuffix {
+				parse = parseCredentialsEnv
+			}
+			cred, err := parse(content)
+			if err != nil {
+				log.Error(err, "failed to parse secret file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			credentialState[userID] = mergeCredentials(cred, credentialState[userID])
+			continue
+		}
+
+		if field == "permissions" {
+			permissions, err := parsePermissions(content)
+			if err != nil {
+				log.Error(err, "failed to parse permissions file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.Permissions = map[string]rabbithole.Permissions{"/": permissions}
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "topic_permissions" {
+			permissions, err := parseTopicPermissions(content)
+			if err != nil {
+				log.Error(err, "failed to parse topic permissions file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.TopicPermissions = permissions
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "limits" {
+			limits, err := parseLimits(content)
+			if err != nil {
+				log.Error(err, "failed to parse limits file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.Limits = limits
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "disabled" {
+			// Only the presence of the marker file matters.
+			if userID == adminUserID {
+				log.Error(nil, "ignoring marker file, the admin user cannot be disabled", "file", name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.Disabled = true
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "passwordless" {
+			// Only the presence of the marker file matters.
+			if userID == adminUserID {
+				log.Error(nil, "ignoring marker file, the admin user needs a password", "file", name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.Passwordless = true
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "delete" {
+			if userID == adminUserID {
+				log.Error(nil, "ignoring marker file, the admin user cannot be deleted", "file", name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.Deleted = true
+			if cred.Username == "" {
+				// A username file of the same user takes precedence.
+				cred.Username = strings.TrimSpace(string(content))
+			}
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "vhost_limits" {
+			limits, err := parseVHostLimits(content)
+			if err != nil {
+				log.Error(err, "failed to parse vhost limits file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			cred := credentialState[userID]
+			cred.VHostLimits = limits
+			credentialState[userID] = cred
+			continue
+		}
+		if field == "vhosts" {
+			permissions, err := parseVHostPermissions(content)
+			if err != nil {
+				log.Error(err, "failed to parse vhosts file", "file", name)
+				failed = append(failed, name)
+				continue
+			}
+			// Added to the permissions in "/" of user_<id>_permissions, if any.
+			cred := credentialState[userID]
+			cred.Permissions = maps.Clone(cred.Permissions)
+			if cred.Permissions == nil {
+				cred.Permissions = make(map[string]rabbithole.Permissions, len(permissions))
+			}
+			maps.Copy(cred.Permissions, permissions)
+			credentialState[userID] = cred
+			continue
+		}
+
+		cred := credentialState[userID]
+		cred.set(field, strings.TrimSpace(string(content)))
 		credentialState[userID] = cred
 
-		if cred.Username != "" && cred.Password != "" {
+		if cred.isComplete() {
 			log.V(2).Info("loaded credential", "userID", userID, "username", cred.Username)
 		}
 	}
 
-	for userID, cred := range credentialState {
-		if cred.Username == "" || cred.Password == "" {
-			if userID == adminUserID {
-				return nil, fmt.Errorf("incomplete credentials during load, missing username or password for admin user")
+	for _, userID := range userDirs {
+		cred, found, ok := s.loadUserDir(ctx, userID)
+		if !ok {
+			failed = append(failed, userID)
+		}
+		if !found {
+			log.V(1).Info("ignoring directory without credential files", "directory", userID)
+			continue
+		}
+		// The flat user_<id>_* files take precedence.
+		credentialState[userID] = mergeCredentials(cred, credentialState[userID])
+	}
+
+	return credentialState, failed, nil
+}
+
+// loadUserDir loads the files username, password (or password_hash) and tag of the per-user subdirectory
+// <watchDir>/<userID>, e.g. a projected secret per user. found is false if none exists, ok is false
+// if one of them could not be read.
+func (s DirectorySource) loadUserDir(ctx context.Context, userID string) (cred UserCredentials, found, ok bool) {
+	ok = true
+	dir := filepath.Join(s.Dir, userID)
+	for _, field := range []string{"username", "password", "password_hash", "hashing_algorithm", "tag"} {
+		for _, name := range []string{field, field + ageFileSuffix, field + systemdCredFileSuffix} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				continue
+			}
+			found = true
+			if content, read := s.readSecretFile(ctx, dir, name, field == "password" || field == "password_hash"); read {
+				cred.set(field, strings.TrimSpace(string(content)))
 			} else {
-				log.V(1).Info("incomplete credentials during initialization",
-					"userID", userID,
-					"hasUsername", cred.Username != "",
-					"hasPassword", cred.Password != "")
+				ok = false
 			}
+			break
 		}
 	}
+	return cred, found, ok
+}
 
-	return credentialState, nil
+// readSecretFile reads and decrypts the file name in dir, checks its optional checksum file if it contains
+// a password, and its signature if SignatureKey is set. Every file is signed, since each of them changes
+// a credential, e.g. the username a signed password is applied to, or the tags of a user.
+// Failures are logged; ok is false if the content must not be used.
+func (s DirectorySource) readSecretFile(ctx context.Context, dir, name string, password bool) (content []byte, ok bool) {
+	log := s.Log
+	path := filepath.Join(dir, name)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Error(err, "failed to read secret file", "file", path)
+		return nil, false
+	}
+	if password {
+		// The checksum is of the file as stored, before decryption.
+		if err := verifyChecksumFile(path+checksumFileSuffix, content); err != nil {
+			log.Error(err, "rejecting password with invalid checksum", "file", path)
+			return nil, false
+		}
+	}
+	content, decrypted, err := decrypt(ctx, path, content, s.Decrypters)
+	if err != nil {
+		log.Error(err, "failed to decrypt secret file", "file", path)
+		return nil, false
+	}
+	key, encrypted := trimEncryptedSuffix(path)
+	if !decrypted && encrypted {
+		log.Error(errors.New("no decrypter configured for the file extension"), "failed to decrypt secret file", "file", path)
+		return nil, false
+	}
+	if s.SignatureKey != nil {
+		// Without a valid signature, the credentials stay incomplete and are not applied.
+		sigPath := key + signatureFileSuffix
+		if err := verifySignatureFile(s.SignatureKey, sigPath, content); err != nil {
+			log.Error(err, "rejecting secret file with invalid signature", "file", path)
+			return nil, false
+		}
+	}
+	return content, true
+}
+
+// isUserDir returns true if file is a per-user subdirectory of watchDir (or a symlink to one).
+// Hidden entries, e.g. the "..data" directories of Kubernetes volumes, are skipped.
+func isUserDir(watchDir string, file os.DirEntry) bool {
+	if strings.HasPrefix(file.Name(), ".") {
+		return false
+	}
+	if file.Type()&os.ModeSymlink != 0 {
+		info, err := os.Stat(filepath.Join(watchDir, file.Name()))
+		return err == nil && info.IsDir()
+	}
+	return file.IsDir()
+}
+
+// watchUserDirs adds the per-user subdirectories of watchDir to watcher, so that changes
+// of their files are observed as well. fsnotify does not watch directories recursively.
+func watchUserDirs(watcher *fsnotify.Watcher, watchDir string, log logr.Logger) {
+	files, err := os.ReadDir(watchDir)
+	if err != nil {
+		log.Error(err, "failed to read watch directory", "watchDir", watchDir)
+		return
+	}
+	for _, file := range files {
+		if isUserDir(watchDir, file) {
+			watchUserDir(watcher, filepath.Join(watchDir, file.Name()), log)
+		}
+	}
+}
+
+func watchUserDir(watcher *fsnotify.Watcher, dir string, log logr.Logger) {
+	if err := watcher.Add(dir); err != nil {
+		log.Error(err, "failed to add directory to watcher", "directory", dir)
+		return
+	}
+	log.V(1).Info("start watching", "directory", dir)
+}
+
+// mapFile returns the user and field of a file that is mapped by Files or matches Pattern.
+func (s DirectorySource) mapFile(name string) (SecretFile, bool) {
+	if file, ok := s.Files[name]; ok {
+		return file, true
+	}
+	if s.Pattern == nil {
+		return SecretFile{}, false
+	}
+	match := s.Pattern.FindStringSubmatch(name)
+	if match == nil {
+		return SecretFile{}, false
+	}
+	file := SecretFile{UserID: match[s.Pattern.SubexpIndex("id")], Field: match[s.Pattern.SubexpIndex("field")]}
+	switch file.Field {
+	case "username", "password", "tag":
+		return file, file.UserID != ""
+	}
+	return SecretFile{}, false
+}
+
+// parseConsolidatedSecretFile returns the userID and the format (file suffix) of a
+// consolidated secret file named user_<id>.json or user_<id>.env.
+func parseConsolidatedSecretFile(name string) (userID string, format string, ok bool) {
+	userID, found := strings.CutPrefix(name, userFilePrefix)
+	if !found {
+		return "", "", false
+	}
+	for _, suffix := range []string{jsonFileSuffix, envFileSuffix} {
+		if id, found := strings.CutSuffix(userID, suffix); found {
+			return id, suffix, id != ""
+		}
+	}
+	return "", "", false
+}
+
+// mergeCredentials returns cred with the fields set in override replaced.
+func mergeCredentials(cred, override UserCredentials) UserCredentials {
+	if override.Username != "" {
+		cred.Username = override.Username
+	}
+	// The password or password hash of override replaces both, since a Password takes precedence over a PasswordHash.
+	if override.Password != "" || override.PasswordHash != "" {
+		cred.Password, cred.PasswordHash = override.Password, override.PasswordHash
+	}
+	if override.HashingAlgorithm != "" {
+		cred.HashingAlgorithm = override.HashingAlgorithm
+	}
+	if override.Tag != "" {
+		cred.Tag = override.Tag
+	}
+	if override.Permissions != nil {
+		cred.Permissions = override.Permissions
+	}
+	if override.TopicPermissions != nil {
+		cred.TopicPermissions = override.TopicPermissions
+	}
+	if override.Limits != nil {
+		cred.Limits = override.Limits
+	}
+	if override.VHostLimits != nil {
+		cred.VHostLimits = override.VHostLimits
+	}
+	cred.Disabled = cred.Disabled || override.Disabled
+	cred.Deleted = cred.Deleted || override.Deleted
+	cred.Passwordless = cred.Passwordless || override.Passwordless
+	return cred
+}
+
+// completeCredentials returns the credentials that have both a username and a password.
+// Incomplete credentials (e.g. an empty password file in the middle of a rotation) are
+// skipped and re-evaluated on the next event.
+func completeCredentials(credentials map[string]UserCredentials, log logr.Logger) map[string]UserCredentials {
+	complete := make(map[string]UserCredentials, len(credentials))
+	for userID, cred := range credentials {
+		// The admin password is needed to authenticate, a password hash is not sufficient.
+		if !cred.isComplete() || (userID == adminUserID && cred.Password == "") {
+			log.V(1).Info("skipping incomplete credentials",
+				"userID", userID,
+				"hasUsername", cred.Username != "",
+				"hasPassword", cred.Password != "")
+			continue
+		}
+		complete[userID] = cred
+	}
+	return complete
 }
@@ -0,0 +1,207 @@
+package updater_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("NewPasswordUpdater", func() {
+	BeforeEach(func() {
+		initConfigFiles()
+	})
+
+	When("RabbitMQ is unreachable", func() {
+		var unreachableClient *fakeRabbitClient
+
+		BeforeEach(func() {
+			errRefused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			unreachableClient = &fakeRabbitClient{
+				whoamiReturn:  whoamiReturn{err: errRefused},
+				putUserReturn: putUserReturn{err: errRefused},
+			}
+		})
+
+		It("starts without contacting RabbitMQ", func() {
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), unreachableClient, unreachableClient)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+
+			Expect(u.CredentialState).To(HaveKey("admin"))
+			Expect(unreachableClient.WhoamiCallCount()).To(BeZero())
+			Expect(unreachableClient.GetUserCallCount()).To(BeZero())
+			Expect(unreachableClient.PutUserCallCount()).To(BeZero())
+		})
+
+		It("does not become ready until RabbitMQ can be reached", func() {
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), unreachableClient, unreachableClient)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+			u.RetryPolicy = RetryPolicy{MaxAttempts: 1, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+			notifier := &fakeNotifier{}
+			u.Notifier = notifier
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			done := make(chan error, 1)
+			go func() {
+				done <- u.HandleEvents(ctx)
+			}()
+
+			// The initial sync is retried instead of terminating, although FailureMode is FailureModeExit.
+			Eventually(unreachableClient.WhoamiCallCount).Should(BeNumerically(">", 3))
+			Consistently(notifier.States, 100*time.Millisecond).ShouldNot(ContainElement("READY=1"))
+			Expect(u.Snapshot().LastSyncError).To(MatchError(ErrBrokerUnreachable))
+			Expect(done).NotTo(Receive())
+
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("becomes ready once RabbitMQ can be reached", func() {
+			errRefused := unreachableClient.whoamiReturn.err
+			unreachableClient.whoamiReturn.err = nil
+			unreachableClient.whoamiErrors = []error{errRefused, errRefused, errRefused}
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), unreachableClient, unreachableClient)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+			u.RetryPolicy = RetryPolicy{MaxAttempts: 1, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+			notifier := &fakeNotifier{}
+			u.Notifier = notifier
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			go func() {
+				_ = u.HandleEvents(ctx)
+			}()
+
+			Eventually(notifier.States).Should(ContainElement("READY=1"))
+			Expect(unreachableClient.WhoamiCallCount()).To(BeNumerically(">", 3))
+			Expect(u.Snapshot().LastSyncError).NotTo(HaveOccurred())
+		})
+	})
+
+	When("RabbitMQ rejects the admin credentials", func() {
+		It("fails the first sync with ErrInvalidAdminCredentials", func() {
+			client := &fakeRabbitClient{whoamiReturn: whoamiReturn{err: errors.New("Error: API responded with a 401 Unauthorized")}}
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), client, client)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+			u.RetryPolicy = RetryPolicy{MaxAttempts: 1, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+			Expect(u.HandleEvents(context.Background())).To(MatchError(ErrInvalidAdminCredentials))
+		})
+	})
+
+	When("the watch directory does not exist", func() {
+		It("fails with ErrWatchDir", func() {
+			_, err := NewPasswordUpdater(testAdminFile, "test/missing", "", initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+			Expect(err).To(MatchError(ErrWatchDir))
+		})
+	})
+
+	When("the admin secret is incomplete", func() {
+		BeforeEach(func() {
+			Expect(os.WriteFile(filepath.Join(testWatchDir, adminPasswordFile), nil, 0644)).To(Succeed())
+		})
+		It("fails the first sync with ErrInvalidAdminCredentials", func() {
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+			Expect(u.CredentialState).NotTo(HaveKey("admin"))
+			Expect(u.HandleEvents(context.Background())).To(MatchError(ErrInvalidAdminCredentials))
+		})
+
+		It("uses the admin credentials once they are complete", func() {
+			client := &fakeRabbitClient{}
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), client, client)
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+			u.FailureMode = FailureModeRetry
+			u.RetryPolicy = RetryPolicy{MaxAttempts: 1, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+			notifier := &fakeNotifier{}
+			u.Notifier = notifier
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			go func() {
+				_ = u.HandleEvents(ctx)
+			}()
+
+			Consistently(notifier.States, 100*time.Millisecond).ShouldNot(ContainElement("READY=1"))
+			Expect(os.WriteFile(filepath.Join(testWatchDir, adminPasswordFile), []byte("pwd1"), 0644)).To(Succeed())
+			Eventually(notifier.States).Should(ContainElement("READY=1"))
+			Expect(u.Snapshot().CredentialState["admin"].Password).To(Equal("pwd1"))
+			Expect(client.PutUserCallCount()).To(BeZero())
+		})
+	})
+
+	When("a state file exists", func() {
+		var stateFile string
+
+		writeStateFile := func(defaultPassword string) {
+			key := []byte("0123456789abcdef0123456789abcdef")
+			Expect(os.WriteFile(stateFile+".key", []byte(hex.EncodeToString(key)+"\n"), 0600)).To(Succeed())
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(defaultPassword))
+			content, err := json.Marshal(map[string]any{
+				"users": map[string]any{
+					"default": map[string]any{
+						"username":     "default",
+						"passwordHash": hex.EncodeToString(mac.Sum(nil)),
+						"tag":          "mytag",
+						"lastApplied":  "2024-01-01T00:00:00Z",
+					},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(stateFile, content, 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			stateFile = filepath.Join(GinkgoT().TempDir(), "state.json")
+		})
+
+		It("keeps credentials that were applied", func() {
+			writeStateFile("pwd1")
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, stateFile, initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+
+			Expect(u.CredentialState).To(HaveKey("default"))
+		})
+
+		It("leaves out credentials that changed since they were applied", func() {
+			writeStateFile("pwd0")
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, stateFile, initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+
+			Expect(u.CredentialState).NotTo(HaveKey("default"))
+			Expect(u.CredentialState).To(HaveKey("admin"))
+		})
+
+		It("leaves out credentials whose hash was recorded with another key", func() {
+			writeStateFile("pwd1")
+			Expect(os.WriteFile(stateFile+".key", []byte("00ff\n"), 0600)).To(Succeed())
+			u, err := NewPasswordUpdater(testAdminFile, testWatchDir, stateFile, initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(u.Watcher.Close)
+
+			Expect(u.CredentialState).NotTo(HaveKey("default"))
+		})
+
+		It("fails if the state file is invalid", func() {
+			Expect(os.WriteFile(stateFile, []byte("{"), 0600)).To(Succeed())
+			_, err := NewPasswordUpdater(testAdminFile, testWatchDir, stateFile, initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+			Expect(err).To(MatchError(ContainSubstring("failed to load state file")))
+		})
+	})
+})
@@ -0,0 +1,61 @@
+package updater
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// passwordlessFileSuffix is the suffix of the optional marker file of a user without password,
+// e.g. user_app_passwordless, see UserCredentials.Passwordless.
+const passwordlessFileSuffix = "_passwordless"
+
+// updatePasswordlessUser creates cred.Username without password, or removes the password of an
+// existing user, unless RabbitMQ already has it without password and with the same tags, and
+// updates its permissions and limits.
+func (u *PasswordUpdater) updatePasswordlessUser(ctx context.Context, cred UserCredentials, spec map[string]UserCredentials) error {
+	pathUsers := "/api/users/" + cred.Username
+	var user *rabbithole.UserInfo
+	err := u.retry(ctx, http.MethodGet+" "+pathUsers, func() (err error) {
+		user, err = u.adminClient.GetUser(ctx, cred.Username)
+		return err
+	})
+	isNewUser := false
+	if errHTTP := u.handleHTTPError(ctx, u.adminClient, err, http.MethodGet, pathUsers, spec[u.clientUserID()].Password); errHTTP != nil {
+		if errHTTP.Error() != errNotFound {
+			return errHTTP
+		}
+		isNewUser = true
+	}
+
+	if user != nil && user.PasswordHash == "" && slices.Equal(normalizeTags(user.Tags...), normalizeTags(cred.Tag)) {
+		u.Log.V(1).Info("RabbitMQ already has the user without password, skipping update", "user", cred.Username)
+	} else {
+		var resp *http.Response
+		err = u.retry(ctx, http.MethodPut+" "+pathUsers, func() (err error) {
+			resp, err = u.adminClient.PutUserWithoutPassword(ctx, cred.Username,
+				rabbithole.UserSettings{Name: cred.Username, Tags: rabbithole.UserTags{cred.Tag}})
+			return err
+		})
+		if err != nil {
+			return u.handleHTTPError(ctx, u.adminClient, err, http.MethodPut, pathUsers, spec[u.clientUserID()].Password)
+		}
+		u.Log.V(2).Info("HTTP response", "method", http.MethodPut, "path", pathUsers, "status", resp.Status)
+		u.Log.V(1).Info("updated user without password on RabbitMQ server", "user", cred.Username)
+		if u.CloseConnections && user != nil && user.PasswordHash != "" {
+			// Connections authenticated with the removed password.
+			u.closeConnections(ctx, cred.Username)
+		}
+	}
+
+	permissions := cred.Permissions
+	if isNewUser && len(permissions) == 0 {
+		permissions = u.newUserPermissions(cred.Tag)
+	}
+	if err := u.updatePermissions(ctx, cred.Username, permissions, cred.TopicPermissions); err != nil {
+		return err
+	}
+	return u.updateLimits(ctx, cred.Username, cred.Limits, cred.VHostLimits)
+}
@@ -0,0 +1,276 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// permissionsFileSuffix is the suffix of the optional file with the permissions of a user
+// in the vhost "/", e.g. user_default_permissions, see parsePermissions.
+const permissionsFileSuffix = "_permissions"
+
+// topicPermissionsFileSuffix is the suffix of the optional file with the topic permissions
+// of a user, e.g. user_default_topic_permissions, see parseTopicPermissions.
+const topicPermissionsFileSuffix = "_topic_permissions"
+
+// TopicPermission grants topic permissions on an exchange in a vhost.
+type TopicPermission struct {
+	VHost string `json:"vhost"`
+	rabbithole.TopicPermissions
+}
+
+// vhostsFileSuffix is the suffix of the optional file with the permissions of a user
+// in several vhosts, e.g. user_default_vhosts, see parseVHostPermissions.
+const vhostsFileSuffix = "_vhosts"
+
+// parsePermissionsFile returns the userID and the kind (permissions, topic_permissions, vhosts,
+// limits, vhost_limits, disabled, delete or passwordless) of a file named user_<id>_<kind>.
+func parsePermissionsFile(name string) (userID string, kind string, ok bool) {
+	userID, found := strings.CutPrefix(name, userFilePrefix)
+	if !found {
+		return "", "", false
+	}
+	for _, f := range []struct{ suffix, kind string }{
+		// Before permissionsFileSuffix, which it ends with.
+		{topicPermissionsFileSuffix, "topic_permissions"},
+		{permissionsFileSuffix, "permissions"},
+		{vhostsFileSuffix, "vhosts"},
+		// Before limitsFileSuffix, which it ends with.
+		{vhostLimitsFileSuffix, "vhost_limits"},
+		{limitsFileSuffix, "limits"},
+		{disabledFileSuffix, "disabled"},
+		{deleteFileSuffix, "delete"},
+		{passwordlessFileSuffix, "passwordless"},
+	} {
+		if id, found := strings.CutSuffix(userID, f.suffix); found {
+			return id, f.kind, id != ""
+		}
+	}
+	return "", "", false
+}
+
+// parsePermissions parses the configure, write and read regular expressions of a user,
+// either as JSON object {"configure": ..., "write": ..., "read": ...} or as "configure;write;read".
+func parsePermissions(content []byte) (rabbithole.Permissions, error) {
+	content = bytes.TrimSpace(content)
+	var permissions rabbithole.Permissions
+	if bytes.HasPrefix(content, []byte("{")) {
+		if err := json.Unmarshal(content, &permissions); err != nil {
+			return rabbithole.Permissions{}, fmt.Errorf("failed to parse permissions: %w", err)
+		}
+		return permissions, nil
+	}
+	parts := strings.Split(string(content), ";")
+	if len(parts) != 3 {
+		return rabbithole.Permissions{}, fmt.Errorf("failed to parse permissions: expected configure;write;read, got %d fields", len(parts))
+	}
+	return rabbithole.Permissions{Configure: parts[0], Write: parts[1], Read: parts[2]}, nil
+}
+
+// parseVHostPermissions parses the permissions of a user per vhost, either as JSON object
+// {"<vhost>": {"configure": ..., "write": ..., "read": ...}} or as lines "<vhost>=configure;write;read".
+func parseVHostPermissions(content []byte) (map[string]rabbithole.Permissions, error) {
+	content = bytes.TrimSpace(content)
+	permissions := make(map[string]rabbithole.Permissions)
+	if bytes.HasPrefix(content, []byte("{")) {
+		if err := json.Unmarshal(content, &permissions); err != nil {
+			return nil, fmt.Errorf("failed to parse vhost permissions: %w", err)
+		}
+		return permissions, nil
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vhost, triple, found := strings.Cut(line, "=")
+		if !found || vhost == "" {
+			return nil, fmt.Errorf("failed to parse vhost permissions: line %d: expected <vhost>=configure;write;read", i+1)
+		}
+		p, err := parsePermissions([]byte(triple))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		permissions[vhost] = p
+	}
+	return permissions, nil
+}
+
+// parseTopicPermissions parses the topic permissions of a user, either as JSON array
+// [{"vhost": ..., "exchange": ..., "write": ..., "read": ...}] or as lines "[<vhost>=]exchange;write;read".
+// The vhost defaults to "/".
+func parseTopicPermissions(content []byte) ([]TopicPermission, error) {
+	content = bytes.TrimSpace(content)
+	var permissions []TopicPermission
+	if bytes.HasPrefix(content, []byte("[")) {
+		if err := json.Unmarshal(content, &permissions); err != nil {
+			return nil, fmt.Errorf("failed to parse topic permissions: %w", err)
+		}
+	} else {
+		for i, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			vhost, triple, found := strings.Cut(line, "=")
+			if !found {
+				vhost, triple = "", line
+			}
+			parts := strings.Split(triple, ";")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("failed to parse topic permissions: line %d: expected [<vhost>=]exchange;write;read", i+1)
+			}
+			permissions = append(permissions, TopicPermission{
+				VHost:            vhost,
+				TopicPermissions: rabbithole.TopicPermissions{Exchange: parts[0], Write: parts[1], Read: parts[2]},
+			})
+		}
+	}
+	for i := range permissions {
+		if permissions[i].VHost == "" {
+			permissions[i].VHost = "/"
+		}
+	}
+	return permissions, nil
+}
+
+// updatePermissions sets the permissions and topic permissions of username in every vhost.
+// Permissions that RabbitMQ already has are not set again, while permissions that were changed
+// on the RabbitMQ server (e.g. with rabbitmqctl) are corrected. Topic permissions are skipped
+// if the broker does not support them.
+// With CreateVhosts, missing vhosts are created first.
+func (u *PasswordUpdater) updatePermissions(ctx context.Context, username string, permissions map[string]rabbithole.Permissions, topicPermissions []TopicPermission) error {
+	for _, vhost := range slices.Sorted(maps.Keys(permissions)) {
+		if u.CreateVhosts {
+			if err := u.ensureVhost(ctx, vhost); err != nil {
+				return err
+			}
+		}
+		pathPermissions := "/api/permissions/" + url.PathEscape(vhost) + "/" + username
+		var current rabbithole.PermissionInfo
+		err := u.retry(ctx, http.MethodGet+" "+pathPermissions, func() (err error) {
+			current, err = u.adminClient.GetPermissionsIn(ctx, vhost, username)
+			return err
+		})
+		if err != nil && err.Error() != errNotFound {
+			return fmt.Errorf("failed to get permissions in vhost %q from RabbitMQ server: %w", vhost, err)
+		}
+		actual := rabbithole.Permissions{Configure: current.Configure, Write: current.Write, Read: current.Read}
+		if err == nil {
+			if actual == permissions[vhost] {
+				u.Log.V(4).Info("permissions unchanged, skipping update", "user", username, "vhost", vhost)
+				continue
+			}
+			u.Log.V(0).Info("permissions differ on RabbitMQ server, correcting them", "user", username, "vhost", vhost,
+				"actual", actual, "expected", permissions[vhost])
+		}
+		err = u.retry(ctx, http.MethodPut+" "+pathPermissions, func() (err error) {
+			_, err = u.adminClient.UpdatePermissionsIn(ctx, vhost, username, permissions[vhost])
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update permissions in vhost %q on RabbitMQ server: %w", vhost, err)
+		}
+		u.Log.V(1).Info("set permissions on RabbitMQ server", "user", username, "vhost", vhost)
+	}
+	if len(topicPermissions) > 0 && !u.broker.supports(topicPermissionsVersion) {
+		u.Log.V(0).Info("topic permissions are not supported by RabbitMQ, skipping them", "user", username,
+			"version", u.broker.version.String())
+		topicPermissions = nil
+	}
+	for _, permission := range topicPermissions {
+		if u.CreateVhosts {
+			if err := u.ensureVhost(ctx, permission.VHost); err != nil {
+				return err
+			}
+		}
+		err := u.retry(ctx, http.MethodPut+" /api/topic-permissions/"+url.PathEscape(permission.VHost)+"/"+username, func() (err error) {
+			_, err = u.adminClient.UpdateTopicPermissionsIn(ctx, permission.VHost, username, permission.TopicPermissions)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update topic permissions in vhost %q on RabbitMQ server: %w", permission.VHost, err)
+		}
+		u.Log.V(1).Info("set topic permissions on RabbitMQ server", "user", username, "vhost", permission.VHost, "exchange", permission.Exchange)
+	}
+	return nil
+}
+
+// ensureVhost creates vhost unless it exists. Existing vhosts are not modified.
+func (u *PasswordUpdater) ensureVhost(ctx context.Context, vhost string) error {
+	pathVhost := "/api/vhosts/" + url.PathEscape(vhost)
+	err := u.retry(ctx, http.MethodGet+" "+pathVhost, func() (err error) {
+		_, err = u.adminClient.GetVhost(ctx, vhost)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if err.Error() != errNotFound {
+		return fmt.Errorf("failed to get vhost %q from RabbitMQ server: %w", vhost, err)
+	}
+	err = u.retry(ctx, http.MethodPut+" "+pathVhost, func() (err error) {
+		_, err = u.adminClient.PutVhost(ctx, vhost, rabbithole.VhostSettings{Description: "Created by the credential updater"})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create vhost %q on RabbitMQ server: %w", vhost, err)
+	}
+	u.Log.V(0).Info("created vhost on RabbitMQ server", "vhost", vhost)
+	return nil
+}
+
+// clearPermissions removes the permissions and topic permissions of username in every vhost.
+// A user that does not exist has no permissions, nor has any user topic permissions on brokers
+// that do not support them.
+func (u *PasswordUpdater) clearPermissions(ctx context.Context, username string) error {
+	var permissions []rabbithole.PermissionInfo
+	err := u.retry(ctx, http.MethodGet+" /api/users/"+username+"/permissions", func() (err error) {
+		permissions, err = u.adminClient.ListPermissionsOf(ctx, username)
+		return err
+	})
+	if err != nil && err.Error() != errNotFound {
+		return fmt.Errorf("failed to list permissions on RabbitMQ server: %w", err)
+	}
+	for _, p := range permissions {
+		err := u.retry(ctx, http.MethodDelete+" /api/permissions/"+url.PathEscape(p.Vhost)+"/"+username, func() (err error) {
+			_, err = u.adminClient.ClearPermissionsIn(ctx, p.Vhost, username)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clear permissions in vhost %q on RabbitMQ server: %w", p.Vhost, err)
+		}
+	}
+
+	var topicPermissions []rabbithole.TopicPermissionInfo
+	if u.broker.supports(topicPermissionsVersion) {
+		err = u.retry(ctx, http.MethodGet+" /api/users/"+username+"/topic-permissions", func() (err error) {
+			topicPermissions, err = u.adminClient.ListTopicPermissionsOf(ctx, username)
+			return err
+		})
+		if err != nil && err.Error() != errNotFound {
+			return fmt.Errorf("failed to list topic permissions on RabbitMQ server: %w", err)
+		}
+	}
+	for _, p := range topicPermissions {
+		err := u.retry(ctx, http.MethodDelete+" /api/topic-permissions/"+url.PathEscape(p.Vhost)+"/"+username, func() (err error) {
+			_, err = u.adminClient.ClearTopicPermissionsIn(ctx, p.Vhost, username)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clear topic permissions in vhost %q on RabbitMQ server: %w", p.Vhost, err)
+		}
+	}
+	u.Log.V(1).Info("cleared permissions on RabbitMQ server", "user", username,
+		"permissions", len(permissions), "topicPermissions", len(topicPermissions))
+	return nil
+}
@@ -0,0 +1,227 @@
+package updater
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// policyFilePrefix and policyFileSuffix enclose the vhost and name of a policy in the watch directory,
+// e.g. policy_tenant-a_ha.json for the policy "ha" in the vhost "tenant-a". The vhost is URL-encoded
+// (e.g. %2F for "/") and can be overridden, like the name, by the "vhost" and "name" fields of the file.
+// Operator policies, which take precedence over the policies of users, are prefixed with
+// operatorPolicyFilePrefix instead, e.g. operator_policy_tenant-a_limits.json.
+const (
+	policyFilePrefix         = "policy_"
+	operatorPolicyFilePrefix = "operator_policy_"
+	policyFileSuffix         = ".json"
+)
+
+// policyKey identifies a policy or an operator policy.
+type policyKey struct {
+	operator    bool
+	vhost, name string
+}
+
+// kind returns the kind of policy for log messages.
+func (k policyKey) kind() string {
+	if k.operator {
+		return "operator policy"
+	}
+	return "policy"
+}
+
+// path returns the Management API path of the policy.
+func (k policyKey) path() string {
+	if k.operator {
+		return "/api/operator-policies/" + url.PathEscape(k.vhost) + "/" + url.PathEscape(k.name)
+	}
+	return "/api/policies/" + url.PathEscape(k.vhost) + "/" + url.PathEscape(k.name)
+}
+
+// isPolicyFile returns true if the base name is a policy or operator policy file.
+func isPolicyFile(filePath string) bool {
+	base := filepath.Base(filePath)
+	return (strings.HasPrefix(base, policyFilePrefix) || strings.HasPrefix(base, operatorPolicyFilePrefix)) &&
+		strings.HasSuffix(base, policyFileSuffix)
+}
+
+// parsePolicyFile parses a policy or operator policy file with the given name, see policyFilePrefix.
+func parsePolicyFile(name string, content []byte) (policyKey, rabbithole.Policy, error) {
+	var policy rabbithole.Policy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return policyKey{}, policy, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	operator := strings.HasPrefix(name, operatorPolicyFilePrefix)
+	prefix := policyFilePrefix
+	if operator {
+		prefix = operatorPolicyFilePrefix
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(name, prefix), policyFileSuffix)
+	if encodedVhost, name, found := strings.Cut(key, "_"); found {
+		vhost, err := url.PathUnescape(encodedVhost)
+		if err != nil {
+			return policyKey{}, policy, fmt.Errorf("invalid vhost in file name: %w", err)
+		}
+		policy.Vhost = cmp.Or(policy.Vhost, vhost)
+		policy.Name = cmp.Or(policy.Name, name)
+	}
+	if policy.Vhost == "" || policy.Name == "" {
+		return policyKey{}, policy, fmt.Errorf("missing vhost or name, expected %s<vhost>_<name>%s", prefix, policyFileSuffix)
+	}
+	if policy.Pattern == "" {
+		return policyKey{}, policy, errors.New("missing pattern")
+	}
+	// RabbitMQ applies policies to all entities and operator policies to queues by default.
+	if operator {
+		policy.ApplyTo = cmp.Or(policy.ApplyTo, "queues")
+	} else {
+		policy.ApplyTo = cmp.Or(policy.ApplyTo, "all")
+	}
+	return policyKey{operator, policy.Vhost, policy.Name}, policy, nil
+}
+
+// loadPolicies reads the policy and operator policy files in dir. Invalid files are logged and skipped;
+// failed are their names.
+func loadPolicies(dir string, log logr.Logger) (_ map[policyKey]rabbithole.Policy, failed []string, _ error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read watch directory: %w", err)
+	}
+	policies := make(map[policyKey]rabbithole.Policy)
+	for _, file := range files {
+		if file.IsDir() || !isPolicyFile(file.Name()) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Error(err, "failed to read policy file", "file", file.Name())
+			failed = append(failed, file.Name())
+			continue
+		}
+		key, policy, err := parsePolicyFile(file.Name(), content)
+		if err != nil {
+			log.Error(err, "invalid policy file", "file", file.Name())
+			failed = append(failed, file.Name())
+			continue
+		}
+		policies[key] = policy
+	}
+	return policies, failed, nil
+}
+
+// applyPolicies creates or updates the policies and operator policies of the policy files in WatchDir, unless RabbitMQ already
+// has them, and deletes the policies that were applied before but whose files have been removed since.
+// While a policy file is invalid (e.g. half-written), no policies are deleted, since it may be one of them.
+// Failures are logged and retried on the next sync.
+func (u *PasswordUpdater) applyPolicies(ctx context.Context) {
+	if u.WatchDir == "" {
+		return
+	}
+	policies, failed, err := loadPolicies(u.WatchDir, u.Log)
+	if err != nil {
+		u.Log.Error(err, "failed to load policies")
+		return
+	}
+	for _, key := range slices.SortedFunc(maps.Keys(policies), comparePolicyKeys) {
+		if err := u.applyPolicy(ctx, key, policies[key]); err != nil {
+			u.Log.Error(err, "failed to apply "+key.kind(), "vhost", key.vhost, "policy", key.name)
+			continue
+		}
+		u.appliedPolicies[key] = true
+	}
+	if len(failed) > 0 {
+		u.Log.V(1).Info("not deleting removed policies, since some policy files are invalid", "files", failed)
+		return
+	}
+	for _, key := range slices.SortedFunc(maps.Keys(u.appliedPolicies), comparePolicyKeys) {
+		if _, exists := policies[key]; exists {
+			continue
+		}
+		err := u.retry(ctx, http.MethodDelete+" "+key.path(), func() (err error) {
+			if key.operator {
+				_, err = u.adminClient.DeleteOperatorPolicy(ctx, key.vhost, key.name)
+			} else {
+				_, err = u.adminClient.DeletePolicy(ctx, key.vhost, key.name)
+			}
+			return err
+		})
+		if err != nil && err.Error() != errNotFound {
+			u.Log.Error(err, "failed to delete "+key.kind(), "vhost", key.vhost, "policy", key.name)
+			continue
+		}
+		u.Log.V(0).Info("deleted "+key.kind()+" on RabbitMQ server", "vhost", key.vhost, "policy", key.name)
+		delete(u.appliedPolicies, key)
+	}
+}
+
+// applyPolicy creates or updates the policy or operator policy key, unless RabbitMQ already has it.
+// With CreateVhosts, a missing vhost is created first.
+func (u *PasswordUpdater) applyPolicy(ctx context.Context, key policyKey, policy rabbithole.Policy) error {
+	if u.CreateVhosts {
+		if err := u.ensureVhost(ctx, policy.Vhost); err != nil {
+			return err
+		}
+	}
+	var current *rabbithole.Policy
+	err := u.retry(ctx, http.MethodGet+" "+key.path(), func() (err error) {
+		if !key.operator {
+			current, err = u.adminClient.GetPolicy(ctx, key.vhost, key.name)
+			return err
+		}
+		operatorPolicy, err := u.adminClient.GetOperatorPolicy(ctx, key.vhost, key.name)
+		if operatorPolicy != nil {
+			current = (*rabbithole.Policy)(operatorPolicy)
+		}
+		return err
+	})
+	if err != nil && err.Error() != errNotFound {
+		return fmt.Errorf("failed to get %s from RabbitMQ server: %w", key.kind(), err)
+	}
+	if err == nil && current.Pattern == policy.Pattern && current.ApplyTo == policy.ApplyTo &&
+		current.Priority == policy.Priority && reflect.DeepEqual(current.Definition, policy.Definition) {
+		u.Log.V(4).Info(key.kind()+" unchanged, skipping update", "vhost", key.vhost, "policy", key.name)
+		return nil
+	}
+	err = u.retry(ctx, http.MethodPut+" "+key.path(), func() (err error) {
+		if key.operator {
+			_, err = u.adminClient.PutOperatorPolicy(ctx, key.vhost, key.name, rabbithole.OperatorPolicy(policy))
+		} else {
+			_, err = u.adminClient.PutPolicy(ctx, key.vhost, key.name, policy)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update %s on RabbitMQ server: %w", key.kind(), err)
+	}
+	u.Log.V(0).Info("updated "+key.kind()+" on RabbitMQ server", "vhost", key.vhost, "policy", key.name)
+	return nil
+}
+
+// comparePolicyKeys orders policies before operator policies, then by vhost and name.
+func comparePolicyKeys(a, b policyKey) int {
+	return cmp.Or(compareBool(a.operator, b.operator), cmp.Compare(a.vhost, b.vhost), cmp.Compare(a.name, b.name))
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,53 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	"go.yaml.in/yaml/v3"
+)
+
+// PermissionPresets map user tags to the permissions per vhost that new users with the tag
+// and without permissions of their own are granted instead of the DefaultPermissions.
+type PermissionPresets map[string]map[string]rabbithole.Permissions
+
+// LoadPermissionPresets reads PermissionPresets from a YAML (or JSON) file, e.g.
+//
+//	monitoring:
+//	  /: {configure: "", write: "", read: ".*"}
+//	administrator:
+//	  /: {configure: ".*", write: ".*", read: ".*"}
+func LoadPermissionPresets(path string) (PermissionPresets, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var presets PermissionPresets
+	if err := yaml.Unmarshal(content, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse permission presets: %w", err)
+	}
+	return presets, nil
+}
+
+// newUserPermissions returns the permissions of a new user without permissions of its own:
+// the presets of its tags, or the DefaultPermissions if none of the tags has a preset.
+// If several tags grant permissions in the same vhost, the first tag wins.
+func (u *PasswordUpdater) newUserPermissions(tag string) map[string]rabbithole.Permissions {
+	var permissions map[string]rabbithole.Permissions
+	for _, t := range strings.Split(tag, ",") {
+		for vhost, p := range u.PermissionPresets[strings.TrimSpace(t)] {
+			if permissions == nil {
+				permissions = make(map[string]rabbithole.Permissions)
+			}
+			if _, exists := permissions[vhost]; !exists {
+				permissions[vhost] = p
+			}
+		}
+	}
+	if permissions == nil {
+		return u.DefaultPermissions
+	}
+	return permissions
+}
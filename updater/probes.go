@@ -0,0 +1,30 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+)
+
+// Probe verifies that messaging clients can log in with the given credentials, e.g. by opening
+// a connection with a protocol other than HTTP, see Probes.
+type Probe func(ctx context.Context, username, password string) error
+
+// runProbes runs the Probes of cred's username (see ProbeUsers) with its credentials, ordered by name.
+func (u *PasswordUpdater) runProbes(ctx context.Context, cred UserCredentials) error {
+	for _, name := range slices.Sorted(maps.Keys(u.Probes)) {
+		if patterns, ok := u.ProbeUsers[name]; ok && !slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := path.Match(pattern, cred.Username)
+			return matched
+		}) {
+			continue
+		}
+		if err := u.Probes[name](ctx, cred.Username, cred.Password); err != nil {
+			return fmt.Errorf("%s probe failed: %w", name, err)
+		}
+		u.Log.V(1).Info("verified credentials with probe", "user", cred.Username, "probe", name)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultPropagationTimeout is used by NewPasswordUpdater.
+const DefaultPropagationTimeout = time.Minute
+
+// clusterNodes returns Nodes if set, or the running cluster nodes reported by /api/nodes.
+func (u *PasswordUpdater) clusterNodes(ctx context.Context) ([]string, error) {
+	if len(u.Nodes) > 0 {
+		return u.Nodes, nil
+	}
+	const pathNodes = "/api/nodes"
+	var names []string
+	err := u.retry(ctx, "GET "+pathNodes, func() error {
+		nodes, err := u.adminClient.ListNodes(ctx)
+		if err != nil {
+			return err
+		}
+		names = names[:0]
+		for _, node := range nodes {
+			if node.IsRunning {
+				names = append(names, node.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover cluster nodes: %w", err)
+	}
+	return names, nil
+}
+
+// waitForPropagation waits until every cluster node accepts cred, since replication of the
+// user database between nodes can lag behind. Returns an error if a node does not accept
+// cred within PropagationTimeout.
+func (u *PasswordUpdater) waitForPropagation(ctx context.Context, cred UserCredentials) error {
+	nodes, err := u.clusterNodes(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, u.PropagationTimeout)
+	defer cancel()
+	for _, node := range nodes {
+		client, err := u.NodeClient(node)
+		if err != nil {
+			return fmt.Errorf("failed to create client for node %q: %w", node, err)
+		}
+		client.SetUsername(cred.Username)
+		client.SetPassword(cred.Password)
+		for attempt := 0; ; attempt++ {
+			_, err := client.Whoami(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return fmt.Errorf("node %q did not accept the new password within %s: %w", node, u.PropagationTimeout, err)
+			}
+			delay := u.RetryPolicy.delay(attempt)
+			u.Log.V(1).Info("new password not yet accepted by node, waiting",
+				"user", cred.Username, "node", node, "delay", delay.String(), "error", err.Error())
+			if err := sleep(ctx, delay); err != nil {
+				return fmt.Errorf("node %q did not accept the new password within %s: %w", node, u.PropagationTimeout, err)
+			}
+		}
+		u.Log.V(2).Info("node accepts the new password", "user", cred.Username, "node", node)
+	}
+	u.Log.V(1).Info("new password propagated to all cluster nodes", "user", cred.Username, "nodes", len(nodes))
+	return nil
+}
@@ -0,0 +1,74 @@
+package updater
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the rate of RabbitMQ Management API requests.
+// It can be shared by several clients.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate requests per second on average,
+// with bursts of up to burst requests. If rate is not positive, it returns nil (no limit).
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a request may be sent, or ctx is cancelled.
+func (l *RateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// Reserve a token, the bucket goes negative while requests are waiting.
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if err := sleep(ctx, delay); err != nil {
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// NewRateLimitedClient wraps client, so that its requests are limited by limiter, e.g. so that
+// event storms or large batches of secrets do not overload the broker.
+// If limiter is nil, client is returned unchanged.
+func NewRateLimitedClient(client RabbitClient, limiter *RateLimiter) RabbitClient {
+	if limiter == nil {
+		return client
+	}
+	return &interceptedClient{RabbitClient: client, intercept: limiter.call}
+}
+
+// call runs fn once a request may be sent.
+func (l *RateLimiter) call(ctx context.Context, fn func() error) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
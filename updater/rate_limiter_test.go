@@ -0,0 +1,55 @@
+package updater_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("RateLimitedClient", func() {
+	var (
+		fakeClient *fakeRabbitClient
+		client     RabbitClient
+	)
+
+	BeforeEach(func() {
+		fakeClient = &fakeRabbitClient{}
+		client = NewRateLimitedClient(fakeClient, NewRateLimiter(20, 2))
+	})
+
+	It("allows bursts and then limits the rate of requests", func() {
+		start := time.Now()
+		for range 2 {
+			_, err := client.Whoami(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", 25*time.Millisecond))
+
+		for range 2 {
+			_, err := client.Whoami(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+		}
+		// 2 requests at 20 requests per second.
+		Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+		Expect(fakeClient.WhoamiCallCount()).To(Equal(4))
+	})
+
+	It("stops waiting when the context is cancelled", func() {
+		for range 2 {
+			_, err := client.Whoami(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.Whoami(ctx)
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(fakeClient.WhoamiCallCount()).To(Equal(2))
+	})
+
+	It("does not limit requests without a rate", func() {
+		Expect(NewRateLimitedClient(fakeClient, NewRateLimiter(0, 0))).To(BeIdenticalTo(fakeClient))
+	})
+})
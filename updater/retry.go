@@ -0,0 +1,102 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// RetryPolicy configures how transient RabbitMQ Management API failures are retried.
+// Delays grow exponentially from InitialDelay up to MaxDelay and are randomized with jitter.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is used by NewPasswordUpdater.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+}
+
+// FailureMode controls whether the updater terminates when a sync fails,
+// e.g. because the admin credentials are rejected.
+type FailureMode string
+
+const (
+	// FailureModeExit terminates HandleEvents after MaxConsecutiveFailures failed syncs,
+	// so that e.g. Kubernetes restarts the container.
+	FailureModeExit FailureMode = "exit"
+	// FailureModeRetry never terminates HandleEvents; failed syncs are retried with backoff.
+	FailureModeRetry FailureMode = "retry"
+)
+
+// delay returns the randomized backoff before the given (zero-based) retry.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.InitialDelay
+	for i := 0; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxDelay)
+	if d <= 0 {
+		return 0
+	}
+	// Equal jitter: wait at least half of the delay, so that concurrent updaters
+	// (one per RabbitMQ node) do not retry in lockstep.
+	return d/2 + rand.N(d/2+1)
+}
+
+// isTransient returns true if err is worth retrying, i.e. a network error
+// (such as connection refused) or a 5xx response from the Management API.
+// Requests aborted by a cancelled context are not retried.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var errResp rabbithole.ErrorResponse
+	if errors.As(err, &errResp) {
+		return errResp.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retry calls fn until it succeeds, returns a non-transient error, or the maximum
+// number of attempts is reached. The last error is returned.
+func (u *PasswordUpdater) retry(ctx context.Context, operation string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !isTransient(err) || attempt >= u.RetryPolicy.MaxAttempts {
+			return err
+		}
+		delay := u.RetryPolicy.delay(attempt - 1)
+		u.Log.V(1).Info("transient failure, retrying",
+			"operation", operation,
+			"attempt", attempt,
+			"maxAttempts", u.RetryPolicy.MaxAttempts,
+			"delay", delay.String(),
+			"error", err.Error())
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for the given duration, or returns an error if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
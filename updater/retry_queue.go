@@ -0,0 +1,79 @@
+package updater
+
+import (
+	"time"
+)
+
+// retryQueue tracks users whose update failed and schedules their next attempt
+// with exponential backoff. It is only accessed from the HandleEvents goroutine.
+type retryQueue struct {
+	entries map[string]retryEntry
+	timer   *time.Timer
+}
+
+type retryEntry struct {
+	attempts int
+	next     time.Time
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{
+		entries: make(map[string]retryEntry),
+	}
+}
+
+// add schedules the next attempt for the given user and returns its delay.
+func (q *retryQueue) add(userID string, policy RetryPolicy) time.Duration {
+	entry := q.entries[userID]
+	delay := policy.delay(entry.attempts)
+	entry.attempts++
+	entry.next = time.Now().Add(delay)
+	q.entries[userID] = entry
+	retryQueueLength.Set(float64(len(q.entries)))
+	return delay
+}
+
+// remove drops the given user from the queue, e.g. after a successful update.
+func (q *retryQueue) remove(userID string) {
+	delete(q.entries, userID)
+	retryQueueLength.Set(float64(len(q.entries)))
+}
+
+// retain drops all users that are not part of the given credentials,
+// e.g. because their secret files have been removed.
+func (q *retryQueue) retain(credentials map[string]UserCredentials) {
+	for userID := range q.entries {
+		if _, ok := credentials[userID]; !ok {
+			q.remove(userID)
+		}
+	}
+}
+
+// attempts returns the number of failed attempts of the given user since its last success.
+func (q *retryQueue) attempts(userID string) int {
+	return q.entries[userID].attempts
+}
+
+// len returns the number of users waiting for a retry.
+func (q *retryQueue) len() int {
+	return len(q.entries)
+}
+
+// wait returns a channel that receives a value once the earliest retry is due.
+// It returns nil (which blocks forever in a select) if the queue is empty.
+func (q *retryQueue) wait() <-chan time.Time {
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	if len(q.entries) == 0 {
+		return nil
+	}
+	var earliest time.Time
+	for _, entry := range q.entries {
+		if earliest.IsZero() || entry.next.Before(earliest) {
+			earliest = entry.next
+		}
+	}
+	q.timer = time.NewTimer(time.Until(earliest))
+	return q.timer.C
+}
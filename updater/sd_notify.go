@@ -0,0 +1,65 @@
+package updater
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notifier reports state changes of the updater to a service manager.
+type Notifier interface {
+	Notify(state string) error
+}
+
+// SystemdNotifier implements the systemd sd_notify protocol, see sd_notify(3).
+type SystemdNotifier struct {
+	socket string
+}
+
+// NewSystemdNotifier returns a notifier for the socket in $NOTIFY_SOCKET,
+// or nil if the updater does not run as a systemd notify service.
+func NewSystemdNotifier() *SystemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	return &SystemdNotifier{socket: socket}
+}
+
+// Notify sends state (e.g. "READY=1") to systemd.
+func (n *SystemdNotifier) Notify(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to write to notify socket: %w", err)
+	}
+	return nil
+}
+
+// SystemdWatchdogInterval returns the interval in which "WATCHDOG=1" must be sent, i.e. half
+// of the watchdog timeout in $WATCHDOG_USEC, or 0 if the systemd watchdog is not enabled.
+func SystemdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notify sends state to the Notifier, if any. Failures are logged only.
+func (u *PasswordUpdater) notify(state string) {
+	if u.Notifier == nil {
+		return
+	}
+	if err := u.Notifier.Notify(state); err != nil {
+		u.Log.Error(err, "failed to notify service manager", "state", state)
+	}
+}
@@ -0,0 +1,61 @@
+package updater_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("SystemdNotifier", func() {
+	var (
+		socket *net.UnixConn
+		cancel context.CancelFunc
+		done   chan error
+	)
+
+	receive := func() string {
+		buf := make([]byte, 64)
+		Expect(socket.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		n, err := socket.Read(buf)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buf[:n])
+	}
+
+	BeforeEach(func() {
+		initConfigFiles()
+		path := filepath.Join(GinkgoT().TempDir(), "notify.sock")
+		var err error
+		socket, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(socket.Close)
+		GinkgoT().Setenv("NOTIFY_SOCKET", path)
+		GinkgoT().Setenv("WATCHDOG_USEC", "20000")
+
+		u, err := NewPasswordUpdater(testAdminFile, testWatchDir, "", initLogging(), &fakeRabbitClient{}, &fakeRabbitClient{})
+		Expect(err).NotTo(HaveOccurred())
+		u.Notifier = NewSystemdNotifier()
+		u.WatchdogInterval = SystemdWatchdogInterval()
+		Expect(u.WatchdogInterval).To(Equal(10 * time.Millisecond))
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		done = make(chan error, 1)
+		go func(u *PasswordUpdater, done chan<- error) {
+			done <- u.HandleEvents(ctx)
+		}(u, done)
+	})
+
+	It("notifies readiness after the initial sync, pings the watchdog and notifies stopping", func() {
+		Expect(receive()).To(Equal("READY=1"))
+		Expect(receive()).To(Equal("WATCHDOG=1"))
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+		Eventually(receive).Should(Equal("STOPPING=1"))
+	})
+})
@@ -0,0 +1,263 @@
+package updater
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+)
+
+// DefaultPollInterval is used by sources that poll for changes if no interval is configured.
+const DefaultPollInterval = time.Minute
+
+// SecretSource provides the expected user credentials.
+type SecretSource interface {
+	// Load returns the current credentials keyed by userID. They may be incomplete.
+	Load(ctx context.Context) (map[string]UserCredentials, error)
+}
+
+// WatchingSecretSource is a SecretSource that detects changes of the credentials itself.
+type WatchingSecretSource interface {
+	SecretSource
+	// Watch calls changed whenever the credentials may have changed, until ctx is cancelled.
+	// Watch retries temporary failures itself; a returned error is fatal.
+	Watch(ctx context.Context, changed func()) error
+}
+
+// DirectorySource reads credentials from files named user_<id>_username, user_<id>_password
+// (or user_<id>_password_hash) and user_<id>_tag in Dir, e.g. a mounted Kubernetes secret, or from a single file
+// user_<id>.json (see parseCredentialsJSON) or user_<id>.env (see parseCredentialsEnv),
+// or from the files username, password and tag of a subdirectory <id>, e.g. a projected secret per user.
+// Changes are detected by the file system watcher of NewPasswordUpdater.
+type DirectorySource struct {
+	Dir string
+	// Decrypters optionally decrypt encrypted files in memory.
+	Decrypters []Decrypter
+	// Files optionally maps the names of files that do not follow the naming convention,
+	// e.g. Docker secrets in /run/secrets, to the user and credential field they contain.
+	Files map[string]SecretFile
+	// Pattern optionally matches the names of such files with the named groups id and
+	// field, e.g. `^rabbitmq-(?P<id>.+)-(?P<field>username|password|tag)$`.
+	Pattern *regexp.Regexp
+	// SignatureKey optionally requires a detached signature (e.g. user_<id>_password.sig,
+	// user_<id>_username.sig or user_<id>.json.sig) of the (decrypted) content of every file, see LoadSignatureKey.
+	SignatureKey crypto.PublicKey
+	Log          logr.Logger
+}
+
+// SecretFile identifies the credential field ("username", "password" or "tag") of a user
+// that a file mapped by DirectorySource.Files contains.
+type SecretFile struct {
+	UserID string
+	Field  string
+}
+
+func (s DirectorySource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	credentials, failed, err := s.loadSecrets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWatchDir, err)
+	}
+	if len(failed) > 0 {
+		return credentials, &IncompleteLoadError{Files: failed}
+	}
+	return credentials, nil
+}
+
+// IncompleteLoadError is returned by Load along with the credentials that could be loaded, if some Files
+// failed to load, e.g. a malformed users.yaml or a password with an invalid signature. Their users may be
+// missing from the credentials, so that removed users are not deleted meanwhile, see deleteRemovedUsers.
+type IncompleteLoadError struct {
+	Files []string
+}
+
+func (e *IncompleteLoadError) Error() string {
+	return "failed to load secret files " + strings.Join(e.Files, ", ")
+}
+
+// pollInterval returns interval, or DefaultPollInterval if interval is not positive.
+func pollInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return DefaultPollInterval
+	}
+	return interval
+}
+
+// pollForChanges calls fingerprint every interval and changed whenever the fingerprint differs
+// from the previous one, until ctx is cancelled. Failures are logged and retried with the next poll.
+func pollForChanges(ctx context.Context, interval time.Duration, log logr.Logger, fingerprint func(context.Context) (string, error), changed func()) error {
+	var last string
+	for {
+		current, err := fingerprint(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.V(0).Info("failed to poll for changes, retrying", "interval", interval.String(), "error", err.Error())
+		case err == nil && current != last:
+			// The first poll is reported as well, in case of changes since the initial load.
+			last = current
+			changed()
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// parseCredentialsJSON parses a JSON object with the keys username, password and tag,
+// and optionally permissions ({"configure": ..., "write": ..., "read": ...}), vhosts and passwordless,
+// as stored in secret managers or user_<id>.json files.
+func parseCredentialsJSON(content []byte) (UserCredentials, error) {
+	var fields struct {
+		Username     string                  `json:"username"`
+		Password     string                  `json:"password"`
+		Tag          string                  `json:"tag"`
+		Permissions  *rabbithole.Permissions `json:"permissions"`
+		VHosts       []string                `json:"vhosts"`
+		Passwordless bool                    `json:"passwordless"`
+	}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return UserCredentials{}, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	cred := UserCredentials{
+		Username:     strings.TrimSpace(fields.Username),
+		Password:     strings.TrimSpace(fields.Password),
+		Tag:          strings.TrimSpace(fields.Tag),
+		Passwordless: fields.Passwordless,
+	}
+	if fields.Permissions != nil || len(fields.VHosts) > 0 {
+		// The permissions are granted in every vhost.
+		permissions := defaultUserPermissions
+		if fields.Permissions != nil {
+			permissions = *fields.Permissions
+		}
+		vhosts := fields.VHosts
+		if len(vhosts) == 0 {
+			vhosts = []string{"/"}
+		}
+		cred.Permissions = make(map[string]rabbithole.Permissions, len(vhosts))
+		for _, vhost := range vhosts {
+			cred.Permissions[vhost] = permissions
+		}
+	}
+	return cred, nil
+}
+
+// parseCredentialsEnv parses dotenv-style lines with the keys USERNAME, PASSWORD and TAG,
+// as written e.g. by Vault Agent templates into user_<id>.env files. Blank lines, comments,
+// an "export " prefix and quotes around values are allowed; other keys are ignored.
+func parseCredentialsEnv(content []byte) (UserCredentials, error) {
+	var cred UserCredentials
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !found {
+			return UserCredentials{}, fmt.Errorf("failed to parse credentials: line %d: missing '='", i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		cred.set(strings.ToLower(strings.TrimSpace(key)), value)
+	}
+	return cred, nil
+}
+
+// credentialsFingerprint returns a hash of credentials, for sources without version metadata.
+func credentialsFingerprint(credentials map[string]UserCredentials) string {
+	// json.Marshal sorts map keys, so the hash is stable.
+	content, _ := json.Marshal(credentials)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// doRequest sends req and returns the response body, or an error if the status is not 200 OK.
+func doRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return body, nil
+}
+
+// parseSecretKey splits the name of a secret file or key, e.g. user_<id>_password or user_<id>_password_hash,
+// into the userID and the credential field. ok is false if the name does not match.
+func parseSecretKey(name string) (userID string, field string, ok bool) {
+	if !strings.HasPrefix(name, userFilePrefix) {
+		return "", "", false
+	}
+	for _, f := range []struct{ suffix, field string }{
+		{usernameFileSuffix, "username"},
+		{passwordFileSuffix, "password"},
+		{passwordHashFileSuffix, "password_hash"},
+		{hashingAlgorithmFileSuffix, "hashing_algorithm"},
+		{tagFileSuffix, "tag"},
+	} {
+		if strings.HasSuffix(name, f.suffix) {
+			userID = strings.TrimSuffix(strings.TrimPrefix(name, userFilePrefix), f.suffix)
+			return userID, f.field, userID != ""
+		}
+	}
+	return "", "", false
+}
+
+// set sets the credential field (as returned by parseSecretKey) to value.
+// A password_hash sets PasswordHash and, if prefixed, HashingAlgorithm, see splitPasswordHash.
+func (c *UserCredentials) set(field, value string) {
+	switch field {
+	case "username":
+		c.Username = value
+	case "password":
+		c.Password = value
+	case "password_hash":
+		var algorithm rabbithole.HashingAlgorithm
+		algorithm, c.PasswordHash = splitPasswordHash(value)
+		if algorithm != "" {
+			c.HashingAlgorithm = algorithm
+		}
+	case "hashing_algorithm":
+		c.HashingAlgorithm = hashingAlgorithm(value)
+	case "tag":
+		c.Tag = value
+	}
+}
+
+// splitPasswordHash splits a password hash, optionally prefixed by its hashing algorithm, e.g.
+// "sha512:<hash>" or "rabbit_password_hashing_sha512:<hash>" (as used by RabbitMQ). Without
+// prefix, the algorithm is empty. Unknown algorithms are passed on to RabbitMQ, which rejects them.
+func splitPasswordHash(value string) (rabbithole.HashingAlgorithm, string) {
+	algorithm, hash, found := strings.Cut(value, ":")
+	if !found {
+		return "", value
+	}
+	return hashingAlgorithm(algorithm), hash
+}
+
+// sourceChanged requests a sync after a WatchingSecretSource detected a change.
+// It does not block; the sync is performed by HandleEvents.
+func (u *PasswordUpdater) sourceChanged() {
+	select {
+	case u.sourceChanges <- struct{}{}:
+	default:
+		// A sync is already pending.
+	}
+}
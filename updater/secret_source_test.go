@@ -0,0 +1,180 @@
+package updater_test
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("NewPasswordUpdaterWithSource", func() {
+	var (
+		source      *fakeSource
+		adminClient *fakeRabbitClient
+		authClient  *fakeRabbitClient
+		u           *PasswordUpdater
+	)
+
+	BeforeEach(func() {
+		source = &fakeSource{
+			credentials: map[string]UserCredentials{
+				"admin":   {Username: "admin", Password: "pwd1", Tag: "administrator"},
+				"default": {Username: "default", Password: "pwd1", Tag: "mytag"},
+			},
+			changes: make(chan struct{}),
+		}
+		adminClient = &fakeRabbitClient{
+			getUserReturn: map[string]getUserReturn{
+				"default": {userInfo: &rabbithole.UserInfo{HashingAlgorithm: "myalgo"}},
+			},
+			putUserReturn: putUserReturn{resp: &http.Response{Status: "204 No Content"}},
+		}
+		authClient = &fakeRabbitClient{whoamiReturn: whoamiReturn{err: errors.New("auth failed")}}
+		var err error
+		u, err = NewPasswordUpdaterWithSource(testAdminFile, source, "", initLogging(), adminClient, authClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Watcher).To(BeNil())
+	})
+
+	JustBeforeEach(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		go func(u *PasswordUpdater) {
+			_ = u.HandleEvents(ctx)
+		}(u)
+	})
+
+	It("syncs when the source reports a change", func() {
+		source.set("default", UserCredentials{Username: "default", Password: "pwd2", Tag: "mytag"})
+		source.changes <- struct{}{}
+		Eventually(func() string {
+			return u.Snapshot().CredentialState["default"].Password
+		}).Should(Equal("pwd2"))
+		Expect(adminClient.PutUserCalls).To(HaveLen(1))
+		Expect(adminClient.PutUserCalls[0].Settings.Password).To(Equal("pwd2"))
+	})
+
+	When("credentials violate the validation rules", func() {
+		BeforeEach(func() {
+			u.ValidationRules.UsernamePattern = regexp.MustCompile(`^[a-z0-9]+$`)
+			adminClient.getUserReturn["app1"] = getUserReturn{err: errors.New("Error 404 (Object Not Found): Not Found")}
+		})
+
+		It("rejects them", func() {
+			source.set("default", UserCredentials{Username: "default", Password: "pwd2\x00", Tag: "mytag"})
+			source.set("app_1", UserCredentials{Username: "app1", Password: "apppwd"})
+			source.set("app_2", UserCredentials{Username: "App 2", Password: "apppwd"})
+			source.set("app_3", UserCredentials{Username: "app3", Password: strings.Repeat("x", 1025)})
+			source.set("app_4", UserCredentials{Username: "app4", Password: "\xff"})
+			source.changes <- struct{}{}
+			Eventually(func() string {
+				return u.Snapshot().CredentialState["app_1"].Password
+			}).Should(Equal("apppwd"))
+			Expect(u.Snapshot().CredentialSpec).To(HaveLen(2))
+			Expect(u.Snapshot().CredentialSpec).To(HaveKey("admin"))
+			Expect(adminClient.PutUserCalls).To(HaveLen(1))
+		})
+	})
+
+	When("users are included and excluded", func() {
+		BeforeEach(func() {
+			u.IncludeUsers = []string{"app_*", "default"}
+			u.ExcludeUsers = []string{"default"}
+			adminClient.getUserReturn["app1"] = getUserReturn{err: errors.New("Error 404 (Object Not Found): Not Found")}
+		})
+
+		It("only updates the selected users", func() {
+			source.set("default", UserCredentials{Username: "default", Password: "pwd2", Tag: "mytag"})
+			source.set("app_1", UserCredentials{Username: "app1", Password: "apppwd"})
+			source.set("other", UserCredentials{Username: "other", Password: "otherpwd"})
+			source.changes <- struct{}{}
+			Eventually(func() string {
+				return u.Snapshot().CredentialState["app_1"].Password
+			}).Should(Equal("apppwd"))
+			Expect(u.Snapshot().CredentialSpec).To(HaveKey("admin"))
+			Expect(u.Snapshot().CredentialSpec).NotTo(HaveKey("default"))
+			Expect(u.Snapshot().CredentialSpec).NotTo(HaveKey("other"))
+			Expect(adminClient.PutUserCalls).To(HaveLen(1))
+			Expect(adminClient.PutUserCalls[0].Username).To(Equal("app1"))
+		})
+	})
+})
+
+type fakeSource struct {
+	mu          sync.Mutex
+	credentials map[string]UserCredentials
+	changes     chan struct{}
+}
+
+func (s *fakeSource) Load(_ context.Context) (map[string]UserCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.credentials), nil
+}
+
+func (s *fakeSource) Watch(ctx context.Context, changed func()) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.changes:
+			changed()
+		}
+	}
+}
+
+func (s *fakeSource) set(userID string, cred UserCredentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[userID] = cred
+}
+
+var _ = Describe("DirectorySource", func() {
+	When("files are mapped to users", func() {
+		It("loads them like user_<id>_<field> files", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "rabbitmq_app_user"), []byte("app\n"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "rabbitmq_app_password"), []byte("apppwd\n"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "unrelated"), []byte("secret"), 0600)).To(Succeed())
+			source := DirectorySource{
+				Dir: dir,
+				Files: map[string]SecretFile{
+					"rabbitmq_app_user":     {UserID: "app", Field: "username"},
+					"rabbitmq_app_password": {UserID: "app", Field: "password"},
+				},
+				Log: initLogging(),
+			}
+			Expect(source.Load(context.Background())).To(Equal(map[string]UserCredentials{
+				"app": {Username: "app", Password: "apppwd"},
+			}))
+		})
+	})
+	When("files match the pattern", func() {
+		It("loads them like user_<id>_<field> files", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "rabbitmq-app-username"), []byte("app"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "rabbitmq-app-password"), []byte("apppwd"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "rabbitmq-app-other"), []byte("ignored"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "user_default_username"), []byte("default"), 0600)).To(Succeed())
+			source := DirectorySource{
+				Dir:     dir,
+				Pattern: regexp.MustCompile(`^rabbitmq-(?P<id>.+)-(?P<field>username|password|tag|other)$`),
+				Log:     initLogging(),
+			}
+			Expect(source.Load(context.Background())).To(Equal(map[string]UserCredentials{
+				"app":     {Username: "app", Password: "apppwd"},
+				"default": {Username: "default"},
+			}))
+		})
+	})
+})
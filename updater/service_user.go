@@ -0,0 +1,40 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+)
+
+// isClientUser returns true if userID is the admin user or the ServiceUserID, whose credentials
+// the updater may authenticate with.
+func (u *PasswordUpdater) isClientUser(userID string) bool {
+	return userID == adminUserID || (u.ServiceUserID != "" && userID == u.ServiceUserID)
+}
+
+// clientUserID returns the userID that the updater authenticates with: the ServiceUserID once its
+// credentials were applied, the admin user otherwise.
+func (u *PasswordUpdater) clientUserID() string {
+	if u.ServiceUserID != "" && u.CredentialState[u.ServiceUserID].hasPassword() {
+		return u.ServiceUserID
+	}
+	return adminUserID
+}
+
+// setClientCredentials sets the credentials of the clientUserID from CredentialState on the admin client.
+func (u *PasswordUpdater) setClientCredentials() {
+	cred := u.CredentialState[u.clientUserID()]
+	u.adminClient.SetUsername(cred.Username)
+	u.adminClient.SetPassword(cred.Password)
+}
+
+// verifyClientCredentials verifies the updated credentials of the admin user, see verifyAdminCredentials,
+// or of the ServiceUserID, by authenticating with them.
+func (u *PasswordUpdater) verifyClientCredentials(ctx context.Context, userID string, cred UserCredentials) error {
+	if userID == adminUserID {
+		return u.verifyAdminCredentials(ctx, cred)
+	}
+	if err := u.authenticate(ctx, u.adminClient); err != nil {
+		return fmt.Errorf("failed to verify updated service user credentials: %w", err)
+	}
+	return nil
+}
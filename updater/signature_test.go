@@ -0,0 +1,119 @@
+package updater_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("Signature verification", func() {
+	var (
+		dir     string
+		source  DirectorySource
+		private ed25519.PrivateKey
+	)
+
+	writePublicKey := func(public any) string {
+		der, err := x509.MarshalPKIXPublicKey(public)
+		Expect(err).NotTo(HaveOccurred())
+		keyFile := filepath.Join(GinkgoT().TempDir(), "key.pem")
+		Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)).To(Succeed())
+		return keyFile
+	}
+
+	writeFile := func(name string, content []byte) {
+		Expect(os.WriteFile(filepath.Join(dir, name), content, 0600)).To(Succeed())
+	}
+
+	// writeSigned writes the file name with content and its detached signature.
+	writeSigned := func(name, content string) {
+		writeFile(name, []byte(content))
+		writeFile(name+".sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(content)))))
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		public, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		private = privateKey
+		key, err := LoadSignatureKey(writePublicKey(public))
+		Expect(err).NotTo(HaveOccurred())
+		source = DirectorySource{Dir: dir, SignatureKey: key, Log: initLogging()}
+		writeSigned("user_default_username", "default")
+		writeFile("user_default_password", []byte("pwd1"))
+	})
+
+	It("accepts passwords with a valid signature", func() {
+		writeFile("user_default_password.sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte("pwd1")))))
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Username: "default", Password: "pwd1"}}))
+	})
+
+	It("rejects passwords without or with an invalid signature", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_password"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Username: "default"}}))
+
+		writeFile("user_default_password.sig", ed25519.Sign(private, []byte("pwd2")))
+		credentials, err = source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_password"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Username: "default"}}))
+	})
+
+	It("rejects an unsigned username, so that a signed password is not applied to another user", func() {
+		writeSigned("user_default_password", "pwd1")
+		writeFile("user_default_username", []byte("admin"))
+		credentials, err := source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_username"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Password: "pwd1"}}))
+	})
+
+	It("rejects unsigned tags", func() {
+		writeSigned("user_default_password", "pwd1")
+		writeFile("user_default_tag", []byte("administrator"))
+		credentials, err := source.Load(context.Background())
+		Expect(err).To(Equal(&IncompleteLoadError{Files: []string{"user_default_tag"}}))
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Username: "default", Password: "pwd1"}}))
+
+		writeSigned("user_default_tag", "monitoring")
+		credentials, err = source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Username: "default", Password: "pwd1", Tag: "monitoring"}}))
+	})
+
+	It("supports ECDSA keys with raw signatures", func() {
+		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		source.SignatureKey, err = LoadSignatureKey(writePublicKey(&ecdsaKey.PublicKey))
+		Expect(err).NotTo(HaveOccurred())
+		for name, content := range map[string]string{"user_default_username": "default", "user_default_password": "pwd1"} {
+			digest := sha256.Sum256([]byte(content))
+			signature, err := ecdsa.SignASN1(rand.Reader, ecdsaKey, digest[:])
+			Expect(err).NotTo(HaveOccurred())
+			writeFile(name+".sig", signature)
+		}
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{"default": {Username: "default", Password: "pwd1"}}))
+	})
+
+	It("rejects files without a public key", func() {
+		keyFile := filepath.Join(GinkgoT().TempDir(), "key.pem")
+		Expect(os.WriteFile(keyFile, []byte("not a key"), 0600)).To(Succeed())
+		_, err := LoadSignatureKey(keyFile)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,34 @@
+package updater
+
+import (
+	"maps"
+	"time"
+)
+
+// Snapshot is a consistent copy of the state of a PasswordUpdater.
+type Snapshot struct {
+	// CredentialState stores the last successfully verified user credentials.
+	CredentialState map[string]UserCredentials
+	// CredentialSpec stores the expected user credentials.
+	CredentialSpec map[string]UserCredentials
+	// LastSync is the time of the last sync, or zero if there was none yet.
+	LastSync time.Time
+	// LastSyncError is the error of the last sync, if it failed.
+	LastSyncError error
+	// LastErrors contains the last error of every user whose update failed.
+	LastErrors map[string]error
+}
+
+// Snapshot returns a copy of the current state. Unlike reading the fields of PasswordUpdater
+// directly, it is safe to call while HandleEvents is running, e.g. from an HTTP handler.
+func (u *PasswordUpdater) Snapshot() Snapshot {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return Snapshot{
+		CredentialState: maps.Clone(u.CredentialState),
+		CredentialSpec:  maps.Clone(u.CredentialSpec),
+		LastSync:        u.lastSync,
+		LastSyncError:   u.lastSyncErr,
+		LastErrors:      maps.Clone(u.lastErrors),
+	}
+}
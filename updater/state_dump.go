@@ -0,0 +1,95 @@
+package updater
+
+import (
+	"sort"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// MarshalLog implements logr.Marshaler, so that passwords never end up in the logs.
+func (c UserCredentials) MarshalLog() any {
+	password, passwordHash := "", ""
+	if c.Password != "" {
+		password = redacted
+	}
+	if c.PasswordHash != "" {
+		passwordHash = redacted
+	}
+	return struct {
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		PasswordHash string `json:"passwordHash,omitempty"`
+		Tag          string `json:"tag"`
+	}{c.Username, password, passwordHash, c.Tag}
+}
+
+// DumpState requests that the internal state is written to the log for debugging.
+// It does not block; the state is dumped by HandleEvents.
+func (u *PasswordUpdater) DumpState() {
+	select {
+	case u.dumpRequests <- struct{}{}:
+	default:
+		// A dump is already pending.
+	}
+}
+
+// dumpState logs the CredentialSpec and CredentialState of every user (with passwords
+// redacted) together with the last sync time and the last errors.
+func (u *PasswordUpdater) dumpState() {
+	var lastSync string
+	if !u.lastSync.IsZero() {
+		lastSync = u.lastSync.Format(time.RFC3339)
+	}
+	var lastSyncError string
+	if u.lastSyncErr != nil {
+		lastSyncError = u.lastSyncErr.Error()
+	}
+	u.Log.V(0).Info("state dump",
+		"directory", u.WatchDir,
+		"adminFile", u.AdminFile,
+		"lastSync", lastSync,
+		"lastSyncError", lastSyncError,
+		"retryQueueLength", u.retries.len())
+
+	userIDs := make(map[string]struct{}, len(u.CredentialSpec))
+	for userID := range u.CredentialSpec {
+		userIDs[userID] = struct{}{}
+	}
+	for userID := range u.CredentialState {
+		userIDs[userID] = struct{}{}
+	}
+	sorted := make([]string, 0, len(userIDs))
+	for userID := range userIDs {
+		sorted = append(sorted, userID)
+	}
+	sort.Strings(sorted)
+
+	for _, userID := range sorted {
+		spec, hasSpec := u.CredentialSpec[userID]
+		state, hasState := u.CredentialState[userID]
+		var specValue, stateValue any
+		if hasSpec {
+			specValue = spec
+		}
+		if hasState {
+			stateValue = state
+		}
+		var lastApplied string
+		if a, ok := u.applied[userID]; ok {
+			lastApplied = a.LastApplied.Format(time.RFC3339)
+		}
+		var lastError string
+		if err := u.lastErrors[userID]; err != nil {
+			lastError = err.Error()
+		}
+		u.Log.V(0).Info("user state",
+			"userID", userID,
+			"spec", specValue,
+			"state", stateValue,
+			"inSync", hasSpec && hasState && spec.equal(state),
+			"lastApplied", lastApplied,
+			"failedAttempts", u.retries.attempts(userID),
+			"lastError", lastError)
+	}
+}
@@ -0,0 +1,181 @@
+package updater
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// stateKeySuffix is appended to the StateFile for the file with the key of the password hashes.
+const stateKeySuffix = ".key"
+
+// appliedCredentials records that a password was applied to (or verified in) RabbitMQ.
+// Only a hash of the password is persisted, keyed with the state key, see hashPassword.
+type appliedCredentials struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Tag          string    `json:"tag"`
+	LastApplied  time.Time `json:"lastApplied"`
+}
+
+type stateFile struct {
+	Users map[string]appliedCredentials `json:"users"`
+}
+
+// hashPassword returns the HMAC-SHA256 of password with key, a random key of the installation,
+// so that the passwords cannot be guessed from the state file alone.
+func hashPassword(key []byte, password string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashCredentials returns the hash of the password of cred, or of its RabbitMQ password hash.
+func hashCredentials(key []byte, cred UserCredentials) string {
+	if cred.Password == "" && cred.PasswordHash != "" {
+		return hashPassword(key, "passwordHash:"+cred.PasswordHash)
+	}
+	return hashPassword(key, cred.Password)
+}
+
+// matches returns true if cred is the applied username, password and tag.
+func (a appliedCredentials) matches(key []byte, cred UserCredentials) bool {
+	return a.Username == cred.Username && hmac.Equal([]byte(a.PasswordHash), []byte(hashCredentials(key, cred))) && a.Tag == cred.Tag
+}
+
+// loadStateKey reads the key of the password hashes from the key file next to the state file at path.
+// Without a key file, e.g. on the first start, a new random key is returned, which is saved with
+// the state file. Hashes recorded with another key do not match, so those users are updated once.
+func loadStateKey(path string) ([]byte, error) {
+	if path != "" {
+		content, err := os.ReadFile(path + stateKeySuffix)
+		if err == nil {
+			key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+			if err != nil || len(key) == 0 {
+				return nil, fmt.Errorf("invalid state key file %q", path+stateKeySuffix)
+			}
+			return key, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read state key file: %w", err)
+		}
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate state key: %w", err)
+	}
+	return key, nil
+}
+
+// loadStateFile reads the applied credentials from path.
+// A missing state file is not an error, e.g. on the first start.
+func loadStateFile(path string) (map[string]appliedCredentials, error) {
+	applied := make(map[string]appliedCredentials)
+	if path == "" {
+		return applied, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return applied, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var state stateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	for userID, a := range state.Users {
+		applied[userID] = a
+	}
+	return applied, nil
+}
+
+// verifiedCredentials drops the credentials that differ from what the state file recorded
+// as applied, i.e. the secrets were changed while the updater was not running, so that they
+// are updated by the next sync. Users without a record are assumed to be applied.
+// The admin user is always kept, since its credentials are needed to authenticate.
+func verifiedCredentials(credentials map[string]UserCredentials, applied map[string]appliedCredentials, key []byte, log logr.Logger) map[string]UserCredentials {
+	for userID, cred := range credentials {
+		a, ok := applied[userID]
+		if !ok || a.matches(key, cred) {
+			continue
+		}
+		if userID == adminUserID {
+			log.V(0).Info("admin credentials differ from the last applied ones, continuing with the current ones",
+				"lastApplied", a.LastApplied.Format(time.RFC3339))
+			continue
+		}
+		log.V(1).Info("credentials changed since last applied, scheduling update",
+			"userID", userID,
+			"lastApplied", a.LastApplied.Format(time.RFC3339))
+		delete(credentials, userID)
+	}
+	return credentials
+}
+
+// recordApplied records that cred was applied and persists the state file, if configured.
+// Failing to write the state file is logged but does not fail the update.
+func (u *PasswordUpdater) recordApplied(userID string, cred UserCredentials) {
+	u.applied[userID] = appliedCredentials{
+		Username:     cred.Username,
+		PasswordHash: hashCredentials(u.stateKey, cred),
+		Tag:          cred.Tag,
+		LastApplied:  time.Now().UTC(),
+	}
+	if u.StateFile == "" {
+		return
+	}
+	if err := u.saveStateFile(); err != nil {
+		u.Log.Error(err, "failed to save state file", "file", u.StateFile)
+	}
+}
+
+// forgetApplied removes the record of userID, e.g. after the user was deleted, and persists the state file.
+func (u *PasswordUpdater) forgetApplied(userID string) {
+	delete(u.applied, userID)
+	if u.StateFile == "" {
+		return
+	}
+	if err := u.saveStateFile(); err != nil {
+		u.Log.Error(err, "failed to save state file", "file", u.StateFile)
+	}
+}
+
+// saveStateFile atomically replaces the state file and its key file, readable only by the owner.
+func (u *PasswordUpdater) saveStateFile() error {
+	content, err := json.MarshalIndent(stateFile{Users: u.applied}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	// The key is saved first, so that the state file never refers to an unknown key.
+	if err := replaceFile(u.StateFile+stateKeySuffix, hex.EncodeToString(u.stateKey)+"\n", 0600); err != nil {
+		return fmt.Errorf("failed to save state key file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.StateFile), "."+filepath.Base(u.StateFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), u.StateFile); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v3"
+	"go.yaml.in/yaml/v3"
+)
+
+// usersSpecFile describes all users in a single file in the watch directory:
+//
+//	users:
+//	  default:                 # userID
+//	    name: default
+//	    password: secret       # or passwordHash, e.g. from rabbitmqctl hash_password,
+//	                           # or passwordless: true, e.g. for x509 authentication
+//	    tags: [monitoring]
+//	    permissions:           # per vhost, defaults to full permissions in "/"
+//	      /: {configure: ".*", write: ".*", read: ".*"}
+const usersSpecFile = "users.yaml"
+
+type usersSpec struct {
+	Users map[string]struct {
+		Name         string                            `yaml:"name"`
+		Password     string                            `yaml:"password"`
+		PasswordHash string                            `yaml:"passwordHash"`
+		Passwordless bool                              `yaml:"passwordless"`
+		Tags         []string                          `yaml:"tags"`
+		Permissions  map[string]rabbithole.Permissions `yaml:"permissions"`
+	} `yaml:"users"`
+}
+
+// parseUsersSpec parses the content of usersSpecFile into credentials keyed by userID.
+func parseUsersSpec(content []byte) (map[string]UserCredentials, error) {
+	var spec usersSpec
+	if err := yaml.Unmarshal(content, &spec); err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]UserCredentials, len(spec.Users))
+	for userID, user := range spec.Users {
+		if user.Password != "" && user.PasswordHash != "" {
+			return nil, fmt.Errorf("user %q: password and passwordHash are mutually exclusive", userID)
+		}
+		if user.Passwordless && (user.Password != "" || user.PasswordHash != "") {
+			return nil, fmt.Errorf("user %q: passwordless users cannot have a password or passwordHash", userID)
+		}
+		credentials[userID] = UserCredentials{
+			Username:     strings.TrimSpace(user.Name),
+			Password:     strings.TrimSpace(user.Password),
+			PasswordHash: strings.TrimSpace(user.PasswordHash),
+			Passwordless: user.Passwordless,
+			Tag:          strings.Join(user.Tags, ","),
+			Permissions:  user.Permissions,
+		}
+	}
+	return credentials, nil
+}
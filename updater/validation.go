@@ -0,0 +1,67 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ValidationRules restrict the credential values that are applied, so that corrupted or
+// malicious secrets (e.g. binary garbage or a truncated file) are not sent to the broker.
+// Values are always required to be valid UTF-8.
+type ValidationRules struct {
+	// MaxLength is the maximum length of a username, password, password hash or tag in bytes.
+	// 0 disables the limit.
+	MaxLength int
+	// AllowControlCharacters allows control characters, e.g. NUL or escape sequences, in values.
+	AllowControlCharacters bool
+	// UsernamePattern, if set, must match every username.
+	UsernamePattern *regexp.Regexp
+}
+
+// DefaultValidationRules is used by NewPasswordUpdater.
+var DefaultValidationRules = ValidationRules{
+	MaxLength: 1024,
+}
+
+// validate returns an error describing the first value of cred that violates the rules.
+// The error does not contain the value, since it may be a password.
+func (r ValidationRules) validate(cred UserCredentials) error {
+	for _, field := range []struct{ name, value string }{
+		{"username", cred.Username},
+		{"password", cred.Password},
+		{"password hash", cred.PasswordHash},
+		{"tag", cred.Tag},
+	} {
+		if !utf8.ValidString(field.value) {
+			return fmt.Errorf("%s is not valid UTF-8", field.name)
+		}
+		if r.MaxLength > 0 && len(field.value) > r.MaxLength {
+			return fmt.Errorf("%s is longer than %d bytes", field.name, r.MaxLength)
+		}
+		if !r.AllowControlCharacters && strings.ContainsFunc(field.value, unicode.IsControl) {
+			return fmt.Errorf("%s contains control characters", field.name)
+		}
+	}
+	if r.UsernamePattern != nil && !r.UsernamePattern.MatchString(cred.Username) {
+		return errors.New("username does not match the allowed pattern")
+	}
+	return nil
+}
+
+// validCredentials returns the credentials that satisfy the ValidationRules.
+// Invalid credentials are logged and skipped, like incomplete ones.
+func (u *PasswordUpdater) validCredentials(credentials map[string]UserCredentials) map[string]UserCredentials {
+	valid := make(map[string]UserCredentials, len(credentials))
+	for userID, cred := range credentials {
+		if err := u.ValidationRules.validate(cred); err != nil {
+			u.Log.Error(err, "rejecting invalid credentials", "userID", userID)
+			continue
+		}
+		valid[userID] = cred
+	}
+	return valid
+}
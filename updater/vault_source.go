@@ -0,0 +1,222 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// VaultSource reads credentials from Vault, e.g. dynamic secrets of the RabbitMQ secrets engine
+// or KV secrets. Every path must contain the keys username and password, and optionally tag.
+// Leases are renewed, and the credentials are rotated (read again) before their lease expires,
+// so that the updater applies short-lived passwords whenever they change.
+type VaultSource struct {
+	// Address is the URL of the Vault server, e.g. https://vault:8200.
+	Address string
+	// TokenFile contains the Vault token, e.g. written by Vault agent. It is read for every request.
+	TokenFile string
+	// Paths maps userIDs to Vault paths, e.g. "default" to "rabbitmq/creds/default".
+	Paths map[string]string
+	// PollInterval is used to re-read secrets without a lease, e.g. KV secrets.
+	// Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	Client       *http.Client
+	Log          logr.Logger
+
+	mu          sync.Mutex
+	credentials map[string]UserCredentials
+	leases      map[string]vaultLease
+}
+
+type vaultLease struct {
+	id        string
+	renewable bool
+	duration  time.Duration
+	// renewAt is when the lease is renewed (or the secret rotated or polled).
+	renewAt time.Time
+}
+
+type vaultResponse struct {
+	LeaseID       string         `json:"lease_id"`
+	Renewable     bool           `json:"renewable"`
+	LeaseDuration int            `json:"lease_duration"`
+	Data          map[string]any `json:"data"`
+	Errors        []string       `json:"errors"`
+}
+
+func (s *VaultSource) Load(ctx context.Context) (map[string]UserCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credentials == nil {
+		s.credentials = make(map[string]UserCredentials)
+		s.leases = make(map[string]vaultLease)
+	}
+	// Dynamic secrets return new credentials on every read, so they are only read once
+	// and then rotated by Watch.
+	for userID := range s.Paths {
+		if _, ok := s.credentials[userID]; ok {
+			continue
+		}
+		if err := s.read(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+	return maps.Clone(s.credentials), nil
+}
+
+// Watch renews the leases and rotates the credentials before their lease expires.
+func (s *VaultSource) Watch(ctx context.Context, changed func()) error {
+	for {
+		userID, renewAt := s.nextLease()
+		if userID == "" {
+			// Nothing loaded yet.
+			renewAt = time.Now().Add(pollInterval(s.PollInterval))
+		}
+		if err := sleep(ctx, time.Until(renewAt)); err != nil {
+			return err
+		}
+		if userID == "" {
+			continue
+		}
+		rotated, err := s.renew(ctx, userID)
+		if err != nil {
+			s.Log.V(0).Info("failed to renew Vault secret, retrying", "userID", userID, "error", err.Error())
+			s.mu.Lock()
+			lease := s.leases[userID]
+			lease.renewAt = time.Now().Add(min(watchMaxDelay, max(watchInitialDelay, lease.duration/10)))
+			s.leases[userID] = lease
+			s.mu.Unlock()
+			continue
+		}
+		if rotated {
+			changed()
+		}
+	}
+}
+
+// nextLease returns the user whose lease must be renewed next.
+func (s *VaultSource) nextLease() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next string
+	var renewAt time.Time
+	for userID, lease := range s.leases {
+		if next == "" || lease.renewAt.Before(renewAt) {
+			next, renewAt = userID, lease.renewAt
+		}
+	}
+	return next, renewAt
+}
+
+// renew renews the lease of userID. If the lease cannot be renewed (any more), the secret
+// is read again. Returns true if the credentials changed.
+func (s *VaultSource) renew(ctx context.Context, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease := s.leases[userID]
+	if lease.renewable {
+		var resp vaultResponse
+		body := map[string]any{"lease_id": lease.id, "increment": int(lease.duration.Seconds())}
+		err := s.request(ctx, http.MethodPut, "sys/leases/renew", body, &resp)
+		// Once the lease approaches its max TTL, renewals are granted for less than requested.
+		if err == nil && time.Duration(resp.LeaseDuration)*time.Second >= lease.duration/2 {
+			lease.duration = time.Duration(resp.LeaseDuration) * time.Second
+			lease.renewAt = renewAt(lease.duration, pollInterval(s.PollInterval))
+			s.leases[userID] = lease
+			s.Log.V(2).Info("renewed Vault lease", "userID", userID, "duration", lease.duration.String())
+			return false, nil
+		}
+		if err != nil {
+			s.Log.V(1).Info("failed to renew Vault lease, rotating credentials", "userID", userID, "error", err.Error())
+		}
+	}
+	previous := s.credentials[userID]
+	if err := s.read(ctx, userID); err != nil {
+		return false, err
+	}
+	if s.credentials[userID].equal(previous) {
+		return false, nil
+	}
+	s.Log.V(1).Info("rotated Vault credentials", "userID", userID)
+	return true, nil
+}
+
+// read reads the secret of userID. s.mu must be held.
+func (s *VaultSource) read(ctx context.Context, userID string) error {
+	path := s.Paths[userID]
+	var resp vaultResponse
+	if err := s.request(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return fmt.Errorf("failed to read Vault secret %q: %w", path, err)
+	}
+	data := resp.Data
+	// KV version 2 nests the secret in data.data.
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	var cred UserCredentials
+	for _, field := range []string{"username", "password", "tag"} {
+		if value, ok := data[field].(string); ok {
+			cred.set(field, strings.TrimSpace(value))
+		}
+	}
+	s.credentials[userID] = cred
+	duration := time.Duration(resp.LeaseDuration) * time.Second
+	s.leases[userID] = vaultLease{
+		id:        resp.LeaseID,
+		renewable: resp.Renewable && resp.LeaseID != "",
+		duration:  duration,
+		renewAt:   renewAt(duration, pollInterval(s.PollInterval)),
+	}
+	return nil
+}
+
+// renewAt returns when a lease of the given duration is renewed: after two thirds of the
+// duration, so that there is time left to rotate the credentials, or after pollInterval for
+// secrets without lease.
+func renewAt(duration, pollInterval time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Now().Add(pollInterval)
+	}
+	return time.Now().Add(duration * 2 / 3)
+}
+
+func (s *VaultSource) request(ctx context.Context, method, path string, body any, result *vaultResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), &reqBody)
+	if err != nil {
+		return err
+	}
+	token, err := os.ReadFile(s.TokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read Vault token: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, strings.Join(result.Errors, "; "))
+	}
+	return nil
+}
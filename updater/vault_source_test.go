@@ -0,0 +1,121 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/rabbitmq/default-user-credential-updater/updater"
+)
+
+var _ = Describe("VaultSource", func() {
+	var (
+		source    *VaultSource
+		reads     atomic.Int32
+		rotations atomic.Int32
+		renewals  atomic.Int32
+		renewable bool
+		renewTTL  int
+	)
+
+	BeforeEach(func() {
+		reads.Store(0)
+		rotations.Store(0)
+		renewals.Store(0)
+		renewable = false
+		renewTTL = 1
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Header.Get("X-Vault-Token")).To(Equal("my-token"))
+			switch r.URL.Path {
+			case "/v1/rabbitmq/creds/default":
+				reads.Add(1)
+				n := rotations.Add(1)
+				fmt.Fprintf(w, `{"lease_id":"rabbitmq/creds/default/%d","renewable":%t,"lease_duration":1,"data":{"username":"default","password":"pwd%d"}}`, n, renewable, n)
+			case "/v1/secret/data/admin":
+				reads.Add(1)
+				fmt.Fprint(w, `{"data":{"data":{"username":"admin","password":"adminpwd","tag":"administrator"}}}`)
+			case "/v1/sys/leases/renew":
+				Expect(r.Method).To(Equal(http.MethodPut))
+				var body map[string]any
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				renewals.Add(1)
+				fmt.Fprintf(w, `{"lease_id":%q,"renewable":true,"lease_duration":%d}`, body["lease_id"], renewTTL)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors":[]}`)
+			}
+		}))
+		DeferCleanup(server.Close)
+
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("my-token"), 0600)).To(Succeed())
+		source = &VaultSource{
+			Address:      server.URL,
+			TokenFile:    tokenFile,
+			Paths:        map[string]string{"default": "rabbitmq/creds/default", "admin": "secret/data/admin"},
+			PollInterval: time.Hour,
+			Client:       server.Client(),
+			Log:          initLogging(),
+		}
+	})
+
+	It("reads dynamic and KV secrets once", func() {
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials).To(Equal(map[string]UserCredentials{
+			"default": {Username: "default", Password: "pwd1"},
+			"admin":   {Username: "admin", Password: "adminpwd", Tag: "administrator"},
+		}))
+		_, err = source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reads.Load()).To(BeEquivalentTo(2))
+	})
+
+	watch := func() *atomic.Int32 {
+		_, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		var changes atomic.Int32
+		go func() {
+			_ = source.Watch(ctx, func() { changes.Add(1) })
+		}()
+		return &changes
+	}
+
+	It("rotates credentials before a non-renewable lease expires", func() {
+		changes := watch()
+		Eventually(changes.Load).WithTimeout(2 * time.Second).Should(BeEquivalentTo(1))
+		credentials, err := source.Load(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(credentials["default"].Password).To(Equal("pwd2"))
+	})
+
+	When("the lease is renewable", func() {
+		BeforeEach(func() {
+			renewable = true
+		})
+
+		It("renews the lease instead of rotating", func() {
+			changes := watch()
+			Eventually(renewals.Load).WithTimeout(2 * time.Second).Should(BeNumerically(">=", 1))
+			Expect(changes.Load()).To(BeZero())
+		})
+
+		It("rotates once renewals are cut short by the max TTL", func() {
+			renewTTL = 0
+			changes := watch()
+			Eventually(changes.Load).WithTimeout(2 * time.Second).Should(BeEquivalentTo(1))
+			Expect(renewals.Load()).To(BeEquivalentTo(1))
+		})
+	})
+})